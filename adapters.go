@@ -0,0 +1,273 @@
+package gitwatch
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// zeroHash is the hash providers send for the missing side of a created or
+// deleted ref
+var zeroHash = plumbing.ZeroHash.String()
+
+// GitHubAdapter parses GitHub push webhooks, signed in `X-Hub-Signature-256`
+type GitHubAdapter struct{}
+
+// Parse implements WebhookAdapter
+func (GitHubAdapter) Parse(r *http.Request, body []byte, secret string) (pushes []Push, ok bool, err error) {
+	event := r.Header.Get("X-GitHub-Event")
+	if event == "" {
+		return nil, false, nil
+	}
+	if secret != "" && !hmac.Equal([]byte(Sign(secret, body)), []byte(r.Header.Get("X-Hub-Signature-256"))) {
+		return nil, true, ErrBadSignature
+	}
+	if event != "push" {
+		return nil, true, nil
+	}
+	p, err := parseGitHubPush(body)
+	return []Push{p}, true, err
+}
+
+// GiteaAdapter parses Gitea and Forgejo push and delete webhooks, signed in
+// `X-Gitea-Signature`
+type GiteaAdapter struct{}
+
+// Parse implements WebhookAdapter
+func (GiteaAdapter) Parse(r *http.Request, body []byte, secret string) (pushes []Push, ok bool, err error) {
+	event := r.Header.Get("X-Gitea-Event")
+	if event == "" {
+		return nil, false, nil
+	}
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(r.Header.Get("X-Gitea-Signature"))) {
+			return nil, true, ErrBadSignature
+		}
+	}
+
+	switch event {
+	case "push":
+		p, err := parseGitHubPush(body)
+		return []Push{p}, true, err
+	case "delete":
+		// a deleted ref is sent by its short name and type
+		var v struct {
+			Ref        string           `json:"ref"`
+			RefType    string           `json:"ref_type"`
+			Repository githubRepository `json:"repository"`
+		}
+		if err = json.Unmarshal(body, &v); err != nil {
+			return nil, true, errors.Wrap(err, "failed to decode gitea payload")
+		}
+		p := Push{URLs: v.Repository.urls(), Ref: "refs/heads/" + v.Ref, Deleted: true}
+		if v.RefType == "tag" {
+			p.Ref = "refs/tags/" + v.Ref
+		}
+		return []Push{p}, true, nil
+	}
+	return nil, true, nil
+}
+
+type githubRepository struct {
+	CloneURL string `json:"clone_url"`
+	SSHURL   string `json:"ssh_url"`
+	GitURL   string `json:"git_url"`
+	HTMLURL  string `json:"html_url"`
+}
+
+func (r githubRepository) urls() []string {
+	return []string{r.CloneURL, r.SSHURL, r.GitURL, r.HTMLURL}
+}
+
+// parseGitHubPush reads a push payload in the form GitHub, Gitea and Forgejo
+// share.
+func parseGitHubPush(body []byte) (p Push, err error) {
+	var v struct {
+		Ref        string           `json:"ref"`
+		Before     string           `json:"before"`
+		After      string           `json:"after"`
+		Deleted    bool             `json:"deleted"`
+		Repository githubRepository `json:"repository"`
+	}
+	if err = json.Unmarshal(body, &v); err != nil {
+		return p, errors.Wrap(err, "failed to decode push payload")
+	}
+	return Push{
+		URLs:    v.Repository.urls(),
+		Ref:     v.Ref,
+		Before:  v.Before,
+		After:   v.After,
+		Deleted: v.Deleted || v.After == zeroHash,
+	}, nil
+}
+
+// GitLabAdapter parses GitLab push and tag push webhooks, which carry the
+// secret token as is in `X-Gitlab-Token`
+type GitLabAdapter struct{}
+
+// Parse implements WebhookAdapter
+func (GitLabAdapter) Parse(r *http.Request, body []byte, secret string) (pushes []Push, ok bool, err error) {
+	event := r.Header.Get("X-Gitlab-Event")
+	if event == "" {
+		return nil, false, nil
+	}
+	if secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(r.Header.Get("X-Gitlab-Token"))) != 1 {
+		return nil, true, ErrBadSignature
+	}
+
+	// system hooks announce pushes with an event name instead
+	if event != "Push Hook" && event != "Tag Push Hook" && event != "System Hook" {
+		return nil, true, nil
+	}
+	var v struct {
+		EventName string `json:"event_name"`
+		Ref       string `json:"ref"`
+		Before    string `json:"before"`
+		After     string `json:"after"`
+		Project   struct {
+			HTTPURL string `json:"git_http_url"`
+			SSHURL  string `json:"git_ssh_url"`
+			WebURL  string `json:"web_url"`
+		} `json:"project"`
+	}
+	if err = json.Unmarshal(body, &v); err != nil {
+		return nil, true, errors.Wrap(err, "failed to decode gitlab payload")
+	}
+	if event == "System Hook" && v.EventName != "push" && v.EventName != "tag_push" {
+		return nil, true, nil
+	}
+	return []Push{{
+		URLs:    []string{v.Project.HTTPURL, v.Project.SSHURL, v.Project.WebURL},
+		Ref:     v.Ref,
+		Before:  v.Before,
+		After:   v.After,
+		Deleted: v.After == zeroHash,
+	}}, true, nil
+}
+
+// BitbucketAdapter parses Bitbucket Cloud `repo:push` and Bitbucket Data
+// Center `repo:refs_changed` webhooks, both signed in `X-Hub-Signature`
+type BitbucketAdapter struct{}
+
+// Parse implements WebhookAdapter
+func (BitbucketAdapter) Parse(r *http.Request, body []byte, secret string) (pushes []Push, ok bool, err error) {
+	event := r.Header.Get("X-Event-Key")
+	if event == "" {
+		return nil, false, nil
+	}
+	if secret != "" && !hmac.Equal([]byte(Sign(secret, body)), []byte(r.Header.Get("X-Hub-Signature"))) {
+		return nil, true, ErrBadSignature
+	}
+
+	switch event {
+	case "repo:push":
+		pushes, err = parseBitbucketCloudPush(body)
+	case "repo:refs_changed":
+		pushes, err = parseBitbucketServerPush(body)
+	}
+	return pushes, true, err
+}
+
+type bitbucketRef struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Target struct {
+		Hash string `json:"hash"`
+	} `json:"target"`
+}
+
+func (r *bitbucketRef) fullName() string {
+	if r.Type == "tag" {
+		return "refs/tags/" + r.Name
+	}
+	return "refs/heads/" + r.Name
+}
+
+func parseBitbucketCloudPush(body []byte) (pushes []Push, err error) {
+	var v struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+			Links    struct {
+				HTML struct {
+					Href string `json:"href"`
+				} `json:"html"`
+			} `json:"links"`
+		} `json:"repository"`
+		Push struct {
+			Changes []struct {
+				Old *bitbucketRef `json:"old"`
+				New *bitbucketRef `json:"new"`
+			} `json:"changes"`
+		} `json:"push"`
+	}
+	if err = json.Unmarshal(body, &v); err != nil {
+		return nil, errors.Wrap(err, "failed to decode bitbucket payload")
+	}
+
+	urls := []string{
+		v.Repository.Links.HTML.Href,
+		"git@bitbucket.org:" + v.Repository.FullName + ".git",
+	}
+	for _, c := range v.Push.Changes {
+		p := Push{URLs: urls}
+		if c.Old != nil {
+			p.Ref = c.Old.fullName()
+			p.Before = c.Old.Target.Hash
+		}
+		if c.New != nil {
+			p.Ref = c.New.fullName()
+			p.After = c.New.Target.Hash
+		} else {
+			p.Deleted = true
+		}
+		pushes = append(pushes, p)
+	}
+	return
+}
+
+func parseBitbucketServerPush(body []byte) (pushes []Push, err error) {
+	var v struct {
+		Repository struct {
+			Links struct {
+				Clone []struct {
+					Href string `json:"href"`
+				} `json:"clone"`
+			} `json:"links"`
+		} `json:"repository"`
+		Changes []struct {
+			Ref struct {
+				ID string `json:"id"`
+			} `json:"ref"`
+			FromHash string `json:"fromHash"`
+			ToHash   string `json:"toHash"`
+			Type     string `json:"type"`
+		} `json:"changes"`
+	}
+	if err = json.Unmarshal(body, &v); err != nil {
+		return nil, errors.Wrap(err, "failed to decode bitbucket payload")
+	}
+
+	var urls []string
+	for _, l := range v.Repository.Links.Clone {
+		urls = append(urls, l.Href)
+	}
+	for _, c := range v.Changes {
+		pushes = append(pushes, Push{
+			URLs:    urls,
+			Ref:     c.Ref.ID,
+			Before:  c.FromHash,
+			After:   c.ToHash,
+			Deleted: strings.EqualFold(c.Type, "DELETE"),
+		})
+	}
+	return
+}
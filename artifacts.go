@@ -0,0 +1,77 @@
+package gitwatch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Artifacts is a Sink that writes each event to its own file in a directory,
+// for batch and CI systems that pick up what to build from disk rather than
+// listening for events. Files are named after the time they're written, the
+// repository, event type and commit, so they sort in the order the events
+// were delivered, and appear complete: each is written elsewhere in the
+// directory first and then renamed. Env files quote values so they can be
+// sourced by a shell.
+type Artifacts struct {
+	Dir    string // the directory to write artifacts to
+	Format Format // the encoding of JSON artifacts
+	Env    bool   // if true, artifacts are .env files of `GITWATCH_*` variables instead of JSON
+}
+
+// Send writes the event's artifact
+func (a Artifacts) Send(ctx context.Context, e Event) (err error) {
+	var body []byte
+	ext := ".json"
+	if a.Env {
+		ext = ".env"
+		var b strings.Builder
+		for _, v := range eventEnv(e) {
+			kv := strings.SplitN(v, "=", 2)
+			fmt.Fprintf(&b, "%s='%s'\n", kv[0], strings.Replace(kv[1], "'", `'\''`, -1))
+		}
+		body = []byte(b.String())
+	} else if body, _, err = Encode(e, a.Format); err != nil {
+		return errors.Wrap(err, "failed to encode event")
+	}
+	return writeArtifact(a.Dir, artifactName(e)+ext, body)
+}
+
+// writeArtifact writes a file elsewhere in the directory first and renames it
+// into place, so readers never see it half written.
+func writeArtifact(dir, name string, body []byte) (err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "failed to create artifact directory")
+	}
+	f, err := ioutil.TempFile(dir, ".artifact-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create artifact")
+	}
+	_, err = f.Write(body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "failed to write artifact")
+	}
+	return nil
+}
+
+// artifactName names an event's artifact
+func artifactName(e Event) string {
+	name := fmt.Sprintf("%s-%s-%s", time.Now().UTC().Format(releaseTimeFormat), filepath.Base(e.Path), e.Type)
+	if c := e.Commit(); !c.Hash.IsZero() {
+		name += "-" + c.Hash.String()[:7]
+	}
+	return name
+}
@@ -0,0 +1,157 @@
+package gitwatch
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+)
+
+// AuditOp names a change the watcher makes outside of its own memory
+type AuditOp string
+
+const (
+	// AuditClone is a repository cloned into the session's directory
+	AuditClone AuditOp = "clone"
+	// AuditFetch is a fetch into a clone that leaves its worktree alone
+	AuditFetch AuditOp = "fetch"
+	// AuditPull is a fetch that also updated the clone's worktree
+	AuditPull AuditOp = "pull"
+	// AuditReset is a clone's worktree reset to another commit
+	AuditReset AuditOp = "reset"
+	// AuditDelete is a clone removed from disk
+	AuditDelete AuditOp = "delete"
+	// AuditReclone is a clone removed and cloned again, after an error or to
+	// pick up a change
+	AuditReclone AuditOp = "reclone"
+	// AuditDeploy is a release made or `current` switched in a deploy layout
+	AuditDeploy AuditOp = "deploy"
+	// AuditPrune is an old release removed from a deploy layout
+	AuditPrune AuditOp = "prune"
+	// AuditPush is a push to a repository's push mirror
+	AuditPush AuditOp = "push"
+)
+
+// AuditEntry records one change the watcher made and how it went
+type AuditEntry struct {
+	Time     time.Time     `json:"time"`               // when the operation started
+	Duration time.Duration `json:"duration"`           // how long it took
+	Op       AuditOp       `json:"op"`                 // what was done
+	URL      string        `json:"url"`                // the repository's URL
+	Path     string        `json:"path"`               // the directory changed: the clone, or the release for deploys and prunes
+	Branch   string        `json:"branch,omitempty"`   // the watched branch, if one is set
+	From     string        `json:"from,omitempty"`     // the commit checked out before, for pulls and resets
+	To       string        `json:"to,omitempty"`       // the commit checked out after, for pulls, resets and deploys
+	Error    string        `json:"error,omitempty"`    // why the operation failed, empty if it succeeded
+	TraceID  string        `json:"trace_id,omitempty"` // the trace of the round of checks, or webhook delivery, that made the change
+}
+
+// AuditLog is an append-only record of the changes the watcher makes to
+// clones, deploy directories and push mirrors. Fetches and pulls that find
+// nothing new change nothing and aren't recorded.
+type AuditLog interface {
+	// Record appends an entry to the log
+	Record(AuditEntry) error
+	// Entries returns the recorded entries matching the filter, oldest first
+	Entries(ctx context.Context, f EventFilter) ([]AuditEntry, error)
+}
+
+// audit records an operation that started at `started` and ended with `err`
+// in the session's AuditLog. The entry's URL, Path and Branch default to the
+// repository's. Failing to record is reported on Errors, the operation itself
+// has already happened.
+func (s *Session) audit(repository Repository, e AuditEntry, started time.Time, err error) {
+	if s.Audit == nil || err == git.NoErrAlreadyUpToDate {
+		return
+	}
+	e.Time = started
+	e.Duration = time.Since(started)
+	if e.URL == "" {
+		e.URL = repository.URL
+	}
+	if e.Path == "" {
+		e.Path = repository.fullPath
+	}
+	if e.Branch == "" {
+		e.Branch = repository.Branch
+	}
+	e.TraceID = s.trace
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if err := s.Audit.Record(e); err != nil {
+		s.reportError(ErrorRecord{Op: "audit", URL: e.URL}, errors.Wrap(err, "failed to record audit entry"))
+	}
+}
+
+// AuditFile is an AuditLog kept in a file, one JSON entry per line. Entries
+// are only ever appended.
+type AuditFile struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// Record implements AuditLog
+func (a *AuditFile) Record(e AuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode audit entry")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.OpenFile(a.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open audit log")
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to write audit log")
+	}
+	return errors.Wrap(f.Close(), "failed to write audit log")
+}
+
+// Entries implements AuditLog
+func (a *AuditFile) Entries(ctx context.Context, f EventFilter) (entries []AuditEntry, err error) {
+	file, err := os.Open(a.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to open audit log")
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, errors.Wrap(err, "failed to decode audit entry")
+		}
+		if f.matches(e.URL, e.Branch, e.Time) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, errors.Wrap(scanner.Err(), "failed to read audit log")
+}
+
+// matches reports whether something of a repository and branch that happened
+// at a given time passes the filter.
+func (f EventFilter) matches(url, branch string, t time.Time) bool {
+	switch {
+	case f.URL != "" && url != f.URL:
+		return false
+	case f.Branch != "" && branch != f.Branch:
+		return false
+	case !f.Since.IsZero() && t.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !t.Before(f.Until):
+		return false
+	}
+	return true
+}
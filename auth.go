@@ -0,0 +1,21 @@
+package gitwatch
+
+import (
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+// BasicAuth authenticates with HTTPS remotes using a username and password
+func BasicAuth(username, password string) transport.AuthMethod {
+	return &http.BasicAuth{Username: username, Password: password}
+}
+
+// TokenAuth authenticates with HTTPS remotes using an access token, sent as the
+// password of basic auth as GitHub, GitLab and Bitbucket expect. Most hosts
+// ignore the username, which is `git` if empty.
+func TokenAuth(username, token string) transport.AuthMethod {
+	if username == "" {
+		username = "git"
+	}
+	return &http.BasicAuth{Username: username, Password: token}
+}
@@ -0,0 +1,106 @@
+package gitwatch
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/pktline"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+// Azure DevOps refuses fetches from clients that don't ask for the multi_ack
+// capability, which go-git leaves out because it can't decode the responses of
+// the full negotiation. As go-git sends all of its haves and `done` in a
+// single request over HTTP, the server only answers with ACK lines go-git can
+// read, so azureTransport asks for the capability on its behalf.
+
+// isAzureDevOps reports whether a repository is hosted on Azure DevOps or its
+// older visualstudio.com domains.
+func isAzureDevOps(repo string) bool {
+	host := repoHost(repo)
+	return host == "dev.azure.com" ||
+		host == "ssh.dev.azure.com" ||
+		strings.HasSuffix(host, ".visualstudio.com")
+}
+
+// normaliseAzureURL strips the organisation name Azure DevOps embeds as the
+// user in the HTTPS clone URLs it hands out, such as
+// `https://org@dev.azure.com/org/project/_git/repo`. go-git would otherwise
+// send it as a user with an empty password when no auth method is set.
+func normaliseAzureURL(repo string) string {
+	if !isAzureDevOps(repo) || !strings.HasPrefix(repo, "http") {
+		return repo
+	}
+	u, err := url.Parse(repo)
+	if err != nil || u.User == nil {
+		return repo
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		return repo
+	}
+	u.User = nil
+	return u.String()
+}
+
+// azureTransport adds the multi_ack capability to the upload-pack requests
+// sent to Azure DevOps, and passes every other request on unchanged. Only
+// HTTP and HTTPS remotes are covered: over SSH, go-git writes the request to
+// the command's input itself, so repositories on `ssh.dev.azure.com` are still
+// refused.
+type azureTransport struct {
+	next http.RoundTripper // the transport requests are sent with, http.DefaultTransport if nil
+}
+
+// RoundTrip implements http.RoundTripper
+func (t azureTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if r.Method != http.MethodPost || r.Body == nil || !isAzureDevOps(r.URL.String()) ||
+		!strings.HasSuffix(r.URL.Path, "/"+transport.UploadPackServiceName) {
+		return next.RoundTrip(r)
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if body, err = withMultiACK(body); err != nil {
+		return nil, err
+	}
+	r = r.Clone(r.Context())
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return next.RoundTrip(r)
+}
+
+// withMultiACK adds the multi_ack capability to the first want line of an
+// upload-pack request, which carries the capabilities the client asks for.
+func withMultiACK(body []byte) ([]byte, error) {
+	if len(body) < 4 {
+		return body, nil
+	}
+	n, err := strconv.ParseUint(string(body[:4]), 16, 16)
+	if err != nil || int(n) > len(body) || n <= 4 {
+		return nil, errors.New("malformed upload-pack request")
+	}
+	line := bytes.TrimSuffix(body[4:n], []byte("\n"))
+	if !bytes.HasPrefix(line, []byte("want ")) || bytes.Contains(line, []byte(" "+capability.MultiACK.String())) {
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	if err = pktline.NewEncoder(&buf).Encodef("%s %s\n", line, capability.MultiACK); err != nil {
+		return nil, err
+	}
+	buf.Write(body[n:])
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,116 @@
+package gitwatch
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// matchBranch reports whether a branch name matches any of a repository's
+// Branches, given as names or as patterns such as `release/*`, where `*` and
+// `?` match within a path segment.
+func matchBranch(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok || p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBranches compares the heads of the remote's branches matching the
+// repository's Branches with those seen on the previous check, fetches any
+// that are new or have moved into their remote-tracking references and returns
+// a commit event for each, naming the branch. A matching branch that
+// disappears emits EventBranchDeleted. The branch checked out in the clone is
+// left to the usual pull, and the first check of a repository only records the
+// heads.
+func (s *Session) checkBranches(repo *git.Repository, repository Repository) (events []Event, err error) {
+	refs, err := s.remoteRefs(repo, repository)
+	if err != nil {
+		return
+	}
+
+	watched := repository.Branch
+	if watched == "" {
+		if head, err := repo.Head(); err == nil {
+			watched = head.Name().Short()
+		}
+	}
+	current := make(map[string]plumbing.Hash)
+	for _, ref := range refs {
+		name := ref.Name()
+		if name.IsBranch() && ref.Type() == plumbing.HashReference && name.Short() != watched && matchBranch(repository.Branches, name.Short()) {
+			current[name.Short()] = ref.Hash()
+		}
+	}
+
+	state := s.stateOf(repository)
+	previous := state.branches
+	state.branches = current
+	if previous == nil {
+		return
+	}
+
+	var changed, deleted []string
+	var specs []config.RefSpec
+	for name, hash := range current {
+		if previous[name] != hash {
+			changed = append(changed, name)
+			specs = append(specs, config.RefSpec(fmt.Sprintf("+%s:%s", plumbing.NewBranchReferenceName(name), plumbing.NewRemoteReferenceName("origin", name))))
+		}
+	}
+	for name := range previous {
+		if _, ok := current[name]; !ok {
+			deleted = append(deleted, name)
+		}
+	}
+	if len(changed) > 0 {
+		if err = s.fetchRefs(repo, repository, specs...); err != nil {
+			state.branches = previous
+			return
+		}
+	}
+
+	sort.Strings(changed)
+	for _, name := range changed {
+		var event Event
+		event, err = newEvent(repo, EventCommit)
+		if err != nil {
+			return nil, err
+		}
+		c, err := repo.CommitObject(current[name])
+		if err != nil {
+			return nil, err
+		}
+		event.Branch = name
+		event.Timestamp = c.Author.When
+		event.commit = *c
+		if err = markForced(repo, &event, previous[name]); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	sort.Strings(deleted)
+	for _, name := range deleted {
+		var event Event
+		event, err = newEvent(repo, EventBranchDeleted)
+		if err != nil {
+			return nil, err
+		}
+		// the event carries the last commit seen on the branch, if it was fetched
+		if c, err := repo.CommitObject(previous[name]); err == nil {
+			event.commit = *c
+		}
+		event.Branch = name
+		event.Timestamp = time.Now()
+		events = append(events, event)
+	}
+	return
+}
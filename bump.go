@@ -0,0 +1,77 @@
+package gitwatch
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Bump is the semantic version increment a change implies
+type Bump int
+
+const (
+	// BumpNone means the change doesn't need a release
+	BumpNone Bump = iota
+	// BumpPatch is for backwards compatible fixes
+	BumpPatch
+	// BumpMinor is for backwards compatible features
+	BumpMinor
+	// BumpMajor is for breaking changes
+	BumpMajor
+)
+
+var bumpNames = []string{
+	BumpNone:  "none",
+	BumpPatch: "patch",
+	BumpMinor: "minor",
+	BumpMajor: "major",
+}
+
+func (b Bump) String() string {
+	if b >= 0 && int(b) < len(bumpNames) {
+		return bumpNames[b]
+	}
+	return "unknown"
+}
+
+// MarshalText encodes the bump by name
+func (b Bump) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+// UnmarshalText parses `none`, `patch`, `minor` or `major`
+func (b *Bump) UnmarshalText(text []byte) error {
+	for i, name := range bumpNames {
+		if string(text) == name {
+			*b = Bump(i)
+			return nil
+		}
+	}
+	return errors.Errorf("unknown bump %q", text)
+}
+
+// DefaultBumpRules follow Conventional Commits: features are minor releases and
+// fixes and performance improvements are patches. Breaking changes are always
+// major releases.
+var DefaultBumpRules = map[string]Bump{
+	"feat": BumpMinor,
+	"fix":  BumpPatch,
+	"perf": BumpPatch,
+}
+
+// inferBump returns the largest bump any of the commits implies under the
+// session's BumpRules.
+func (s *Session) inferBump(types []CommitType) (bump Bump) {
+	rules := s.BumpRules
+	if rules == nil {
+		rules = DefaultBumpRules
+	}
+	for _, t := range types {
+		b := rules[t.Type]
+		if t.Breaking {
+			b = BumpMajor
+		}
+		if b > bump {
+			bump = b
+		}
+	}
+	return
+}
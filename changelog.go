@@ -0,0 +1,118 @@
+package gitwatch
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// Changelog is an Enricher that renders the new commits of commit and digest
+// events as a changelog, grouped by their CommitTypes, for notification
+// e-mails and release notes. The changelog is attached to the event's
+// Changelog and, if Dir is set, also written to a file there, named like the
+// files of Artifacts.
+type Changelog struct {
+	Template *template.Template // executed with a ChangelogData, DefaultChangelogTemplate if nil
+	Dir      string             // if set, each changelog is also written to a file in this directory
+	Ext      string             // the extension of the files, `.md` if empty
+}
+
+// ChangelogData is what a changelog template is executed with
+type ChangelogData struct {
+	Event    Event
+	Sections []ChangelogSection // the sections with commits, in the order of ChangelogSections
+}
+
+// ChangelogSection is a titled list of commits in a changelog
+type ChangelogSection struct {
+	Title   string
+	Commits []CommitType // newest first
+}
+
+// ChangelogSections are the titles commits are grouped under, in order, and
+// the commit types that go in each. Breaking changes of any type go in the
+// first, and commits of other types in the last.
+var ChangelogSections = []struct {
+	Title string
+	Types []string
+}{
+	{"Breaking Changes", nil},
+	{"Features", []string{"feat"}},
+	{"Bug Fixes", []string{"fix"}},
+	{"Performance", []string{"perf"}},
+	{"Other Changes", nil},
+}
+
+// ChangelogFuncs are available to changelog templates: `short` abbreviates a
+// commit hash.
+var ChangelogFuncs = template.FuncMap{
+	"short": func(hash string) string {
+		if len(hash) > 7 {
+			return hash[:7]
+		}
+		return hash
+	},
+}
+
+// DefaultChangelogTemplate renders a changelog in Markdown
+var DefaultChangelogTemplate = template.Must(template.New("changelog").Funcs(ChangelogFuncs).Parse(
+	`{{range .Sections}}### {{.Title}}
+
+{{range .Commits}}- {{if .Scope}}**{{.Scope}}:** {{end}}{{.Description}} ({{short .Hash}})
+{{end}}
+{{end}}`))
+
+// Enrich renders the event's changelog
+func (c Changelog) Enrich(e *Event) error {
+	if len(e.CommitTypes) == 0 {
+		return nil
+	}
+	tmpl := c.Template
+	if tmpl == nil {
+		tmpl = DefaultChangelogTemplate
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, ChangelogData{Event: *e, Sections: changelogSections(e.CommitTypes)}); err != nil {
+		return errors.Wrap(err, "failed to render changelog")
+	}
+	e.Changelog = strings.TrimSpace(b.String()) + "\n"
+
+	if c.Dir == "" {
+		return nil
+	}
+	ext := c.Ext
+	if ext == "" {
+		ext = ".md"
+	}
+	return writeArtifact(c.Dir, artifactName(*e)+ext, []byte(e.Changelog))
+}
+
+// changelogSections groups commits under ChangelogSections, leaving out empty
+// sections.
+func changelogSections(commits []CommitType) (sections []ChangelogSection) {
+	last := len(ChangelogSections) - 1
+	grouped := make([][]CommitType, len(ChangelogSections))
+	for _, c := range commits {
+		i := last
+		if c.Breaking {
+			i = 0
+		} else {
+			for j, s := range ChangelogSections {
+				for _, t := range s.Types {
+					if c.Type == t {
+						i = j
+					}
+				}
+			}
+		}
+		grouped[i] = append(grouped[i], c)
+	}
+	for i, commits := range grouped {
+		if len(commits) > 0 {
+			sections = append(sections, ChangelogSection{ChangelogSections[i].Title, commits})
+		}
+	}
+	return
+}
@@ -0,0 +1,88 @@
+package gitwatch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Format is an encoding sinks can deliver events in
+type Format int
+
+const (
+	// FormatJSON encodes events as plain JSON
+	FormatJSON Format = iota
+	// FormatCloudEvents encodes events as CloudEvents 1.0 in structured mode,
+	// with the plain JSON event as the data
+	FormatCloudEvents
+)
+
+// CloudEventsTypePrefix prefixes the event type in CloudEvents, for example
+// `io.github.southclaws.gitwatch.commit`
+const CloudEventsTypePrefix = "io.github.southclaws.gitwatch."
+
+// CloudEvent is an event in the CloudEvents 1.0 JSON format
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// NewCloudEvent wraps an event in a CloudEvent. The source is the repository
+// URL and the subject is the most specific ref or commit the event is about.
+// The ID is derived from the event's contents so redeliveries of the same
+// event can be deduplicated.
+func NewCloudEvent(e Event) (ce CloudEvent, err error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return ce, errors.Wrap(err, "failed to encode event")
+	}
+	sum := sha256.Sum256(data)
+
+	subject := e.commit.Hash.String()
+	switch {
+	case e.Tag != "":
+		subject = e.Tag
+	case e.Branch != "":
+		subject = e.Branch
+	case e.commit.Hash.IsZero():
+		subject = ""
+	}
+
+	return CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              hex.EncodeToString(sum[:16]),
+		Source:          e.URL,
+		Type:            CloudEventsTypePrefix + e.Type.String(),
+		Subject:         subject,
+		Time:            e.Timestamp,
+		DataContentType: "application/json",
+		Data:            data,
+	}, nil
+}
+
+// Encode encodes an event in the given format and returns the content type
+// that describes it.
+func Encode(e Event, f Format) (body []byte, contentType string, err error) {
+	switch f {
+	case FormatJSON:
+		body, err = json.Marshal(e)
+		return body, "application/json", err
+	case FormatCloudEvents:
+		ce, err := NewCloudEvent(e)
+		if err != nil {
+			return nil, "", err
+		}
+		body, err = json.Marshal(ce)
+		return body, "application/cloudevents+json", err
+	}
+	return nil, "", errors.Errorf("unknown format %d", f)
+}
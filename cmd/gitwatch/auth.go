@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/Southclaws/gitwatch"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+var authFlag = cli.StringSliceFlag{
+	Name:   "auth",
+	EnvVar: "GITWATCH_AUTH",
+	Usage:  "credentials for the repositories whose URL starts with a prefix, as `prefix=type:credentials`, where the type is token:[user:]token, basic:user:password, ssh-key:file or ssh-agent, the longest matching prefix wins",
+}
+
+// prefixAuth is an authentication method for repositories whose URL starts
+// with a prefix
+type prefixAuth struct {
+	prefix string
+	auth   transport.AuthMethod
+}
+
+// parseAuths parses --auth specifications. Keys given with `ssh-key` are
+// decrypted with `passphrase`.
+func parseAuths(specs []string, passphrase string) (auths []prefixAuth, err error) {
+	for _, spec := range specs {
+		eq := strings.Index(spec, "=")
+		if eq < 1 {
+			return nil, errors.Errorf("invalid --auth %q, expected prefix=type:credentials", spec)
+		}
+		prefix, method := spec[:eq], spec[eq+1:]
+		kind, creds := method, ""
+		if colon := strings.Index(method, ":"); colon != -1 {
+			kind, creds = method[:colon], method[colon+1:]
+		}
+
+		var auth transport.AuthMethod
+		switch kind {
+		case "token":
+			user, token := "", creds
+			if colon := strings.Index(creds, ":"); colon != -1 {
+				user, token = creds[:colon], creds[colon+1:]
+			}
+			auth = gitwatch.TokenAuth(user, token)
+		case "basic":
+			colon := strings.Index(creds, ":")
+			if colon == -1 {
+				return nil, errors.Errorf("invalid --auth for %s, expected basic:user:password", prefix)
+			}
+			auth = gitwatch.BasicAuth(creds[:colon], creds[colon+1:])
+		case "ssh-key":
+			if auth, err = ssh.NewPublicKeysFromFile("git", creds, passphrase); err != nil {
+				return nil, errors.Wrapf(err, "failed to load SSH key for %s", prefix)
+			}
+		case "ssh-agent":
+			if auth, err = ssh.NewSSHAgentAuth("git"); err != nil {
+				return nil, errors.Wrapf(err, "failed to set up SSH authentication for %s", prefix)
+			}
+		default:
+			return nil, errors.Errorf("unknown --auth type %q for %s", kind, prefix)
+		}
+		auths = append(auths, prefixAuth{prefix, auth})
+	}
+	return
+}
+
+// applyAuths sets the Auth of each repository with a URL matching one of the
+// prefixes to the method of the longest.
+func applyAuths(repos []gitwatch.Repository, auths []prefixAuth) {
+	for i, r := range repos {
+		longest := -1
+		for _, a := range auths {
+			if strings.HasPrefix(r.URL, a.prefix) && len(a.prefix) > longest {
+				longest = len(a.prefix)
+				repos[i].Auth = a.auth
+			}
+		}
+	}
+}
+
+// checkConfigAuth returns an error if credentials were given as flags along
+// with --config, which takes them from the config file's auths instead.
+func checkConfigAuth(c *cli.Context) error {
+	if len(c.StringSlice("auth")) > 0 {
+		return errors.New("--auth can't be used with --config, set auths in the config file instead")
+	}
+	for _, name := range []string{"token", "username", "password", "ssh-key"} {
+		if c.String(name) != "" {
+			return errors.Errorf("--%s can't be used with --config, set auths in the config file instead", name)
+		}
+	}
+	return nil
+}
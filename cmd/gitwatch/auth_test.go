@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/Southclaws/gitwatch"
+	"github.com/bmizerany/assert"
+	"github.com/urfave/cli"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+func TestParseAuths(t *testing.T) {
+	for _, tc := range []struct {
+		spec   string
+		prefix string
+		auth   transport.AuthMethod
+		err    string
+	}{
+		{"https://github.com/=token:abc", "https://github.com/", gitwatch.TokenAuth("", "abc"), ""},
+		{"https://github.com/=token:bot:abc", "https://github.com/", gitwatch.TokenAuth("bot", "abc"), ""},
+		{"https://git.example.com/=basic:me:p:ss", "https://git.example.com/", gitwatch.BasicAuth("me", "p:ss"), ""},
+		{"https://git.example.com/=basic:me", "", nil, "invalid --auth for https://git.example.com/, expected basic:user:password"},
+		{"=token:abc", "", nil, `invalid --auth "=token:abc", expected prefix=type:credentials`},
+		{"token:abc", "", nil, `invalid --auth "token:abc", expected prefix=type:credentials`},
+		{"https://github.com/=oauth:abc", "", nil, `unknown --auth type "oauth" for https://github.com/`},
+		{"git@github.com:=ssh-key:./test/missing-key", "", nil, "failed to load SSH key for git@github.com:"},
+	} {
+		auths, err := parseAuths([]string{tc.spec}, "")
+		if tc.err != "" {
+			assert.NotEqual(t, nil, err)
+			assert.T(t, strings.HasPrefix(err.Error(), tc.err), err)
+			continue
+		}
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 1, len(auths))
+		assert.Equal(t, tc.prefix, auths[0].prefix)
+		assert.Equal(t, tc.auth, auths[0].auth)
+	}
+}
+
+func TestApplyAuths(t *testing.T) {
+	org := gitwatch.TokenAuth("", "org")
+	host := gitwatch.TokenAuth("", "host")
+	other := gitwatch.BasicAuth("me", "secret")
+	auths := []prefixAuth{
+		{"https://github.com/", host},
+		{"https://github.com/Southclaws/", org},
+		{"https://gitlab.com/", other},
+	}
+
+	for _, tc := range []struct {
+		url  string
+		auth transport.AuthMethod
+	}{
+		{"https://github.com/Southclaws/gitwatch", org},
+		{"https://github.com/someone/else", host},
+		{"https://gitlab.com/group/project", other},
+		{"https://bitbucket.org/team/repo", nil},
+		{"git@github.com:Southclaws/gitwatch", nil},
+	} {
+		repos := []gitwatch.Repository{{URL: tc.url}}
+		applyAuths(repos, auths)
+		assert.Equal(t, tc.auth, repos[0].Auth)
+	}
+
+	// the longest prefix wins wherever it's listed
+	repos := []gitwatch.Repository{{URL: "https://github.com/Southclaws/gitwatch"}}
+	applyAuths(repos, []prefixAuth{auths[1], auths[0]})
+	assert.Equal(t, org, repos[0].Auth)
+}
+
+func TestCheckConfigAuth(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		err  string
+	}{
+		{nil, ""},
+		{[]string{"--ssh-key-passphrase", "x"}, ""},
+		{[]string{"--auth", "https://github.com/=token:abc"}, "--auth can't be used with --config, set auths in the config file instead"},
+		{[]string{"--token", "abc"}, "--token can't be used with --config, set auths in the config file instead"},
+		{[]string{"--username", "me"}, "--username can't be used with --config, set auths in the config file instead"},
+		{[]string{"--password", "secret"}, "--password can't be used with --config, set auths in the config file instead"},
+		{[]string{"--ssh-key", "id_rsa"}, "--ssh-key can't be used with --config, set auths in the config file instead"},
+	} {
+		set := flag.NewFlagSet("gitwatch", flag.ContinueOnError)
+		for _, f := range []cli.Flag{
+			authFlag,
+			cli.StringFlag{Name: "token"},
+			cli.StringFlag{Name: "username"},
+			cli.StringFlag{Name: "password"},
+			cli.StringFlag{Name: "ssh-key"},
+			cli.StringFlag{Name: "ssh-key-passphrase"},
+		} {
+			f.Apply(set)
+		}
+		assert.Equal(t, nil, set.Parse(tc.args))
+
+		err := checkConfigAuth(cli.NewContext(nil, set, nil))
+		if tc.err == "" {
+			assert.Equal(t, nil, err)
+		} else {
+			assert.Equal(t, tc.err, err.Error())
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Southclaws/gitwatch"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var listenFlag = cli.StringFlag{
+	Name:   "listen",
+	EnvVar: "GITWATCH_LISTEN",
+	Usage:  "address to serve the health endpoint on, `host:port` or `unix:/path/to.sock`",
+}
+
+var healthcheckCommand = cli.Command{
+	Name:  "healthcheck",
+	Usage: "exits 0 if the gitwatch daemon serving --listen is healthy, 1 otherwise",
+	Flags: []cli.Flag{
+		listenFlag,
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "how long to wait for the daemon to respond",
+			Value: 5 * time.Second,
+		},
+	},
+	Action: func(c *cli.Context) error {
+		addr := c.String("listen")
+		if addr == "" {
+			return cli.NewExitError("healthcheck: --listen or GITWATCH_LISTEN is required", 1)
+		}
+		if err := healthcheck(addr, c.Duration("timeout")); err != nil {
+			return cli.NewExitError("unhealthy: "+err.Error(), 1)
+		}
+		return nil
+	},
+}
+
+// serve starts the HTTP endpoints of the daemon on a TCP address or a Unix
+// socket.
+func serve(addr string, watch *gitwatch.Session) error {
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+		// a socket left behind by a previous run would block the listen
+		os.Remove(addr)
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", gitwatch.HealthHandler(watch))
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			fmt.Println("Error:", err)
+		}
+	}()
+	return nil
+}
+
+// healthcheck queries the health endpoint of a daemon
+func healthcheck(addr string, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+	url := "http://" + addr + "/healthz"
+	if strings.HasPrefix(addr, ":") {
+		url = "http://localhost" + addr + "/healthz"
+	} else if strings.HasPrefix(addr, "unix:") {
+		socket := strings.TrimPrefix(addr, "unix:")
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		url = "http://gitwatch/healthz"
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		if reason := resp.Header.Get("X-Gitwatch-Unhealthy"); reason != "" {
+			return errors.New(reason)
+		}
+		return errors.Errorf("daemon responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Southclaws/gitwatch"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var sqliteFlag = cli.StringFlag{
+	Name:   "sqlite",
+	EnvVar: "GITWATCH_SQLITE",
+	Usage:  "SQLite database to record events, repository state, undeliverable events and the audit log in",
+}
+
+var historyCommand = cli.Command{
+	Name:  "history",
+	Usage: "prints the events recorded in the --sqlite database",
+	Flags: []cli.Flag{
+		sqliteFlag,
+		cli.StringFlag{
+			Name:  "repo",
+			Usage: "only events of the repository with this URL",
+		},
+		cli.StringFlag{
+			Name:  "branch",
+			Usage: "only events of this branch",
+		},
+		cli.StringFlag{
+			Name:  "since",
+			Usage: "only events from this time on, RFC 3339 or a duration before now such as `24h`",
+		},
+		cli.StringFlag{
+			Name:  "until",
+			Usage: "only events before this time, RFC 3339 or a duration before now",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print one JSON event per line instead of a table",
+		},
+	},
+	Action: func(c *cli.Context) (err error) {
+		path := c.String("sqlite")
+		if path == "" {
+			return cli.NewExitError("history: --sqlite or GITWATCH_SQLITE is required", 1)
+		}
+		filter := gitwatch.EventFilter{
+			URL:    c.String("repo"),
+			Branch: c.String("branch"),
+		}
+		if filter.Since, err = parseTime(c.String("since")); err != nil {
+			return errors.Wrap(err, "invalid --since")
+		}
+		if filter.Until, err = parseTime(c.String("until")); err != nil {
+			return errors.Wrap(err, "invalid --until")
+		}
+
+		// the database is only read, so don't create one for a mistyped path
+		if _, err = os.Stat(path); err != nil {
+			return errors.Wrap(err, "failed to open database")
+		}
+		db, err := sql.Open("sqlite3", path)
+		if err != nil {
+			return errors.Wrap(err, "failed to open database")
+		}
+		defer db.Close()
+		ctx := context.Background()
+		store, err := gitwatch.NewSQLStore(ctx, db)
+		if err != nil {
+			return err
+		}
+		events, err := store.Events(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		if c.Bool("json") {
+			enc := json.NewEncoder(os.Stdout)
+			for _, e := range events {
+				if err = enc.Encode(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return printHistory(os.Stdout, events)
+	},
+}
+
+// parseTime reads an RFC 3339 time or a duration before now, and returns the
+// zero time for an empty string.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// printHistory writes events as a table, one line each
+func printHistory(w io.Writer, events []gitwatch.Event) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tTYPE\tREPOSITORY\tBRANCH\tREF\tCOMMIT\tAUTHOR\tMESSAGE")
+	for _, e := range events {
+		ref := e.Tag
+		if ref == "" {
+			ref = e.Ref
+		}
+		var hash, author, message string
+		if c := e.Commit(); !c.Hash.IsZero() {
+			hash = c.Hash.String()[:7]
+			author = c.Author.Name
+			message = strings.SplitN(c.Message, "\n", 2)[0]
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Timestamp.Local().Format(time.RFC3339), e.Type, e.URL, e.Branch, ref, hash, author, message)
+	}
+	return tw.Flush()
+}
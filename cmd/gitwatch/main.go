@@ -2,16 +2,22 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Southclaws/gitwatch"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"golang.org/x/xerrors"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
 )
 
@@ -19,7 +25,7 @@ func main() {
 	app := cli.NewApp()
 	app.Name = "gitwatch"
 	app.Usage = "Writes to stdout whenever the specified git repository receives a commit"
-	app.UsageText = "gitwatch [flags] [repositories with ssh URLs]"
+	app.UsageText = "gitwatch [flags] [repositories with ssh or https URLs]"
 	app.HideVersion = true
 	app.HideHelp = true
 
@@ -38,82 +44,598 @@ func main() {
 			Name:   "initial-event",
 			EnvVar: "GITWATCH_INITIAL_EVENT",
 		},
+		cli.StringFlag{
+			Name:   "username",
+			EnvVar: "GITWATCH_USERNAME",
+			Usage:  "username for HTTPS repositories, with --password or --token",
+		},
+		cli.StringFlag{
+			Name:   "password",
+			EnvVar: "GITWATCH_PASSWORD",
+			Usage:  "password for HTTPS repositories",
+		},
+		cli.StringFlag{
+			Name:   "token",
+			EnvVar: "GITWATCH_TOKEN",
+			Usage:  "access token for HTTPS repositories",
+		},
+		cli.StringFlag{
+			Name:   "ssh-key",
+			EnvVar: "GITWATCH_SSH_KEY",
+			Usage:  "private key file for SSH repositories, instead of the SSH agent",
+		},
+		cli.StringFlag{
+			Name:   "ssh-key-passphrase",
+			EnvVar: "GITWATCH_SSH_KEY_PASSPHRASE",
+			Usage:  "passphrase of --ssh-key, if it's encrypted",
+		},
+		authFlag,
+		cli.BoolFlag{
+			Name:   "ordered-events",
+			EnvVar: "GITWATCH_ORDERED_EVENTS",
+			Usage:  "print the events of each check in the order the repositories are listed",
+		},
+		cli.BoolFlag{
+			Name:   "reuse-ssh",
+			EnvVar: "GITWATCH_REUSE_SSH",
+			Usage:  "keep SSH connections open between checks of repositories on the same server",
+		},
+		cli.StringFlag{
+			Name:   "error-policy",
+			EnvVar: "GITWATCH_ERROR_POLICY",
+			Usage:  "`fail-fast` to exit on the first error at startup, or `resilient` to keep retrying failing repositories",
+		},
+		cli.IntFlag{
+			Name:   "failing-limit",
+			EnvVar: "GITWATCH_FAILING_LIMIT",
+			Usage:  "with --error-policy resilient, exit once every repository has failed this many checks in a row",
+		},
+		cli.StringFlag{
+			Name:   "recovery",
+			EnvVar: "GITWATCH_RECOVERY",
+			Usage:  "what to do with a clone that fails to update: `report` the error, reset, fetch-reset or reclone",
+		},
+		cli.IntFlag{
+			Name:   "retry-attempts",
+			EnvVar: "GITWATCH_RETRY_ATTEMPTS",
+			Usage:  "stop checking a repository once this many checks of it in a row have failed",
+		},
+		cli.DurationFlag{
+			Name:   "retry-backoff",
+			EnvVar: "GITWATCH_RETRY_BACKOFF",
+			Usage:  "wait this long before retrying a failing repository, doubling with each failure",
+		},
+		cli.DurationFlag{
+			Name:   "retry-max-backoff",
+			EnvVar: "GITWATCH_RETRY_MAX_BACKOFF",
+			Usage:  "the longest wait between retries of a failing repository",
+			Value:  time.Hour,
+		},
+		cli.Float64Flag{
+			Name:   "retry-jitter",
+			EnvVar: "GITWATCH_RETRY_JITTER",
+			Usage:  "the fraction of each wait between retries taken off at random",
+		},
+		cli.IntFlag{
+			Name:   "concurrency",
+			EnvVar: "GITWATCH_CONCURRENCY",
+			Usage:  "how many repositories to fetch at once in each round of checks",
+		},
+		cli.IntFlag{
+			Name:   "depth",
+			EnvVar: "GITWATCH_DEPTH",
+			Usage:  "clone and fetch repositories shallowly with this many commits of history",
+		},
+		cli.DurationFlag{
+			Name:   "operation-timeout",
+			EnvVar: "GITWATCH_OPERATION_TIMEOUT",
+			Usage:  "abandon clones, fetches, pulls and pushes taking longer than this and report them as errors",
+		},
+		cli.StringFlag{
+			Name:   "shard-dir",
+			EnvVar: "GITWATCH_SHARD_DIR",
+			Usage:  "shared directory through which instances with the same repositories split them between themselves",
+		},
+		cli.StringFlag{
+			Name:   "shard-name",
+			EnvVar: "GITWATCH_SHARD_NAME",
+			Usage:  "this instance's name in --shard-dir, the host name if empty",
+		},
+		cli.IntFlag{
+			Name:   "http-max-idle",
+			EnvVar: "GITWATCH_HTTP_MAX_IDLE",
+			Usage:  "idle HTTP connections to keep open per host between checks",
+			Value:  16,
+		},
+		cli.StringFlag{
+			Name:   "exec",
+			EnvVar: "GITWATCH_EXEC",
+			Usage:  "shell command to run for each event, described in GITWATCH_URL, GITWATCH_BRANCH, GITWATCH_COMMIT, GITWATCH_PATH and similar variables",
+		},
+		cli.DurationFlag{
+			Name:   "exec-timeout",
+			EnvVar: "GITWATCH_EXEC_TIMEOUT",
+			Usage:  "stop --exec commands running for longer than this",
+		},
+		cli.StringFlag{
+			Name:   "plugins",
+			EnvVar: "GITWATCH_PLUGINS",
+			Usage:  "directory of executables to pass each event to as JSON on stdin",
+		},
+		cli.StringFlag{
+			Name:   "wasm-dir",
+			EnvVar: "GITWATCH_WASM_DIR",
+			Usage:  "directory of WebAssembly modules to filter and annotate each event with",
+		},
+		cli.DurationFlag{
+			Name:   "wasm-timeout",
+			EnvVar: "GITWATCH_WASM_TIMEOUT",
+			Usage:  "stop WebAssembly filters taking longer than this over an event",
+			Value:  5 * time.Second,
+		},
+		cli.StringSliceFlag{
+			Name:   "webhook",
+			EnvVar: "GITWATCH_WEBHOOK",
+			Usage:  "URL to POST each event to, may be repeated",
+		},
+		cli.StringFlag{
+			Name:   "webhook-secret",
+			EnvVar: "GITWATCH_WEBHOOK_SECRET",
+			Usage:  "secret to sign webhook deliveries with",
+		},
+		cli.StringFlag{
+			Name:   "receive",
+			EnvVar: "GITWATCH_RECEIVE",
+			Usage:  "address to receive push webhooks from GitHub, GitLab, Gitea or Bitbucket on, such as `:8080`",
+		},
+		cli.StringFlag{
+			Name:   "receive-secret",
+			EnvVar: "GITWATCH_RECEIVE_SECRET",
+			Usage:  "secret push webhooks received with --receive must be signed with",
+		},
+		cli.StringFlag{
+			Name:   "artifacts",
+			EnvVar: "GITWATCH_ARTIFACTS",
+			Usage:  "directory to write a file describing each event to",
+		},
+		cli.BoolFlag{
+			Name:   "artifacts-env",
+			EnvVar: "GITWATCH_ARTIFACTS_ENV",
+			Usage:  "write artifacts as .env files instead of JSON",
+		},
+		cli.StringFlag{
+			Name:   "changelog",
+			EnvVar: "GITWATCH_CHANGELOG",
+			Usage:  "directory to write a Markdown changelog of the new commits of each event to",
+		},
+		cli.StringFlag{
+			Name:   "dead-letter",
+			EnvVar: "GITWATCH_DEAD_LETTER",
+			Usage:  "directory to store events that could not be delivered to plugins or webhooks",
+		},
+		cli.StringFlag{
+			Name:   "audit-log",
+			EnvVar: "GITWATCH_AUDIT_LOG",
+			Usage:  "file to append a JSON record of every clone, fetch, reset, deploy and push to",
+		},
+		cli.StringFlag{
+			Name:   "state-file",
+			EnvVar: "GITWATCH_STATE_FILE",
+			Usage:  "file to record the last event of each repository in, so a restart resumes from there",
+		},
+		sqliteFlag,
+		cli.StringFlag{
+			Name:   "replay-since",
+			EnvVar: "GITWATCH_REPLAY_SINCE",
+			Usage:  "on startup, deliver the events recorded in --sqlite since this time again, RFC 3339 or a duration before now",
+		},
+		cli.StringFlag{
+			Name:   "config",
+			EnvVar: "GITWATCH_CONFIG",
+			Usage:  "YAML, JSON or TOML file describing the session, may be encrypted with SOPS or age",
+		},
+		cli.StringFlag{
+			Name:   "config-repo",
+			EnvVar: "GITWATCH_CONFIG_REPO",
+			Usage:  "git repository to read --config from, relative to its root",
+		},
+		cli.StringFlag{
+			Name:   "config-branch",
+			EnvVar: "GITWATCH_CONFIG_BRANCH",
+			Usage:  "branch of --config-repo, the default branch if not set",
+		},
+		cli.StringFlag{
+			Name:   "config-dir",
+			EnvVar: "GITWATCH_CONFIG_DIR",
+			Value:  "./gitwatch-config/",
+			Usage:  "directory to clone --config-repo into",
+		},
+		cli.BoolFlag{
+			Name:   "reconcile",
+			EnvVar: "GITWATCH_RECONCILE",
+			Usage:  "apply changes to --config while running, without a restart, instead of only on SIGHUP",
+		},
+		listenFlag,
+		cli.BoolFlag{
+			Name:   "cloudevents",
+			EnvVar: "GITWATCH_CLOUDEVENTS",
+			Usage:  "encode events delivered to plugins and webhooks as CloudEvents",
+		},
+		cli.DurationFlag{
+			Name:   "shutdown-timeout",
+			EnvVar: "GITWATCH_SHUTDOWN_TIMEOUT",
+			Usage:  "how long to let checks, deliveries and --exec commands finish after SIGINT or SIGTERM",
+			Value:  30 * time.Second,
+		},
+		cli.BoolFlag{
+			Name:   "json-errors",
+			EnvVar: "GITWATCH_JSON_ERRORS",
+			Usage:  "print errors to stderr as JSON records, with the repository, operation and class of error",
+		},
 	}
+	app.Commands = []cli.Command{healthcheckCommand, historyCommand}
 	app.Action = func(c *cli.Context) (err error) {
 		repos := c.Args()
+		config := c.String("config")
 
-		if len(repos) == 0 {
+		if len(repos) == 0 && config == "" {
 			return cli.ShowAppHelp(c)
 		}
 
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
 
-		auth, err := ssh.NewSSHAgentAuth("git")
+		gitwatch.UseHTTPClient(gitwatch.NewHTTPClient(gitwatch.HTTPOptions{
+			MaxIdleConnsPerHost: c.Int("http-max-idle"),
+		}))
+
+		var watch *gitwatch.Session
+		if config != "" {
+			if err := checkConfigAuth(c); err != nil {
+				return err
+			}
+			w := gitwatch.ConfigWatch{
+				Path:       config,
+				Repository: c.String("config-repo"),
+				Branch:     c.String("config-branch"),
+				Directory:  c.String("config-dir"),
+			}
+			w.Manual = !c.Bool("reconcile")
+			watch, err = newFromConfigFile(ctx, w)
+			if err == nil {
+				watch.ConfigWatch = &w
+				go reloadOnHangup(ctx, watch)
+			}
+		} else {
+			watch, err = newFromArgs(ctx, c, repos)
+		}
 		if err != nil {
-			return errors.Wrap(err, "failed to set up SSH authentication")
+			return err
 		}
 
-		interval := c.Duration("interval")
-		dir := c.String("dir")
-		initialEvent := c.Bool("initial-event")
+		if c.Bool("ordered-events") {
+			watch.OrderedEvents = true
+		}
+		if c.Bool("reuse-ssh") {
+			watch.ReuseSSH = true
+		}
+		if policy := c.String("error-policy"); policy != "" {
+			if err = watch.ErrorPolicy.UnmarshalText([]byte(policy)); err != nil {
+				return err
+			}
+		}
+		if c.IsSet("failing-limit") {
+			watch.FailingLimit = c.Int("failing-limit")
+		}
+		if recovery := c.String("recovery"); recovery != "" {
+			if err = watch.Recovery.UnmarshalText([]byte(recovery)); err != nil {
+				return err
+			}
+		}
+		if c.IsSet("retry-attempts") {
+			watch.Retry.MaxAttempts = c.Int("retry-attempts")
+		}
+		if c.IsSet("retry-backoff") {
+			watch.Retry.MinBackoff = c.Duration("retry-backoff")
+		}
+		if c.IsSet("retry-max-backoff") {
+			watch.Retry.MaxBackoff = c.Duration("retry-max-backoff")
+		}
+		if c.IsSet("retry-jitter") {
+			watch.Retry.Jitter = c.Float64("retry-jitter")
+		}
+		if c.IsSet("concurrency") {
+			watch.Concurrency = c.Int("concurrency")
+		}
+		if c.IsSet("depth") {
+			watch.Depth = c.Int("depth")
+		}
+		if c.IsSet("operation-timeout") {
+			watch.OperationTimeout = c.Duration("operation-timeout")
+		}
 
-		fmt.Printf("interval: %v, dir: %v, initial event: %v\n", interval, dir, initialEvent)
+		if dir := c.String("shard-dir"); dir != "" {
+			watch.Sharding = &gitwatch.Sharding{
+				Name:    c.String("shard-name"),
+				Members: gitwatch.FileMembers{Dir: dir},
+			}
+		}
 
-		watch, err := gitwatch.New(
-			ctx,
-			MakeRepositoryList(repos),
-			interval,
-			dir,
-			auth,
-			initialEvent,
-		)
-		if err != nil {
-			return errors.Wrap(err, "failed to initialise watcher")
+		if dir := c.String("dead-letter"); dir != "" {
+			watch.DeadLetter = gitwatch.DeadLetterDir(dir)
+		}
+		if path := c.String("audit-log"); path != "" {
+			watch.Audit = &gitwatch.AuditFile{Path: path}
+		}
+		if path := c.String("state-file"); path != "" {
+			watch.State = &gitwatch.StateFile{Path: path}
+		}
+		if path := c.String("sqlite"); path != "" {
+			db, err := sql.Open("sqlite3", path)
+			if err != nil {
+				return errors.Wrap(err, "failed to open database")
+			}
+			defer db.Close()
+			store, err := gitwatch.NewSQLStore(ctx, db)
+			if err != nil {
+				return err
+			}
+			watch.Sinks = append(watch.Sinks, store)
+			watch.History = store
+			if watch.DeadLetter == nil {
+				watch.DeadLetter = store
+			}
+			if watch.Audit == nil {
+				watch.Audit = store
+			}
+		}
+		var replaySince time.Time
+		if replaySince, err = parseTime(c.String("replay-since")); err != nil {
+			return errors.Wrap(err, "invalid --replay-since")
+		}
+
+		format := gitwatch.FormatJSON
+		if c.Bool("cloudevents") {
+			format = gitwatch.FormatCloudEvents
 		}
 
+		if command := c.String("exec"); command != "" {
+			watch.Exec = &gitwatch.ExecHook{
+				Command: []string{"sh", "-c", command},
+				Timeout: c.Duration("exec-timeout"),
+				Output:  os.Stdout,
+			}
+		}
+		if dir := c.String("changelog"); dir != "" {
+			watch.Enrichers = append(watch.Enrichers, gitwatch.Changelog{Dir: dir})
+		}
+		if dir := c.String("wasm-dir"); dir != "" {
+			filters, err := gitwatch.LoadWASMFilters(dir, gitwatch.LoadWASM, c.Duration("wasm-timeout"))
+			if err != nil {
+				return err
+			}
+			watch.Enrichers = append(watch.Enrichers, filters...)
+		}
+		if dir := c.String("plugins"); dir != "" {
+			watch.Sinks = append(watch.Sinks, &gitwatch.Plugins{Dir: dir, Format: format})
+		}
+		if dir := c.String("artifacts"); dir != "" {
+			watch.Sinks = append(watch.Sinks, gitwatch.Artifacts{Dir: dir, Format: format, Env: c.Bool("artifacts-env")})
+		}
+		for _, url := range c.StringSlice("webhook") {
+			watch.Sinks = append(watch.Sinks, gitwatch.Webhook{
+				URL:    url,
+				Secret: c.String("webhook-secret"),
+				Format: format,
+			})
+		}
+
+		if addr := c.String("listen"); addr != "" {
+			if err = serve(addr, watch); err != nil {
+				return err
+			}
+		}
+		if addr := c.String("receive"); addr != "" {
+			l := gitwatch.WebhookListener{
+				Receiver: gitwatch.Receiver{Session: watch, Secret: c.String("receive-secret")},
+				Addr:     addr,
+			}
+			go func() {
+				if err := l.ListenAndServe(ctx); err != nil {
+					fmt.Println("Error:", err)
+				}
+			}()
+		}
+
+		jsonErrors := c.Bool("json-errors")
+		if jsonErrors {
+			watch.ErrorRecords = make(chan gitwatch.ErrorRecord)
+		}
 		go func() {
+			enc := json.NewEncoder(os.Stderr)
 			for {
 				select {
-				case e := <-watch.Events:
+				case e, ok := <-watch.Events:
+					if !ok {
+						return
+					}
 					fmt.Println("Event:", e)
-				case e := <-watch.Errors:
+				case e, ok := <-watch.Errors:
+					if !ok {
+						return
+					}
+					if jsonErrors {
+						continue
+					}
 					if xerrors.Is(e, io.EOF) {
 						fmt.Println("EOF:", e)
 					}
 					fmt.Println("Error:", e)
+				case r, ok := <-watch.ErrorRecords:
+					if !ok {
+						return
+					}
+					enc.Encode(r)
 				}
 			}
 		}()
 
-		return watch.Run()
+		if !replaySince.IsZero() {
+			go func() {
+				<-watch.InitialDone
+				n, err := watch.Replay(replaySince)
+				if err != nil {
+					fmt.Println("Error:", err)
+					return
+				}
+				fmt.Println("Replayed", n, "events")
+			}()
+		}
+
+		shutdown := shutdownOnSignal(watch, c.Duration("shutdown-timeout"))
+		if err = watch.Run(); err == context.Canceled {
+			return <-shutdown
+		}
+		return err
 	}
 	if err := app.Run(os.Args); err != nil {
 		fmt.Println(err)
 	}
 }
 
+// shutdownOnSignal shuts the session down gracefully on SIGINT or SIGTERM,
+// giving in-flight work up to timeout. The result of Shutdown is sent on the
+// channel returned.
+func shutdownOnSignal(watch *gitwatch.Session, timeout time.Duration) <-chan error {
+	done := make(chan error, 1)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		signal.Stop(stop)
+		fmt.Println("shutting down")
+		ctx, cf := context.WithTimeout(context.Background(), timeout)
+		defer cf()
+		done <- watch.Shutdown(ctx)
+	}()
+	return done
+}
+
+// reloadOnHangup reloads the session's config file whenever the process
+// receives SIGHUP.
+func reloadOnHangup(ctx context.Context, watch *gitwatch.Session) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+			if err := watch.ReloadConfig(); err != nil {
+				fmt.Println("Error:", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func newFromArgs(ctx context.Context, c *cli.Context, repos []string) (*gitwatch.Session, error) {
+	list := MakeRepositoryList(repos)
+
+	// HTTPS credentials apply to HTTPS repositories, the others use SSH
+	var httpAuth transport.AuthMethod
+	if token := c.String("token"); token != "" {
+		httpAuth = gitwatch.TokenAuth(c.String("username"), token)
+	} else if c.String("username") != "" || c.String("password") != "" {
+		httpAuth = gitwatch.BasicAuth(c.String("username"), c.String("password"))
+	}
+	if httpAuth != nil {
+		for i, r := range list {
+			if strings.HasPrefix(r.URL, "https://") || strings.HasPrefix(r.URL, "http://") {
+				list[i].Auth = httpAuth
+			}
+		}
+	}
+	auths, err := parseAuths(c.StringSlice("auth"), c.String("ssh-key-passphrase"))
+	if err != nil {
+		return nil, err
+	}
+	applyAuths(list, auths)
+
+	var auth transport.AuthMethod
+	if key := c.String("ssh-key"); key != "" {
+		keys, err := ssh.NewPublicKeysFromFile("git", key, c.String("ssh-key-passphrase"))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load SSH key")
+		}
+		auth = keys
+	} else if agent, err := ssh.NewSSHAgentAuth("git"); err == nil {
+		auth = agent
+	} else if httpAuth == nil && len(auths) == 0 {
+		return nil, errors.Wrap(err, "failed to set up SSH authentication")
+	}
+
+	interval := c.Duration("interval")
+	dir := c.String("dir")
+	initialEvent := c.Bool("initial-event")
+
+	fmt.Printf("interval: %v, dir: %v, initial event: %v\n", interval, dir, initialEvent)
+
+	watch, err := gitwatch.New(
+		ctx,
+		list,
+		interval,
+		dir,
+		auth,
+		initialEvent,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialise watcher")
+	}
+	return watch, nil
+}
+
+func newFromConfigFile(ctx context.Context, w gitwatch.ConfigWatch) (*gitwatch.Session, error) {
+	config, err := w.Load(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load config")
+	}
+
+	fmt.Printf("config: %v, repositories: %d\n", w.Path, len(config.Repositories))
+
+	watch, err := gitwatch.NewFromConfig(ctx, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialise watcher")
+	}
+	return watch, nil
+}
+
 // MakeRepositoryList Creates a repository list from an array of
 // strings, while also checking is the string contains a special
-// character which can be used to get the branch to use
+// character which can be used to get the branch to use. Any more
+// branches or patterns after it, separated by commas, are watched too.
 func MakeRepositoryList(repos []string) []gitwatch.Repository {
 	result := make([]gitwatch.Repository, len(repos))
 	for i, repo := range repos {
 		url := repo
 		branch := "master"
+		var branches []string
 
 		if strings.Contains(repo, "#") {
 			path := strings.Split(repo, "#")
 
 			url = path[0]
-			if len(path[1]) > 0 {
-				branch = path[1]
+			names := strings.Split(path[1], ",")
+			if len(names[0]) > 0 {
+				branch = names[0]
 			}
+			branches = names[1:]
 		}
 
 		result[i] = gitwatch.Repository{
-			URL:    url,
-			Branch: branch,
+			URL:      url,
+			Branch:   branch,
+			Branches: branches,
 		}
 	}
 	return result
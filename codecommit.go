@@ -0,0 +1,194 @@
+package gitwatch
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CodeCommitAuth authenticates with AWS CodeCommit over HTTPS using git
+// credentials derived from AWS credentials with Signature Version 4, the same
+// way the AWS CLI's credential helper does, so no static git password is
+// needed. A fresh signature is made for every request.
+//
+// Credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN if set, otherwise from the profile in the shared
+// credentials file.
+type CodeCommitAuth struct {
+	Profile string // the shared credentials profile, AWS_PROFILE or `default` if empty
+	Region  string // the region, taken from the repository host if empty
+}
+
+// AWSCredentials is a set of AWS access keys
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// NewCodeCommitAuth creates a CodeCommitAuth for a profile and checks that
+// credentials can be found for it.
+func NewCodeCommitAuth(profile, region string) (a *CodeCommitAuth, err error) {
+	a = &CodeCommitAuth{Profile: profile, Region: region}
+	if _, err = a.Credentials(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Name is the name of the auth
+func (a *CodeCommitAuth) Name() string {
+	return "codecommit-sigv4"
+}
+
+func (a *CodeCommitAuth) String() string {
+	return fmt.Sprintf("%s - %s", a.Name(), a.profile())
+}
+
+// SetAuth signs a request to CodeCommit. If no credentials can be found the
+// request is left unsigned and CodeCommit will reject it.
+func (a *CodeCommitAuth) SetAuth(r *http.Request) {
+	creds, err := a.Credentials()
+	if err != nil {
+		return
+	}
+	region := a.Region
+	if region == "" {
+		region = codeCommitRegion(r.URL.Hostname())
+	}
+	user, password := codeCommitPassword(creds, region, r.URL.Hostname(), codeCommitRepoPath(r.URL.Path), time.Now())
+	r.SetBasicAuth(user, password)
+}
+
+// Credentials finds the AWS credentials to sign requests with
+func (a *CodeCommitAuth) Credentials() (creds AWSCredentials, err error) {
+	creds = AWSCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID != "" && creds.SecretAccessKey != "" {
+		return
+	}
+
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return creds, errors.Wrap(err, "failed to find home directory")
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return creds, errors.Wrap(err, "failed to open AWS credentials")
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != a.profile() {
+			continue
+		}
+		if i := strings.Index(line, "="); i != -1 {
+			values[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return creds, errors.Wrap(err, "failed to read AWS credentials")
+	}
+
+	creds = AWSCredentials{
+		AccessKeyID:     values["aws_access_key_id"],
+		SecretAccessKey: values["aws_secret_access_key"],
+		SessionToken:    values["aws_session_token"],
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return creds, errors.Errorf("no AWS credentials for profile %s", a.profile())
+	}
+	return
+}
+
+func (a *CodeCommitAuth) profile() string {
+	if a.Profile != "" {
+		return a.Profile
+	}
+	if p := os.Getenv("AWS_PROFILE"); p != "" {
+		return p
+	}
+	return "default"
+}
+
+// codeCommitRegion reads the region from a host such as
+// `git-codecommit.eu-west-1.amazonaws.com`.
+func codeCommitRegion(host string) string {
+	parts := strings.Split(host, ".")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// codeCommitRepoPath trims a request path down to the repository it belongs
+// to, `/v1/repos/name`, which is what CodeCommit expects to be signed.
+func codeCommitRepoPath(path string) string {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 4)
+	if len(parts) < 3 {
+		return path
+	}
+	return "/" + strings.Join(parts[:3], "/")
+}
+
+// codeCommitPassword derives the git username and password for a repository
+// at a point in time.
+func codeCommitPassword(creds AWSCredentials, region, host, path string, now time.Time) (user, password string) {
+	timestamp := now.UTC().Format("20060102T150405")
+	canonical := fmt.Sprintf("GIT\n%s\n\nhost:%s\n\nhost\n", path, host)
+	signature := signV4(creds.SecretAccessKey, timestamp, region, "codecommit", canonical)
+
+	user = creds.AccessKeyID
+	if creds.SessionToken != "" {
+		user += "%" + creds.SessionToken
+	}
+	return user, timestamp + "Z" + signature
+}
+
+// signV4 signs a canonical request with Signature Version 4 and returns the
+// signature in hex. The date is the first 8 characters of the timestamp.
+func signV4(secret, timestamp, region, service, canonical string) string {
+	date := timestamp[:8]
+	hash := sha256.Sum256([]byte(canonical))
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+	toSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%s", timestamp, scope, hex.EncodeToString(hash[:]))
+
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
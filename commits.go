@@ -0,0 +1,313 @@
+package gitwatch
+
+import (
+	"fmt"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// processCommitEvent annotates a commit event with what can be learned from
+// the new commits and applies the repository's options for holding events
+// back. A nil event is returned when nothing should be emitted yet.
+func (s *Session) processCommitEvent(repo *git.Repository, repository Repository, event *Event, initial bool) (*Event, error) {
+	state := s.stateOf(repository)
+
+	// digests replace individual commit events entirely.
+	if repository.Digest > 0 {
+		return nil, nil
+	}
+
+	// ignored changes are passed over as if they had been reported
+	if !initial {
+		ignore, err := ignoredChange(repo, repository, state.lastEvent, &event.commit)
+		if err != nil {
+			return nil, err
+		}
+		if ignore {
+			s.setLastEvent(repository, event.commit.Hash)
+			return nil, nil
+		}
+	}
+
+	if !initial && repository.MinCommits > 1 {
+		n, err := countCommits(repo, state.lastEvent, event.commit.Hash, repository.MinCommits)
+		if err != nil {
+			return nil, err
+		}
+		if n < repository.MinCommits {
+			return nil, nil
+		}
+	}
+
+	event.PullRequest = mergedPullRequest(&event.commit, state.pulls)
+	event.Trailers = parseTrailers(event.commit.Message)
+	event.CommitTypes = classifyCommits([]object.Commit{event.commit})
+
+	if !initial {
+		commits, err := commitRange(repo, state.lastEvent, event.commit.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if len(commits) > 0 {
+			event.CommitTypes = classifyCommits(commits)
+			if repository.AllCommits {
+				event.commits = commits
+			}
+		}
+		event.Bump = s.inferBump(event.CommitTypes)
+		if len(commits) > 1 {
+			event.Summary, err = summarise(commits)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = s.attachChanges(repo, repository, event, state.lastEvent)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// within the rate limit window the event replaces any already waiting, it
+	// describes the newest state of the branch so nothing is lost.
+	if repository.RateLimit > 0 && time.Since(state.lastEmitted) < repository.RateLimit {
+		state.pending = event
+		return nil, nil
+	}
+
+	state.pending = nil
+	s.setLastEvent(repository, event.commit.Hash)
+	state.lastEmitted = time.Now()
+	return event, nil
+}
+
+// pendingEvent returns the event held back by a repository's rate limit once
+// the limit allows it to be emitted.
+func (s *Session) pendingEvent(repository Repository) *Event {
+	state := s.stateOf(repository)
+	if state.pending == nil || time.Since(state.lastEmitted) < repository.RateLimit {
+		return nil
+	}
+
+	event := state.pending
+	state.pending = nil
+	s.setLastEvent(repository, event.commit.Hash)
+	state.lastEmitted = time.Now()
+	return event
+}
+
+// digestEvent returns a digest of the commits made since the last one, once
+// the repository's digest period has passed and there is something to report.
+func (s *Session) digestEvent(repo *git.Repository, repository Repository) (event *Event, err error) {
+	state := s.stateOf(repository)
+	if time.Since(state.lastDigestAt) < repository.Digest {
+		return nil, nil
+	}
+	state.lastDigestAt = time.Now()
+
+	head, err := s.watchedHead(repo, repository)
+	if err != nil {
+		return nil, err
+	}
+	from := state.lastDigest
+	commits, err := commitRange(repo, from, head)
+	if err != nil {
+		return
+	}
+	state.lastDigest = head
+	if len(commits) == 0 {
+		return nil, nil
+	}
+
+	e, err := newEvent(repo, EventDigest)
+	if err != nil {
+		return
+	}
+	e.Timestamp = state.lastDigestAt
+	e.commit = commits[0]
+	e.commits = commits
+	e.CommitTypes = classifyCommits(commits)
+	e.Bump = s.inferBump(e.CommitTypes)
+	if len(commits) > 1 {
+		e.Summary, err = summarise(commits)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = s.attachChanges(repo, repository, &e, from)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// attachChanges annotates an event with details of the files changed between
+// `from` and the event's commit.
+func (s *Session) attachChanges(repo *git.Repository, repository Repository, event *Event, from plumbing.Hash) error {
+	if from.IsZero() || from == event.commit.Hash {
+		return nil
+	}
+
+	c, err := repo.CommitObject(from)
+	if err != nil {
+		return errors.Wrap(err, "failed to get commit to compare against")
+	}
+
+	files, err := changedFiles(c, &event.commit)
+	if err != nil {
+		return err
+	}
+	event.Changed = files
+	event.Owners, err = codeOwners(&event.commit, files)
+	if err != nil {
+		return err
+	}
+	event.Files, err = watchedFiles(c, &event.commit, files, repository.WatchFiles)
+	if err != nil {
+		return err
+	}
+	event.Components, err = affectedComponents(files, repository.Components)
+	if err != nil {
+		return err
+	}
+
+	if s.MaxDiffSize > 0 {
+		patch, err := c.Patch(&event.commit)
+		if err != nil {
+			return errors.Wrap(err, "failed to diff commits")
+		}
+		event.Diff = patch.String()
+		if len(event.Diff) > s.MaxDiffSize {
+			event.Diff = truncate(event.Diff, s.MaxDiffSize)
+			event.DiffCut = true
+		}
+	}
+	return nil
+}
+
+// truncate cuts s to at most n bytes, backing off to the start of the rune
+// that would be split so the result stays valid UTF-8
+func truncate(s string, n int) string {
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// changedFiles lists the paths of files added, modified or removed between two
+// commits, sorted.
+func changedFiles(from, to *object.Commit) (files []string, err error) {
+	fromTree, err := from.Tree()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get tree")
+	}
+	toTree, err := to.Tree()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get tree")
+	}
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to diff trees")
+	}
+	for _, change := range changes {
+		name := change.To.Name
+		if name == "" {
+			name = change.From.Name
+		}
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	return
+}
+
+// Summary aggregates the commits covered by an event
+type Summary struct {
+	Commits    int      `json:"commits"`    // the number of commits
+	Authors    []string `json:"authors"`    // distinct authors as `Name <email>`, newest first
+	Insertions int      `json:"insertions"` // lines added, excluding merge commits
+	Deletions  int      `json:"deletions"`  // lines removed, excluding merge commits
+	Merges     bool     `json:"merges"`     // true if any of the commits is a merge
+}
+
+// summarise builds a Summary of a list of commits. Line counts skip merge
+// commits as their changes are already counted in the merged commits.
+func summarise(commits []object.Commit) (*Summary, error) {
+	summary := &Summary{Commits: len(commits)}
+	seen := make(map[string]bool)
+	for i := range commits {
+		c := &commits[i]
+
+		author := fmt.Sprintf("%s <%s>", c.Author.Name, c.Author.Email)
+		if !seen[author] {
+			seen[author] = true
+			summary.Authors = append(summary.Authors, author)
+		}
+
+		if c.NumParents() > 1 {
+			summary.Merges = true
+			continue
+		}
+		stats, err := c.Stats()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get commit stats")
+		}
+		for _, stat := range stats {
+			summary.Insertions += stat.Addition
+			summary.Deletions += stat.Deletion
+		}
+	}
+	return summary, nil
+}
+
+// commitRange lists the commits reachable from `to` that come after `from`,
+// newest first.
+func commitRange(repo *git.Repository, from, to plumbing.Hash) (commits []object.Commit, err error) {
+	err = walkCommits(repo, from, to, func(c *object.Commit) bool {
+		commits = append(commits, *c)
+		return true
+	})
+	return
+}
+
+// countCommits counts the commits reachable from `to` that come after `from`,
+// giving up once `limit` is reached. If `from` isn't an ancestor of `to`, as
+// happens after a history rewrite, the limit is returned.
+func countCommits(repo *git.Repository, from, to plumbing.Hash, limit int) (n int, err error) {
+	err = walkCommits(repo, from, to, func(c *object.Commit) bool {
+		n++
+		return n < limit
+	})
+	return
+}
+
+// walkCommits calls `fn` for each commit reachable from `to`, newest first,
+// until `from` is reached or `fn` returns false. The walk ends quietly where a
+// shallow clone's history does.
+func walkCommits(repo *git.Repository, from, to plumbing.Hash, fn func(*object.Commit) bool) error {
+	if from == to {
+		return nil
+	}
+
+	iter, err := repo.Log(&git.LogOptions{From: to})
+	if err != nil {
+		return errors.Wrap(err, "failed to read commit log")
+	}
+	defer iter.Close()
+
+	err = iter.ForEach(func(c *object.Commit) error {
+		if c.Hash == from || !fn(c) {
+			return storer.ErrStop
+		}
+		return nil
+	})
+	if err != nil && err != plumbing.ErrObjectNotFound {
+		return errors.Wrap(err, "failed to walk commits")
+	}
+	return nil
+}
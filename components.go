@@ -0,0 +1,32 @@
+package gitwatch
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// affectedComponents returns the names of the components, sorted, that any of
+// the changed files belongs to. Components map gitignore-style path patterns
+// to names, see Repository.Components.
+func affectedComponents(files []string, components map[string]string) (names []string, err error) {
+	seen := make(map[string]bool)
+	for pattern, name := range components {
+		p, err := compilePattern(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid component pattern %s", pattern)
+		}
+		if seen[name] {
+			continue
+		}
+		for _, file := range files {
+			if p.Match(file) {
+				seen[name] = true
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return
+}
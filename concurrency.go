@@ -0,0 +1,73 @@
+package gitwatch
+
+import (
+	"sync"
+)
+
+// checkEach checks every repository a round of checks covers and hands each
+// one's result to done, in the order of Repositories, stopping once done
+// returns false.
+//
+// With a Concurrency above 1, up to that many repositories are fetched at once
+// so a slow remote doesn't hold up the others. Everything else, including
+// emitting events, happens on the daemon's goroutine once all of them are
+// done, so events keep the order of Repositories.
+func (s *Session) checkEach(initial bool, done func(Repository, error) bool) {
+	var repos []Repository
+	for _, repository := range s.Repositories {
+		if s.polled(repository) && s.due(repository) {
+			repos = append(repos, repository)
+		}
+	}
+
+	if s.Concurrency <= 1 {
+		for _, repository := range repos {
+			if s.shuttingDown() {
+				return
+			}
+			if !done(repository, s.checkOne(repository, initial)) {
+				return
+			}
+		}
+		return
+	}
+
+	type result struct {
+		repository Repository
+		due        bool
+		events     []Event
+		err        error
+	}
+	results := make([]result, len(repos))
+	slots := make(chan struct{}, s.Concurrency)
+	var wg sync.WaitGroup
+	for i, repository := range repos {
+		if s.shuttingDown() {
+			repos, results = repos[:i], results[:i]
+			break
+		}
+		r := &results[i]
+		if r.repository, r.due, r.err = s.beforeCheck(repository); !r.due {
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			r.events, r.err = s.checkRepo(r.repository, initial)
+			<-slots
+		}()
+	}
+	wg.Wait()
+
+	stopped := false
+	for i, r := range results {
+		err := r.err
+		if r.due {
+			err = s.afterCheck(r.repository, r.events, r.err)
+		}
+		if !stopped {
+			stopped = !done(repos[i], err)
+		}
+	}
+}
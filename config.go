@@ -0,0 +1,664 @@
+package gitwatch
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+	"gopkg.in/yaml.v2"
+)
+
+// SessionConfig is a declarative description of a session, as read from a
+// YAML or JSON file by LoadConfig, or a TOML file by LoadTOMLConfig.
+type SessionConfig struct {
+	Directory        string                 `yaml:"directory"`         // the directory to store repositories
+	Interval         Duration               `yaml:"interval"`          // the interval between remote checks
+	Auth             string                 `yaml:"auth"`              // the name of the default authentication method
+	InitialEvent     bool                   `yaml:"initial_event"`     // see Session.InitialEvent
+	OrderedEvents    bool                   `yaml:"ordered_events"`    // see Session.OrderedEvents
+	EventDelivery    EventDelivery          `yaml:"event_delivery"`    // see Session.EventDelivery, `buffer`, `block` or `drop-oldest`
+	EventQueue       int                    `yaml:"event_queue"`       // see Session.EventQueue
+	AllowDeletion    bool                   `yaml:"allow_deletion"`    // see Session.AllowDeletion
+	Recovery         RecoveryStrategy       `yaml:"recovery"`          // see Session.Recovery, `report`, `reset`, `fetch-reset` or `reclone`
+	UseForce         bool                   `yaml:"use_force"`         // see Session.UseForce
+	ReuseSSH         bool                   `yaml:"reuse_ssh"`         // see Session.ReuseSSH
+	ErrorPolicy      ErrorPolicy            `yaml:"error_policy"`      // see Session.ErrorPolicy, `fail-fast` or `resilient`
+	FailingLimit     int                    `yaml:"failing_limit"`     // see Session.FailingLimit
+	Retry            RetryPolicy            `yaml:"retry"`             // see Session.Retry
+	Concurrency      int                    `yaml:"concurrency"`       // see Session.Concurrency
+	Depth            int                    `yaml:"depth"`             // see Session.Depth
+	OperationTimeout Duration               `yaml:"operation_timeout"` // see Session.OperationTimeout
+	Exec             *ExecHook              `yaml:"exec"`              // see Session.Exec
+	ExecLimit        int                    `yaml:"exec_limit"`        // see Session.ExecLimit
+	MaxDiffSize      int                    `yaml:"max_diff_size"`     // see Session.MaxDiffSize
+	BumpRules        map[string]Bump        `yaml:"bump_rules"`        // see Session.BumpRules
+	Shard            *ShardConfig           `yaml:"shard"`             // see Session.Sharding
+	AuditLog         string                 `yaml:"audit_log"`         // the file of an AuditFile to record changes in, see Session.Audit
+	StateFile        string                 `yaml:"state_file"`        // the file of a StateFile to record each repository's last event in, see Session.State
+	WASMDir          string                 `yaml:"wasm_dir"`          // the directory to load WebAssembly filters from with LoadWASM, see LoadWASMFilters
+	WASMTimeout      Duration               `yaml:"wasm_timeout"`      // how long each WebAssembly filter may take over an event, 5s if zero
+	Policy           *PolicyConfig          `yaml:"policy"`            // see Session.Policy
+	Auths            map[string]AuthConfig  `yaml:"auths"`             // named authentication methods
+	Groups           map[string]GroupConfig `yaml:"groups"`            // named groups of shared settings
+	Repositories     []RepositoryConfig     `yaml:"repositories"`      // the repositories to watch
+	Discover         []DiscoveryConfig      `yaml:"discover"`          // where to find more repositories to watch
+
+	// Secrets resolves references in auth passwords, tokens and passphrases,
+	// DefaultSecrets is used if nil.
+	Secrets SecretResolver `yaml:"-"`
+}
+
+// AuthConfig describes an authentication method
+type AuthConfig struct {
+	Type       string `yaml:"type"`       // one of `basic`, `token`, `ssh-key`, `ssh-agent`, `codecommit` or `google`
+	Username   string `yaml:"username"`   // the user for `basic`, `token` and the SSH types, `git` if empty for `token` and SSH
+	Password   string `yaml:"password"`   // the password for `basic`, may be a secret reference
+	Token      string `yaml:"token"`      // the access token for `token`, may be a secret reference
+	KeyFile    string `yaml:"key_file"`   // the private key file for `ssh-key`, or credentials file for `google`
+	Passphrase string `yaml:"passphrase"` // the private key's passphrase for `ssh-key`, may be a secret reference
+	Profile    string `yaml:"profile"`    // the AWS credentials profile for `codecommit`
+	Region     string `yaml:"region"`     // the AWS region for `codecommit`, taken from the URL if empty
+}
+
+// ShardConfig describes a Sharding. The members are either listed or found in
+// a shared directory.
+type ShardConfig struct {
+	Name    string   `yaml:"name"`    // this instance's name, the host name if empty
+	Members []string `yaml:"members"` // the names of every instance
+	Dir     string   `yaml:"dir"`     // the directory of a FileMembers
+	TTL     Duration `yaml:"ttl"`     // see FileMembers.TTL
+}
+
+// PolicyConfig describes a Policy
+type PolicyConfig struct {
+	Keyring          string   `yaml:"keyring"`           // a file holding the armored PGP key ring of Policy.Keyring
+	AllowedAuthors   []string `yaml:"allowed_authors"`   // see Policy.AllowedAuthors
+	ProtectedPaths   []string `yaml:"protected_paths"`   // see Policy.ProtectedPaths
+	ProtectedAuthors []string `yaml:"protected_authors"` // see Policy.ProtectedAuthors
+	GitHubStatus     bool     `yaml:"github_status"`     // if true, the GitHub combined status of new heads must succeed
+	Token            string   `yaml:"token"`             // see GitHubStatus.Token, may be a secret reference
+	API              string   `yaml:"api"`               // see GitHubStatus.API
+}
+
+// DiscoveryConfig describes a Discovery, from either a GitHub organisation or
+// a directory
+type DiscoveryConfig struct {
+	GitHub        string   `yaml:"github"`         // the organisation to watch the repositories of
+	Token         string   `yaml:"token"`          // see GitHubOrg.Token, may be a secret reference
+	SSH           bool     `yaml:"ssh"`            // see GitHubOrg.SSH
+	API           string   `yaml:"api"`            // see GitHubOrg.API
+	Dir           string   `yaml:"dir"`            // the directory to watch the repositories in
+	Include       []string `yaml:"include"`        // see DiscoveryFilter
+	Exclude       []string `yaml:"exclude"`        // see DiscoveryFilter
+	Topics        []string `yaml:"topics"`         // see DiscoveryFilter
+	ExcludeTopics []string `yaml:"exclude_topics"` // see DiscoveryFilter
+	Archived      bool     `yaml:"archived"`       // see DiscoveryFilter
+	Visibility    string   `yaml:"visibility"`     // see DiscoveryFilter
+	Every         Duration `yaml:"every"`          // see Discovery.Every
+	Branch        string   `yaml:"branch"`         // the branch to watch in the repositories found
+	Auth          string   `yaml:"auth"`           // the name of the authentication method for the repositories found
+	Group         string   `yaml:"group"`          // the group the repositories found join
+}
+
+// GroupConfig describes a Group
+type GroupConfig struct {
+	Branch     string            `yaml:"branch"`
+	Branches   []string          `yaml:"branches"`
+	Auth       string            `yaml:"auth"`
+	Webhook    bool              `yaml:"webhook"`
+	WatchTags  bool              `yaml:"watch_tags"`
+	WatchNotes bool              `yaml:"watch_notes"`
+	WatchPulls bool              `yaml:"watch_pulls"`
+	WatchFiles []string          `yaml:"watch_files"`
+	Ignore     []string          `yaml:"ignore"`
+	Include    []string          `yaml:"include"`
+	Components map[string]string `yaml:"components"`
+	MinCommits int               `yaml:"min_commits"`
+	AllCommits bool              `yaml:"all_commits"`
+	RateLimit  Duration          `yaml:"rate_limit"`
+	Interval   Duration          `yaml:"interval"`
+	Depth      int               `yaml:"depth"`
+	Digest     Duration          `yaml:"digest"`
+	Timeout    Duration          `yaml:"timeout"`
+	Retry      *RetryPolicy      `yaml:"retry"`
+	Exec       *ExecHook         `yaml:"exec"`
+}
+
+// RepositoryConfig describes a Repository
+type RepositoryConfig struct {
+	URL        string            `yaml:"url"`
+	Mirrors    []string          `yaml:"mirrors"`
+	PushMirror string            `yaml:"push_mirror"`
+	PushAuth   string            `yaml:"push_auth"`
+	Deploy     DeployLayout      `yaml:"deploy"`
+	Observe    bool              `yaml:"observe"`
+	Bare       bool              `yaml:"bare"`
+	RefsOnly   bool              `yaml:"refs_only"`
+	Webhook    bool              `yaml:"webhook"`
+	Branch     string            `yaml:"branch"`
+	Branches   []string          `yaml:"branches"`
+	Directory  string            `yaml:"directory"`
+	Auth       string            `yaml:"auth"`
+	Group      string            `yaml:"group"`
+	WatchTags  bool              `yaml:"watch_tags"`
+	WatchNotes bool              `yaml:"watch_notes"`
+	WatchPulls bool              `yaml:"watch_pulls"`
+	WatchFiles []string          `yaml:"watch_files"`
+	Ignore     []string          `yaml:"ignore"`
+	Include    []string          `yaml:"include"`
+	Components map[string]string `yaml:"components"`
+	MinCommits int               `yaml:"min_commits"`
+	AllCommits bool              `yaml:"all_commits"`
+	RateLimit  Duration          `yaml:"rate_limit"`
+	Interval   Duration          `yaml:"interval"`
+	Depth      int               `yaml:"depth"`
+	Digest     Duration          `yaml:"digest"`
+	Timeout    Duration          `yaml:"timeout"`
+	Retry      *RetryPolicy      `yaml:"retry"`
+	Exec       *ExecHook         `yaml:"exec"`
+}
+
+// Duration is a time.Duration written as a string such as `30s` or `1h` in
+// configuration files
+type Duration time.Duration
+
+// UnmarshalYAML parses a duration string
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// envVar matches `${VAR}` references to environment variables.
+var envVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces `${VAR}` references with the value of the environment
+// variable. Other uses of `$` are left alone so passwords and URLs containing
+// it survive, and referencing an unset variable is an error.
+func expandEnv(s string) (string, error) {
+	var missing []string
+	out := envVar.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envVar.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", errors.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
+
+// expandHome replaces a leading `~` in a path with the user's home directory
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to find home directory")
+	}
+	return filepath.Join(home, path[1:]), nil
+}
+
+// expand applies expandEnv to the fields that commonly vary between
+// environments or hold secrets: directories, URLs and credentials.
+func (c *SessionConfig) expand() error {
+	expand := func(fields ...*string) (err error) {
+		for _, f := range fields {
+			if *f, err = expandEnv(*f); err != nil {
+				return errors.Wrap(err, "config")
+			}
+		}
+		return nil
+	}
+
+	if err := expand(&c.Directory, &c.AuditLog, &c.StateFile, &c.WASMDir); err != nil {
+		return err
+	}
+	for _, f := range []*string{&c.Directory, &c.AuditLog, &c.StateFile, &c.WASMDir} {
+		var err error
+		if *f, err = expandHome(*f); err != nil {
+			return errors.Wrap(err, "config")
+		}
+	}
+	for i := range c.Discover {
+		d := &c.Discover[i]
+		if err := expand(&d.Token, &d.API, &d.Dir); err != nil {
+			return err
+		}
+	}
+	if err := expandExec(c.Exec); err != nil {
+		return err
+	}
+	if c.Shard != nil {
+		if err := expand(&c.Shard.Name, &c.Shard.Dir); err != nil {
+			return err
+		}
+	}
+	if c.Policy != nil {
+		if err := expand(&c.Policy.Keyring, &c.Policy.Token, &c.Policy.API); err != nil {
+			return err
+		}
+	}
+	for _, g := range c.Groups {
+		if err := expandExec(g.Exec); err != nil {
+			return err
+		}
+	}
+	for name, a := range c.Auths {
+		if err := expand(&a.Username, &a.Password, &a.Token, &a.KeyFile, &a.Passphrase); err != nil {
+			return err
+		}
+		c.Auths[name] = a
+	}
+	for i := range c.Repositories {
+		r := &c.Repositories[i]
+		if err := expand(&r.URL, &r.Directory, &r.PushMirror, &r.Deploy.Dir); err != nil {
+			return err
+		}
+		if err := expandExec(r.Exec); err != nil {
+			return err
+		}
+		for j := range r.Mirrors {
+			if err := expand(&r.Mirrors[j]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expandExec applies expandEnv to an exec hook's working directory and
+// environment.
+func expandExec(h *ExecHook) (err error) {
+	if h == nil {
+		return nil
+	}
+	if h.Dir, err = expandEnv(h.Dir); err != nil {
+		return errors.Wrap(err, "config")
+	}
+	for i := range h.Env {
+		if h.Env[i], err = expandEnv(h.Env[i]); err != nil {
+			return errors.Wrap(err, "config")
+		}
+	}
+	return nil
+}
+
+// LoadConfig reads and validates a session configuration in YAML or JSON.
+// `${VAR}` references to environment variables are expanded in directories,
+// URLs and credentials.
+func LoadConfig(r io.Reader) (c SessionConfig, err error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return c, errors.Wrap(err, "failed to read config")
+	}
+	if err = yaml.UnmarshalStrict(b, &c); err != nil {
+		return c, errors.Wrap(err, "failed to parse config")
+	}
+	if err = c.expand(); err != nil {
+		return c, err
+	}
+	if err = c.Validate(); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// LoadTOMLConfig reads a configuration written in TOML, with the same keys as
+// LoadConfig.
+func LoadTOMLConfig(r io.Reader) (c SessionConfig, err error) {
+	var doc map[string]interface{}
+	if _, err = toml.DecodeReader(r, &doc); err != nil {
+		return c, errors.Wrap(err, "failed to parse config")
+	}
+	b, err := yaml.Marshal(doc)
+	if err != nil {
+		return c, errors.Wrap(err, "failed to parse config")
+	}
+	return LoadConfig(bytes.NewReader(b))
+}
+
+// Validate checks that a configuration describes a usable session: every
+// repository has a URL and every reference to an auth method or group exists.
+func (c SessionConfig) Validate() error {
+	if c.Directory == "" {
+		return errors.New("config: directory is required")
+	}
+	if c.Interval <= 0 {
+		return errors.New("config: interval must be positive")
+	}
+	if err := c.checkAuth(c.Auth); err != nil {
+		return errors.Wrap(err, "config")
+	}
+	for name, a := range c.Auths {
+		if err := a.validate(); err != nil {
+			return errors.Wrapf(err, "config: auth %s", name)
+		}
+	}
+	if err := checkExec(c.Exec); err != nil {
+		return errors.Wrap(err, "config")
+	}
+	if c.Shard != nil && (len(c.Shard.Members) > 0) == (c.Shard.Dir != "") {
+		return errors.New("config: shard needs either members or dir")
+	}
+	if p := c.Policy; p != nil && !p.GitHubStatus && (p.Token != "" || p.API != "") {
+		return errors.New("config: policy token and api need github_status")
+	}
+	for name, g := range c.Groups {
+		if err := c.checkAuth(g.Auth); err != nil {
+			return errors.Wrapf(err, "config: group %s", name)
+		}
+		if err := checkExec(g.Exec); err != nil {
+			return errors.Wrapf(err, "config: group %s", name)
+		}
+	}
+	for i, d := range c.Discover {
+		if (d.GitHub == "") == (d.Dir == "") {
+			return errors.Errorf("config: discover %d needs either github or dir", i)
+		}
+		if d.Visibility != "" && d.Visibility != "public" && d.Visibility != "private" {
+			return errors.Errorf("config: discover %d: unknown visibility %s", i, d.Visibility)
+		}
+		if err := c.checkAuth(d.Auth); err != nil {
+			return errors.Wrapf(err, "config: discover %d", i)
+		}
+		if _, ok := c.Groups[d.Group]; d.Group != "" && !ok {
+			return errors.Errorf("config: discover %d: unknown group %s", i, d.Group)
+		}
+	}
+	for i, r := range c.Repositories {
+		if r.URL == "" {
+			return errors.Errorf("config: repository %d has no url", i)
+		}
+		if err := c.checkAuth(r.Auth); err != nil {
+			return errors.Wrapf(err, "config: repository %s", r.URL)
+		}
+		if err := c.checkAuth(r.PushAuth); err != nil {
+			return errors.Wrapf(err, "config: repository %s push_auth", r.URL)
+		}
+		if err := checkExec(r.Exec); err != nil {
+			return errors.Wrapf(err, "config: repository %s", r.URL)
+		}
+		if _, ok := c.Groups[r.Group]; r.Group != "" && !ok {
+			return errors.Errorf("config: repository %s: unknown group %s", r.URL, r.Group)
+		}
+	}
+	return nil
+}
+
+func (c SessionConfig) checkAuth(name string) error {
+	if _, ok := c.Auths[name]; name != "" && !ok {
+		return errors.Errorf("unknown auth %s", name)
+	}
+	return nil
+}
+
+func checkExec(h *ExecHook) error {
+	if h != nil && len(h.Command) == 0 {
+		return errors.New("exec requires a command")
+	}
+	return nil
+}
+
+func (a AuthConfig) validate() error {
+	switch a.Type {
+	case "basic":
+		// Azure DevOps personal access tokens are sent with an empty username
+		if a.Username == "" && a.Password == "" {
+			return errors.New("basic auth requires a username or password")
+		}
+	case "token":
+		if a.Token == "" {
+			return errors.New("token auth requires a token")
+		}
+	case "ssh-key":
+		if a.KeyFile == "" {
+			return errors.New("ssh-key auth requires a key_file")
+		}
+	case "ssh-agent", "codecommit", "google":
+	default:
+		return errors.Errorf("unknown auth type %q", a.Type)
+	}
+	return nil
+}
+
+// method builds the transport.AuthMethod an AuthConfig describes, resolving
+// any secret references.
+func (a AuthConfig) method(ctx context.Context, secrets SecretResolver) (m transport.AuthMethod, err error) {
+	for _, f := range []*string{&a.Password, &a.Token, &a.Passphrase} {
+		if *f == "" {
+			continue
+		}
+		if *f, err = secrets.Resolve(ctx, *f); err != nil {
+			return nil, err
+		}
+	}
+
+	user := a.Username
+	switch a.Type {
+	case "basic":
+		return BasicAuth(user, a.Password), nil
+	case "token":
+		return TokenAuth(user, a.Token), nil
+	case "codecommit":
+		return NewCodeCommitAuth(a.Profile, a.Region)
+	case "google":
+		return NewGoogleAuth(a.KeyFile)
+	}
+
+	if user == "" {
+		user = "git"
+	}
+	if a.Type == "ssh-key" {
+		return ssh.NewPublicKeysFromFile(user, a.KeyFile, a.Passphrase)
+	}
+	return ssh.NewSSHAgentAuth(user)
+}
+
+// NewFromConfig constructs a session from a configuration
+func NewFromConfig(ctx context.Context, c SessionConfig) (*Session, error) {
+	s, err := newFromConfig(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if c.WASMDir != "" {
+		filters, err := LoadWASMFilters(c.WASMDir, LoadWASM, time.Duration(c.WASMTimeout))
+		if err != nil {
+			s.cf()
+			return nil, err
+		}
+		s.Enrichers = append(s.Enrichers, filters...)
+	}
+	return s, nil
+}
+
+// newFromConfig constructs a session from a configuration, apart from the
+// WebAssembly filters, which are only loaded on startup rather than compiled
+// again whenever the configuration is applied.
+func newFromConfig(ctx context.Context, c SessionConfig) (*Session, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	secrets := c.Secrets
+	if secrets == nil {
+		secrets = DefaultSecrets
+	}
+	auths := make(map[string]transport.AuthMethod, len(c.Auths))
+	for name, a := range c.Auths {
+		m, err := a.method(ctx, secrets)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to set up auth %s", name)
+		}
+		auths[name] = m
+	}
+
+	repos := make([]Repository, len(c.Repositories))
+	for i, r := range c.Repositories {
+		repos[i] = Repository{
+			URL:        r.URL,
+			Mirrors:    r.Mirrors,
+			PushMirror: r.PushMirror,
+			PushAuth:   auths[r.PushAuth],
+			Deploy:     r.Deploy,
+			Observe:    r.Observe,
+			Bare:       r.Bare,
+			RefsOnly:   r.RefsOnly,
+			Webhook:    r.Webhook,
+			Branch:     r.Branch,
+			Branches:   r.Branches,
+			Directory:  r.Directory,
+			Auth:       auths[r.Auth],
+			Group:      r.Group,
+			WatchTags:  r.WatchTags,
+			WatchNotes: r.WatchNotes,
+			WatchPulls: r.WatchPulls,
+			WatchFiles: r.WatchFiles,
+			Ignore:     r.Ignore,
+			Include:    r.Include,
+			Components: r.Components,
+			MinCommits: r.MinCommits,
+			AllCommits: r.AllCommits,
+			RateLimit:  time.Duration(r.RateLimit),
+			Interval:   time.Duration(r.Interval),
+			Depth:      r.Depth,
+			Digest:     time.Duration(r.Digest),
+			Timeout:    time.Duration(r.Timeout),
+			Retry:      r.Retry,
+			Exec:       r.Exec,
+		}
+	}
+
+	s, err := New(ctx, repos, time.Duration(c.Interval), c.Directory, auths[c.Auth], c.InitialEvent)
+	if err != nil {
+		return nil, err
+	}
+	s.OrderedEvents = c.OrderedEvents
+	s.EventDelivery = c.EventDelivery
+	s.EventQueue = c.EventQueue
+	s.AllowDeletion = c.AllowDeletion
+	s.Recovery = c.Recovery
+	s.UseForce = c.UseForce
+	s.ReuseSSH = c.ReuseSSH
+	s.ErrorPolicy = c.ErrorPolicy
+	s.FailingLimit = c.FailingLimit
+	s.Retry = c.Retry
+	s.Concurrency = c.Concurrency
+	s.Depth = c.Depth
+	s.OperationTimeout = time.Duration(c.OperationTimeout)
+	s.Exec = c.Exec
+	s.ExecLimit = c.ExecLimit
+	s.MaxDiffSize = c.MaxDiffSize
+	s.BumpRules = c.BumpRules
+	if c.AuditLog != "" {
+		s.Audit = &AuditFile{Path: c.AuditLog}
+	}
+	if c.StateFile != "" {
+		s.State = &StateFile{Path: c.StateFile}
+	}
+	if sh := c.Shard; sh != nil {
+		s.Sharding = &Sharding{Name: sh.Name, Members: StaticMembers(sh.Members)}
+		if sh.Dir != "" {
+			s.Sharding.Members = FileMembers{Dir: sh.Dir, TTL: time.Duration(sh.TTL)}
+		}
+	}
+	if p := c.Policy; p != nil {
+		s.Policy = &Policy{
+			AllowedAuthors:   p.AllowedAuthors,
+			ProtectedPaths:   p.ProtectedPaths,
+			ProtectedAuthors: p.ProtectedAuthors,
+		}
+		if p.Keyring != "" {
+			keyring, err := ioutil.ReadFile(p.Keyring)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to read policy keyring")
+			}
+			s.Policy.Keyring = string(keyring)
+		}
+		if p.GitHubStatus {
+			token := p.Token
+			if token != "" {
+				if token, err = secrets.Resolve(ctx, token); err != nil {
+					return nil, err
+				}
+			}
+			s.Policy.Status = GitHubStatus{Token: token, API: p.API}
+		}
+	}
+
+	if len(c.Groups) > 0 {
+		s.Groups = make(map[string]Group, len(c.Groups))
+	}
+	for name, g := range c.Groups {
+		s.Groups[name] = Group{
+			Branch:     g.Branch,
+			Branches:   g.Branches,
+			Auth:       auths[g.Auth],
+			Webhook:    g.Webhook,
+			WatchTags:  g.WatchTags,
+			WatchNotes: g.WatchNotes,
+			WatchPulls: g.WatchPulls,
+			WatchFiles: g.WatchFiles,
+			Ignore:     g.Ignore,
+			Include:    g.Include,
+			Components: g.Components,
+			MinCommits: g.MinCommits,
+			AllCommits: g.AllCommits,
+			RateLimit:  time.Duration(g.RateLimit),
+			Interval:   time.Duration(g.Interval),
+			Depth:      g.Depth,
+			Digest:     time.Duration(g.Digest),
+			Timeout:    time.Duration(g.Timeout),
+			Retry:      g.Retry,
+			Exec:       g.Exec,
+		}
+	}
+
+	for _, d := range c.Discover {
+		var source Source = DirectorySource(d.Dir)
+		if d.GitHub != "" {
+			token := d.Token
+			if token != "" {
+				if token, err = secrets.Resolve(ctx, token); err != nil {
+					return nil, err
+				}
+			}
+			source = GitHubOrg{Org: d.GitHub, Token: token, SSH: d.SSH, API: d.API}
+		}
+		s.Discovery = append(s.Discovery, Discovery{
+			Source: source,
+			Filter: DiscoveryFilter{
+				Include:       d.Include,
+				Exclude:       d.Exclude,
+				Topics:        d.Topics,
+				ExcludeTopics: d.ExcludeTopics,
+				Archived:      d.Archived,
+				Visibility:    d.Visibility,
+			},
+			Template: Repository{Branch: d.Branch, Auth: auths[d.Auth], Group: d.Group},
+			Every:    time.Duration(d.Every),
+		})
+	}
+	return s, nil
+}
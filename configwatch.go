@@ -0,0 +1,204 @@
+package gitwatch
+
+import (
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+// ConfigWatch is a configuration file a session is reconciled with, read from
+// disk or from a git repository. Whenever its contents change, the session
+// takes on the repositories and settings it describes without a restart.
+type ConfigWatch struct {
+	Path       string               // the configuration file, relative to the repository's root if Repository is set
+	Repository string               // if set, the URL of the git repository the file is read from
+	Branch     string               // the repository's branch, the remote's default branch if empty
+	Directory  string               // where the repository is cloned, required if Repository is set
+	Auth       transport.AuthMethod // authentication method for the repository
+	Manual     bool                 // if true, the file is only read again by ReloadConfig, not before every round of checks
+}
+
+// Load reads the configuration with LoadConfigFile, after cloning or pulling
+// the repository it's in, if there is one.
+func (w ConfigWatch) Load(ctx context.Context) (c SessionConfig, err error) {
+	path, err := w.fetch(ctx)
+	if err != nil {
+		return c, err
+	}
+	return LoadConfigFile(ctx, path)
+}
+
+// fetch brings the clone of the repository up to date, if there is one, and
+// returns the path of the configuration file.
+func (w ConfigWatch) fetch(ctx context.Context) (path string, err error) {
+	if w.Repository == "" {
+		return w.Path, nil
+	}
+	if w.Directory == "" {
+		return "", errors.New("config watch: a directory to clone the repository into is required")
+	}
+
+	var ref plumbing.ReferenceName
+	if w.Branch != "" {
+		ref = plumbing.NewBranchReferenceName(w.Branch)
+	}
+	repo, err := git.PlainOpen(w.Directory)
+	if err == git.ErrRepositoryNotExists {
+		_, err = git.PlainCloneContext(ctx, w.Directory, false, &git.CloneOptions{
+			URL:           w.Repository,
+			Auth:          w.Auth,
+			ReferenceName: ref,
+			SingleBranch:  true,
+		})
+		if err != nil {
+			return "", errors.Wrap(err, "failed to clone config repository")
+		}
+	} else if err != nil {
+		return "", errors.Wrap(err, "failed to open config repository")
+	} else {
+		wt, err := repo.Worktree()
+		if err != nil {
+			return "", errors.Wrap(err, "failed to get worktree")
+		}
+		err = wt.PullContext(ctx, &git.PullOptions{
+			Auth:          w.Auth,
+			ReferenceName: ref,
+			SingleBranch:  true,
+			Force:         true,
+		})
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			return "", errors.Wrap(err, "failed to pull config repository")
+		}
+	}
+	return filepath.Join(w.Directory, w.Path), nil
+}
+
+// ApplyConfig reconciles the session with a configuration between checks, as
+// a ConfigWatch does when its file changes. The repositories are replaced as
+// by SetRepositories and the session takes the configuration's auth methods,
+// groups, discovery sources, policy, exec hook and other settings. The
+// directory and interval can't change while the session runs, and the audit
+// log, state file, sharding, SSH reuse, exec limit and WebAssembly filters only
+// change on a restart.
+func (s *Session) ApplyConfig(ctx context.Context, c SessionConfig) error {
+	return s.onDaemon(func() error {
+		s.beginTrace("")
+		return s.applyConfig(ctx, c, s.IsRunning())
+	})
+}
+
+func (s *Session) applyConfig(ctx context.Context, c SessionConfig, check bool) error {
+	if filepath.Clean(c.Directory) != filepath.Clean(s.Directory) {
+		return errors.Errorf("config: directory can't change from %s while running", s.Directory)
+	}
+	if time.Duration(c.Interval) != s.Interval {
+		return errors.Errorf("config: interval can't change from %s while running", s.Interval)
+	}
+
+	next, err := newFromConfig(ctx, c)
+	if err != nil {
+		return err
+	}
+	next.cf()
+	if err = sharedDirectories(next.Repositories); err != nil {
+		return err
+	}
+
+	s.Auth = next.Auth
+	s.Groups = next.Groups
+	s.Discovery = next.Discovery
+	s.discoveredAt = nil
+	s.Policy = next.Policy
+	s.OrderedEvents = next.OrderedEvents
+	s.AllowDeletion = next.AllowDeletion
+	s.Recovery = next.Recovery
+	s.UseForce = next.UseForce
+	s.ErrorPolicy = next.ErrorPolicy
+	s.FailingLimit = next.FailingLimit
+	s.Retry = next.Retry
+	s.Concurrency = next.Concurrency
+	s.Depth = next.Depth
+	s.OperationTimeout = next.OperationTimeout
+	s.Exec = next.Exec
+	s.MaxDiffSize = next.MaxDiffSize
+	s.BumpRules = next.BumpRules
+	return s.setRepositories(next.Repositories, check)
+}
+
+// ReloadConfig reconciles the session with its ConfigWatch file straight away,
+// rather than before the next round of checks, as the CLI does on SIGHUP.
+func (s *Session) ReloadConfig() error {
+	if s.ConfigWatch == nil {
+		return errors.New("session has no ConfigWatch to reload")
+	}
+	return s.onDaemon(func() error {
+		s.beginTrace("")
+		s.reconcileConfig(!s.IsRunning())
+		return nil
+	})
+}
+
+// readsConfig reports whether a round of checks reads the ConfigWatch file:
+// every round, or only the one before the daemon starts if it's Manual.
+func (s *Session) readsConfig() bool {
+	if s.ConfigWatch == nil || !s.ConfigWatch.Manual {
+		return true
+	}
+	select {
+	case <-s.started:
+		return false
+	default:
+		return true
+	}
+}
+
+// reconcileConfig applies the ConfigWatch file if it changed since it was
+// last read, emitting EventConfigApplied or EventConfigError. The same error
+// is only reported once. During the initial checks, new repositories are left
+// to the round of checks rather than checked straight away.
+func (s *Session) reconcileConfig(initial bool) {
+	w := s.ConfigWatch
+	if w == nil {
+		return
+	}
+
+	source := w.Path
+	if w.Repository != "" {
+		source = w.Repository
+	}
+	path, err := w.fetch(s.ctx)
+	if err == nil {
+		var b []byte
+		if b, err = ioutil.ReadFile(path); err == nil {
+			sum := sha256.Sum256(b)
+			if sum == s.configSum {
+				return
+			}
+			s.configSum = sum
+			var c SessionConfig
+			if c, err = LoadConfigFile(s.ctx, path); err == nil {
+				err = s.applyConfig(s.ctx, c, !initial)
+			}
+		}
+	}
+
+	event := Event{Type: EventConfigApplied, URL: source, Path: path, Timestamp: time.Now()}
+	if err != nil {
+		if err.Error() == s.configErr {
+			return
+		}
+		s.configErr = err.Error()
+		event.Type = EventConfigError
+		event.Error = err.Error()
+	} else {
+		s.configErr = ""
+	}
+	s.emitSession(event)
+}
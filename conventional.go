@@ -0,0 +1,70 @@
+package gitwatch
+
+import (
+	"regexp"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// CommitType classifies a commit by its Conventional Commits header, such as
+// `feat(api)!: remove v1 endpoints`.
+type CommitType struct {
+	Hash        string `json:"hash"`
+	Type        string `json:"type,omitempty"`        // such as `feat`, `fix` or `docs`, lower cased, empty if the message doesn't follow the convention
+	Scope       string `json:"scope,omitempty"`       // the part in parentheses after the type
+	Breaking    bool   `json:"breaking,omitempty"`    // true if the header has a `!` or the message a `BREAKING CHANGE` footer
+	Description string `json:"description,omitempty"` // the rest of the header, or the whole subject if the message doesn't follow the convention
+}
+
+// conventionalHeader matches `type(scope)!: description`
+var conventionalHeader = regexp.MustCompile(`^([A-Za-z]+)(?:\(([^()]*)\))?(!)?: +(.+)$`)
+
+// classifyCommits classifies each of the commits, in the same order
+func classifyCommits(commits []object.Commit) (types []CommitType) {
+	for i := range commits {
+		types = append(types, classifyCommit(&commits[i]))
+	}
+	return
+}
+
+func classifyCommit(c *object.Commit) CommitType {
+	lines := strings.Split(strings.TrimSpace(c.Message), "\n")
+	t := CommitType{Hash: c.Hash.String(), Description: lines[0]}
+	m := conventionalHeader.FindStringSubmatch(lines[0])
+	if m == nil {
+		return t
+	}
+	t.Type = strings.ToLower(m[1])
+	t.Scope = m[2]
+	t.Breaking = m[3] == "!"
+	t.Description = m[4]
+	for _, line := range lines[1:] {
+		if strings.HasPrefix(line, "BREAKING CHANGE:") || strings.HasPrefix(line, "BREAKING-CHANGE:") {
+			t.Breaking = true
+		}
+	}
+	return t
+}
+
+// OnlyCommitTypes reports whether every commit an event covers has one of the
+// types, such as `docs` and `chore` for changes that don't need deploying. It's
+// false for events without CommitTypes.
+func (e Event) OnlyCommitTypes(types ...string) bool {
+	if len(e.CommitTypes) == 0 {
+		return false
+	}
+	for _, c := range e.CommitTypes {
+		found := false
+		for _, t := range types {
+			if c.Type == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package gitwatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DeadLetter stores events that could not be delivered to a sink after every
+// retry, so they can be inspected and replayed later.
+type DeadLetter interface {
+	Store(l Letter) error
+}
+
+// Letter is an undeliverable event along with why and where it failed
+type Letter struct {
+	Group    string    `json:"group,omitempty"` // the group the sink belongs to, empty for the session's own sinks
+	Sink     int       `json:"sink"`            // the index of the sink in Sinks of the session or group
+	Error    string    `json:"error"`           // the error from the last delivery attempt
+	FailedAt time.Time `json:"failed_at"`       // when the last attempt failed
+	Event    Event     `json:"event"`
+}
+
+// DeadLetterDir is a DeadLetter that writes each letter to its own JSON file
+// in a directory.
+type DeadLetterDir string
+
+// Store writes the letter to a new file, named so that files sort in the order
+// they failed.
+func (d DeadLetterDir) Store(l Letter) error {
+	if err := os.MkdirAll(string(d), 0700); err != nil {
+		return errors.Wrap(err, "failed to create dead letter directory")
+	}
+	b, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode dead letter")
+	}
+
+	name := fmt.Sprintf("%d-%d.json", l.FailedAt.UnixNano(), l.Sink)
+	tmp := filepath.Join(string(d), "."+name)
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrap(err, "failed to write dead letter")
+	}
+	return os.Rename(tmp, filepath.Join(string(d), name))
+}
+
+// Replay calls fn for each stored letter, oldest first, removing the ones it
+// succeeds for. Replaying stops at the first error.
+func (d DeadLetterDir) Replay(fn func(Letter) error) error {
+	files, err := ioutil.ReadDir(string(d))
+	if err != nil {
+		return errors.Wrap(err, "failed to read dead letter directory")
+	}
+
+	var names []string
+	for _, f := range files {
+		if f.Mode().IsRegular() && !strings.HasPrefix(f.Name(), ".") && filepath.Ext(f.Name()) == ".json" {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(string(d), name)
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "failed to read dead letter")
+		}
+		var l Letter
+		if err := json.Unmarshal(b, &l); err != nil {
+			return errors.Wrapf(err, "failed to decode dead letter %s", name)
+		}
+		if err := fn(l); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return errors.Wrap(err, "failed to remove replayed dead letter")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package gitwatch
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// ErrSkipEvent may be returned by an Enricher to drop an event so that it is
+// never delivered.
+var ErrSkipEvent = errors.New("skip event")
+
+// Enricher annotates or modifies events before they are delivered. Enrichers
+// run in the order they are configured on the session, each seeing the changes
+// made by the ones before it.
+type Enricher interface {
+	Enrich(e *Event) error
+}
+
+// ContextEnricher is an Enricher that is also given the session's context, so
+// it can give up once the session is closed.
+type ContextEnricher interface {
+	Enricher
+	EnrichContext(ctx context.Context, e *Event) error
+}
+
+// EnricherFunc adapts an ordinary function to the Enricher interface
+type EnricherFunc func(e *Event) error
+
+// Enrich calls f(e)
+func (f EnricherFunc) Enrich(e *Event) error {
+	return f(e)
+}
+
+// Annotate sets a free-form annotation on an event, for use by enrichers
+func (e *Event) Annotate(key, value string) {
+	if e.Annotations == nil {
+		e.Annotations = make(map[string]string)
+	}
+	e.Annotations[key] = value
+}
+
+// emit runs an event through the session's enrichers, then those of the
+// repository's group, and delivers it. An enricher failing doesn't stop the
+// event, the error is reported separately.
+func (s *Session) emit(repository Repository, event Event) {
+	if event.TraceID == "" {
+		event.TraceID = s.trace
+	}
+	enrichers := s.Enrichers
+	if g, ok := s.Groups[repository.Group]; ok && repository.Group != "" {
+		enrichers = append(enrichers[:len(enrichers):len(enrichers)], g.Enrichers...)
+	}
+
+	for _, enricher := range enrichers {
+		var err error
+		if e, ok := enricher.(ContextEnricher); ok {
+			err = e.EnrichContext(s.ctx, &event)
+		} else {
+			err = enricher.Enrich(&event)
+		}
+		if err != nil {
+			if err == ErrSkipEvent {
+				return
+			}
+			s.reportError(ErrorRecord{Op: "enrich", URL: event.URL}, errors.Wrap(err, "failed to enrich event"))
+		}
+	}
+
+	if event.Branch == "" && (event.Type == EventCommit || event.Type == EventDigest) {
+		event.Branch = repository.Branch
+	}
+	s.sendEvent(event)
+
+	for _, q := range s.sinkQueues {
+		if q.group == "" || q.group == repository.Group {
+			s.enqueue(q, event)
+		}
+	}
+	s.runHook(repository, event)
+}
+
+// emitSession delivers an event about the session itself, rather than one of
+// its repositories, to Events and the sinks not tied to a group
+func (s *Session) emitSession(event Event) {
+	if event.TraceID == "" {
+		event.TraceID = s.trace
+	}
+	s.sendEvent(event)
+	for _, q := range s.sinkQueues {
+		if q.group == "" {
+			s.enqueue(q, event)
+		}
+	}
+}
+
+// Sink is a destination events are delivered to in addition to the Events
+// channel. Each sink has its own delivery queue, see SinkRetry, and errors are
+// reported on the Errors channel.
+type Sink interface {
+	Send(ctx context.Context, e Event) error
+}
+
+// SinkFunc adapts an ordinary function to the Sink interface
+type SinkFunc func(ctx context.Context, e Event) error
+
+// Send calls f(ctx, e)
+func (f SinkFunc) Send(ctx context.Context, e Event) error {
+	return f(ctx, e)
+}
@@ -0,0 +1,259 @@
+package gitwatch
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// DeployLayout describes a Capistrano-style deploy directory. Each new head
+// commit is checked out into its own directory under `releases/`, then the
+// `current` symlink is switched to it in a single rename, so anything serving
+// files from `current` never sees a half-updated tree.
+//
+// Old releases are pruned unless one of the retention rules keeps them: they
+// are among the newest Keep, younger than KeepFor, pinned with PinRelease or
+// the release `current` points at.
+type DeployLayout struct {
+	Dir     string        `yaml:"dir"`      // the deploy root holding `releases/` and `current`, deploys are off if empty
+	Keep    int           `yaml:"keep"`     // the number of newest releases kept, 5 if zero and KeepFor is not set
+	KeepFor time.Duration `yaml:"keep_for"` // if set, releases younger than this are kept
+}
+
+const (
+	defaultKeepReleases = 5
+	releaseTimeFormat   = "20060102150405.000000"
+)
+
+// deploy checks the watched commit out as a new release if `current` doesn't
+// already point at it, and returns the release's directory along with any
+// releases pruned to make way for it. It returns an empty path if there was
+// nothing to do.
+func (s *Session) deploy(repo *git.Repository, repository Repository) (release string, pruned []string, err error) {
+	layout := repository.Deploy
+	head, err := s.watchedHead(repo, repository)
+	if err != nil {
+		return "", nil, err
+	}
+	commit, err := repo.CommitObject(head)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to get head commit for deploy")
+	}
+
+	current := filepath.Join(layout.Dir, "current")
+	if target, err := os.Readlink(current); err == nil && strings.HasSuffix(target, commit.Hash.String()[:7]) {
+		return "", nil, nil
+	}
+
+	started := time.Now()
+	name, err := makeRelease(commit, layout)
+	if err == nil {
+		err = switchCurrent(layout, name)
+	}
+	release = filepath.Join(layout.Dir, "releases", name)
+	s.audit(repository, AuditEntry{Op: AuditDeploy, Path: release, To: commit.Hash.String()}, started, err)
+	if err != nil {
+		return "", nil, err
+	}
+
+	started = time.Now()
+	pruned, err = pruneReleases(layout, name, started)
+	for _, path := range pruned {
+		s.audit(repository, AuditEntry{Op: AuditPrune, Path: path}, started, nil)
+	}
+	if err != nil {
+		s.audit(repository, AuditEntry{Op: AuditPrune, Path: filepath.Join(layout.Dir, "releases")}, started, err)
+	}
+	return release, pruned, err
+}
+
+// makeRelease checks a commit out into a new release directory and returns the
+// release's name.
+func makeRelease(commit *object.Commit, layout DeployLayout) (name string, err error) {
+	releases := filepath.Join(layout.Dir, "releases")
+	name = fmt.Sprintf("%s-%s", time.Now().UTC().Format(releaseTimeFormat), commit.Hash.String()[:7])
+	if err = os.MkdirAll(releases, 0755); err != nil {
+		return "", errors.Wrap(err, "failed to create releases directory")
+	}
+
+	// check the tree out somewhere that isn't a release yet, so a failure
+	// half way never leaves a partial release behind.
+	staging, err := ioutil.TempDir(releases, ".staging-")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create staging directory")
+	}
+	if err = checkoutTree(commit, staging); err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+	if err = os.Chmod(staging, 0755); err != nil {
+		os.RemoveAll(staging)
+		return "", errors.Wrap(err, "failed to set release permissions")
+	}
+	if err = os.Rename(staging, filepath.Join(releases, name)); err != nil {
+		os.RemoveAll(staging)
+		return "", errors.Wrap(err, "failed to move release into place")
+	}
+	return name, nil
+}
+
+// switchCurrent points the `current` symlink at a release. A new symlink
+// renamed over the old one replaces it atomically.
+func switchCurrent(layout DeployLayout, name string) (err error) {
+	link := filepath.Join(layout.Dir, ".current-"+name)
+	if err = os.Symlink(filepath.Join("releases", name), link); err != nil {
+		return errors.Wrap(err, "failed to create current symlink")
+	}
+	if err = os.Rename(link, filepath.Join(layout.Dir, "current")); err != nil {
+		os.Remove(link)
+		return errors.Wrap(err, "failed to switch current symlink")
+	}
+	return nil
+}
+
+// findRelease returns the newest release of a commit, if one is still kept.
+func findRelease(layout DeployLayout, hash plumbing.Hash) (name string, ok bool) {
+	entries, err := ioutil.ReadDir(filepath.Join(layout.Dir, "releases"))
+	if err != nil {
+		return "", false
+	}
+	for _, e := range entries {
+		if e.IsDir() && strings.HasSuffix(e.Name(), "-"+hash.String()[:7]) && e.Name() > name {
+			name, ok = e.Name(), true
+		}
+	}
+	return
+}
+
+// checkoutTree writes every file in a commit's tree to a directory. Submodules
+// are not checked out.
+func checkoutTree(commit *object.Commit, dir string) error {
+	tree, err := commit.Tree()
+	if err != nil {
+		return errors.Wrap(err, "failed to get tree for deploy")
+	}
+	return tree.Files().ForEach(func(f *object.File) (err error) {
+		path := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return errors.Wrapf(err, "failed to create directory for %s", f.Name)
+		}
+
+		if f.Mode == filemode.Symlink {
+			target, err := f.Contents()
+			if err != nil {
+				return errors.Wrapf(err, "failed to read symlink %s", f.Name)
+			}
+			return os.Symlink(target, path)
+		}
+
+		perm := os.FileMode(0644)
+		if f.Mode == filemode.Executable {
+			perm = 0755
+		}
+		r, err := f.Reader()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", f.Name)
+		}
+		defer r.Close()
+		out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create %s", f.Name)
+		}
+		defer out.Close()
+		if _, err = io.Copy(out, r); err != nil {
+			return errors.Wrapf(err, "failed to write %s", f.Name)
+		}
+		return out.Close()
+	})
+}
+
+// pruneReleases removes the releases no retention rule keeps and returns
+// their directories.
+func pruneReleases(layout DeployLayout, current string, now time.Time) (pruned []string, err error) {
+	keep := layout.Keep
+	if keep <= 0 && layout.KeepFor == 0 {
+		keep = defaultKeepReleases
+	}
+
+	releases := filepath.Join(layout.Dir, "releases")
+	entries, err := ioutil.ReadDir(releases)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list releases")
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	// names start with a timestamp, so they sort oldest first
+	sort.Strings(names)
+
+	for i, name := range names {
+		switch {
+		case name == current:
+			continue
+		case len(names)-i <= keep:
+			continue
+		case layout.KeepFor > 0 && now.Sub(releaseTime(name)) < layout.KeepFor:
+			continue
+		case releasePinned(layout.Dir, name):
+			continue
+		}
+		path := filepath.Join(releases, name)
+		if err = os.RemoveAll(path); err != nil {
+			return pruned, errors.Wrapf(err, "failed to remove old release %s", name)
+		}
+		pruned = append(pruned, path)
+	}
+	return
+}
+
+// releaseTime reads the time a release was made from its name.
+func releaseTime(name string) time.Time {
+	i := strings.LastIndex(name, "-")
+	if i == -1 {
+		return time.Time{}
+	}
+	t, err := time.Parse(releaseTimeFormat, name[:i])
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// PinRelease keeps a release in a deploy directory from being pruned until
+// it's unpinned. Pins are files under `<dir>/pinned/`, so they can also be
+// managed by hand.
+func PinRelease(dir, release string) error {
+	pins := filepath.Join(dir, "pinned")
+	if err := os.MkdirAll(pins, 0755); err != nil {
+		return errors.Wrap(err, "failed to create pinned directory")
+	}
+	return ioutil.WriteFile(filepath.Join(pins, filepath.Base(release)), nil, 0644)
+}
+
+// UnpinRelease allows a pinned release to be pruned again
+func UnpinRelease(dir, release string) error {
+	err := os.Remove(filepath.Join(dir, "pinned", filepath.Base(release)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func releasePinned(dir, name string) bool {
+	_, err := os.Stat(filepath.Join(dir, "pinned", name))
+	return err == nil
+}
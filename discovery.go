@@ -0,0 +1,243 @@
+package gitwatch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Discovery finds repositories to watch from a Source, such as every
+// repository of a GitHub organisation, and adds the ones its Filter accepts.
+// Repositories are only ever added: one that disappears from the source or
+// stops matching keeps being watched.
+type Discovery struct {
+	Source   Source          // where to look for repositories
+	Filter   DiscoveryFilter // which of the repositories found to watch
+	Template Repository      // the settings of the repositories added, such as Branch, Group or Auth, with URL set to what was found
+	Every    time.Duration   // how often to look for new repositories, every 10 minutes if zero
+}
+
+// Source lists repositories that could be watched
+type Source interface {
+	Discover(ctx context.Context) ([]Discovered, error)
+}
+
+// Discovered is a repository found by a Source
+type Discovered struct {
+	Name     string   // the repository's name, without its owner
+	URL      string   // the URL to clone it from
+	Topics   []string // the repository's topics, if the source has them
+	Archived bool     // true if the repository is archived
+	Private  bool     // true if the repository isn't public
+}
+
+// DiscoveryFilter selects discovered repositories. Name patterns use the
+// syntax of path.Match, such as `*-sandbox`.
+type DiscoveryFilter struct {
+	Include       []string // if set, only repositories with a name matching one of these
+	Exclude       []string // repositories with a name matching one of these are left out
+	Topics        []string // if set, only repositories with one of these topics
+	ExcludeTopics []string // repositories with one of these topics are left out
+	Archived      bool     // if true, archived repositories are included
+	Visibility    string   // `public` or `private` to only include those, both if empty
+}
+
+const defaultDiscoveryInterval = 10 * time.Minute
+
+// Match reports whether the filter accepts a repository
+func (f DiscoveryFilter) Match(d Discovered) bool {
+	switch {
+	case d.Archived && !f.Archived:
+		return false
+	case f.Visibility == "public" && d.Private, f.Visibility == "private" && !d.Private:
+		return false
+	case len(f.Include) > 0 && !matchName(f.Include, d.Name):
+		return false
+	case matchName(f.Exclude, d.Name):
+		return false
+	case len(f.Topics) > 0 && !hasAny(d.Topics, f.Topics):
+		return false
+	case hasAny(d.Topics, f.ExcludeTopics):
+		return false
+	}
+	return true
+}
+
+func matchName(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAny(values, wanted []string) bool {
+	for _, v := range values {
+		for _, w := range wanted {
+			if strings.EqualFold(v, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// discoverRepos runs the session's discoveries that are due and adds the new
+// repositories they find. A discovery that fails is reported and tried again
+// on the next check, without holding up the others, unless it's one of the
+// initial checks that ErrorsFailFast stops Run for.
+func (s *Session) discoverRepos(initial bool) error {
+	if len(s.discoveredAt) != len(s.Discovery) {
+		s.discoveredAt = make([]time.Time, len(s.Discovery))
+	}
+	for i, d := range s.Discovery {
+		every := d.Every
+		if every <= 0 {
+			every = defaultDiscoveryInterval
+		}
+		if time.Since(s.discoveredAt[i]) < every {
+			continue
+		}
+
+		found, err := d.Source.Discover(s.ctx)
+		if err != nil {
+			err = errors.Wrap(err, "failed to discover repositories")
+			if initial && s.ErrorPolicy != ErrorsResilient {
+				return err
+			}
+			s.reportError(ErrorRecord{Op: "discover"}, err)
+			continue
+		}
+		s.discoveredAt[i] = time.Now()
+		for _, f := range found {
+			if !d.Filter.Match(f) || s.watching(f.URL) {
+				continue
+			}
+			r := d.Template
+			r.URL = f.URL
+			if r, err = hydrate(s.Directory, r); err != nil {
+				if initial && s.ErrorPolicy != ErrorsResilient {
+					return err
+				}
+				s.reportError(ErrorRecord{Op: "discover", URL: f.URL}, err)
+				continue
+			}
+			s.setRepos(append(s.Repositories, r))
+		}
+	}
+	return nil
+}
+
+// watching reports whether the session already watches a repository
+func (s *Session) watching(url string) bool {
+	for _, r := range s.Repositories {
+		if repositoryKey(r.URL) == repositoryKey(url) {
+			return true
+		}
+	}
+	return false
+}
+
+// DirectorySource is a Source listing the git repositories, bare or not,
+// directly inside a directory, for example one that a provisioning tool fills
+// with mirrors.
+type DirectorySource string
+
+// Discover implements Source
+func (d DirectorySource) Discover(ctx context.Context) (found []Discovered, err error) {
+	entries, err := ioutil.ReadDir(string(d))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read directory")
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(string(d), e.Name())
+		if !isGitDir(dir) && !isGitDir(filepath.Join(dir, ".git")) {
+			continue
+		}
+		found = append(found, Discovered{Name: strings.TrimSuffix(e.Name(), ".git"), URL: dir})
+	}
+	return
+}
+
+// isGitDir reports whether a directory looks like a git directory
+func isGitDir(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "HEAD"))
+	return err == nil
+}
+
+// GitHubOrg is a Source listing the repositories of a GitHub organisation
+type GitHubOrg struct {
+	Org    string       // the organisation's login
+	Token  string       // if set, used to list private repositories and for a higher rate limit
+	SSH    bool         // if true, repositories are cloned over SSH rather than HTTPS
+	API    string       // the API's base URL, https://api.github.com if empty, set it for GitHub Enterprise
+	Client *http.Client // the client to call the API with, the one set with UseHTTPClient if nil
+}
+
+// Discover implements Source
+func (g GitHubOrg) Discover(ctx context.Context) (found []Discovered, err error) {
+	api := strings.TrimSuffix(g.API, "/")
+	if api == "" {
+		api = "https://api.github.com"
+	}
+	client := g.Client
+	if client == nil {
+		client = httpClient()
+	}
+
+	for page := 1; ; page++ {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/orgs/%s/repos?per_page=100&page=%d", api, g.Org, page), nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create request")
+		}
+		req.Header.Set("Accept", "application/vnd.github+json")
+		if g.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+g.Token)
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list repositories of %s", g.Org)
+		}
+		var repos []struct {
+			Name     string   `json:"name"`
+			CloneURL string   `json:"clone_url"`
+			SSHURL   string   `json:"ssh_url"`
+			Topics   []string `json:"topics"`
+			Archived bool     `json:"archived"`
+			Private  bool     `json:"private"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, errors.Errorf("failed to list repositories of %s: %s", g.Org, resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&repos)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode repositories")
+		}
+
+		for _, r := range repos {
+			d := Discovered{Name: r.Name, URL: r.CloneURL, Topics: r.Topics, Archived: r.Archived, Private: r.Private}
+			if g.SSH {
+				d.URL = r.SSHURL
+			}
+			found = append(found, d)
+		}
+		if len(repos) < 100 {
+			return found, nil
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package gitwatch
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// Commit is the JSON representation of a commit
+type Commit struct {
+	Hash      string    `json:"hash"`
+	Message   string    `json:"message"`
+	Author    Signature `json:"author"`
+	Committer Signature `json:"committer"`
+	Parents   []string  `json:"parents,omitempty"`
+}
+
+// Signature is the JSON representation of a commit author or committer
+type Signature struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	When  time.Time `json:"when"`
+}
+
+func newCommit(c object.Commit) *Commit {
+	if c.Hash.IsZero() {
+		return nil
+	}
+	parents := make([]string, len(c.ParentHashes))
+	for i, p := range c.ParentHashes {
+		parents[i] = p.String()
+	}
+	return &Commit{
+		Hash:      c.Hash.String(),
+		Message:   c.Message,
+		Author:    Signature{c.Author.Name, c.Author.Email, c.Author.When},
+		Committer: Signature{c.Committer.Name, c.Committer.Email, c.Committer.When},
+		Parents:   parents,
+	}
+}
+
+// MarshalJSON encodes an event along with its commits
+func (e Event) MarshalJSON() ([]byte, error) {
+	type event Event
+	var commits []Commit
+	for _, c := range e.commits {
+		commits = append(commits, *newCommit(c))
+	}
+	return json.Marshal(struct {
+		event
+		Commit  *Commit  `json:"commit,omitempty"`
+		Commits []Commit `json:"commits,omitempty"`
+	}{event(e), newCommit(e.commit), commits})
+}
+
+// UnmarshalJSON decodes an event encoded by MarshalJSON. Commits are restored
+// without access to their repository, so their trees and parents can't be
+// traversed.
+func (e *Event) UnmarshalJSON(b []byte) error {
+	type event Event
+	var v struct {
+		*event
+		Commit  *Commit  `json:"commit"`
+		Commits []Commit `json:"commits"`
+	}
+	v.event = (*event)(e)
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if v.Commit != nil {
+		e.commit = v.Commit.object()
+	}
+	e.commits = nil
+	for _, c := range v.Commits {
+		e.commits = append(e.commits, c.object())
+	}
+	return nil
+}
+
+func (c Commit) object() object.Commit {
+	parents := make([]plumbing.Hash, len(c.Parents))
+	for i, p := range c.Parents {
+		parents[i] = plumbing.NewHash(p)
+	}
+	return object.Commit{
+		Hash:         plumbing.NewHash(c.Hash),
+		Message:      c.Message,
+		Author:       object.Signature{Name: c.Author.Name, Email: c.Author.Email, When: c.Author.When},
+		Committer:    object.Signature{Name: c.Committer.Name, Email: c.Committer.Email, When: c.Committer.When},
+		ParentHashes: parents,
+	}
+}
+
+// MarshalJSON encodes a note with its commit hash as a hex string
+func (n Note) MarshalJSON() ([]byte, error) {
+	type note Note
+	return json.Marshal(struct {
+		note
+		Commit string `json:"commit"`
+	}{note(n), n.Commit.String()})
+}
+
+// UnmarshalJSON decodes a note encoded by MarshalJSON
+func (n *Note) UnmarshalJSON(b []byte) error {
+	type note Note
+	var v struct {
+		*note
+		Commit string `json:"commit"`
+	}
+	v.note = (*note)(n)
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	n.Commit = plumbing.NewHash(v.Commit)
+	return nil
+}
+
+// MarshalText encodes an event type as its name
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText decodes an event type from its name
+func (t *EventType) UnmarshalText(b []byte) error {
+	for i, name := range eventTypeNames {
+		if name == string(b) {
+			*t = EventType(i)
+			return nil
+		}
+	}
+	return errors.Errorf("unknown event type %q", b)
+}
@@ -0,0 +1,74 @@
+package gitwatch
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// LoadConfigFile reads a configuration file with LoadConfig, or LoadTOMLConfig
+// if its name ends in `.toml`, first decrypting it if it was encrypted with
+// SOPS or age. Decryption uses the `sops` and `age` tools, so their usual keys
+// apply. age identities are read from the file named by SOPS_AGE_KEY_FILE.
+func LoadConfigFile(ctx context.Context, path string) (c SessionConfig, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, errors.Wrap(err, "failed to read config")
+	}
+
+	switch {
+	case isAgeEncrypted(b):
+		identity := os.Getenv("SOPS_AGE_KEY_FILE")
+		if identity == "" {
+			return c, errors.New("config is age encrypted but SOPS_AGE_KEY_FILE is not set")
+		}
+		b, err = decryptConfig(ctx, "age", "--decrypt", "--identity", identity, path)
+	case isSOPSEncrypted(b):
+		b, err = decryptConfig(ctx, "sops", "--decrypt", path)
+	}
+	if err != nil {
+		return c, err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		return LoadTOMLConfig(bytes.NewReader(b))
+	}
+	return LoadConfig(bytes.NewReader(b))
+}
+
+// isAgeEncrypted reports whether the contents are an age file, in either the
+// binary or the armored format.
+func isAgeEncrypted(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("age-encryption.org/")) ||
+		bytes.HasPrefix(bytes.TrimSpace(b), []byte("-----BEGIN AGE ENCRYPTED FILE-----"))
+}
+
+// isSOPSEncrypted reports whether the contents are a YAML or JSON document
+// carrying the `sops` metadata key that SOPS adds when encrypting.
+func isSOPSEncrypted(b []byte) bool {
+	var doc struct {
+		SOPS map[string]interface{} `yaml:"sops"`
+	}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return false
+	}
+	return doc.SOPS != nil
+}
+
+func decryptConfig(ctx context.Context, tool string, args ...string) (b []byte, err error) {
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, tool, args...)
+	cmd.Stderr = stderr
+	b, err = cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt config with %s: %s", tool, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return
+}
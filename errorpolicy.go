@@ -0,0 +1,89 @@
+package gitwatch
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrorPolicy decides how a session reacts to repositories that fail to be
+// checked.
+type ErrorPolicy int
+
+const (
+	// ErrorsFailFast stops Run with the first error of the initial checks.
+	// After startup, every repository is still checked each round and each
+	// error is reported on Errors.
+	ErrorsFailFast ErrorPolicy = iota
+	// ErrorsResilient never lets one repository hold up the others. Every
+	// repository is checked each round, errors are reported on Errors, and
+	// failing repositories, including ones that couldn't be cloned, are
+	// retried on every check.
+	ErrorsResilient
+)
+
+// ErrAllFailing is returned by Run under ErrorsResilient once every
+// repository has failed the session's FailingLimit checks in a row or run out
+// of retries
+var ErrAllFailing = errors.New("every repository is failing")
+
+var errorPolicyNames = []string{
+	ErrorsFailFast:  "fail-fast",
+	ErrorsResilient: "resilient",
+}
+
+func (p ErrorPolicy) String() string {
+	if p >= 0 && int(p) < len(errorPolicyNames) {
+		return errorPolicyNames[p]
+	}
+	return "unknown"
+}
+
+// UnmarshalText parses `fail-fast` or `resilient`, as used in configuration
+// files and flags
+func (p *ErrorPolicy) UnmarshalText(b []byte) error {
+	for i, name := range errorPolicyNames {
+		if string(b) == name {
+			*p = ErrorPolicy(i)
+			return nil
+		}
+	}
+	return errors.Errorf("unknown error policy %q", b)
+}
+
+// checkResiliently checks every repository regardless of failures and returns
+// ErrAllFailing if the session's FailingLimit has been reached.
+func (s *Session) checkResiliently(initial bool) error {
+	s.checkEach(initial, func(repository Repository, err error) bool {
+		if err == nil {
+			return true
+		}
+
+		// a failed check was counted by retryLater, an error taking the
+		// repository's lock wasn't
+		retries := s.stateOf(repository).attempts - 1
+		if retries < 0 {
+			retries = 0
+		}
+		s.reportError(ErrorRecord{Op: "check", URL: repository.URL, Retries: retries}, errors.Wrapf(err, "failed to check %s", repository.URL))
+		return true
+	})
+	if s.FailingLimit > 0 && s.allFailing() {
+		return errors.Wrapf(ErrAllFailing, "after %d checks", s.FailingLimit)
+	}
+	return nil
+}
+
+// allFailing reports whether every repository has failed FailingLimit checks
+// in a row, or run out of retries, going by their last checks rather than
+// this round's, which skips repositories that are backing off or not due.
+func (s *Session) allFailing() bool {
+	if len(s.Repositories) == 0 {
+		return false
+	}
+	for _, repository := range s.Repositories {
+		state := s.stateOf(repository)
+		if !state.exhausted && state.attempts < s.FailingLimit {
+			return false
+		}
+	}
+	return true
+}
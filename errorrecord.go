@@ -0,0 +1,149 @@
+package gitwatch
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/xerrors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+// ErrorRecord is a machine-readable description of an error reported on the
+// session's Errors channel, for monitoring systems that shouldn't have to
+// parse error messages.
+type ErrorRecord struct {
+	Time    time.Time  `json:"time"`
+	URL     string     `json:"url,omitempty"`     // the repository the error concerns, empty for session-wide errors
+	Op      string     `json:"op"`                // what failed: check, discover, shard, lock, update, push, deploy, enrich, deliver, dead-letter, exec, audit or webhook
+	Class   ErrorClass `json:"class"`             // the kind of error, to tell failures that need attention from transient ones
+	Retries int        `json:"retries,omitempty"` // for checks, how many checks in a row had failed before, for deliveries, how many retries were made
+	Message string     `json:"message"`           // the error's message, as reported on Errors
+}
+
+// Error is the type of the errors a session sends to Errors. It says which
+// repository failed and at what stage, so consumers can retry or alert per
+// repository without parsing messages.
+type Error struct {
+	Repository string // the URL of the repository the error concerns, empty for session-wide errors
+	Stage      string // StageClone, StageFetch or StagePull if a check failed at one of them, otherwise the Op of the error's ErrorRecord
+	Err        error  // the error itself
+}
+
+// Stages of a check an Error can report
+const (
+	StageClone = "clone"
+	StageFetch = "fetch"
+	StagePull  = "pull"
+)
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns the error itself, for errors.Cause
+func (e *Error) Cause() error {
+	return e.Err
+}
+
+// Unwrap returns the error itself, for errors.Is and errors.As
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// stageError marks the stage of a check an error happened at
+type stageError struct {
+	stage string
+	err   error
+}
+
+func withStage(stage string, err error) error {
+	return &stageError{stage, err}
+}
+
+func (e *stageError) Error() string { return e.err.Error() }
+func (e *stageError) Cause() error  { return e.err }
+func (e *stageError) Unwrap() error { return e.err }
+
+// ErrorClass is the kind of an error
+type ErrorClass string
+
+const (
+	// ErrorClassAuth is an error authenticating with, or being refused by, a
+	// remote
+	ErrorClassAuth ErrorClass = "auth"
+	// ErrorClassNotFound is a repository or branch that doesn't exist
+	ErrorClassNotFound ErrorClass = "not-found"
+	// ErrorClassNetwork is a remote that couldn't be reached or timed out
+	ErrorClassNetwork ErrorClass = "network"
+	// ErrorClassRateLimited is a remote limiting the rate of requests
+	ErrorClassRateLimited ErrorClass = "rate-limited"
+	// ErrorClassConflict is a local copy that can't be updated without
+	// UseForce, after a history rewrite or local changes
+	ErrorClassConflict ErrorClass = "conflict"
+	// ErrorClassOther is any other error
+	ErrorClassOther ErrorClass = "other"
+)
+
+// classifyError finds the class of an error from its cause
+func classifyError(err error) ErrorClass {
+	if _, limited := rateLimitDelay(err); limited {
+		return ErrorClassRateLimited
+	}
+	cause := errors.Cause(err)
+	if unexpected, ok := cause.(*plumbing.UnexpectedError); ok {
+		cause = unexpected.Err
+	}
+	switch cause {
+	case transport.ErrAuthenticationRequired, transport.ErrAuthorizationFailed:
+		return ErrorClassAuth
+	case transport.ErrRepositoryNotFound, plumbing.ErrReferenceNotFound:
+		return ErrorClassNotFound
+	case git.ErrNonFastForwardUpdate, git.ErrUnstagedChanges:
+		return ErrorClassConflict
+	case context.DeadlineExceeded:
+		return ErrorClassNetwork
+	}
+	if _, ok := cause.(net.Error); ok {
+		return ErrorClassNetwork
+	}
+	return ErrorClassOther
+}
+
+// reportError sends an error to the Errors channel as an *Error, and its record
+// to the ErrorRecords channel if set, unless the session is shutting down. The
+// record describes the operation that failed, its time, class and message are
+// filled in from the error.
+func (s *Session) reportError(r ErrorRecord, err error) {
+	e := &Error{Repository: r.URL, Stage: r.Op, Err: err}
+	var stage *stageError
+	if xerrors.As(err, &stage) {
+		e.Stage = stage.stage
+	}
+	sent := true
+	if !s.handleError(e) {
+		sent = false
+		s.send(func() {
+			select {
+			case s.Errors <- e:
+				sent = true
+			case <-s.ctx.Done():
+			}
+		})
+	}
+	if !sent || s.ErrorRecords == nil {
+		return
+	}
+	r.Time = time.Now()
+	r.Class = classifyError(err)
+	r.Message = err.Error()
+	s.send(func() {
+		select {
+		case s.ErrorRecords <- r:
+		case <-s.ctx.Done():
+		}
+	})
+}
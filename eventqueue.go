@@ -0,0 +1,132 @@
+package gitwatch
+
+import (
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// EventDelivery decides how events wait to be read from a session's Events
+// channel. However they wait, delivery stops when the session is closed, and
+// events that were never read are counted by Close.
+type EventDelivery int
+
+const (
+	// DeliverBuffer queues events for the reader, in the order they were
+	// emitted. If EventQueue is above 0, emitting an event waits for room
+	// once that many are queued.
+	DeliverBuffer EventDelivery = iota
+	// DeliverBlock hands each event over before carrying on, as with
+	// OrderedEvents.
+	DeliverBlock
+	// DeliverDropOldest queues up to EventQueue events, 64 if zero, and
+	// drops the oldest to make room for a new one, counting it in
+	// Status.DroppedEvents.
+	DeliverDropOldest
+)
+
+var eventDeliveryNames = []string{
+	DeliverBuffer:     "buffer",
+	DeliverBlock:      "block",
+	DeliverDropOldest: "drop-oldest",
+}
+
+const defaultEventQueue = 64
+
+func (d EventDelivery) String() string {
+	if d >= 0 && int(d) < len(eventDeliveryNames) {
+		return eventDeliveryNames[d]
+	}
+	return "unknown"
+}
+
+// UnmarshalText parses `buffer`, `block` or `drop-oldest`, as used in
+// configuration files
+func (d *EventDelivery) UnmarshalText(b []byte) error {
+	for i, name := range eventDeliveryNames {
+		if string(b) == name {
+			*d = EventDelivery(i)
+			return nil
+		}
+	}
+	return errors.Errorf("unknown event delivery %q", b)
+}
+
+// queueEvent adds an event to the queue the delivery goroutine hands to
+// Events, waiting for room or dropping the oldest if it's full.
+func (s *Session) queueEvent(event Event) {
+	s.eventOnce.Do(func() {
+		s.eventQueued = make(chan struct{}, 1)
+		s.eventRoom = make(chan struct{}, 1)
+		go s.deliverEvents()
+	})
+
+	limit := s.EventQueue
+	if limit <= 0 && s.EventDelivery == DeliverDropOldest {
+		limit = defaultEventQueue
+	}
+
+	s.eventMu.Lock()
+	for limit > 0 && len(s.eventQueue) >= limit {
+		if s.EventDelivery == DeliverDropOldest {
+			s.eventQueue = s.eventQueue[1:]
+			atomic.AddUint64(&s.droppedEvents, 1)
+			atomic.AddInt32(&s.pendingEvents, -1)
+			continue
+		}
+		s.eventMu.Unlock()
+		select {
+		case <-s.eventRoom:
+		case <-s.ctx.Done():
+			return
+		}
+		s.eventMu.Lock()
+	}
+	s.eventQueue = append(s.eventQueue, event)
+	s.eventMu.Unlock()
+	notify(s.eventQueued)
+}
+
+// deliverEvents hands queued events to Events one at a time until the
+// session is closed.
+func (s *Session) deliverEvents() {
+	for {
+		s.eventMu.Lock()
+		if len(s.eventQueue) == 0 {
+			s.eventMu.Unlock()
+			select {
+			case <-s.eventQueued:
+				continue
+			case <-s.ctx.Done():
+				return
+			}
+		}
+		event := s.eventQueue[0]
+		s.eventQueue = s.eventQueue[1:]
+		s.eventMu.Unlock()
+		notify(s.eventRoom)
+
+		sent := false
+		s.send(func() {
+			select {
+			case s.Events <- event:
+				sent = true
+			case <-s.ctx.Done():
+			}
+		})
+		if !sent {
+			return
+		}
+		atomic.AddInt32(&s.pendingEvents, -1)
+		s.checkBacklog()
+	}
+}
+
+// notify wakes whoever waits on a signal channel, without blocking if it's
+// already signalled.
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
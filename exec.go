@@ -0,0 +1,334 @@
+package gitwatch
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ExecHook runs a command for every event of a repository. The event is
+// written to the command's standard input as JSON and described in
+// `GITWATCH_*` environment variables. Commands for one repository run strictly
+// one after another, see Supersede for what happens to events that arrive
+// while one is running, while those of different repositories run in
+// parallel up to the session's ExecLimit.
+type ExecHook struct {
+	Command   []string        `yaml:"command"`   // the program to run and its arguments
+	Env       []string        `yaml:"env"`       // extra `KEY=value` variables, added to gitwatch's own environment
+	Dir       string          `yaml:"dir"`       // the working directory, the repository's clone if empty
+	Timeout   time.Duration   `yaml:"timeout"`   // if set, commands running for longer than this are stopped
+	Supersede SupersedePolicy `yaml:"supersede"` // what happens when a new event arrives while the command is running
+	Grace     time.Duration   `yaml:"grace"`     // how long a stopped command has between SIGTERM and SIGKILL, 10s if zero
+	QueueSize int             `yaml:"queue"`     // events waiting per repository before the oldest is dropped, 16 if zero
+	Coalesce  bool            `yaml:"coalesce"`  // if true, a waiting event is replaced by a newer one of the same type
+	Output    io.Writer       `yaml:"-"`         // if set, the command's output is copied here, otherwise it's only part of errors
+}
+
+// SupersedePolicy decides what happens to a new event for a repository while
+// its exec hook is still running for an earlier one.
+type SupersedePolicy int
+
+const (
+	// SupersedeQueue runs the command for the new event once the running one
+	// has finished.
+	SupersedeQueue SupersedePolicy = iota
+	// SupersedeCancel stops the running command, and drops any queued events,
+	// in favour of the new event.
+	SupersedeCancel
+)
+
+var supersedePolicyNames = []string{
+	SupersedeQueue:  "queue",
+	SupersedeCancel: "cancel",
+}
+
+func (p SupersedePolicy) String() string {
+	if p >= 0 && int(p) < len(supersedePolicyNames) {
+		return supersedePolicyNames[p]
+	}
+	return "unknown"
+}
+
+// UnmarshalText parses `queue` or `cancel`, as used in configuration files
+func (p *SupersedePolicy) UnmarshalText(b []byte) error {
+	for i, name := range supersedePolicyNames {
+		if string(b) == name {
+			*p = SupersedePolicy(i)
+			return nil
+		}
+	}
+	return errors.Errorf("unknown supersede policy %q", b)
+}
+
+const (
+	defaultExecGrace = 10 * time.Second
+	defaultExecQueue = 16
+)
+
+// execRunner runs a repository's exec hooks one at a time
+type execRunner struct {
+	mu      sync.Mutex
+	queue   []Event
+	running bool
+	cancel  context.CancelFunc // stops the running command
+}
+
+// runHook hands an event to the exec hook of its repository, or the session's
+// if the repository has none.
+func (s *Session) runHook(repository Repository, event Event) {
+	hook := repository.Exec
+	if hook == nil {
+		hook = s.Exec
+	}
+	if hook == nil || len(hook.Command) == 0 {
+		return
+	}
+	if event.Branch == "" {
+		event.Branch = repository.Branch
+	}
+
+	s.execMu.Lock()
+	if s.execRunners == nil {
+		s.execRunners = make(map[string]*execRunner)
+	}
+	r, ok := s.execRunners[repository.fullPath]
+	if !ok {
+		r = &execRunner{}
+		s.execRunners[repository.fullPath] = r
+	}
+	s.execMu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running && hook.Supersede == SupersedeCancel {
+		r.queue = []Event{event}
+		if r.cancel != nil {
+			r.cancel()
+		}
+	} else if err := r.push(event, *hook); err != nil {
+		s.reportError(ErrorRecord{Op: "exec", URL: event.URL}, err)
+	}
+	if !r.running {
+		r.running = true
+		s.hooks.Add(1)
+		go s.drainHooks(r, *hook)
+	}
+}
+
+// push queues an event, coalescing it with a waiting event of the same type
+// if the hook asks for it, and dropping the oldest event if the queue is full.
+func (r *execRunner) push(event Event, hook ExecHook) (err error) {
+	if hook.Coalesce {
+		for i, queued := range r.queue {
+			if queued.Type == event.Type {
+				r.queue = append(append(r.queue[:i:i], r.queue[i+1:]...), event)
+				return nil
+			}
+		}
+	}
+
+	size := hook.QueueSize
+	if size <= 0 {
+		size = defaultExecQueue
+	}
+	if len(r.queue) >= size {
+		err = errors.Errorf("exec hook queue for %s is full, dropped the %s event from %s", event.URL, r.queue[0].Type, r.queue[0].Timestamp.Format(time.RFC3339))
+		r.queue = r.queue[1:]
+	}
+	r.queue = append(r.queue, event)
+	return
+}
+
+// drainHooks runs the hook for each queued event until the queue is empty.
+func (s *Session) drainHooks(r *execRunner, hook ExecHook) {
+	defer s.hooks.Done()
+	for {
+		r.mu.Lock()
+		if len(r.queue) == 0 {
+			r.running = false
+			r.mu.Unlock()
+			return
+		}
+		event := r.queue[0]
+		r.queue = r.queue[1:]
+		ctx, cf := context.WithCancel(s.ctx)
+		r.cancel = cf
+		r.mu.Unlock()
+
+		var err error
+		if s.acquireExec(ctx) {
+			err = hook.run(ctx, event)
+			s.releaseExec()
+		}
+		superseded := ctx.Err() != nil
+		cf()
+		// a superseded command is stopped on purpose, so it isn't an error
+		if err != nil && !superseded {
+			s.reportError(ErrorRecord{Op: "exec", URL: event.URL}, errors.Wrapf(err, "exec hook failed for %s", event.URL))
+		}
+	}
+}
+
+// acquireExec waits for a slot under the session's ExecLimit, and returns
+// false if ctx is done first.
+func (s *Session) acquireExec(ctx context.Context) bool {
+	if s.ExecLimit <= 0 {
+		return true
+	}
+	s.execMu.Lock()
+	if s.execSlots == nil {
+		s.execSlots = make(chan struct{}, s.ExecLimit)
+	}
+	slots := s.execSlots
+	s.execMu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *Session) releaseExec() {
+	if s.ExecLimit > 0 {
+		<-s.execSlots
+	}
+}
+
+// run runs the command for an event. If ctx is done first, or the timeout
+// passes, the command is sent SIGTERM and then killed if it's still running
+// after the grace period.
+func (h ExecHook) run(ctx context.Context, event Event) (err error) {
+	payload, _, err := Encode(event, FormatJSON)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode event")
+	}
+
+	cmd := exec.Command(h.Command[0], h.Command[1:]...)
+	cmd.Dir = h.Dir
+	if cmd.Dir == "" {
+		cmd.Dir = event.Path
+	}
+	cmd.Env = append(append(os.Environ(), h.Env...), eventEnv(event)...)
+	cmd.Stdin = bytes.NewReader(payload)
+
+	var out bytes.Buffer
+	var dst io.Writer = &out
+	if h.Output != nil {
+		dst = io.MultiWriter(&out, h.Output)
+	}
+	copied, err := startWithOutput(cmd, dst)
+	if err != nil {
+		return errors.Wrapf(err, "failed to start %s", h.Command[0])
+	}
+	defer func() {
+		copied()
+		if err != nil {
+			err = errors.Wrapf(err, "%s: %s", h.Command[0], strings.TrimSpace(out.String()))
+		}
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var timeout <-chan time.Time
+	if h.Timeout > 0 {
+		timer := time.NewTimer(h.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = h.stop(cmd, done)
+	case <-timeout:
+		err = errors.Errorf("timed out after %s", h.Timeout)
+		h.stop(cmd, done)
+	}
+	return
+}
+
+// startWithOutput starts a command with its output copied to dst through a
+// pipe of our own rather than one exec.Cmd waits on, because background
+// processes a stopped command leaves behind would hold that open and block
+// Wait. Once the command has exited, copied waits briefly for the rest of the
+// output and gives up on any still held open.
+func startWithOutput(cmd *exec.Cmd, dst io.Writer) (copied func(), err error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create output pipe")
+	}
+	cmd.Stdout, cmd.Stderr = pw, pw
+	err = cmd.Start()
+	pw.Close()
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(dst, pr)
+		close(done)
+	}()
+	return func() {
+		select {
+		case <-done:
+		case <-time.After(100 * time.Millisecond):
+		}
+		pr.Close()
+		<-done
+	}, nil
+}
+
+// stop asks a command to exit and kills it if it hasn't after the grace
+// period.
+func (h ExecHook) stop(cmd *exec.Cmd, done chan error) error {
+	grace := h.Grace
+	if grace <= 0 {
+		grace = defaultExecGrace
+	}
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		cmd.Process.Kill()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(grace):
+		cmd.Process.Kill()
+		return <-done
+	}
+}
+
+// eventEnv describes an event in environment variables
+func eventEnv(e Event) []string {
+	env := []string{
+		"GITWATCH_EVENT=" + e.Type.String(),
+		"GITWATCH_URL=" + e.URL,
+		"GITWATCH_PATH=" + e.Path,
+		"GITWATCH_BRANCH=" + e.Branch,
+		"GITWATCH_TAG=" + e.Tag,
+	}
+	if e.TraceID != "" {
+		env = append(env, "GITWATCH_TRACE_ID="+e.TraceID)
+	}
+	if c := e.Commit(); !c.Hash.IsZero() {
+		env = append(env,
+			"GITWATCH_COMMIT="+c.Hash.String(),
+			"GITWATCH_AUTHOR="+c.Author.Name,
+			"GITWATCH_AUTHOR_EMAIL="+c.Author.Email,
+			"GITWATCH_TIMESTAMP="+e.Timestamp.Format(time.RFC3339),
+			"GITWATCH_BUMP="+e.Bump.String(),
+		)
+	}
+	return env
+}
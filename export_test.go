@@ -0,0 +1,8 @@
+package gitwatch
+
+// SignV4 and CodeCommitPassword are exported for the tests only, so they can
+// be checked against AWS's published signatures.
+var (
+	SignV4             = signV4
+	CodeCommitPassword = codeCommitPassword
+)
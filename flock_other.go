@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package gitwatch
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func tryFlock(f *os.File) (bool, error) {
+	return false, errors.New("FileLocker is not supported on this platform")
+}
+
+func unflock(f *os.File) error {
+	return nil
+}
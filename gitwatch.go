@@ -5,16 +5,19 @@ package gitwatch
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"net/url"
-	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/xerrors"
+	"gopkg.in/src-d/go-billy.v4"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
@@ -23,40 +26,256 @@ import (
 
 // Repository represents a Git repository address and branch name
 type Repository struct {
-	URL       string               // local or remote repository URL to watch
-	Branch    string               // the name of the branch to use `master` being default
-	Directory string               // the directory name to clone the repository to, relative from the session's directory
-	Auth      transport.AuthMethod // authentication method for git operations
+	URL        string               // local or remote repository URL to watch
+	Mirrors    []string             // fallback URLs tried in order when URL can't be reached
+	PushMirror string               // if set, the watched branch, and tags if watched, are pushed to this URL after every change
+	PushAuth   transport.AuthMethod // authentication method for pushing to PushMirror
+	Deploy     DeployLayout         // if its Dir is set, each new head commit is checked out as a release there
+	Observe    bool                 // if true, the local clone is never changed: updates are only fetched into remote-tracking refs and reported
+	Bare       bool                 // if true, the repository is cloned without a worktree and observed, see Observe
+	RefsOnly   bool                 // if true, nothing is cloned: every ref created, moved or deleted on the remote emits an event
+	Webhook    bool                 // if true, once cloned the repository isn't polled, it's only checked when a webhook announces a change to it
+	Exec       *ExecHook            // if set, a command run for each of the repository's events, instead of the session's
+	Branch     string               // the name of the branch to use `master` being default
+	Branches   []string             // more branches to watch, by name or pattern such as `release/*`, fetched without touching the worktree
+	Directory  string               // the directory name to clone the repository to, relative from the session's directory
+	Auth       transport.AuthMethod // authentication method for git operations
+	Group      string               // the name of the session group to take unset settings from
+	WatchTags  bool                 // if true, the remote's tags are tracked and tags pushed, moved or deleted emit events
+	WatchNotes bool                 // if true, `refs/notes/*` are fetched and added or updated notes emit events
+	WatchPulls bool                 // if true, pull/merge request head refs are fetched and updates to them emit events
+	WatchFiles []string             // paths or patterns of files whose old and new contents are included in commit and digest events that change them
+	Ignore     []string             // path patterns of files whose changes don't emit commit events, followed by those in the repository's .gitwatchignore
+	Include    []string             // if set, path patterns of the only files whose changes emit commit events, less those ignored
+	Components map[string]string    // path patterns and the names of the components, such as services of a monorepo, files matching them belong to
+	MinCommits int                  // if above 1, commit events are held back until this many commits have landed since the last one
+	AllCommits bool                 // if true, commit events list every commit since the last one in Commits, not only the newest
+	RateLimit  time.Duration        // if set, at most one commit event is emitted per period, with later changes coalesced into it
+	Interval   time.Duration        // if set, the interval between checks of this repository, instead of the session's
+	Depth      int                  // if above 0, the repository is cloned and fetched shallowly with this much history, instead of the session's Depth
+	Digest     time.Duration        // if set, commit events are replaced by one digest event per period listing every new commit
+	Timeout    time.Duration        // if set, how long each clone, fetch, pull or push of the repository may take, instead of the session's OperationTimeout
+	Retry      *RetryPolicy         // if set, how the repository is retried when its checks fail, instead of the session's Retry
 
 	fullPath string // the full path, computed at construction time
 }
 
 // Session represents a git watch session configuration
 type Session struct {
-	Repositories  []Repository         // list of local or remote repository URLs to watch
-	Interval      time.Duration        // the interval between remote checks
-	Directory     string               // the directory to store repositories
-	Auth          transport.AuthMethod // authentication method for git operations
-	InitialEvent  bool                 // if true, an event for each repo will be emitted upon construction
-	AllowDeletion bool                 // if true, repository will be deleted upon error and re-cloned
-	UseForce      bool                 // if true, use force-pull when pulling changes, wiping any local changes
-	InitialDone   chan struct{}        // if InitialEvent true, this is pushed to after initial setup done
-	Events        chan Event           // when a change is detected, events are pushed here
-	Errors        chan error           // when an error occurs, errors come here instead of halting the loop
-
-	running  bool            // has the watcher started?
-	newRepos chan Repository // new repositories to add at runtime
+	Repositories     []Repository         // list of local or remote repository URLs to watch
+	Interval         time.Duration        // the interval between remote checks
+	Directory        string               // the directory to store repositories
+	Auth             transport.AuthMethod // authentication method for git operations
+	Groups           map[string]Group     // named groups of settings repositories can share
+	Discovery        []Discovery          // sources of more repositories to watch, checked for new ones periodically
+	InitialEvent     bool                 // if true, an event for each repo will be emitted upon construction
+	OrderedEvents    bool                 // if true, events are delivered one at a time in the order of Repositories, each waiting until the last is read
+	EventDelivery    EventDelivery        // how events wait to be read from Events, see DeliverBuffer
+	EventQueue       int                  // if above 0, the events waiting to be read before emitting waits or, with DeliverDropOldest, the oldest is dropped
+	AllowDeletion    bool                 // if true and Recovery is unset, repository will be deleted upon error and re-cloned, as with RecoverReclone
+	Recovery         RecoveryStrategy     // what is done with a clone whose update failed, see RecoverReport
+	UseForce         bool                 // if true, use force-pull when pulling changes, wiping any local changes
+	ReuseSSH         bool                 // if true, SSH connections are kept open and shared by checks of repositories on the same server
+	BeforeUpdate     UpdateHook           // if set, called before a worktree is updated, an error defers the update until accepted
+	Policy           *Policy              // if set, rules every update must pass before the worktree is updated or an event emitted
+	ConfigWatch      *ConfigWatch         // if set, the configuration the session is reconciled with before every round of checks
+	BranchDeleted    BranchDeletionPolicy // what to do with a repository once its watched branch is deleted upstream
+	ErrorPolicy      ErrorPolicy          // whether a failing repository stops the session or is retried while the others are checked
+	FailingLimit     int                  // if above 0, under ErrorsResilient Run returns ErrAllFailing once every repository failed this many checks in a row or ran out of retries
+	Retry            RetryPolicy          // how repositories are retried when their checks fail, unless they set their own
+	Concurrency      int                  // if above 1, up to this many repositories are fetched at once during a round of checks
+	Depth            int                  // if above 0, repositories are cloned and fetched shallowly with this much history unless they set their own
+	OperationTimeout time.Duration        // if set, how long each clone, fetch, pull or push may take before it's abandoned and reported as an error
+	MaxDiffSize      int                  // if above 0, commit and digest events carry their unified diff, truncated to this many bytes
+	BumpRules        map[string]Bump      // the release each commit type implies, DefaultBumpRules if nil
+	Enrichers        []Enricher           // run in order on every event before it is delivered
+	Sinks            []Sink               // every event is also delivered to each of these
+	Exec             *ExecHook            // if set, a command run for each event of repositories without their own
+	ExecLimit        int                  // if above 0, at most this many exec hook commands run at once
+	Locker           Locker               // if set, a repository is only polled by the instance holding its lock
+	Audit            AuditLog             // if set, every change made to clones, deploy directories and push mirrors is recorded here
+	State            StateStore           // if set, each repository's last commit event is recorded here so a restarted session resumes from it
+	Storage          Storage              // if set, where clones are kept instead of under Directory on the local filesystem
+	Sharding         *Sharding            // if set, repositories are split between the instances sharing this configuration
+	SinkRetry        SinkRetry            // how deliveries to sinks are queued and retried
+	DeadLetter       DeadLetter           // if set, events a sink failed to receive after every retry are stored here
+	History          History              // if set, the record of past events Replay delivers again
+	BacklogLimit     int                  // the event backlog above which OnBacklog is called
+	OnBacklog        func(Status, bool)   // called with true when the event backlog rises above BacklogLimit and false when it drops back
+	BacklogPause     bool                 // if true, checks are skipped while the event backlog is above BacklogLimit
+	CloseTimeout     time.Duration        // how long Close waits for Run to return, 10 seconds if zero
+	AsyncHandlers    bool                 // if true, OnEvent and OnError handlers are called by a few worker goroutines, in no particular order
+	InitialDone      chan struct{}        // if InitialEvent true, this is pushed to after initial setup done
+	Events           chan Event           // when a change is detected, events are pushed here
+	Errors           chan error           // when an error occurs, errors come here instead of halting the loop
+	ErrorRecords     chan ErrorRecord     // if set, a structured record of each error sent to Errors is sent here too
+
+	running  int32                 // 1 while the daemon runs
+	lifeMu   sync.Mutex            // held to start or stop the daemon, and by onDaemon to run a function while it isn't running
+	repoMu   sync.RWMutex          // held by the daemon to replace Repositories, and by other goroutines to read it
+	started  chan struct{}         // closed once the daemon's loop has begun
+	stopping chan struct{}         // closed by Shutdown to stop the daemon after its current check
+	stopped  chan struct{}         // closed once the daemon has returned
+	addMu    sync.Mutex            // guards added
+	added    []Repository          // repositories given to Add, not yet picked up by the daemon
+	newRepos chan struct{}         // signals the daemon that repositories were added
+	control  chan func()           // functions to run on the daemon's goroutine between checks
+	state    map[string]*repoState // per-repository state, keyed by full path
+
+	sinkMu        sync.RWMutex             // held by the daemon to replace sinkQueues, and by other goroutines to read it
+	sinkQueues    []*sinkQueue             // delivery queues for each of the sinks
+	pendingEvents int32                    // events waiting to be read from Events
+	droppedEvents uint64                   // events DeliverDropOldest dropped
+	eventMu       sync.Mutex               // guards eventQueue
+	eventQueue    []Event                  // events waiting for the delivery goroutine
+	eventOnce     sync.Once                // starts the delivery goroutine
+	eventQueued   chan struct{}            // signals the delivery goroutine that events were queued
+	eventRoom     chan struct{}            // signals waiting emitters that the queue has room
+	lastCheck     int64                    // when the last round of checks finished, in Unix nanoseconds
+	throttleMu    sync.Mutex               // guards throttles
+	throttles     map[string]*hostThrottle // hosts that have rate limited the watcher
+	retryMu       sync.Mutex               // guards retrying
+	retrying      map[string]RetryState    // repositories whose last check failed, by the path of their clone
+	backpressured int32                    // 1 while the backlog is above BacklogLimit
+	sshPool       sshPool                  // pooled SSH connections, used if ReuseSSH is set
+	execMu        sync.Mutex               // guards execRunners
+	execRunners   map[string]*execRunner   // runs each repository's exec hooks, keyed by full path
+	execSlots     chan struct{}            // limits the exec hook commands running at once to ExecLimit
+	hooks         sync.WaitGroup           // the goroutines running exec hooks
+	sendMu        sync.RWMutex             // held to send on Events, Errors and ErrorRecords, and to close them
+	chansClosed   bool                     // whether Shutdown closed Events, Errors and ErrorRecords
+	members       []string                 // the live shard members, sorted, as of the last round of checks
+	memberName    string                   // this instance's name among the shard members
+	discoveredAt  []time.Time              // when each of the session's Discovery last ran
+	closeOnce     sync.Once                // makes Close idempotent
+	closeErr      error                    // what the first Close found wrong, returned by every call
+	trace         string                   // the trace ID of the daemon's current round of checks, see beginTrace
+	roundAt       time.Time                // when the last full round of checks began, see fullRound
+	configSum     [sha256.Size]byte        // the contents of the ConfigWatch file last handled
+	configErr     string                   // the last error reported for the ConfigWatch file, so it's reported once
+	handlerMu     sync.Mutex               // guards eventHandlers and errorHandlers
+	eventHandlers []func(Event)            // registered with OnEvent
+	errorHandlers []func(error)            // registered with OnError
+	handlerOnce   sync.Once                // starts the handler workers
+	handlerCalls  chan func()              // handler calls waiting for the workers, if AsyncHandlers is set
 
 	ctx context.Context
 	cf  context.CancelFunc
 }
 
+// EventType describes the kind of change an Event represents
+type EventType int
+
+const (
+	// EventCommit is emitted when a watched branch receives new commits
+	EventCommit EventType = iota
+	// EventTagDeleted is emitted when a previously seen tag is removed from
+	// the remote
+	EventTagDeleted
+	// EventBranchDeleted is emitted when the watched branch no longer exists
+	// on the remote
+	EventBranchDeleted
+	// EventNotes is emitted when git notes are added or updated
+	EventNotes
+	// EventPullRequest is emitted when a pull or merge request is opened or
+	// its head is updated
+	EventPullRequest
+	// EventDigest is emitted once per digest period and lists the commits
+	// made since the previous digest
+	EventDigest
+	// EventReleasePruned is emitted when an old release is removed from a
+	// repository's deploy directory
+	EventReleasePruned
+	// EventRefCreated is emitted when a ref appears on the remote of a
+	// clone-less repository
+	EventRefCreated
+	// EventRefMoved is emitted when a ref on the remote of a clone-less
+	// repository points at a different object
+	EventRefMoved
+	// EventRefDeleted is emitted when a ref disappears from the remote of a
+	// clone-less repository
+	EventRefDeleted
+	// EventPolicyViolation is emitted when an update breaks the session's
+	// Policy and isn't checked out
+	EventPolicyViolation
+	// EventConfigApplied is emitted when the session's ConfigWatch file has
+	// changed and the session was reconciled with it
+	EventConfigApplied
+	// EventConfigError is emitted when the session's ConfigWatch file couldn't
+	// be read or applied, the session carries on as it was
+	EventConfigError
+	// EventTagCreated is emitted when a tag is pushed to the remote, or an
+	// existing tag is moved to another commit
+	EventTagCreated
+)
+
+// eventTypeNames are the names of event types, indexed by type
+var eventTypeNames = []string{
+	EventCommit:          "commit",
+	EventTagDeleted:      "tag-deleted",
+	EventBranchDeleted:   "branch-deleted",
+	EventNotes:           "notes",
+	EventPullRequest:     "pull-request",
+	EventDigest:          "digest",
+	EventReleasePruned:   "release-pruned",
+	EventRefCreated:      "ref-created",
+	EventRefMoved:        "ref-moved",
+	EventRefDeleted:      "ref-deleted",
+	EventPolicyViolation: "policy-violation",
+	EventConfigApplied:   "config-applied",
+	EventConfigError:     "config-error",
+	EventTagCreated:      "tag-created",
+}
+
+func (t EventType) String() string {
+	if t >= 0 && int(t) < len(eventTypeNames) {
+		return eventTypeNames[t]
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
 // Event represents an update detected on one of the watched repositories
 type Event struct {
-	URL       string
-	Path      string
-	Timestamp time.Time
-	commit    object.Commit
+	Type        EventType         `json:"type"`
+	URL         string            `json:"url"`
+	Path        string            `json:"path"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Branch      string            `json:"branch,omitempty"`       // the name of the branch, for branch events and commits to a watched branch
+	Tag         string            `json:"tag,omitempty"`          // the name of the tag, for tag events
+	TagMessage  string            `json:"tag_message,omitempty"`  // the message of an annotated tag, for tag events
+	Notes       []Note            `json:"notes,omitempty"`        // the notes that were added or updated, for notes events
+	PullRequest int               `json:"pull_request,omitempty"` // the pull or merge request number, for pull request events and commits that merge one
+	Summary     *Summary          `json:"summary,omitempty"`      // aggregate details, for events covering more than one commit
+	Trailers    Trailers          `json:"trailers,omitempty"`     // the trailers of the commit message, such as Signed-off-by, for commit events
+	CommitTypes []CommitType      `json:"commit_types,omitempty"` // the Conventional Commits classification of each new commit, newest first, for commit and digest events
+	Bump        Bump              `json:"bump,omitempty"`         // the release the new commits imply under the session's BumpRules, for commit and digest events
+	Changelog   string            `json:"changelog,omitempty"`    // the new commits rendered by a Changelog enricher
+	Owners      []string          `json:"owners,omitempty"`       // owners of the changed files according to the repository's CODEOWNERS file
+	Changed     []string          `json:"changed,omitempty"`      // the paths of the files added, modified or removed since the previous event, sorted
+	Files       []FileChange      `json:"files,omitempty"`        // the changed files among the repository's WatchFiles
+	Components  []string          `json:"components,omitempty"`   // the names of the repository's Components with changed files, sorted
+	Diff        string            `json:"diff,omitempty"`         // the unified diff of the change, if the session's MaxDiffSize is set
+	DiffCut     bool              `json:"diff_cut,omitempty"`     // true if Diff was truncated to MaxDiffSize
+	Mirror      string            `json:"mirror,omitempty"`       // the mirror the change was fetched from, if the primary URL couldn't be reached
+	Release     string            `json:"release,omitempty"`      // the release directory the change was deployed to, or that was pruned
+	Ref         string            `json:"ref,omitempty"`          // the full name of the ref, for ref events
+	From        string            `json:"from,omitempty"`         // the hash the ref pointed at before, for ref events and forced updates
+	To          string            `json:"to,omitempty"`           // the hash the ref points at now, for ref events and forced updates
+	Forced      bool              `json:"forced,omitempty"`       // true if the branch was force-pushed or rewound, so From isn't an ancestor of To
+	Annotations map[string]string `json:"annotations,omitempty"`  // free-form values set by the session's enrichers
+	Replayed    bool              `json:"replayed,omitempty"`     // true if the event was delivered before and is repeated by Replay
+	Violations  []string          `json:"violations,omitempty"`   // the rules of the session's Policy the update breaks, for policy violation events
+	TraceID     string            `json:"trace_id,omitempty"`     // identifies the round of checks, or webhook delivery, that caused the event
+	Error       string            `json:"error,omitempty"`        // why the configuration couldn't be applied, for config error events
+	commit      object.Commit
+	commits     []object.Commit
+}
+
+// Note is a git note attached to a commit
+type Note struct {
+	Ref     string        `json:"ref"`     // the notes reference, such as `refs/notes/commits`
+	Commit  plumbing.Hash `json:"commit"`  // the commit the note is attached to
+	Message string        `json:"message"` // the contents of the note
 }
 
 // Commit returns the (immutable) commit associated with an event
@@ -64,6 +283,26 @@ func (e Event) Commit() object.Commit {
 	return e.commit
 }
 
+// Commits returns the (immutable) commits a digest event covers, or a commit
+// event of a repository with AllCommits, newest first
+func (e Event) Commits() []object.Commit {
+	return e.commits
+}
+
+// WithCommit returns a copy of the event with its commit replaced, to build
+// events such as those a fake Watcher emits.
+func (e Event) WithCommit(c object.Commit) Event {
+	e.commit = c
+	return e
+}
+
+// WithCommits returns a copy of the event with the commits it covers replaced,
+// newest first.
+func (e Event) WithCommits(commits []object.Commit) Event {
+	e.commits = commits
+	return e
+}
+
 // New constructs a new git watch session on the given repositories
 // The `auth` parameter is the default authentication method. Elements of the
 // `repos` list may specify their own authentication methods, which override
@@ -93,6 +332,13 @@ func New(
 		InitialEvent: initialEvent,
 		InitialDone:  make(chan struct{}, 1),
 
+		started:  make(chan struct{}),
+		stopping: make(chan struct{}),
+		stopped:  make(chan struct{}),
+		newRepos: make(chan struct{}, 1),
+		control:  make(chan func()),
+		state:    make(map[string]*repoState),
+
 		ctx: ctx2,
 		cf:  cf,
 	}
@@ -104,35 +350,130 @@ func (s *Session) Run() (err error) {
 	return s.daemon()
 }
 
-// IsRunning returns true if `Run` has been called
+// IsRunning returns true if `Run` has been called and the session hasn't
+// stopped since. It's safe to call from any goroutine.
 func (s *Session) IsRunning() bool {
-	return s.running
+	return atomic.LoadInt32(&s.running) == 1
 }
 
-// Add will add a new repository to the list. Works even after the watcher
-// daemon has already been started.
-func (s *Session) Add(r Repository) (err error) {
-	r, err = hydrate(s.Directory, r)
-	if err != nil {
-		return
+// setRunning marks the daemon as running or not, once any function onDaemon is
+// running directly has returned.
+func (s *Session) setRunning(running bool) {
+	s.lifeMu.Lock()
+	defer s.lifeMu.Unlock()
+	var flag int32
+	if running {
+		flag = 1
 	}
-	if s.running {
-		s.newRepos <- r
-	} else {
-		s.Repositories = append(s.Repositories, r)
+	atomic.StoreInt32(&s.running, flag)
+}
+
+// setRepos replaces Repositories. It's only called by the daemon, or by
+// functions onDaemon runs while it isn't running.
+func (s *Session) setRepos(repos []Repository) {
+	s.repoMu.Lock()
+	defer s.repoMu.Unlock()
+	s.Repositories = repos
+}
+
+// Started returns a channel closed once the daemon has finished its initial
+// checks and begun its loop, from which point Add, Notify and the other
+// calls made while running are served.
+func (s *Session) Started() <-chan struct{} {
+	return s.started
+}
+
+// Add will add a new repository to the list, whether or not the session has
+// been started. Repositories added before Run are part of the initial checks,
+// those added after are checked straight away, with an initial event if
+// InitialEvent is set. A session can be created with no repositories and fed
+// them this way.
+func (s *Session) Add(r Repository) (err error) {
+	return s.AddAll([]Repository{r})
+}
+
+// takeAdded moves the repositories given to Add and AddAll into Repositories
+// and returns them. It's only called by the daemon.
+func (s *Session) takeAdded() []Repository {
+	s.addMu.Lock()
+	added := s.added
+	s.added = nil
+	s.addMu.Unlock()
+	s.setRepos(append(s.Repositories, added...))
+	return added
+}
+
+// checkAdded checks the repositories added since the last round of checks
+func (s *Session) checkAdded() {
+	s.beginTrace("")
+	s.checkNew(s.takeAdded())
+}
+
+// checkNew checks repositories that just joined the session
+func (s *Session) checkNew(repos []Repository) {
+	for _, repository := range repos {
+		if err := s.checkOne(repository, s.InitialEvent); err != nil {
+			s.reportError(ErrorRecord{Op: "check", URL: repository.URL}, errors.Wrapf(err, "failed to check %s", repository.URL))
+		}
 	}
-	return
 }
 
-// Close gracefully shuts down the git watcher
-func (s *Session) Close() {
+// Close stops the git watcher, cancelling any checks in progress, and waits,
+// up to CloseTimeout, for Run to return. See Shutdown to let them finish
+// first. It's safe to call more than once and from several goroutines, every
+// call returns the same error: nil if the session stopped cleanly, otherwise a
+// description of what it left behind.
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() { s.closeErr = s.finish(nil) })
+	return s.closeErr
+}
+
+// finish cancels the session and waits for Run to return, reporting what it
+// left behind along with any earlier problems.
+func (s *Session) finish(problems []string) error {
 	s.cf()
-	s.running = false
+
+	stopped := true
+	if s.IsRunning() {
+		timeout := s.CloseTimeout
+		if timeout <= 0 {
+			timeout = 10 * time.Second
+		}
+		select {
+		case <-s.stopped:
+		case <-time.After(timeout):
+			stopped = false
+			problems = append(problems, fmt.Sprintf("checks still running after %s", timeout))
+		}
+	}
+	// a daemon still running clears running itself once it returns, until
+	// then onDaemon mustn't take its place
+	s.sshPool.close()
+
+	if n := s.eventBacklog(); n > 0 {
+		problems = append(problems, fmt.Sprintf("%d events never read from Events", n))
+	}
+	if stopped {
+		if n := s.Status().PendingDeliveries; n > 0 {
+			problems = append(problems, fmt.Sprintf("%d events never delivered to sinks", n))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("session did not shut down cleanly: %s", strings.Join(problems, ", "))
+	}
+	return nil
 }
 
 func (s *Session) daemon() (err error) {
-	s.running = true
-	t := time.NewTicker(s.Interval)
+	s.setRunning(true)
+	defer close(s.stopped)
+	defer s.setRunning(false)
+	defer s.releaseLocks()
+	defer s.leaveMembers()
+	s.startSinks()
+	tick := s.tick()
+	t := time.NewTicker(tick)
+	defer func() { t.Stop() }()
 
 	// a function to select over the session's context and the ticker to check
 	// repositories.
@@ -140,17 +481,27 @@ func (s *Session) daemon() (err error) {
 		select {
 		case <-s.ctx.Done():
 			err = s.ctx.Err()
+		case <-s.stopping:
+			err = context.Canceled
 		case <-t.C:
+			if s.BacklogPause && s.backlogged() {
+				return nil
+			}
 			err = s.checkRepos(false)
 			if err != nil {
+				if errors.Cause(err) == ErrAllFailing {
+					return err
+				}
 				if xerrors.Is(err, io.EOF) {
 					return nil
 				}
-				s.Errors <- err
+				s.reportError(ErrorRecord{Op: "check"}, err)
 				return nil
 			}
-		case r := <-s.newRepos:
-			s.Repositories = append(s.Repositories, r)
+		case <-s.newRepos:
+			s.checkAdded()
+		case f := <-s.control:
+			f()
 		}
 		return
 	}
@@ -163,12 +514,19 @@ func (s *Session) daemon() (err error) {
 		return
 	}
 	s.InitialDone <- struct{}{}
+	close(s.started)
 
 	for {
 		err = f()
 		if err != nil {
 			return
 		}
+		// repositories with intervals of their own may have come or gone
+		if next := s.tick(); next != tick {
+			t.Stop()
+			tick = next
+			t = time.NewTicker(tick)
+		}
 	}
 }
 
@@ -197,6 +555,7 @@ func hydrate(root string, r Repository) (Repository, error) {
 	} else {
 		directory = r.Directory
 	}
+	r.URL = normaliseAzureURL(r.URL)
 	r.fullPath = filepath.Join(root, directory)
 	return r, nil
 }
@@ -204,25 +563,118 @@ func hydrate(root string, r Repository) (Repository, error) {
 // checkRepos simply iterates all repositories and collects events from them, if
 // there are any, they will be emitted to the Events channel concurrently.
 func (s *Session) checkRepos(initial bool) (err error) {
-	for _, repository := range s.Repositories {
-		var event *Event
-		event, err = s.checkRepo(repository, initial)
-		if err != nil {
+	defer s.pruneRepos()
+	s.beginTrace("")
+	full := s.fullRound()
+	if full && s.readsConfig() {
+		s.reconcileConfig(initial)
+	}
+	s.takeAdded()
+
+	if full {
+		if err = s.refreshMembers(); err != nil {
 			return
 		}
+	}
+	if err = s.discoverRepos(initial); err != nil {
+		return
+	}
+	if s.ErrorPolicy == ErrorsResilient {
+		err = s.checkResiliently(initial)
+	} else {
+		s.checkEach(initial, func(repository Repository, checkErr error) bool {
+			if checkErr == nil {
+				return true
+			}
+			if initial {
+				// Run stops with the first error, so the rest needn't be checked
+				err = checkErr
+				return false
+			}
+			if !xerrors.Is(checkErr, io.EOF) {
+				s.reportError(ErrorRecord{Op: "check", URL: repository.URL}, checkErr)
+			}
+			return true
+		})
+	}
+	if err != nil {
+		return
+	}
+	// the round finished, even if some repositories failed: they're listed
+	// in Status().Retrying and don't make the session unhealthy
+	atomic.StoreInt64(&s.lastCheck, time.Now().UnixNano())
+	return
+}
+
+// polled reports whether a round of checks covers a repository. Those fed by
+// webhooks are only polled until their first successful check.
+func (s *Session) polled(repository Repository) bool {
+	return !s.withGroup(repository).Webhook || !s.stateOf(repository).checked
+}
+
+// checkOne checks a single repository, unless it's paused, belongs to another
+// shard member or its host is throttled, and emits any events.
+func (s *Session) checkOne(repository Repository, initial bool) (err error) {
+	repository, due, err := s.beforeCheck(repository)
+	if !due {
+		return err
+	}
+	events, err := s.checkRepo(repository, initial)
+	return s.afterCheck(repository, events, err)
+}
 
-		if event != nil {
-			go func() { s.Events <- *event }()
+// beforeCheck returns the repository with its group's settings and whether it
+// is due a check: not paused, owned by this shard member, locked by this
+// instance and not on a throttled host.
+func (s *Session) beforeCheck(repository Repository) (r Repository, due bool, err error) {
+	if st := s.stateOf(repository); st.parked || st.rolledBack || s.backingOff(st) || s.busy(repository) {
+		return repository, false, nil
+	}
+	repository = s.withGroup(repository)
+	if !s.owns(repository) {
+		return repository, false, nil
+	}
+
+	if held, err := s.holdsLock(repository); !held {
+		return repository, false, err
+	}
+	return repository, !s.throttled(repoHost(repository.URL)), nil
+}
+
+// afterCheck handles the outcome of checking a repository: a rate limit
+// throttles its host, otherwise any events are emitted.
+func (s *Session) afterCheck(repository Repository, events []Event, err error) error {
+	host := repoHost(repository.URL)
+	if err != nil {
+		if delay, limited := rateLimitDelay(err); limited {
+			until := s.throttle(host, delay)
+			s.reportError(ErrorRecord{Op: "check", URL: repository.URL}, errors.Wrapf(err, "rate limited by %s, checks paused until %s", host, until.Format(time.RFC3339)))
+			return nil
+		}
+		if s.ctx.Err() != nil {
+			return err
 		}
+		return s.retryLater(repository, err)
 	}
-	return
+	s.unthrottle(host)
+	s.retried(repository)
+	s.stateOf(repository).checked = true
+
+	for _, event := range events {
+		s.emit(repository, event)
+	}
+	return nil
 }
 
 // checkRepo checks a specific git repository that may or may not exist locally
 // and if there are changes or the repository had to be cloned fresh (and
-// InitialEvents is true) then an event is returned.
-func (s *Session) checkRepo(repository Repository, initial bool) (event *Event, err error) {
-	repo, err := git.PlainOpen(repository.fullPath)
+// InitialEvents is true) then events are returned.
+func (s *Session) checkRepo(repository Repository, initial bool) (events []Event, err error) {
+	if repository.RefsOnly {
+		return s.checkRefTable(repository)
+	}
+
+	repo, err := s.openRepo(repository)
 	if err != nil {
 		if err != git.ErrRepositoryNotExists {
 			err = errors.Wrap(err, "failed to open local repo")
@@ -234,49 +686,195 @@ func (s *Session) checkRepo(repository Repository, initial bool) (event *Event,
 			return
 		}
 	}
+	repo = openShallow(repo)
 
-	// always generate an event for the initial check
-	if initial {
-		return GetEventFromRepo(repo)
+	// remember where the branch was before anything is pulled so the first
+	// event after startup can be compared against it, or where the last event
+	// was if the session's State recorded it before a restart.
+	state := s.stateOf(repository)
+	catchUp := false
+	if state.lastEvent.IsZero() {
+		head, err := s.watchedHead(repo, repository)
+		if err == nil {
+			state.lastEvent = head
+			state.lastDigest = head
+			state.lastDigestAt = time.Now()
+			state.observed = head
+		}
+		if last := s.recordedEvent(repo, repository); !last.IsZero() {
+			state.lastEvent = last
+			state.lastDigest = last
+			state.observed = last
+			// the clone was updated but the event for it never sent
+			catchUp = err == nil && head != last && !repository.observed()
+			initial = false
+		}
 	}
 
-	// otherwise, check for new events - if there are any changes, `event` will
-	// not be nil.
-	evt, err := s.GetEventFromRepoChanges(repo, repository.Branch, repository.Auth)
-	if err != nil {
-		if s.AllowDeletion {
-			// fresh start if there was a failure
-			if err := os.RemoveAll(repository.fullPath); err != nil {
-				return nil, errors.Wrap(err, "failed to remove repository for re-clone")
+	// always generate an event for the initial check, otherwise, check for new
+	// events - if there are any changes, `event` will not be nil.
+	var event *Event
+	if initial || catchUp {
+		event, err = GetEventFromRepo(repo)
+	} else {
+		if repository.observed() {
+			event, err = s.observeChanges(repo, repository)
+		} else if s.ReuseSSH && isSSHURL(repository.URL) {
+			// only pay for a full fetch once the pooled listing shows a change
+			var moved bool
+			moved, err = s.branchMoved(repo, repository)
+			if moved || err != nil && len(repository.Mirrors) > 0 && failsOver(err) && !s.busy(repository) {
+				event, err = s.pullWithMirrors(repo, repository)
 			}
+		} else {
+			event, err = s.pullWithMirrors(repo, repository)
+		}
+		if err == nil {
+			state.branchDeleted = false
+		} else if s.isBranchDeleted(repo, repository, err) {
+			event, err = s.branchDeleted(repo, repository)
+		} else if s.recovery() != RecoverReport && !repository.observed() && s.ctx.Err() == nil && !transient(err) {
+			// recover from the failure, unless the remote couldn't be reached,
+			// when a reset or new clone would fail too
+			repo, event, err = s.recoverRepo(repo, repository, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if event != nil && event.Type == EventCommit {
+		event, err = s.processCommitEvent(repo, repository, event, initial)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if event == nil {
+		event = s.pendingEvent(repository)
+	}
+	if event == nil && repository.Digest > 0 {
+		event, err = s.digestEvent(repo, repository)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if event != nil {
+		events = append(events, *event)
+	}
 
-			repo, err = s.cloneRepo(repository)
+	if repository.WatchTags {
+		var tagEvents []Event
+		tagEvents, err = s.checkTags(repo, repository)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, tagEvents...)
+	}
+
+	// a failed push doesn't hold back the events, it's retried next check
+	if repository.PushMirror != "" {
+		if err := s.pushMirror(repo, repository, len(events) > 0); err != nil {
+			s.reportError(ErrorRecord{Op: "push", URL: repository.URL}, err)
+		}
+	}
+
+	if repository.Deploy.Dir != "" {
+		release, pruned, err := s.deploy(repo, repository)
+		if err != nil {
+			s.reportError(ErrorRecord{Op: "deploy", URL: repository.URL}, err)
+		}
+		for i := range events {
+			if events[i].Type == EventCommit || events[i].Type == EventDigest {
+				events[i].Release = release
+			}
+		}
+		for _, path := range pruned {
+			event, err := newEvent(repo, EventReleasePruned)
 			if err != nil {
-				return nil, errors.Wrap(err, "failed to clone repository for re-clone")
+				return nil, err
 			}
-			return GetEventFromRepo(repo)
-		} else {
+			event.Release = path
+			event.Timestamp = time.Now()
+			events = append(events, event)
+		}
+	}
+
+	if len(repository.Branches) > 0 {
+		var branchEvents []Event
+		branchEvents, err = s.checkBranches(repo, repository)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, branchEvents...)
+	}
+
+	if repository.WatchNotes {
+		var notesEvents []Event
+		notesEvents, err = s.checkNotes(repo, repository)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, notesEvents...)
+	}
+
+	if repository.WatchPulls {
+		var pullEvents []Event
+		pullEvents, err = s.checkPulls(repo, repository)
+		if err != nil {
 			return nil, err
 		}
+		events = append(events, pullEvents...)
 	}
-	return evt, nil
+	return
+}
+
+// recloneRepo removes the local copy of a repository and clones it again.
+func (s *Session) recloneRepo(repository Repository) (repo *git.Repository, event *Event, err error) {
+	started := time.Now()
+	defer func() { s.audit(repository, AuditEntry{Op: AuditReclone}, started, err) }()
+
+	if err = s.removeRepo(repository); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to remove repository for re-clone")
+	}
+
+	repo, err = s.cloneRepo(repository)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to clone repository for re-clone")
+	}
+
+	event, err = GetEventFromRepo(repo)
+	return
 }
 
-// cloneRepo clones the specified repository to the session's cache.
+// cloneRepo clones the specified repository to the session's cache, falling
+// back to its mirrors if the primary URL can't be reached.
 func (s *Session) cloneRepo(repository Repository) (repo *git.Repository, err error) {
+	repo, err = s.cloneRepoFrom(repository)
+	if err != nil && len(repository.Mirrors) > 0 && failsOver(err) && !s.busy(repository) {
+		started := time.Now()
+		s.audit(repository, AuditEntry{Op: AuditDelete}, started, s.removeRepo(repository))
+		return s.cloneFromMirror(repository, err)
+	}
+	return
+}
+
+// cloneRepoFrom clones a repository from its URL.
+func (s *Session) cloneRepoFrom(repository Repository) (repo *git.Repository, err error) {
 	var ref plumbing.ReferenceName
 	if repository.Branch != "" {
 		ref = plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", repository.Branch))
 	}
 
-	repo, err = git.PlainCloneContext(s.ctx, repository.fullPath, false, &git.CloneOptions{
+	started := time.Now()
+	repo, err = s.cloneInto(repository, &git.CloneOptions{
 		Auth:              s.chooseAuth(repository.Auth),
 		URL:               repository.URL,
 		ReferenceName:     ref,
 		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+		Depth:             s.depth(repository),
 	})
+	s.audit(repository, AuditEntry{Op: AuditClone}, started, err)
 	if err != nil {
-		err = errors.Wrap(err, "failed to clone initial copy of repository")
+		err = withStage(StageClone, errors.Wrap(err, "failed to clone initial copy of repository"))
 		return
 	}
 	return
@@ -285,6 +883,17 @@ func (s *Session) cloneRepo(repository Repository) (repo *git.Repository, err er
 // GetEventFromRepoChanges reads a locally cloned git repository an returns an
 // event only if an attempted fetch resulted in new changes in the working tree.
 func (s *Session) GetEventFromRepoChanges(repo *git.Repository, branch string, auth transport.AuthMethod) (event *Event, err error) {
+	return s.pullChanges(repo, "origin", Repository{Branch: branch, Auth: auth})
+}
+
+// pullChanges pulls the repository's branch from the named remote and returns
+// an event if anything changed.
+func (s *Session) pullChanges(repo *git.Repository, remote string, repository Repository) (event *Event, err error) {
+	if s.gated() {
+		return s.vetoablePull(repo, remote, repository)
+	}
+
+	branch, auth := repository.Branch, repository.Auth
 	wt, err := repo.Worktree()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get worktree")
@@ -295,30 +904,93 @@ func (s *Session) GetEventFromRepoChanges(repo *git.Repository, branch string, a
 		ref = plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", branch))
 	}
 
-	err = wt.Pull(&git.PullOptions{
-		Auth:              s.chooseAuth(auth),
-		ReferenceName:     ref,
-		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
-		Force:             s.UseForce,
+	var from, to string
+	if head, err := repo.Head(); err == nil {
+		from = head.Hash().String()
+	}
+	ctx, cancel := s.opContext(repository)
+	defer cancel()
+	started := time.Now()
+	err = s.within(ctx, repository, func() error {
+		return wt.PullContext(ctx, &git.PullOptions{
+			RemoteName:        remote,
+			Auth:              s.chooseAuth(auth),
+			ReferenceName:     ref,
+			RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+			Depth:             s.depth(repository),
+			Force:             s.UseForce,
+		})
 	})
+	err = s.timedOut(ctx, repository, err)
+	if err == git.ErrNonFastForwardUpdate && (s.UseForce || s.depth(repository) > 0) {
+		// go-git won't pull a rewritten branch even with Force, and after more
+		// commits than Depth a shallow clone's fetched history no longer
+		// reaches the old head, either way follow the branch to what was fetched
+		err = resetToFetched(repo, wt, remote, branch, s.UseForce)
+	}
+	if head, err := repo.Head(); err == nil && head.Hash().String() != from {
+		to = head.Hash().String()
+	}
+	s.audit(repository, AuditEntry{Op: AuditPull, From: from, To: to}, started, err)
 	if err != nil {
 		if err == git.NoErrAlreadyUpToDate {
 			return nil, nil
 		}
-		return nil, errors.Wrap(err, "failed to pull local repo")
+		return nil, withStage(StagePull, errors.Wrap(err, "failed to pull local repo"))
 	}
+	// the pull also fetches the remote's other branches, which may be all
+	// that moved
+	return changedEvent(repo, from, to)
+}
 
-	return GetEventFromRepo(repo)
+// resetToFetched moves a branch and the worktree to what was just fetched for
+// it from the remote, discarding local changes if `hard` is set.
+func resetToFetched(repo *git.Repository, wt *git.Worktree, remote, branch string, hard bool) error {
+	if branch == "" {
+		head, err := repo.Head()
+		if err != nil {
+			return errors.Wrap(err, "failed to get head")
+		}
+		branch = head.Name().Short()
+	}
+	fetched, err := repo.Reference(plumbing.NewRemoteReferenceName(remote, branch), true)
+	if err != nil {
+		return errors.Wrap(err, "failed to find fetched branch")
+	}
+	mode := git.MergeReset
+	if hard {
+		mode = git.HardReset
+	}
+	return wt.Reset(&git.ResetOptions{Commit: fetched.Hash(), Mode: mode})
+}
+
+// markForced flags an event whose commit doesn't descend from `old`, the
+// commit the branch was at before, as a forced update from one to the other.
+// Shallow clones can't tell, so their events are never flagged, nor are those
+// whose old commit was never fetched.
+func markForced(repo *git.Repository, event *Event, old plumbing.Hash) error {
+	if _, shallow := repo.Storer.(shallowStorage); shallow || old.IsZero() || old == event.commit.Hash {
+		return nil
+	}
+	if _, err := repo.CommitObject(old); err != nil {
+		return nil
+	}
+	ff, err := isAncestor(repo, old, event.commit.Hash)
+	if err != nil {
+		return err
+	}
+	if !ff {
+		event.Forced = true
+		event.From = old.String()
+		event.To = event.commit.Hash.String()
+	}
+	return nil
 }
 
 // GetEventFromRepo reads a locally cloned git repository and returns an event
 // based on the most recent commit.
 func GetEventFromRepo(repo *git.Repository) (event *Event, err error) {
-	wt, err := repo.Worktree()
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to get worktree")
-	}
-	remote, err := repo.Remote("origin")
+	e, err := newEvent(repo, EventCommit)
 	if err != nil {
 		return
 	}
@@ -330,14 +1002,44 @@ func GetEventFromRepo(repo *git.Repository) (event *Event, err error) {
 	if err != nil {
 		return
 	}
-	return &Event{
-		URL:       remote.Config().URLs[0],
-		Path:      wt.Filesystem.Root(),
-		Timestamp: c.Author.When,
-		commit:    *c,
+	e.Timestamp = c.Author.When
+	e.commit = *c
+	return &e, nil
+}
+
+// newEvent creates an event of the given type with the fields that describe
+// the repository itself filled in.
+func newEvent(repo *git.Repository, t EventType) (event Event, err error) {
+	path, err := repoPath(repo)
+	if err != nil {
+		return
+	}
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return
+	}
+	return Event{
+		Type: t,
+		URL:  remote.Config().URLs[0],
+		Path: path,
 	}, nil
 }
 
+// repoPath returns the root of a repository's worktree, or its own directory
+// if it's bare.
+func repoPath(repo *git.Repository) (string, error) {
+	wt, err := repo.Worktree()
+	if err == git.ErrIsBareRepository {
+		if st, ok := repo.Storer.(interface{ Filesystem() billy.Filesystem }); ok {
+			return st.Filesystem().Root(), nil
+		}
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get worktree")
+	}
+	return wt.Filesystem.Root(), nil
+}
+
 // GetRepoDirectory the directory name for a repository.
 func GetRepoDirectory(repo string) (string, error) {
 	if strings.HasPrefix(repo, "http") {
@@ -360,6 +1062,15 @@ func GetRepoDirectory(repo string) (string, error) {
 	}
 }
 
+// depth returns how many commits of history a repository is cloned and
+// fetched with, zero for all of it.
+func (s *Session) depth(repository Repository) int {
+	if repository.Depth > 0 {
+		return repository.Depth
+	}
+	return s.Depth
+}
+
 func (s *Session) chooseAuth(a transport.AuthMethod) transport.AuthMethod {
 	if a != nil {
 		return a
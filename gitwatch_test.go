@@ -1,18 +1,48 @@
 package gitwatch_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/Southclaws/gitwatch"
+	"github.com/Southclaws/gitwatch/gitwatchtest"
 	"github.com/bmizerany/assert"
+	_ "github.com/mattn/go-sqlite3"
+	cryptossh "golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-billy.v4/util"
 	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	gitserver "gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
 )
 
 var (
@@ -20,6 +50,7 @@ var (
 	ctx     context.Context
 	cf      context.CancelFunc
 	initial time.Time
+	server  *gitwatchtest.Server
 )
 
 func TestMain(m *testing.M) {
@@ -27,19 +58,22 @@ func TestMain(m *testing.M) {
 
 	mockRepo("a")
 	mockRepo("b")
+	mockRepoTag("a", "v1")
 	err = os.RemoveAll("./test/gitwatch.git")
 	if err != nil {
 		panic(err)
 	}
+	server = gitwatchtest.NewServer()
+	remote := server.Seed("gitwatch.git", map[string]string{"README.md": "gitwatch"})
 
 	log.Println("creating global watcher")
 	ctx, cf = context.WithCancel(context.Background())
 	gw, err = gitwatch.New(
 		ctx,
 		[]gitwatch.Repository{
-			{URL: "./test/local/a"},
+			{URL: "./test/local/a", WatchTags: true},
 			{URL: "./test/local/b"},
-			{URL: "https://github.com/Southclaws/gitwatch.git"},
+			{URL: remote.URL()},
 		},
 		time.Second,
 		"./test/",
@@ -79,6 +113,7 @@ func TestMain(m *testing.M) {
 	ret := m.Run()
 
 	gw.Close()
+	server.Close()
 
 	os.Exit(ret)
 }
@@ -93,6 +128,21 @@ func consumeAndAssert(t *testing.T, events chan gitwatch.Event, expected gitwatc
 	assertEventsEqual(t, expected, <-events)
 }
 
+// nextEvent reads the session's next event, failing the test if an error comes
+// first or nothing arrives in time
+func nextEvent(t *testing.T, session *gitwatch.Session) gitwatch.Event {
+	t.Helper()
+	select {
+	case e := <-session.Events:
+		return e
+	case err := <-session.Errors:
+		t.Fatal("error instead of an event:", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("no event")
+	}
+	return gitwatch.Event{}
+}
+
 func TestMakeChange1(t *testing.T) {
 	ts := mockRepoChange("a", "hello world!", false)
 	consumeAndAssert(t, gw.Events, gitwatch.Event{
@@ -102,31 +152,4349 @@ func TestMakeChange1(t *testing.T) {
 	})
 }
 
-func TestMakeChange2(t *testing.T) {
-	tsa := mockRepoChange("a", "hello world!!", false)
-	consumeAndAssert(t, gw.Events, gitwatch.Event{
-		URL:       "./test/local/a",
-		Path:      fullPath("./test/a"),
-		Timestamp: tsa.Truncate(time.Second),
-	})
+func TestMakeChange2(t *testing.T) {
+	tsa := mockRepoChange("a", "hello world!!", false)
+	consumeAndAssert(t, gw.Events, gitwatch.Event{
+		URL:       "./test/local/a",
+		Path:      fullPath("./test/a"),
+		Timestamp: tsa.Truncate(time.Second),
+	})
+
+	tsb := mockRepoChange("b", "hello earth", false)
+	consumeAndAssert(t, gw.Events, gitwatch.Event{
+		URL:       "./test/local/b",
+		Path:      fullPath("./test/b"),
+		Timestamp: tsb.Truncate(time.Second),
+	})
+}
+
+func TestMakeChangeWithUntracked(t *testing.T) {
+	ts := mockRepoChange("a", "hello world!", true)
+	consumeAndAssert(t, gw.Events, gitwatch.Event{
+		URL:       "./test/local/a",
+		Path:      fullPath("./test/a"),
+		Timestamp: ts.Truncate(time.Second),
+	})
+}
+
+func TestTagDeleted(t *testing.T) {
+	mockRepoDeleteTag("a", "v1")
+	e := <-gw.Events
+	assert.Equal(t, gitwatch.EventTagDeleted, e.Type)
+	assert.Equal(t, "v1", e.Tag)
+	assert.Equal(t, "./test/local/a", e.URL)
+}
+
+func TestTagCreated(t *testing.T) {
+	source := server.Seed("tagged.git", map[string]string{"README.md": "tagged"})
+	err := os.RemoveAll("./test/tagged")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{{URL: source.URL(), WatchTags: true}},
+		100*time.Millisecond,
+		"./test/tagged/",
+		nil,
+		false,
+	)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	source.Tag("v1")
+	e := <-session.Events
+	assert.Equal(t, gitwatch.EventTagCreated, e.Type)
+	assert.Equal(t, "v1", e.Tag)
+	assert.Equal(t, "", e.TagMessage)
+
+	hash := source.Commit("release", map[string]string{"README.md": "released"})
+	e = <-session.Events
+	assert.Equal(t, gitwatch.EventCommit, e.Type)
+	err = source.Do(func(repo *git.Repository) error {
+		_, err := repo.CreateTag("v2", hash, &git.CreateTagOptions{Tagger: &gitwatchtest.Author, Message: "release 2"})
+		return err
+	})
+	assert.Equal(t, nil, err)
+	e = <-session.Events
+	assert.Equal(t, gitwatch.EventTagCreated, e.Type)
+	assert.Equal(t, "v2", e.Tag)
+	assert.Equal(t, "release 2\n", e.TagMessage)
+	assert.Equal(t, hash, e.Commit().Hash)
+
+	repo, err := git.PlainOpen("./test/tagged/tagged.git")
+	assert.Equal(t, nil, err)
+	_, err = repo.Tag("v2")
+	assert.Equal(t, nil, err)
+}
+
+func TestMirrorFailover(t *testing.T) {
+	mockRepo("mirror")
+	err := os.RemoveAll("./test/mirrored")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{
+			{URL: "./test/local/unreachable", Mirrors: []string{"./test/local/mirror"}},
+		},
+		100*time.Millisecond,
+		"./test/mirrored/",
+		nil,
+		false,
+	)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	mockRepoChange("mirror", "mirrored", false)
+	e := <-session.Events
+	assert.Equal(t, "./test/local/unreachable", e.URL)
+	assert.Equal(t, "./test/local/mirror", e.Mirror)
+}
+
+func TestPushMirror(t *testing.T) {
+	mockRepo("source")
+	err := os.RemoveAll("./test/local/pushed.git")
+	assert.Equal(t, nil, err)
+	pushed, err := git.PlainInit("./test/local/pushed.git", true)
+	assert.Equal(t, nil, err)
+	err = os.RemoveAll("./test/pushing")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{
+			{URL: "./test/local/source", PushMirror: fullPath("./test/local/pushed.git")},
+		},
+		100*time.Millisecond,
+		"./test/pushing/",
+		nil,
+		false,
+	)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	mockRepoChange("source", "pushed", false)
+	e := <-session.Events
+
+	ref, err := pushed.Reference("refs/heads/master", true)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, e.Commit().Hash, ref.Hash())
+}
+
+func TestOrderedEvents(t *testing.T) {
+	names := []string{"ordered-c", "ordered-a", "ordered-b"}
+	var repos []gitwatch.Repository
+	for _, name := range names {
+		mockRepo(name)
+		repos = append(repos, gitwatch.Repository{URL: "./test/local/" + name})
+	}
+	err := os.RemoveAll("./test/ordering")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, repos, time.Hour, "./test/ordering/", nil, true)
+	assert.Equal(t, nil, err)
+	session.OrderedEvents = true
+	go session.Run()
+	defer session.Close()
+
+	for _, name := range names {
+		e := <-session.Events
+		assert.Equal(t, "./test/local/"+name, e.URL)
+	}
+	<-session.InitialDone
+
+	// change them in reverse and check them all at once, Notify waits for the
+	// events to be read so it can't run on this goroutine
+	push := gitwatch.Push{Ref: "refs/heads/master"}
+	for i := len(names) - 1; i >= 0; i-- {
+		mockRepoChange(names[i], "ordered", false)
+		push.URLs = append(push.URLs, "./test/local/"+names[i])
+	}
+	go session.Notify(push)
+	for _, name := range names {
+		e := <-session.Events
+		assert.Equal(t, "./test/local/"+name, e.URL)
+	}
+}
+
+func TestGitServer(t *testing.T) {
+	source := server.Seed("served.git", map[string]string{"README.md": "served"})
+	mirror := server.Seed("mirror.git", nil)
+	err := os.RemoveAll("./test/serving")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{{URL: source.URL(), PushMirror: mirror.URL()}},
+		100*time.Millisecond,
+		"./test/serving/",
+		nil,
+		false,
+	)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	hash := source.Commit("change", map[string]string{"README.md": "changed", "new.txt": "new"})
+	e := <-session.Events
+	assert.Equal(t, source.URL(), e.URL)
+	assert.Equal(t, hash, e.Commit().Hash)
+
+	contents, err := ioutil.ReadFile("./test/serving/served.git/new.txt")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "new", string(contents))
+
+	err = mirror.Do(func(repo *git.Repository) error {
+		ref, err := repo.Reference("refs/heads/master", true)
+		if err == nil {
+			assert.Equal(t, hash, ref.Hash())
+		}
+		return err
+	})
+	assert.Equal(t, nil, err)
+}
+
+func TestBranches(t *testing.T) {
+	source := server.Seed("branches.git", map[string]string{"README.md": "branches"})
+	source.Branch("release/1")
+	source.Branch("master")
+	err := os.RemoveAll("./test/branches")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{{URL: source.URL(), Branch: "master", Branches: []string{"release/*"}}},
+		100*time.Millisecond,
+		"./test/branches/",
+		nil,
+		false,
+	)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	source.Branch("release/1")
+	hash := source.Commit("release 1", map[string]string{"release.txt": "1"})
+	e := <-session.Events
+	assert.Equal(t, gitwatch.EventCommit, e.Type)
+	assert.Equal(t, "release/1", e.Branch)
+	assert.Equal(t, hash, e.Commit().Hash)
+
+	source.Branch("feature")
+	source.Commit("feature", map[string]string{"feature.txt": "feature"})
+	source.Branch("master")
+	hash = source.Commit("master", map[string]string{"README.md": "changed"})
+	e = <-session.Events
+	assert.Equal(t, "master", e.Branch)
+	assert.Equal(t, hash, e.Commit().Hash)
+
+	_, err = os.Stat("./test/branches/branches.git/release.txt")
+	assert.T(t, os.IsNotExist(err))
+
+	err = source.Do(func(repo *git.Repository) error {
+		return repo.Storer.RemoveReference("refs/heads/release/1")
+	})
+	assert.Equal(t, nil, err)
+	e = <-session.Events
+	assert.Equal(t, gitwatch.EventBranchDeleted, e.Type)
+	assert.Equal(t, "release/1", e.Branch)
+}
+
+func TestBranchDeleted(t *testing.T) {
+	for _, policy := range []gitwatch.BranchDeletionPolicy{gitwatch.BranchDeletionKeep, gitwatch.BranchDeletionPark, gitwatch.BranchDeletionRemove} {
+		name := fmt.Sprintf("branch-deleted-%d.git", policy)
+		source := server.Seed(name, map[string]string{"README.md": "deleted"})
+		source.Branch("watched")
+		source.Branch("master")
+		err := os.RemoveAll("./test/branch-deleted")
+		assert.Equal(t, nil, err)
+
+		session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: source.URL(), Branch: "watched"}}, 20*time.Millisecond, "./test/branch-deleted/", nil, false)
+		assert.Equal(t, nil, err)
+		session.BranchDeleted = policy
+		go session.Run()
+		<-session.InitialDone
+
+		// a single event is emitted rather than an error every check
+		err = source.Do(func(repo *git.Repository) error {
+			return repo.Storer.RemoveReference("refs/heads/watched")
+		})
+		assert.Equal(t, nil, err)
+		e := <-session.Events
+		assert.Equal(t, gitwatch.EventBranchDeleted, e.Type)
+		assert.Equal(t, "watched", e.Branch)
+		select {
+		case e := <-session.Events:
+			t.Errorf("%v: unexpected event: %v", policy, e)
+		case err := <-session.Errors:
+			t.Errorf("%v: unexpected error: %v", policy, err)
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		// only a kept repository sees the branch come back
+		source.Branch("watched")
+		source.Commit("back", map[string]string{"README.md": "back"})
+		switch policy {
+		case gitwatch.BranchDeletionKeep:
+			e = <-session.Events
+			assert.Equal(t, "back", e.Commit().Message)
+			assert.Equal(t, 1, session.Status().Repositories)
+		case gitwatch.BranchDeletionPark:
+			select {
+			case e := <-session.Events:
+				t.Errorf("parked repository checked: %v", e)
+			case <-time.After(200 * time.Millisecond):
+			}
+			assert.Equal(t, 1, session.Status().Repositories)
+		case gitwatch.BranchDeletionRemove:
+			assert.Equal(t, 0, session.Status().Repositories)
+		}
+		assert.Equal(t, nil, session.Close())
+	}
+}
+
+func TestNotes(t *testing.T) {
+	source := server.Seed("notes.git", map[string]string{"README.md": "notes"})
+	first := source.Commit("first", map[string]string{"first.txt": "first"})
+	second := source.Commit("second", map[string]string{"second.txt": "second"})
+	err := os.RemoveAll("./test/notes")
+	assert.Equal(t, nil, err)
+
+	session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: source.URL(), WatchNotes: true}}, 50*time.Millisecond, "./test/notes/", nil, false)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	addNote(source, first, "reviewed")
+	e := <-session.Events
+	assert.Equal(t, gitwatch.EventNotes, e.Type)
+	assert.Equal(t, []gitwatch.Note{{Ref: "refs/notes/commits", Commit: first, Message: "reviewed"}}, e.Notes)
+
+	// later events only list the notes that were added or changed
+	addNote(source, second, "deployed")
+	e = <-session.Events
+	assert.Equal(t, []gitwatch.Note{{Ref: "refs/notes/commits", Commit: second, Message: "deployed"}}, e.Notes)
+	addNote(source, first, "reverted")
+	e = <-session.Events
+	assert.Equal(t, []gitwatch.Note{{Ref: "refs/notes/commits", Commit: first, Message: "reverted"}}, e.Notes)
+}
+
+// addNote sets the note on a commit in a repository's refs/notes/commits,
+// keeping the other notes
+func addNote(source *gitwatchtest.Repo, commit plumbing.Hash, message string) {
+	err := source.Do(func(repo *git.Repository) error {
+		write := func(o object.Object) (plumbing.Hash, error) {
+			obj := repo.Storer.NewEncodedObject()
+			if err := o.Encode(obj); err != nil {
+				return plumbing.ZeroHash, err
+			}
+			return repo.Storer.SetEncodedObject(obj)
+		}
+
+		blob := repo.Storer.NewEncodedObject()
+		blob.SetType(plumbing.BlobObject)
+		w, err := blob.Writer()
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write([]byte(message)); err != nil {
+			return err
+		}
+		w.Close()
+		blobHash, err := repo.Storer.SetEncodedObject(blob)
+		if err != nil {
+			return err
+		}
+
+		entries := []object.TreeEntry{{Name: commit.String(), Mode: filemode.Regular, Hash: blobHash}}
+		var parents []plumbing.Hash
+		if ref, err := repo.Reference("refs/notes/commits", true); err == nil {
+			parent, err := repo.CommitObject(ref.Hash())
+			if err != nil {
+				return err
+			}
+			tree, err := parent.Tree()
+			if err != nil {
+				return err
+			}
+			for _, entry := range tree.Entries {
+				if entry.Name != commit.String() {
+					entries = append(entries, entry)
+				}
+			}
+			parents = append(parents, parent.Hash)
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+		treeHash, err := write(&object.Tree{Entries: entries})
+		if err != nil {
+			return err
+		}
+
+		author := gitwatchtest.Author
+		author.When = time.Now()
+		hash, err := write(&object.Commit{Author: author, Committer: author, Message: "Notes added by 'git notes add'", TreeHash: treeHash, ParentHashes: parents})
+		if err != nil {
+			return err
+		}
+		return repo.Storer.SetReference(plumbing.NewHashReference("refs/notes/commits", hash))
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestPullRequests(t *testing.T) {
+	source := server.Seed("pulls.git", map[string]string{"README.md": "pulls"})
+	err := os.RemoveAll("./test/pulls")
+	assert.Equal(t, nil, err)
+
+	session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: source.URL(), Branch: "master", WatchPulls: true}}, 50*time.Millisecond, "./test/pulls/", nil, false)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	source.Branch("feature")
+	opened := source.Commit("feature", map[string]string{"feature.txt": "feature"})
+	source.Branch("master")
+	setRef(source, "refs/pull/7/head", opened)
+	e := <-session.Events
+	assert.Equal(t, gitwatch.EventPullRequest, e.Type)
+	assert.Equal(t, 7, e.PullRequest)
+	assert.Equal(t, opened, e.Commit().Hash)
+
+	// pushing to the pull request moves its head
+	source.Branch("feature")
+	updated := source.Commit("feature fixed", map[string]string{"feature.txt": "fixed"})
+	source.Branch("master")
+	setRef(source, "refs/pull/7/head", updated)
+	e = <-session.Events
+	assert.Equal(t, 7, e.PullRequest)
+	assert.Equal(t, updated, e.Commit().Hash)
+
+	// GitLab's merge requests are watched too
+	setRef(source, "refs/merge-requests/9/head", opened)
+	e = <-session.Events
+	assert.Equal(t, gitwatch.EventPullRequest, e.Type)
+	assert.Equal(t, 9, e.PullRequest)
+	assert.Equal(t, opened, e.Commit().Hash)
+}
+
+// setRef points a reference of a repository at a commit
+func setRef(source *gitwatchtest.Repo, name string, hash plumbing.Hash) {
+	err := source.Do(func(repo *git.Repository) error {
+		return repo.Storer.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(name), hash))
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestMergedPullRequest(t *testing.T) {
+	source := server.Seed("merged.git", map[string]string{"README.md": "merged"})
+	err := os.RemoveAll("./test/merged")
+	assert.Equal(t, nil, err)
+
+	session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: source.URL(), Branch: "master", WatchPulls: true}}, 50*time.Millisecond, "./test/merged/", nil, false)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	// without a merge commit, the number comes from the message
+	for i, c := range []struct {
+		message string
+		number  int
+	}{
+		{"Fix the thing (#12)", 12},
+		{"Merge pull request #56 from user/branch\n\nAdd the thing", 56},
+		{"Merge branch 'thing' into 'master'\n\nSee merge request group/project!34", 34},
+		{"Mention #78 in passing", 0},
+	} {
+		source.Commit(c.message, map[string]string{"README.md": strconv.Itoa(i)})
+		e := <-session.Events
+		assert.Equal(t, c.message, e.Commit().Message)
+		assert.Equal(t, c.number, e.PullRequest)
+	}
+
+	// a merge commit is matched against the pull request heads seen
+	source.Branch("feature")
+	feature := source.Commit("feature", map[string]string{"feature.txt": "feature"})
+	source.Branch("master")
+	setRef(source, "refs/pull/7/head", feature)
+	e := <-session.Events
+	assert.Equal(t, gitwatch.EventPullRequest, e.Type)
+	var merge plumbing.Hash
+	err = source.Do(func(repo *git.Repository) error {
+		head, err := repo.Head()
+		if err != nil {
+			return err
+		}
+		wt, err := repo.Worktree()
+		if err != nil {
+			return err
+		}
+		author := gitwatchtest.Author
+		author.When = time.Now()
+		merge, err = wt.Commit("Merge branch 'feature'", &git.CommitOptions{Author: &author, Parents: []plumbing.Hash{head.Hash(), feature}})
+		return err
+	})
+	assert.Equal(t, nil, err)
+	e = <-session.Events
+	assert.Equal(t, gitwatch.EventCommit, e.Type)
+	assert.Equal(t, merge, e.Commit().Hash)
+	assert.Equal(t, 7, e.PullRequest)
+}
+
+func TestMinCommits(t *testing.T) {
+	source := server.Seed("batched.git", map[string]string{"README.md": "batched"})
+	err := os.RemoveAll("./test/batched")
+	assert.Equal(t, nil, err)
+
+	session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: source.URL(), MinCommits: 3}}, 20*time.Millisecond, "./test/batched/", nil, false)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	quiet := func() {
+		select {
+		case e := <-session.Events:
+			t.Errorf("event before enough commits: %v", e.Commit().Message)
+		case err := <-session.Errors:
+			t.Errorf("unexpected error: %v", err)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+
+	// each commit is seen by a check of its own, the third emits the event
+	source.Commit("one", map[string]string{"README.md": "1"})
+	quiet()
+	source.Commit("two", map[string]string{"README.md": "2"})
+	quiet()
+	source.Commit("three", map[string]string{"README.md": "3"})
+	e := <-session.Events
+	assert.Equal(t, "three", e.Commit().Message)
+
+	// and the count starts again from the event
+	source.Commit("four", map[string]string{"README.md": "4"})
+	quiet()
+}
+
+func TestRateLimit(t *testing.T) {
+	source := server.Seed("rate-limited.git", map[string]string{"README.md": "rate limited"})
+	err := os.RemoveAll("./test/rate-limited")
+	assert.Equal(t, nil, err)
+
+	limit := 400 * time.Millisecond
+	session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: source.URL(), RateLimit: limit}}, 20*time.Millisecond, "./test/rate-limited/", nil, false)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	source.Commit("one", map[string]string{"README.md": "1"})
+	e := <-session.Events
+	assert.Equal(t, "one", e.Commit().Message)
+	emitted := time.Now()
+
+	// the commits within the window are coalesced into one event for the
+	// newest, emitted once the window has passed
+	time.Sleep(50 * time.Millisecond)
+	source.Commit("two", map[string]string{"README.md": "2"})
+	time.Sleep(100 * time.Millisecond)
+	source.Commit("three", map[string]string{"README.md": "3"})
+	e = <-session.Events
+	assert.Equal(t, "three", e.Commit().Message)
+	assert.T(t, time.Since(emitted) > limit-50*time.Millisecond, time.Since(emitted))
+	assert.Equal(t, 0, len(session.Events))
+}
+
+func TestDigest(t *testing.T) {
+	source := server.Seed("digested.git", map[string]string{"README.md": "digested"})
+	err := os.RemoveAll("./test/digested")
+	assert.Equal(t, nil, err)
+
+	period := 300 * time.Millisecond
+	session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: source.URL(), Digest: period}}, 20*time.Millisecond, "./test/digested/", nil, false)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	// the commits of a period arrive together, as one digest. Both are made
+	// while the server is held, so no check can fall between them.
+	err = source.Do(func(repo *git.Repository) error {
+		wt, err := repo.Worktree()
+		if err != nil {
+			return err
+		}
+		for _, c := range []struct{ message, file string }{{"feat: one", "one.txt"}, {"fix: two", "two.txt"}} {
+			if err = util.WriteFile(wt.Filesystem, c.file, []byte(c.message), 0644); err != nil {
+				return err
+			}
+			if _, err = wt.Add(c.file); err != nil {
+				return err
+			}
+			author := gitwatchtest.Author
+			author.When = time.Now()
+			if _, err = wt.Commit(c.message, &git.CommitOptions{Author: &author}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assert.Equal(t, nil, err)
+	e := <-session.Events
+	assert.Equal(t, gitwatch.EventDigest, e.Type)
+	var messages []string
+	for _, c := range e.Commits() {
+		messages = append(messages, c.Message)
+	}
+	assert.Equal(t, []string{"fix: two", "feat: one"}, messages)
+	assert.Equal(t, "fix: two", e.Commit().Message)
+	assert.Equal(t, []string{"one.txt", "two.txt"}, e.Changed)
+
+	// a period without commits has no digest, and the next only lists what's
+	// new since the last
+	select {
+	case e := <-session.Events:
+		t.Errorf("unexpected event: %v", e)
+	case <-time.After(2 * period):
+	}
+	source.Commit("three", map[string]string{"one.txt": "3"})
+	e = <-session.Events
+	assert.Equal(t, gitwatch.EventDigest, e.Type)
+	assert.Equal(t, 1, len(e.Commits()))
+	assert.Equal(t, "three", e.Commit().Message)
+	assert.Equal(t, []string{"one.txt"}, e.Changed)
+}
+
+func TestSummary(t *testing.T) {
+	source := server.Seed("summarised.git", map[string]string{"README.md": "summarised"})
+	err := os.RemoveAll("./test/summarised")
+	assert.Equal(t, nil, err)
+
+	session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: source.URL()}}, 50*time.Millisecond, "./test/summarised/", nil, false)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	// three commits pushed at once: two by different authors, then a merge
+	// whose changes aren't counted again
+	err = source.Do(func(repo *git.Repository) error {
+		wt, err := repo.Worktree()
+		if err != nil {
+			return err
+		}
+		var first plumbing.Hash
+		for i, c := range []struct{ author, file, contents string }{
+			{"alice", "a.txt", "1\n2\n"},
+			{"bob", "a.txt", "1\n3\n"},
+			{"alice", "b.txt", "merged\n"},
+		} {
+			if err = util.WriteFile(wt.Filesystem, c.file, []byte(c.contents), 0644); err != nil {
+				return err
+			}
+			if _, err = wt.Add(c.file); err != nil {
+				return err
+			}
+			opts := &git.CommitOptions{Author: &object.Signature{Name: c.author, Email: c.author + "@example.com", When: time.Now()}}
+			if i == 2 {
+				head, err := repo.Head()
+				if err != nil {
+					return err
+				}
+				opts.Parents = []plumbing.Hash{head.Hash(), first}
+			}
+			hash, err := wt.Commit(c.author, opts)
+			if err != nil {
+				return err
+			}
+			if i == 0 {
+				first = hash
+			}
+		}
+		return nil
+	})
+	assert.Equal(t, nil, err)
+	e := <-session.Events
+	assert.Equal(t, &gitwatch.Summary{
+		Commits:    3,
+		Authors:    []string{"alice <alice@example.com>", "bob <bob@example.com>"},
+		Insertions: 3,
+		Deletions:  1,
+		Merges:     true,
+	}, e.Summary)
+
+	// a single commit needs no summary
+	source.Commit("single", map[string]string{"a.txt": "single"})
+	e = <-session.Events
+	assert.Equal(t, "single", e.Commit().Message)
+	assert.T(t, e.Summary == nil, e.Summary)
+}
+
+func TestCodeOwners(t *testing.T) {
+	source := server.Seed("owned.git", map[string]string{
+		"README.md": "owned",
+		// the first of the locations found wins
+		"CODEOWNERS": "* @ignored\n",
+		".github/CODEOWNERS": `# everyone owns everything unless a later rule says otherwise
+* @everyone
+/docs/ @docs-team
+*.go @gophers @reviewers
+/cmd/main.go @cli # the last matching rule wins
+
+[Section]
+`,
+	})
+	err := os.RemoveAll("./test/owned")
+	assert.Equal(t, nil, err)
+
+	session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: source.URL()}}, 50*time.Millisecond, "./test/owned/", nil, false)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	source.Commit("owned", map[string]string{"docs/guide.md": "guide", "cmd/main.go": "package main", "pkg/x.go": "package pkg"})
+	e := <-session.Events
+	assert.Equal(t, []string{"@cli", "@docs-team", "@gophers", "@reviewers"}, e.Owners)
+
+	source.Commit("readme", map[string]string{"README.md": "changed"})
+	e = <-session.Events
+	assert.Equal(t, []string{"@everyone"}, e.Owners)
+}
+
+func TestGroups(t *testing.T) {
+	mockRepo("ungrouped")
+	source := server.Seed("grouped.git", map[string]string{"README.md": "grouped"})
+	target, err := url.Parse(server.URL)
+	assert.Equal(t, nil, err)
+	users := make(chan string, 64)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _, _ := r.BasicAuth()
+		select {
+		case users <- user:
+		default:
+		}
+		httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+	err = os.RemoveAll("./test/grouped")
+	assert.Equal(t, nil, err)
+
+	session, err := gitwatch.New(context.Background(), []gitwatch.Repository{
+		{URL: proxy.URL + "/grouped.git", Group: "team"},
+		{URL: "./test/local/ungrouped"},
+	}, time.Hour, "./test/grouped/", nil, false)
+	assert.Equal(t, nil, err)
+	sunk := make(chan gitwatch.Event, 4)
+	session.Groups = map[string]gitwatch.Group{"team": {
+		Interval: 20 * time.Millisecond,
+		Auth:     gitwatch.BasicAuth("team", "secret"),
+		Ignore:   []string{"*.md"},
+		Sinks: []gitwatch.Sink{gitwatch.SinkFunc(func(ctx context.Context, e gitwatch.Event) error {
+			sunk <- e
+			return nil
+		})},
+	}}
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	// the group's repository is cloned with the group's credentials
+	assert.Equal(t, "team", <-users)
+
+	// and checked at the group's interval, with its filters
+	source.Commit("docs", map[string]string{"README.md": "docs"})
+	time.Sleep(100 * time.Millisecond)
+	source.Commit("code", map[string]string{"main.go": "package main"})
+	e := <-session.Events
+	assert.Equal(t, "code", e.Commit().Message)
+	e = <-sunk
+	assert.Equal(t, "code", e.Commit().Message)
+
+	// the other repository keeps the session's hourly interval, and its
+	// events wouldn't go to the group's sinks anyway
+	mockRepoChange("ungrouped", "ungrouped", false)
+	select {
+	case e := <-session.Events:
+		t.Errorf("unexpected event: %v", e.Commit().Message)
+	case e := <-sunk:
+		t.Errorf("unexpected delivery: %v", e.Commit().Message)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestDeploy(t *testing.T) {
+	mockRepo("deployed")
+	err := os.RemoveAll("./test/deploy")
+	assert.Equal(t, nil, err)
+	err = os.RemoveAll("./test/deploying")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{
+			{URL: "./test/local/deployed", Deploy: gitwatch.DeployLayout{Dir: "./test/deploy", Keep: 1}},
+		},
+		100*time.Millisecond,
+		"./test/deploying/",
+		nil,
+		false,
+	)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	// the new release and the pruning of the initial one arrive in any order
+	mockRepoChange("deployed", "released", false)
+	e, pruned := nextEvent(t, session), nextEvent(t, session)
+	if e.Type == gitwatch.EventReleasePruned {
+		e, pruned = pruned, e
+	}
+	assert.Equal(t, gitwatch.EventReleasePruned, pruned.Type)
+	assert.NotEqual(t, "", e.Release)
+
+	contents, err := ioutil.ReadFile("./test/deploy/current/file")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "released", string(contents))
+
+	// only the release current points at is left
+	releases, err := ioutil.ReadDir("./test/deploy/releases")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(releases))
+
+	// pinned releases outlive the retention rules
+	err = gitwatch.PinRelease("./test/deploy", e.Release)
+	assert.Equal(t, nil, err)
+	mockRepoChange("deployed", "released again", false)
+	e = nextEvent(t, session)
+	assert.Equal(t, gitwatch.EventCommit, e.Type)
+	releases, err = ioutil.ReadDir("./test/deploy/releases")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(releases))
+}
+
+func TestRollback(t *testing.T) {
+	mockRepo("rolled")
+	err := os.RemoveAll("./test/rolling")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{{URL: "./test/local/rolled"}},
+		100*time.Millisecond,
+		"./test/rolling/",
+		nil,
+		true,
+	)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	first := <-session.Events
+	<-session.InitialDone
+
+	mockRepoChange("rolled", "bad change", false)
+	<-session.Events
+
+	err = session.Rollback("./test/local/rolled", first.Commit().Hash)
+	assert.Equal(t, nil, err)
+	contents, err := ioutil.ReadFile("./test/rolling/rolled/file")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "hello world", string(contents))
+
+	// forward updates are paused until resumed
+	mockRepoChange("rolled", "fixed", false)
+	select {
+	case e := <-session.Events:
+		t.Fatal("unexpected event while rolled back:", e)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	err = session.Resume("./test/local/rolled")
+	assert.Equal(t, nil, err)
+	<-session.Events
+	contents, err = ioutil.ReadFile("./test/rolling/rolled/file")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "fixed", string(contents))
+}
+
+func TestBeforeUpdate(t *testing.T) {
+	mockRepo("gated")
+	err := os.RemoveAll("./test/gating")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{{URL: "./test/local/gated"}},
+		100*time.Millisecond,
+		"./test/gating/",
+		nil,
+		false,
+	)
+	assert.Equal(t, nil, err)
+
+	updates := make(chan gitwatch.PendingUpdate, 16)
+	var accept int32
+	session.BeforeUpdate = func(u gitwatch.PendingUpdate) error {
+		updates <- u
+		if atomic.LoadInt32(&accept) == 0 {
+			return errors.New("not yet")
+		}
+		return nil
+	}
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	mockRepoChange("gated", "gated change", false)
+	u := <-updates
+	assert.Equal(t, []string{"file"}, u.Files)
+	assert.NotEqual(t, nil, <-session.Errors)
+
+	contents, err := ioutil.ReadFile("./test/gating/gated/file")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "hello world", string(contents))
+
+	atomic.StoreInt32(&accept, 1)
+	e := <-session.Events
+	assert.Equal(t, u.New, e.Commit().Hash)
+	contents, err = ioutil.ReadFile("./test/gating/gated/file")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "gated change", string(contents))
+}
+
+// statusFunc is a StatusChecker reporting the state it returns
+type statusFunc func() string
+
+func (f statusFunc) Status(ctx context.Context, url string, commit plumbing.Hash) (string, error) {
+	return f(), nil
+}
+
+func TestPolicy(t *testing.T) {
+	mockRepo("policed")
+	err := os.RemoveAll("./test/policing")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: "./test/local/policed"}}, 50*time.Millisecond, "./test/policing/", nil, false)
+	assert.Equal(t, nil, err)
+	var status atomic.Value
+	status.Store("pending")
+	session.Policy = &gitwatch.Policy{
+		AllowedAuthors: []string{"*@test.com"},
+		ProtectedPaths: []string{"/protected"},
+		Status:         statusFunc(func() string { return status.Load().(string) }),
+	}
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	mockRepoChange("policed", "unchecked", false)
+	e := <-session.Events
+	assert.Equal(t, gitwatch.EventPolicyViolation, e.Type)
+	hash := e.Commit().Hash
+	assert.Equal(t, []string{"commit " + hash.String()[:7] + " has status pending"}, e.Violations)
+	contents, err := ioutil.ReadFile("./test/policing/policed/file")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "hello world", string(contents))
+
+	// reported once, then checked out once the status passes
+	select {
+	case e = <-session.Events:
+		t.Fatal("violation emitted again", e)
+	case <-time.After(200 * time.Millisecond):
+	}
+	status.Store("success")
+	e = <-session.Events
+	assert.Equal(t, gitwatch.EventCommit, e.Type)
+	assert.Equal(t, hash, e.Commit().Hash)
+
+	mockRepoFile("policed", "protected", "changed")
+	e = <-session.Events
+	assert.Equal(t, gitwatch.EventPolicyViolation, e.Type)
+	assert.Equal(t, []string{"commit " + e.Commit().Hash.String()[:7] + " by test@test.com changes protected path protected"}, e.Violations)
+}
+
+func TestObserve(t *testing.T) {
+	mockRepo("observed")
+	err := os.RemoveAll("./test/observing")
+	assert.Equal(t, nil, err)
+
+	// a clone that belongs to something else
+	existing, err := git.PlainClone("./test/observing/observed", false, &git.CloneOptions{URL: "./test/local/observed"})
+	assert.Equal(t, nil, err)
+	before, err := existing.Head()
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{{URL: "./test/local/observed", Branch: "master", Observe: true}},
+		100*time.Millisecond,
+		"./test/observing/",
+		nil,
+		false,
+	)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	mockRepoChange("observed", "observed change", false)
+	e := <-session.Events
+	assert.Equal(t, gitwatch.EventCommit, e.Type)
+	assert.NotEqual(t, before.Hash(), e.Commit().Hash)
+
+	repo, err := git.PlainOpen("./test/observing/observed")
+	assert.Equal(t, nil, err)
+	after, err := repo.Head()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, before.Hash(), after.Hash())
+	contents, err := ioutil.ReadFile("./test/observing/observed/file")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "hello world", string(contents))
+}
+
+func TestMemoryStorage(t *testing.T) {
+	r := server.Seed("in-memory.git", map[string]string{"README.md": "one"})
+	err := os.RemoveAll("./test/in-memory")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: r.URL()}}, 50*time.Millisecond, "./test/in-memory/", nil, false)
+	assert.Equal(t, nil, err)
+	storage := &gitwatch.MemoryStorage{}
+	session.Storage = storage
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	hash := r.Commit("two", map[string]string{"README.md": "two"})
+	e := <-session.Events
+	assert.Equal(t, hash, e.Commit().Hash)
+	assert.Equal(t, []string{"README.md"}, e.Changed)
+	_, err = os.Stat("./test/in-memory/in-memory.git")
+	assert.T(t, os.IsNotExist(err))
+
+	st, _, err := storage.Open(filepath.Join("./test/in-memory/", "in-memory.git"), false)
+	assert.Equal(t, nil, err)
+	head, err := st.Reference(plumbing.HEAD)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, plumbing.SymbolicReference, head.Type())
+
+	err = session.RemoveAndClean(r.URL())
+	assert.Equal(t, nil, err)
+	st, _, err = storage.Open(filepath.Join("./test/in-memory/", "in-memory.git"), false)
+	assert.Equal(t, nil, err)
+	_, err = st.Reference(plumbing.HEAD)
+	assert.Equal(t, plumbing.ErrReferenceNotFound, err)
+}
+
+func TestStateFile(t *testing.T) {
+	r := server.Seed("stateful.git", map[string]string{"README.md": "one"})
+	err := os.RemoveAll("./test/stateful")
+	assert.Equal(t, nil, err)
+	err = os.MkdirAll("./test/stateful", 0755)
+	assert.Equal(t, nil, err)
+
+	start := func() (*gitwatch.Session, func()) {
+		ctx, cf := context.WithCancel(context.Background())
+		session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: r.URL()}}, 50*time.Millisecond, "./test/stateful/", nil, true)
+		assert.Equal(t, nil, err)
+		session.State = &gitwatch.StateFile{Path: "./test/stateful/state.json"}
+		go session.Run()
+		return session, func() {
+			session.Close()
+			cf()
+		}
+	}
+
+	session, stop := start()
+	<-session.Events
+	hash := r.Commit("two", map[string]string{"README.md": "two"})
+	e := <-session.Events
+	assert.Equal(t, hash, e.Commit().Hash)
+	stop()
+
+	// resumed from the last event, with what was missed while stopped
+	hash = r.Commit("three", map[string]string{"README.md": "three"})
+	session, stop = start()
+	e = <-session.Events
+	assert.Equal(t, hash, e.Commit().Hash)
+	assert.Equal(t, []string{"README.md"}, e.Changed)
+	stop()
+
+	// the clone was updated but the event never recorded
+	err = (&gitwatch.StateFile{Path: "./test/stateful/state.json"}).SetLastEvent(r.URL(), e.Commit().ParentHashes[0])
+	assert.Equal(t, nil, err)
+	session, stop = start()
+	defer stop()
+	e = <-session.Events
+	assert.Equal(t, hash, e.Commit().Hash)
+}
+
+func TestAllCommits(t *testing.T) {
+	r := server.Seed("all-commits.git", map[string]string{"README.md": "one"})
+	err := os.RemoveAll("./test/all-commits")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: r.URL(), Webhook: true, AllCommits: true}}, 50*time.Millisecond, "./test/all-commits/", nil, false)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	first := r.Commit("two", map[string]string{"README.md": "two"})
+	second := r.Commit("three", map[string]string{"README.md": "three"})
+	go session.Notify(gitwatch.Push{URLs: []string{r.URL()}, Ref: "refs/heads/master"})
+	e := <-session.Events
+	assert.Equal(t, second, e.Commit().Hash)
+	commits := e.Commits()
+	assert.Equal(t, 2, len(commits))
+	assert.Equal(t, second, commits[0].Hash)
+	assert.Equal(t, first, commits[1].Hash)
+}
+
+func TestForced(t *testing.T) {
+	r := server.Seed("forced.git", map[string]string{"README.md": "one"})
+	base := r.Commit("two", map[string]string{"README.md": "two"})
+	err := os.RemoveAll("./test/forcing")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: r.URL()}}, 50*time.Millisecond, "./test/forcing/", nil, false)
+	assert.Equal(t, nil, err)
+	session.UseForce = true
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	old := r.Commit("three", map[string]string{"README.md": "three"})
+	e := <-session.Events
+	assert.Equal(t, old, e.Commit().Hash)
+	assert.Equal(t, false, e.Forced)
+
+	r.Reset(base)
+	rewritten := r.Commit("three, again", map[string]string{"README.md": "rewritten"})
+	e = <-session.Events
+	assert.Equal(t, rewritten, e.Commit().Hash)
+	assert.Equal(t, true, e.Forced)
+	assert.Equal(t, old.String(), e.From)
+	assert.Equal(t, rewritten.String(), e.To)
+}
+
+func TestBare(t *testing.T) {
+	r := server.Seed("bare.git", map[string]string{"README.md": "bare"})
+	err := os.RemoveAll("./test/bare")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: r.URL(), Bare: true}}, 50*time.Millisecond, "./test/bare/", nil, false)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	hash := r.Commit("bare change", map[string]string{"README.md": "bare change"})
+	e := <-session.Events
+	assert.Equal(t, gitwatch.EventCommit, e.Type)
+	assert.Equal(t, hash, e.Commit().Hash)
+	assert.Equal(t, fullPath("./test/bare/bare.git"), e.Path)
+
+	_, err = os.Stat("./test/bare/bare.git/README.md")
+	assert.T(t, os.IsNotExist(err))
+	_, err = os.Stat("./test/bare/bare.git/HEAD")
+	assert.Equal(t, nil, err)
+}
+
+func TestWatchFilesAndComponents(t *testing.T) {
+	mockRepo("configured")
+	err := os.RemoveAll("./test/watching-files")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{{
+			URL:        "./test/local/configured",
+			WatchFiles: []string{"fi*"},
+			Components: map[string]string{"/file": "core", "docs/": "docs"},
+		}},
+		100*time.Millisecond,
+		"./test/watching-files/",
+		nil,
+		false,
+	)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	mockRepoChange("configured", "version 2", false)
+	e := <-session.Events
+	assert.Equal(t, []gitwatch.FileChange{{Path: "file", Old: "hello world", New: "version 2"}}, e.Files)
+	assert.Equal(t, []string{"core"}, e.Components)
+}
+
+func TestWatchFilesNested(t *testing.T) {
+	r := server.Seed("nested-files.git", map[string]string{
+		"VERSION":            "1",
+		"svc/VERSION":        "1",
+		"deploy/app.yaml":    "v1",
+		"deploy/sub/db.yaml": "v1",
+	})
+	err := os.RemoveAll("./test/watching-nested")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{
+		URL:        r.URL(),
+		WatchFiles: []string{"VERSION", "deploy/*.yaml"},
+	}}, 50*time.Millisecond, "./test/watching-nested/", nil, false)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	// a bare name matches at any depth, a pattern with a slash only from the
+	// root and `*` doesn't cross directories
+	r.Commit("bump", map[string]string{
+		"svc/VERSION":        "2",
+		"deploy/app.yaml":    "v2",
+		"deploy/sub/db.yaml": "v2",
+	})
+	select {
+	case e := <-session.Events:
+		assert.Equal(t, []gitwatch.FileChange{
+			{Path: "deploy/app.yaml", Old: "v1", New: "v2"},
+			{Path: "svc/VERSION", Old: "1", New: "2"},
+		}, e.Files)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event for the change")
+	}
+}
+
+func TestChangedFiles(t *testing.T) {
+	source := server.Seed("changed.git", map[string]string{"README.md": "changed", "old.txt": "old"})
+	err := os.RemoveAll("./test/changed")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{{URL: source.URL()}},
+		100*time.Millisecond,
+		"./test/changed/",
+		nil,
+		false,
+	)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	source.Commit("reshuffle", map[string]string{"README.md": "updated", "old.txt": "", "src/new.go": "package src"})
+	e := <-session.Events
+	assert.Equal(t, []string{"README.md", "old.txt", "src/new.go"}, e.Changed)
+}
+
+func TestMaxDiffSize(t *testing.T) {
+	source := server.Seed("diffed.git", map[string]string{"README.md": "diffed"})
+	err := os.RemoveAll("./test/diffed")
+	assert.Equal(t, nil, err)
+
+	session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: source.URL()}}, 100*time.Millisecond, "./test/diffed/", nil, false)
+	assert.Equal(t, nil, err)
+	session.MaxDiffSize = 200
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	// the cut lands inside one of the three-byte runes, which is left out
+	source.Commit("euros", map[string]string{"prices.txt": strings.Repeat("€", 100)})
+	e := <-session.Events
+	assert.T(t, e.DiffCut)
+	assert.T(t, utf8.ValidString(e.Diff), e.Diff)
+	assert.T(t, len(e.Diff) > 197 && len(e.Diff) <= 200, len(e.Diff))
+	assert.T(t, strings.HasPrefix(e.Diff, "diff --git a/prices.txt b/prices.txt"), e.Diff)
+}
+
+func TestIgnore(t *testing.T) {
+	mockRepo("ignoring")
+	err := os.RemoveAll("./test/ignoring-changes")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: "./test/local/ignoring", Ignore: []string{"/file"}}}, 50*time.Millisecond, "./test/ignoring-changes/", nil, false)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	mockRepoChange("ignoring", "ignored", false)
+	select {
+	case e := <-session.Events:
+		t.Fatal("ignored change emitted", e)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// the repository's own ignore file can override the configured patterns
+	mockRepoFile("ignoring", ".gitwatchignore", "# watched after all\n!file\n")
+	e := <-session.Events
+	assert.Equal(t, "add: # watched after all\n!file\n", e.Commit().Message)
+	mockRepoChange("ignoring", "not ignored", false)
+	e = <-session.Events
+	assert.Equal(t, "add: not ignored", e.Commit().Message)
+}
+
+func TestInclude(t *testing.T) {
+	source := server.Seed("included.git", map[string]string{"README.md": "included", "src/main.go": "package main"})
+	err := os.RemoveAll("./test/including")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: source.URL(), Include: []string{"src/"}, Ignore: []string{"*_test.go"}}}, 50*time.Millisecond, "./test/including/", nil, false)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	source.Commit("docs", map[string]string{"README.md": "docs only"})
+	source.Commit("tests", map[string]string{"src/main_test.go": "package main"})
+	select {
+	case e := <-session.Events:
+		t.Fatal("change outside Include emitted", e)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	hash := source.Commit("code", map[string]string{"README.md": "docs and code", "src/main.go": "package main\n"})
+	e := <-session.Events
+	assert.Equal(t, hash, e.Commit().Hash)
+}
+
+func TestDiscovery(t *testing.T) {
+	err := os.RemoveAll("./test/local/discovered")
+	assert.Equal(t, nil, err)
+	err = os.RemoveAll("./test/discovering")
+	assert.Equal(t, nil, err)
+	for _, name := range []string{"app", "app-sandbox", "lib"} {
+		mockRepo("discovered/" + name)
+	}
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, nil, 50*time.Millisecond, "./test/discovering/", nil, false)
+	assert.Equal(t, nil, err)
+	session.Discovery = []gitwatch.Discovery{{
+		Source: gitwatch.DirectorySource("./test/local/discovered"),
+		Filter: gitwatch.DiscoveryFilter{Exclude: []string{"*-sandbox"}},
+	}}
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+	assert.Equal(t, 2, session.Status().Repositories)
+
+	mockRepoChange("discovered/lib", "found", false)
+	e := <-session.Events
+	assert.Equal(t, "test/local/discovered/lib", e.URL)
+
+	// GitHub's repositories have topics, visibility and can be archived
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/orgs/acme/repos", r.URL.Path)
+		w.Write([]byte(`[
+			{"name": "api", "clone_url": "https://github.com/acme/api.git", "topics": ["service"]},
+			{"name": "web", "clone_url": "https://github.com/acme/web.git", "topics": ["service"], "private": true},
+			{"name": "old", "clone_url": "https://github.com/acme/old.git", "topics": ["service"], "archived": true},
+			{"name": "docs", "clone_url": "https://github.com/acme/docs.git"}
+		]`))
+	}))
+	defer server.Close()
+	found, err := gitwatch.GitHubOrg{Org: "acme", API: server.URL}.Discover(ctx)
+	assert.Equal(t, nil, err)
+	var matched []string
+	filter := gitwatch.DiscoveryFilter{Topics: []string{"service"}, Visibility: "public"}
+	for _, d := range found {
+		if filter.Match(d) {
+			matched = append(matched, d.URL)
+		}
+	}
+	assert.Equal(t, []string{"https://github.com/acme/api.git"}, matched)
+}
+
+func TestDiscoveryErrors(t *testing.T) {
+	mockRepo("discovery-watched")
+	for _, dir := range []string{"./test/local/discovery-failing", "./test/local/discovery-working", "./test/discovery-errors"} {
+		err := os.RemoveAll(dir)
+		assert.Equal(t, nil, err)
+	}
+	err := os.MkdirAll("./test/local/discovery-failing", 0755)
+	assert.Equal(t, nil, err)
+	err = os.MkdirAll("./test/local/discovery-working", 0755)
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: "./test/local/discovery-watched"}}, 50*time.Millisecond, "./test/discovery-errors/", nil, false)
+	assert.Equal(t, nil, err)
+	session.Discovery = []gitwatch.Discovery{
+		{Source: gitwatch.DirectorySource("./test/local/discovery-failing"), Every: 10 * time.Millisecond},
+		{Source: gitwatch.DirectorySource("./test/local/discovery-working"), Every: 10 * time.Millisecond},
+	}
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	// a source failing after startup is reported, and neither the other source
+	// nor the repositories already watched stop being checked
+	err = os.RemoveAll("./test/local/discovery-failing")
+	assert.Equal(t, nil, err)
+	mockRepo("discovery-working/found")
+	mockRepoChange("discovery-watched", "still checked", false)
+	var checked, reported bool
+	for !checked || !reported || session.Status().Repositories < 2 {
+		select {
+		case err := <-session.Errors:
+			var failed *gitwatch.Error
+			assert.T(t, errors.As(err, &failed))
+			assert.Equal(t, "discover", failed.Stage)
+			reported = true
+		case e := <-session.Events:
+			assert.Equal(t, "add: still checked", e.Commit().Message)
+			checked = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("checks stopped at the failing discovery")
+		}
+	}
+}
+
+func TestTrailersAndCommitTypes(t *testing.T) {
+	mockRepo("trailed")
+	err := os.RemoveAll("./test/trailing")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: "./test/local/trailed"}}, 100*time.Millisecond, "./test/trailing/", nil, false)
+	assert.Equal(t, nil, err)
+	session.BumpRules = map[string]gitwatch.Bump{"add": gitwatch.BumpMinor}
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	mockRepoChange("trailed", "trailers\n\nSigned-off-by: A <a@example.com>\nChange-Id: I1234\n  continued\nSigned-off-by: B <b@example.com>", false)
+	e := <-session.Events
+	assert.Equal(t, gitwatch.Trailers{
+		"Signed-off-by": {"A <a@example.com>", "B <b@example.com>"},
+		"Change-Id":     {"I1234 continued"},
+	}, e.Trailers)
+
+	assert.Equal(t, 1, len(e.CommitTypes))
+	assert.Equal(t, "add", e.CommitTypes[0].Type)
+	assert.T(t, !e.CommitTypes[0].Breaking)
+	assert.T(t, e.OnlyCommitTypes("docs", "add"))
+	assert.T(t, !e.OnlyCommitTypes("docs"))
+	assert.Equal(t, gitwatch.BumpMinor, e.Bump)
+
+	mockRepoChange("trailed", "no trailers\n\nJust: a sentence\nthat has a colon\n\nBREAKING CHANGE: it's different", false)
+	e = <-session.Events
+	assert.Equal(t, gitwatch.Trailers(nil), e.Trailers)
+	assert.T(t, e.CommitTypes[0].Breaking)
+	assert.Equal(t, gitwatch.BumpMajor, e.Bump)
+}
+
+func TestRefsOnly(t *testing.T) {
+	mockRepo("changefeed")
+	err := os.RemoveAll("./test/changefeeds")
+	assert.Equal(t, nil, err)
+
+	watch := func() (*gitwatch.Session, context.CancelFunc) {
+		ctx, cf := context.WithCancel(context.Background())
+		session, err := gitwatch.New(
+			ctx,
+			[]gitwatch.Repository{{URL: "./test/local/changefeed", RefsOnly: true}},
+			100*time.Millisecond,
+			"./test/changefeeds/",
+			nil,
+			true,
+		)
+		assert.Equal(t, nil, err)
+		go session.Run()
+		<-session.InitialDone
+		return session, cf
+	}
+	// events are emitted concurrently, so collect them by ref
+	refEvents := func(session *gitwatch.Session, refs ...string) map[string]gitwatch.Event {
+		events := make(map[string]gitwatch.Event)
+		for _, ref := range refs {
+			for _, ok := events[ref]; !ok; _, ok = events[ref] {
+				select {
+				case e := <-session.Events:
+					events[e.Ref] = e
+				case <-time.After(2 * time.Second):
+					t.Fatal("timed out waiting for", ref, "got", events)
+				}
+			}
+		}
+		return events
+	}
+
+	session, cf := watch()
+	_, err = os.Stat("./test/changefeeds/changefeed/.git")
+	assert.T(t, os.IsNotExist(err))
+
+	mockRepoChange("changefeed", "moved", false)
+	mockRepoTag("changefeed", "v1")
+	events := refEvents(session, "refs/heads/master", "refs/tags/v1")
+	assert.Equal(t, gitwatch.EventRefMoved, events["refs/heads/master"].Type)
+	assert.Equal(t, "master", events["refs/heads/master"].Branch)
+	assert.NotEqual(t, "", events["refs/heads/master"].From)
+	assert.Equal(t, gitwatch.EventRefCreated, events["refs/tags/v1"].Type)
+	assert.Equal(t, "v1", events["refs/tags/v1"].Tag)
+	session.Close()
+	cf()
+
+	// changes made while nothing is watching are reported on the next start
+	mockRepoDeleteTag("changefeed", "v1")
+	session, cf = watch()
+	defer cf()
+	defer session.Close()
+	events = refEvents(session, "refs/tags/v1")
+	assert.Equal(t, gitwatch.EventRefDeleted, events["refs/tags/v1"].Type)
+	assert.Equal(t, "", events["refs/tags/v1"].To)
+}
+
+func TestReceiver(t *testing.T) {
+	mockRepo("hooked")
+	err := os.RemoveAll("./test/hooks")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{{URL: "./test/local/hooked", Branch: "master"}},
+		time.Hour,
+		"./test/hooks/",
+		nil,
+		false,
+	)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	server := httptest.NewServer(gitwatch.Receiver{Session: session, Secret: "secret"})
+	defer server.Close()
+	deliver := func(headers map[string]string, body string) int {
+		req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(body))
+		assert.Equal(t, nil, err)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Equal(t, nil, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	awaitEvent := func() gitwatch.Event {
+		select {
+		case e := <-session.Events:
+			return e
+		case err := <-session.Errors:
+			t.Fatal(err)
+		case <-time.After(2 * time.Second):
+			t.Fatal("webhook didn't trigger a check")
+		}
+		return gitwatch.Event{}
+	}
+
+	github := `{"ref":"refs/heads/master","repository":{"clone_url":"./test/local/hooked"}}`
+	status := deliver(map[string]string{
+		"X-GitHub-Event":      "push",
+		"X-Hub-Signature-256": gitwatch.Sign("wrong", []byte(github)),
+	}, github)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	mockRepoChange("hooked", "github push", false)
+	status = deliver(map[string]string{
+		"X-GitHub-Event":      "push",
+		"X-Hub-Signature-256": gitwatch.Sign("secret", []byte(github)),
+	}, github)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, "add: github push", awaitEvent().Commit().Message)
+
+	mockRepoChange("hooked", "gitlab push", false)
+	gitlab := `{"ref":"refs/heads/master","project":{"git_http_url":"./test/local/hooked.git"}}`
+	status = deliver(map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "secret"}, gitlab)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, "add: gitlab push", awaitEvent().Commit().Message)
+
+	mockRepoChange("hooked", "bitbucket push", false)
+	bitbucket := `{"repository":{"links":{"clone":[{"href":"./test/local/hooked"}]}},"changes":[{"ref":{"id":"refs/heads/master"}}]}`
+	status = deliver(map[string]string{
+		"X-Event-Key":     "repo:refs_changed",
+		"X-Hub-Signature": gitwatch.Sign("secret", []byte(bitbucket)),
+	}, bitbucket)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, "add: bitbucket push", awaitEvent().Commit().Message)
+}
+
+func TestWebhookListener(t *testing.T) {
+	source := server.Seed("listened.git", map[string]string{"README.md": "listened"})
+	err := os.RemoveAll("./test/listened")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{{URL: source.URL(), Branch: "master", Webhook: true}},
+		50*time.Millisecond,
+		"./test/listened/",
+		nil,
+		false,
+	)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	listener := gitwatch.WebhookListener{Receiver: gitwatch.Receiver{Session: session, Secret: "secret"}, Path: "/hooks"}
+	served := make(chan error, 1)
+	go func() { served <- listener.Serve(ctx, ln) }()
+
+	// webhook-fed repositories aren't polled
+	hash := source.Commit("pushed", map[string]string{"README.md": "pushed"})
+	select {
+	case e := <-session.Events:
+		t.Fatal("polled a webhook-fed repository:", e)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	body := fmt.Sprintf(`{"urls":[%q],"ref":"refs/heads/master"}`, source.URL())
+	req, err := http.NewRequest(http.MethodPost, "http://"+ln.Addr().String()+"/hooks", strings.NewReader(body))
+	assert.Equal(t, nil, err)
+	req.Header.Set(gitwatch.SignatureHeader, gitwatch.Sign("secret", []byte(body)))
+	resp, err := http.DefaultClient.Do(req)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	select {
+	case e := <-session.Events:
+		assert.Equal(t, hash, e.Commit().Hash)
+	case err := <-session.Errors:
+		t.Fatal(err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook didn't trigger a check")
+	}
+
+	cf()
+	assert.Equal(t, nil, <-served)
+}
+
+func TestHealthHandler(t *testing.T) {
+	server := httptest.NewServer(gitwatch.HealthHandler(gw))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	idle, err := gitwatch.New(ctx, nil, time.Second, "./test/", nil, false)
+	assert.Equal(t, nil, err)
+	server = httptest.NewServer(gitwatch.HealthHandler(idle))
+	defer server.Close()
+	resp, err = http.Get(server.URL)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "session is not running", resp.Header.Get("X-Gitwatch-Unhealthy"))
+}
+
+func TestErrorPolicy(t *testing.T) {
+	mockRepo("resilient")
+	err := os.RemoveAll("./test/resilience")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{
+			{URL: "./test/local/missing"},
+			{URL: "./test/local/resilient"},
+		},
+		100*time.Millisecond,
+		"./test/resilience/",
+		nil,
+		false,
+	)
+	assert.Equal(t, nil, err)
+	session.ErrorPolicy = gitwatch.ErrorsResilient
+	go session.Run()
+	defer session.Close()
+
+	// the missing repository is reported, but doesn't stop the other
+	assert.NotEqual(t, nil, <-session.Errors)
+	<-session.InitialDone
+	mockRepoChange("resilient", "still watched", false)
+	for {
+		select {
+		case err := <-session.Errors:
+			assert.NotEqual(t, nil, err)
+			continue
+		case e := <-session.Events:
+			assert.Equal(t, "add: still watched", e.Commit().Message)
+		}
+		break
+	}
+
+	failing, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{{URL: "./test/local/missing"}},
+		10*time.Millisecond,
+		"./test/resilience/",
+		nil,
+		false,
+	)
+	assert.Equal(t, nil, err)
+	failing.ErrorPolicy = gitwatch.ErrorsResilient
+	failing.FailingLimit = 3
+	go func() {
+		for range failing.Errors {
+		}
+	}()
+	err = failing.Run()
+	assert.T(t, errors.Is(err, gitwatch.ErrAllFailing))
+
+	// repositories skipped while they back off, or once they've run out of
+	// retries, still count as failing
+	backingOff, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{
+			{URL: "./test/local/missing"},
+			{URL: "./test/local/missing-too", Retry: &gitwatch.RetryPolicy{MaxAttempts: 2}},
+		},
+		10*time.Millisecond,
+		"./test/resilience/",
+		nil,
+		false,
+	)
+	assert.Equal(t, nil, err)
+	backingOff.ErrorPolicy = gitwatch.ErrorsResilient
+	backingOff.FailingLimit = 3
+	backingOff.Retry = gitwatch.RetryPolicy{MinBackoff: 20 * time.Millisecond}
+	go func() {
+		for range backingOff.Errors {
+		}
+	}()
+	done := make(chan error, 1)
+	go func() { done <- backingOff.Run() }()
+	select {
+	case err = <-done:
+		assert.T(t, errors.Is(err, gitwatch.ErrAllFailing), err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return ErrAllFailing while backing off")
+	}
+}
+
+func TestFailFastRound(t *testing.T) {
+	for _, concurrency := range []int{1, 2} {
+		mockRepo("failing-first")
+		mockRepo("failing-second")
+		err := os.RemoveAll("./test/failing")
+		assert.Equal(t, nil, err)
+
+		ctx, cf := context.WithCancel(context.Background())
+		session, err := gitwatch.New(
+			ctx,
+			[]gitwatch.Repository{{URL: "./test/local/failing-first"}, {URL: "./test/local/failing-second"}},
+			50*time.Millisecond,
+			"./test/failing/",
+			nil,
+			false,
+		)
+		assert.Equal(t, nil, err)
+		session.Concurrency = concurrency
+		go session.Run()
+		<-session.InitialDone
+
+		// the first repository failing doesn't stop the second being checked
+		err = os.RemoveAll("./test/local/failing-first")
+		assert.Equal(t, nil, err)
+		mockRepoChange("failing-second", "still checked", false)
+		var checked, reported bool
+		for !checked || !reported {
+			select {
+			case err := <-session.Errors:
+				var failed *gitwatch.Error
+				assert.T(t, errors.As(err, &failed))
+				assert.Equal(t, "./test/local/failing-first", failed.Repository)
+				reported = true
+			case e := <-session.Events:
+				assert.Equal(t, "add: still checked", e.Commit().Message)
+				checked = true
+			case <-time.After(5 * time.Second):
+				t.Fatal("not every repository was checked with concurrency", concurrency)
+			}
+		}
+
+		// rounds still finish, so the session stays healthy with the failing
+		// repository listed as retrying
+		before := session.Status().LastCheck
+		deadline := time.After(5 * time.Second)
+		for !session.Status().LastCheck.After(before) {
+			select {
+			case <-session.Errors:
+			case <-time.After(10 * time.Millisecond):
+			case <-deadline:
+				t.Fatal("no round finished with a failing repository")
+			}
+		}
+		assert.Equal(t, nil, session.Healthy())
+		_, retrying := session.Status().Retrying[filepath.Join("./test/failing/", "failing-first")]
+		assert.T(t, retrying)
+		session.Close()
+		cf()
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	a := server.Seed("concurrent-a.git", map[string]string{"README.md": "a"})
+	b := server.Seed("concurrent-b.git", map[string]string{"README.md": "b"})
+	err := os.RemoveAll("./test/concurrent")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{{URL: a.URL()}, {URL: b.URL()}},
+		100*time.Millisecond,
+		"./test/concurrent/",
+		nil,
+		false,
+	)
+	assert.Equal(t, nil, err)
+	session.Concurrency = 2
+
+	// each update waits for the other, which only arrives if both repositories
+	// are being checked at once
+	var inside int32
+	var once sync.Once
+	together := make(chan struct{})
+	session.BeforeUpdate = func(u gitwatch.PendingUpdate) error {
+		defer atomic.AddInt32(&inside, -1)
+		if atomic.AddInt32(&inside, 1) == 2 {
+			once.Do(func() { close(together) })
+		}
+		select {
+		case <-together:
+			return nil
+		case <-time.After(time.Second):
+			return errors.New("checked alone")
+		}
+	}
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+	go func() {
+		for range session.Errors {
+		}
+	}()
+
+	hashA := a.Commit("a", map[string]string{"README.md": "changed a"})
+	hashB := b.Commit("b", map[string]string{"README.md": "changed b"})
+	events := make(map[string]plumbing.Hash)
+	for len(events) < 2 {
+		select {
+		case e := <-session.Events:
+			events[e.URL] = e.Commit().Hash
+		case <-time.After(5 * time.Second):
+			t.Fatal("repositories weren't checked concurrently, got", events)
+		}
+	}
+	assert.Equal(t, hashA, events[a.URL()])
+	assert.Equal(t, hashB, events[b.URL()])
+}
+
+func TestStarted(t *testing.T) {
+	mockRepo("started-a")
+	mockRepo("started-b")
+	err := os.RemoveAll("./test/starting")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: "./test/local/started-a"}}, 100*time.Millisecond, "./test/starting/", nil, false)
+	assert.Equal(t, nil, err)
+	assert.T(t, !session.IsRunning())
+	go session.Run()
+	<-session.Started()
+	assert.T(t, session.IsRunning())
+
+	err = session.Add(gitwatch.Repository{URL: "./test/local/started-b"})
+	assert.Equal(t, nil, err)
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if _, err = os.Stat("./test/starting/started-b"); err == nil {
+			break
+		}
+	}
+	mockRepoChange("started-b", "added", false)
+	e := <-session.Events
+	assert.Equal(t, "./test/local/started-b", e.URL)
+
+	session.Close()
+	assert.T(t, !session.IsRunning())
+}
+
+func TestEmptySession(t *testing.T) {
+	mockRepo("fed-before")
+	mockRepo("fed-after")
+	err := os.RemoveAll("./test/feeding")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, nil, time.Hour, "./test/feeding/", nil, true)
+	assert.Equal(t, nil, err)
+	defer session.Close()
+
+	err = session.Add(gitwatch.Repository{URL: "./test/local/fed-before"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, session.Status().Repositories)
+	go session.Run()
+	assert.Equal(t, "./test/local/fed-before", (<-session.Events).URL)
+	<-session.Started()
+
+	err = session.Add(gitwatch.Repository{URL: "./test/local/fed-after"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "./test/local/fed-after", (<-session.Events).URL)
+	assert.Equal(t, 2, session.Status().Repositories)
+}
+
+func TestSetRepositories(t *testing.T) {
+	mockRepo("set-a")
+	mockRepo("set-b")
+	mockRepo("set-c")
+	err := os.RemoveAll("./test/setting")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: "./test/local/set-a"}, {URL: "./test/local/set-b"}}, 100*time.Millisecond, "./test/setting/", nil, false)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.Started()
+
+	err = session.AddAll([]gitwatch.Repository{{URL: "./test/local/set-c"}, {URL: "http://%zz"}})
+	assert.NotEqual(t, nil, err)
+	err = session.SetRepositories([]gitwatch.Repository{{URL: "./test/local/set-b"}, {URL: "./test/local/set-b", Directory: "set-b"}})
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, 2, session.Status().Repositories)
+
+	err = session.SetRepositories([]gitwatch.Repository{{URL: "./test/local/set-b", WatchTags: true}, {URL: "./test/local/set-c"}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, session.Status().Repositories)
+
+	mockRepoChange("set-a", "dropped", false)
+	mockRepoChange("set-c", "added", false)
+	e := <-session.Events
+	assert.Equal(t, "./test/local/set-c", e.URL)
+	select {
+	case e = <-session.Events:
+		t.Fatalf("unexpected event from %s", e.URL)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestRepositoryInterval(t *testing.T) {
+	fast := server.Seed("interval-fast.git", map[string]string{"README.md": "fast"})
+	slow := server.Seed("interval-slow.git", map[string]string{"README.md": "slow"})
+	err := os.RemoveAll("./test/intervals")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: slow.URL()}, {URL: fast.URL(), Interval: 50 * time.Millisecond}}, time.Hour, "./test/intervals/", nil, false)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	slow.Commit("slow", map[string]string{"README.md": "slow change"})
+	hash := fast.Commit("fast", map[string]string{"README.md": "fast change"})
+	e := <-session.Events
+	assert.Equal(t, fast.URL(), e.URL)
+	assert.Equal(t, hash, e.Commit().Hash)
+	select {
+	case e := <-session.Events:
+		t.Fatal("repository polled before its interval", e)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestDepth(t *testing.T) {
+	mockRepo("shallow")
+	mockRepoChange("shallow", "two", false)
+	mockRepoChange("shallow", "three", false)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: fullPath("./test/local/shallow"), Depth: 1, Webhook: true}}, 50*time.Millisecond, "./test/", nil, false)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	shallow, err := ioutil.ReadFile("./test/shallow/.git/shallow")
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, 0, len(shallow))
+
+	push := gitwatch.Push{URLs: []string{fullPath("./test/local/shallow")}, Ref: "refs/heads/master"}
+	mockRepoChange("shallow", "four", false)
+	go session.Notify(push)
+	e := <-session.Events
+	assert.Equal(t, "add: four", e.Commit().Message)
+	assert.Equal(t, []string{"file"}, e.Changed)
+
+	// more commits than the depth between checks
+	mockRepoChange("shallow", "five", false)
+	mockRepoChange("shallow", "six", false)
+	go session.Notify(push)
+	e = <-session.Events
+	assert.Equal(t, "add: six", e.Commit().Message)
+}
+
+func TestRemove(t *testing.T) {
+	a := server.Seed("removed-a.git", map[string]string{"README.md": "a"})
+	b := server.Seed("removed-b.git", map[string]string{"README.md": "b"})
+	err := os.RemoveAll("./test/removing")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: a.URL()}, {URL: b.URL()}}, 50*time.Millisecond, "./test/removing/", nil, false)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	err = session.Remove(a.URL())
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, nil, session.Remove(a.URL()))
+	a.Commit("unwatched", map[string]string{"README.md": "unwatched"})
+	hash := b.Commit("watched", map[string]string{"README.md": "watched"})
+	e := <-session.Events
+	assert.Equal(t, b.URL(), e.URL)
+	assert.Equal(t, hash, e.Commit().Hash)
+	_, err = os.Stat("./test/removing/removed-a.git")
+	assert.Equal(t, nil, err)
+
+	err = session.RemoveAndClean(b.URL())
+	assert.Equal(t, nil, err)
+	_, err = os.Stat("./test/removing/removed-b.git")
+	assert.T(t, os.IsNotExist(err))
+	assert.Equal(t, 0, session.Status().Repositories)
+}
+
+func TestTrace(t *testing.T) {
+	mockRepo("traced")
+	err := os.RemoveAll("./test/tracing")
+	assert.Equal(t, nil, err)
+	log := fullPath("./test/tracing.log")
+	os.Remove(log)
+	os.Remove("./test/tracing-audit.log")
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: "./test/local/traced"}}, time.Hour, "./test/tracing/", nil, true)
+	assert.Equal(t, nil, err)
+	sent := make(chan string, 2)
+	session.Sinks = []gitwatch.Sink{gitwatch.SinkFunc(func(ctx context.Context, e gitwatch.Event) error {
+		sent <- gitwatch.TraceFromContext(ctx)
+		return nil
+	})}
+	session.Exec = &gitwatch.ExecHook{Command: []string{"sh", "-c", `echo "$GITWATCH_TRACE_ID" >> ` + log}}
+	audit := &gitwatch.AuditFile{Path: "./test/tracing-audit.log"}
+	session.Audit = audit
+	go session.Run()
+	defer session.Close()
+
+	initial := <-session.Events
+	assert.Equal(t, 32, len(initial.TraceID))
+	assert.Equal(t, initial.TraceID, <-sent)
+	<-session.Started()
+
+	server := httptest.NewServer(gitwatch.Receiver{Session: session})
+	defer server.Close()
+	mockRepoChange("traced", "traced", false)
+	req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(`{"urls": ["./test/local/traced"], "ref": "refs/heads/master"}`))
+	assert.Equal(t, nil, err)
+	req.Header.Set(gitwatch.TraceHeader, "delivery-1")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+
+	e := <-session.Events
+	assert.Equal(t, "delivery-1", e.TraceID)
+	assert.Equal(t, "delivery-1", <-sent)
+
+	entries, err := audit.Entries(context.Background(), gitwatch.EventFilter{})
+	assert.Equal(t, nil, err)
+	last := entries[len(entries)-1]
+	assert.Equal(t, gitwatch.AuditPull, last.Op)
+	assert.Equal(t, "delivery-1", last.TraceID)
+
+	want := initial.TraceID + "\ndelivery-1\n"
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if b, _ := ioutil.ReadFile(log); string(b) == want {
+			return
+		}
+	}
+	b, _ := ioutil.ReadFile(log)
+	t.Fatalf("hook output %q, want %q", b, want)
+}
+
+func TestConfigWatch(t *testing.T) {
+	mockRepo("reconciled-a")
+	mockRepo("reconciled-b")
+	for _, dir := range []string{"./test/reconciling", "./test/reconciling-config"} {
+		err := os.RemoveAll(dir)
+		assert.Equal(t, nil, err)
+	}
+	config := func(repo string) map[string]string {
+		return map[string]string{"gitwatch.yaml": "directory: ./test/reconciling/\ninterval: 100ms\nrepositories:\n  - url: ./test/local/" + repo + "\n"}
+	}
+	remote := server.Seed("reconciled-config.git", config("reconciled-a"))
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	w := gitwatch.ConfigWatch{Repository: remote.URL(), Path: "gitwatch.yaml", Directory: "./test/reconciling-config"}
+	c, err := w.Load(ctx)
+	assert.Equal(t, nil, err)
+	session, err := gitwatch.NewFromConfig(ctx, c)
+	assert.Equal(t, nil, err)
+	session.ConfigWatch = &w
+	go session.Run()
+	defer session.Close()
+
+	e := <-session.Events
+	assert.Equal(t, gitwatch.EventConfigApplied, e.Type)
+	assert.Equal(t, remote.URL(), e.URL)
+	<-session.Started()
+
+	remote.Commit("watch b instead", config("reconciled-b"))
+	e = <-session.Events
+	assert.Equal(t, gitwatch.EventConfigApplied, e.Type)
+	mockRepoChange("reconciled-a", "dropped", false)
+	mockRepoChange("reconciled-b", "added", false)
+	e = <-session.Events
+	assert.Equal(t, "./test/local/reconciled-b", e.URL)
+
+	remote.Commit("move", map[string]string{"gitwatch.yaml": "directory: ./test/elsewhere/\ninterval: 100ms\n"})
+	e = <-session.Events
+	assert.Equal(t, gitwatch.EventConfigError, e.Type)
+	assert.T(t, strings.Contains(e.Error, "directory can't change"))
+	select {
+	case e = <-session.Events:
+		t.Fatalf("unexpected %s event", e.Type)
+	case <-time.After(300 * time.Millisecond):
+	}
+	assert.Equal(t, 1, session.Status().Repositories)
+}
+
+func TestReloadConfig(t *testing.T) {
+	mockRepo("reloaded-a")
+	mockRepo("reloaded-b")
+	err := os.RemoveAll("./test/reloading")
+	assert.Equal(t, nil, err)
+	config := func(repo string) {
+		err := ioutil.WriteFile("./test/reloading.yaml", []byte("directory: ./test/reloading/\ninterval: 100ms\nrepositories:\n  - url: ./test/local/"+repo+"\n"), 0600)
+		assert.Equal(t, nil, err)
+	}
+	config("reloaded-a")
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	w := gitwatch.ConfigWatch{Path: "./test/reloading.yaml", Manual: true}
+	c, err := w.Load(ctx)
+	assert.Equal(t, nil, err)
+	session, err := gitwatch.NewFromConfig(ctx, c)
+	assert.Equal(t, nil, err)
+	session.ConfigWatch = &w
+	go session.Run()
+	defer session.Close()
+
+	e := <-session.Events
+	assert.Equal(t, gitwatch.EventConfigApplied, e.Type)
+	<-session.Started()
+
+	// a manual ConfigWatch isn't read again between checks
+	config("reloaded-b")
+	select {
+	case e = <-session.Events:
+		t.Fatalf("unexpected %s event", e.Type)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	go session.ReloadConfig()
+	e = <-session.Events
+	assert.Equal(t, gitwatch.EventConfigApplied, e.Type)
+	mockRepoChange("reloaded-b", "added", false)
+	e = <-session.Events
+	assert.Equal(t, "./test/local/reloaded-b", e.URL)
+	assert.Equal(t, 1, session.Status().Repositories)
+}
+
+func TestClose(t *testing.T) {
+	mockRepo("closed")
+	err := os.RemoveAll("./test/closing")
+	assert.Equal(t, nil, err)
+
+	session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: "./test/local/closed"}}, 100*time.Millisecond, "./test/closing/", nil, true)
+	assert.Equal(t, nil, err)
+	ran := make(chan error, 1)
+	go func() { ran <- session.Run() }()
+	<-session.Started()
+
+	// the initial event is never read
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() { errs <- session.Close() }()
+	}
+	first := <-errs
+	assert.NotEqual(t, nil, first)
+	assert.T(t, strings.Contains(first.Error(), "1 events never read"))
+	assert.Equal(t, first, <-errs)
+	assert.Equal(t, first, <-errs)
+	assert.Equal(t, first, session.Close())
+
+	select {
+	case err = <-ran:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+	assert.T(t, !session.IsRunning())
+
+	session, err = gitwatch.New(context.Background(), []gitwatch.Repository{{URL: "./test/local/closed"}}, 100*time.Millisecond, "./test/closing/", nil, true)
+	assert.Equal(t, nil, err)
+	go session.Run()
+	<-session.Events
+	<-session.Started()
+	assert.Equal(t, nil, session.Close())
+}
+
+func TestOnEvent(t *testing.T) {
+	mockRepo("handled")
+	err := os.RemoveAll("./test/handling")
+	assert.Equal(t, nil, err)
+
+	session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: "./test/local/handled"}}, 100*time.Millisecond, "./test/handling/", nil, true)
+	assert.Equal(t, nil, err)
+	events := make(chan gitwatch.Event, 4)
+	session.OnEvent(func(e gitwatch.Event) { events <- e })
+	session.OnError(func(err error) { t.Errorf("unexpected error: %v", err) })
+	go session.Run()
+	<-session.Started()
+
+	e := <-events
+	assert.Equal(t, gitwatch.EventCommit, e.Type)
+	assert.Equal(t, "./test/local/handled", e.URL)
+	mockRepoChange("handled", "handled", false)
+	e = <-events
+	assert.Equal(t, "add: handled", e.Commit().Message)
+
+	// handlers replace the channels, so nothing is left unread
+	assert.Equal(t, nil, session.Close())
+}
+
+func TestEventDelivery(t *testing.T) {
+	var repos []gitwatch.Repository
+	for _, name := range []string{"delivered-a", "delivered-b", "delivered-c"} {
+		mockRepo(name)
+		repos = append(repos, gitwatch.Repository{URL: "./test/local/" + name})
+	}
+	err := os.RemoveAll("./test/delivering")
+	assert.Equal(t, nil, err)
+
+	session, err := gitwatch.New(context.Background(), repos, time.Hour, "./test/delivering/", nil, true)
+	assert.Equal(t, nil, err)
+	session.Events = make(chan gitwatch.Event)
+	session.EventDelivery = gitwatch.DeliverDropOldest
+	session.EventQueue = 1
+	go session.Run()
+	<-session.Started()
+
+	// one event is being handed over and one waits, the rest were dropped
+	var read []gitwatch.Event
+	for done := false; !done; {
+		select {
+		case e := <-session.Events:
+			read = append(read, e)
+		case <-time.After(200 * time.Millisecond):
+			done = true
+		}
+	}
+	assert.T(t, len(read) >= 1 && len(read) <= 2)
+	assert.Equal(t, "./test/local/delivered-c", read[len(read)-1].URL)
+	assert.Equal(t, uint64(3-len(read)), session.Status().DroppedEvents)
+	assert.Equal(t, nil, session.Close())
+
+	// events nobody reads are counted, not left on blocked goroutines
+	err = os.RemoveAll("./test/delivering")
+	assert.Equal(t, nil, err)
+	session, err = gitwatch.New(context.Background(), repos, time.Hour, "./test/delivering/", nil, true)
+	assert.Equal(t, nil, err)
+	session.Events = make(chan gitwatch.Event)
+	go session.Run()
+	<-session.Started()
+	err = session.Close()
+	assert.NotEqual(t, nil, err)
+	assert.T(t, strings.Contains(err.Error(), "3 events never read"))
+}
+
+func TestBacklog(t *testing.T) {
+	var repos []gitwatch.Repository
+	for _, name := range []string{"backlog-a", "backlog-b", "backlog-c", "backlog-d"} {
+		mockRepo(name)
+		repos = append(repos, gitwatch.Repository{URL: "./test/local/" + name})
+	}
+	err := os.RemoveAll("./test/backlog")
+	assert.Equal(t, nil, err)
+
+	type crossing struct {
+		over    bool
+		backlog int
+	}
+	crossings := make(chan crossing, 8)
+	session, err := gitwatch.New(context.Background(), repos, time.Hour, "./test/backlog/", nil, true)
+	assert.Equal(t, nil, err)
+	session.Events = make(chan gitwatch.Event)
+	session.EventDelivery = gitwatch.DeliverDropOldest
+	session.EventQueue = 2
+	session.BacklogLimit = 1
+	session.OnBacklog = func(status gitwatch.Status, over bool) {
+		crossings <- crossing{over, status.EventBacklog}
+	}
+	go session.Run()
+	defer session.Close()
+	<-session.Started()
+
+	// nobody reads the events, so the backlog rises over the limit once and
+	// the oldest are dropped to keep it at the queue's size
+	c := <-crossings
+	assert.Equal(t, crossing{true, 2}, c)
+	status := session.Status()
+	assert.T(t, status.EventBacklog >= 2 && status.EventBacklog <= 3, status.EventBacklog)
+	assert.Equal(t, uint64(4-status.EventBacklog), status.DroppedEvents)
+
+	// reading them brings it back under, which is reported once too
+	for i := 0; i < status.EventBacklog; i++ {
+		<-session.Events
+	}
+	c = <-crossings
+	assert.T(t, !c.over && c.backlog <= 1, c)
+	assert.Equal(t, 0, len(crossings))
+}
+
+func TestBacklogPause(t *testing.T) {
+	mockRepo("paused-a")
+	mockRepo("paused-b")
+	err := os.RemoveAll("./test/paused")
+	assert.Equal(t, nil, err)
+
+	session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: "./test/local/paused-a"}, {URL: "./test/local/paused-b"}}, 20*time.Millisecond, "./test/paused/", nil, true)
+	assert.Equal(t, nil, err)
+	session.Events = make(chan gitwatch.Event)
+	session.BacklogLimit = 1
+	session.BacklogPause = true
+	go session.Run()
+	defer session.Close()
+	<-session.Started()
+
+	// the two unread initial events are over the limit, so no checks are made
+	mockRepoChange("paused-a", "while paused", false)
+	time.Sleep(100 * time.Millisecond)
+	paused := session.Status().LastCheck
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, paused, session.Status().LastCheck)
+
+	// until they've been read
+	<-session.Events
+	<-session.Events
+	e := <-session.Events
+	assert.Equal(t, "add: while paused", e.Commit().Message)
+}
+
+func TestShutdown(t *testing.T) {
+	mockRepo("shut-down")
+	err := os.RemoveAll("./test/shutting-down")
+	assert.Equal(t, nil, err)
+	marker, err := filepath.Abs("./test/shut-down-hook")
+	assert.Equal(t, nil, err)
+	os.Remove(marker)
+
+	session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: "./test/local/shut-down"}}, 100*time.Millisecond, "./test/shutting-down/", nil, true)
+	assert.Equal(t, nil, err)
+	session.Exec = &gitwatch.ExecHook{Command: []string{"sh", "-c", "sleep 0.3 && touch " + marker}}
+	ran := make(chan error, 1)
+	go func() { ran <- session.Run() }()
+	read := make(chan int)
+	go func() {
+		n := 0
+		for range session.Events {
+			n++
+		}
+		read <- n
+	}()
+	<-session.Started()
+
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	assert.Equal(t, nil, session.Shutdown(ctx))
+	assert.Equal(t, 1, <-read)
+	assert.Equal(t, context.Canceled, <-ran)
+	_, err = os.Stat(marker)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, session.Close())
+
+	// a deadline cuts the wait short
+	err = os.RemoveAll("./test/shutting-down")
+	assert.Equal(t, nil, err)
+	session, err = gitwatch.New(context.Background(), []gitwatch.Repository{{URL: "./test/local/shut-down"}}, 100*time.Millisecond, "./test/shutting-down/", nil, true)
+	assert.Equal(t, nil, err)
+	session.Exec = &gitwatch.ExecHook{Command: []string{"sleep", "5"}, Grace: 100 * time.Millisecond}
+	go session.Run()
+	<-session.Events
+	<-session.Started()
+	ctx, cf = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cf()
+	err = session.Shutdown(ctx)
+	assert.NotEqual(t, nil, err)
+	assert.T(t, strings.Contains(err.Error(), "deliveries interrupted"))
+}
+
+func TestThrottle(t *testing.T) {
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+	// a different host name from the test server's, which keeps being checked
+	url := strings.Replace(limited.URL, "127.0.0.1", "localhost", 1) + "/limited.git"
+	r := server.Seed("unlimited.git", map[string]string{"README.md": "unlimited"})
+	err := os.RemoveAll("./test/throttling")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: url}, {URL: r.URL()}}, 10*time.Millisecond, "./test/throttling/", nil, false)
+	assert.Equal(t, nil, err)
+	session.ErrorPolicy = gitwatch.ErrorsResilient
+	go session.Run()
+	defer session.Close()
+
+	err = <-session.Errors
+	assert.T(t, strings.Contains(err.Error(), "rate limited by localhost"), err)
+
+	// the throttled hosts are read while checks of the other host unthrottle it
+	for i := 0; i < 20; i++ {
+		until, ok := session.Status().Throttled["localhost"]
+		assert.T(t, ok)
+		assert.T(t, time.Until(until) > 50*time.Second)
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	var urls []string
+	for _, name := range []string{"concurrent-a", "concurrent-b", "concurrent-c", "concurrent-d"} {
+		mockRepo(name)
+		urls = append(urls, "./test/local/"+name)
+	}
+	err := os.RemoveAll("./test/concurrent")
+	assert.Equal(t, nil, err)
+
+	session, err := gitwatch.New(context.Background(), nil, 10*time.Millisecond, "./test/concurrent/", nil, false)
+	assert.Equal(t, nil, err)
+	session.OnEvent(func(gitwatch.Event) {})
+	session.OnError(func(error) {})
+
+	// Run, Add, Remove and Status race each other, then Close joins in
+	var wg sync.WaitGroup
+	ran := make(chan error, 1)
+	go func() { ran <- session.Run() }()
+	for _, url := range urls {
+		url := url
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				session.Add(gitwatch.Repository{URL: url})
+				time.Sleep(5 * time.Millisecond)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				session.Remove(url)
+				time.Sleep(7 * time.Millisecond)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				session.Status()
+				time.Sleep(3 * time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, nil, session.Close())
+	assert.Equal(t, context.Canceled, <-ran)
+	session.Status()
+}
+
+func TestAsyncHandlers(t *testing.T) {
+	err := os.RemoveAll("./test/handling-async")
+	assert.Equal(t, nil, err)
+
+	session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: "./test/local/async-missing"}}, time.Millisecond, "./test/handling-async/", nil, false)
+	assert.Equal(t, nil, err)
+	session.ErrorPolicy = gitwatch.ErrorsResilient
+	session.AsyncHandlers = true
+	session.CloseTimeout = time.Second
+	var running, most int32
+	release := make(chan struct{})
+	session.OnError(func(error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&running, -1)
+	})
+	ran := make(chan error, 1)
+	go func() { ran <- session.Run() }()
+
+	// every check fails, but the handlers stuck on release don't pile up
+	time.Sleep(300 * time.Millisecond)
+	assert.T(t, atomic.LoadInt32(&most) > 1)
+	assert.T(t, atomic.LoadInt32(&most) <= 8, atomic.LoadInt32(&most))
+
+	// and the daemon waiting for room in the queue gives up once closed
+	assert.Equal(t, nil, session.Close())
+	assert.Equal(t, context.Canceled, <-ran)
+	close(release)
+}
+
+func TestCloseTimeout(t *testing.T) {
+	mockRepo("close-timeout")
+	err := os.RemoveAll("./test/closing-late")
+	assert.Equal(t, nil, err)
+
+	url := "./test/local/close-timeout"
+	session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: url}}, 10*time.Millisecond, "./test/closing-late/", nil, true)
+	assert.Equal(t, nil, err)
+	session.CloseTimeout = 50 * time.Millisecond
+	entered, release := make(chan struct{}), make(chan struct{})
+	session.OnEvent(func(gitwatch.Event) {
+		close(entered)
+		<-release
+	})
+	ran := make(chan error, 1)
+	go func() { ran <- session.Run() }()
+	<-entered
+
+	// the daemon is stuck in the handler, so it's still running after Close
+	err = session.Close()
+	assert.T(t, strings.Contains(err.Error(), "checks still running"), err)
+	assert.T(t, session.IsRunning())
+	// and calls meant for it aren't run alongside it
+	assert.Equal(t, context.Canceled, session.Resume(url))
+
+	close(release)
+	<-ran
+	assert.T(t, !session.IsRunning())
+}
+
+func TestFakeWatcher(t *testing.T) {
+	fake := gitwatchtest.New(1, gitwatch.Repository{URL: "https://example.com/a.git"})
+	var w gitwatch.Watcher = fake
+	go w.Run()
+	<-w.Started()
+	assert.T(t, w.IsRunning())
+
+	fake.Emit(gitwatch.Event{Type: gitwatch.EventCommit, URL: "https://example.com/a.git"}.WithCommit(object.Commit{Message: "faked"}))
+	e := <-w.EventStream()
+	assert.Equal(t, "faked", e.Commit().Message)
+	fake.Fail(errors.New("failed"))
+	assert.Equal(t, "failed", (<-w.ErrorStream()).Error())
+
+	hash := plumbing.NewHash("0123456789012345678901234567890123456789")
+	assert.Equal(t, nil, w.Rollback("https://example.com/a.git", hash))
+	assert.NotEqual(t, nil, w.Rollback("https://example.com/b.git", hash))
+	rolledBack, ok := fake.RolledBack("https://example.com/a.git")
+	assert.T(t, ok)
+	assert.Equal(t, hash, rolledBack)
+
+	assert.Equal(t, nil, w.Add(gitwatch.Repository{URL: "https://example.com/b.git"}))
+	assert.Equal(t, 2, w.Status().Repositories)
+	w.Close()
+	assert.NotEqual(t, nil, w.Healthy())
+}
+
+func TestManager(t *testing.T) {
+	mockRepo("managed-staging")
+	mockRepo("managed-production")
+	err := os.RemoveAll("./test/managing")
+	assert.Equal(t, nil, err)
+
+	watch := func(name string) *gitwatch.Session {
+		session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: "./test/local/" + name}}, 50*time.Millisecond, "./test/managing/", nil, true)
+		assert.Equal(t, nil, err)
+		session.ErrorPolicy = gitwatch.ErrorsResilient
+		return session
+	}
+	m := gitwatch.NewManager()
+	staging, production := watch("managed-staging"), watch("managed-production")
+	assert.Equal(t, nil, m.Add("staging", staging))
+	assert.Equal(t, nil, m.Add("production", production))
+	assert.NotEqual(t, nil, m.Add("staging", staging))
+	assert.Equal(t, staging, m.Session("staging"))
+
+	// both sessions' initial events arrive on the manager's channel, tagged
+	m.Start()
+	urls := map[string]string{}
+	for len(urls) < 2 {
+		e := <-m.Events
+		urls[e.Session] = e.URL
+	}
+	assert.Equal(t, map[string]string{"staging": "./test/local/managed-staging", "production": "./test/local/managed-production"}, urls)
+
+	// a session added to a started manager is started too, and its errors
+	// are tagged as well
+	broken := watch("managed-missing")
+	assert.Equal(t, nil, m.Add("broken", broken))
+	failure := <-m.Errors
+	assert.Equal(t, "broken", failure.Session)
+	var failed *gitwatch.Error
+	assert.T(t, errors.As(failure, &failed))
+	assert.Equal(t, "./test/local/managed-missing", failed.Repository)
+
+	mockRepoChange("managed-production", "released", false)
+	for {
+		e := <-m.Events
+		if e.Type == gitwatch.EventCommit && e.Session == "production" && e.Commit().Message == "add: released" {
+			break
+		}
+	}
+	assert.Equal(t, 3, len(m.Status()))
+
+	// Stop closes every session and returns once they've all finished
+	m.Stop()
+	for _, session := range []*gitwatch.Session{staging, production, broken} {
+		assert.T(t, !session.IsRunning())
+	}
+	m.Stop()
+}
+
+func TestErrorRecords(t *testing.T) {
+	err := os.RemoveAll("./test/recording-errors")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: "./test/local/missing"}}, 50*time.Millisecond, "./test/recording-errors/", nil, false)
+	assert.Equal(t, nil, err)
+	session.ErrorPolicy = gitwatch.ErrorsResilient
+	session.ErrorRecords = make(chan gitwatch.ErrorRecord)
+	go session.Run()
+	defer session.Close()
+
+	for retries := 0; retries < 2; retries++ {
+		err := <-session.Errors
+		r := <-session.ErrorRecords
+		assert.Equal(t, "check", r.Op)
+		assert.Equal(t, "./test/local/missing", r.URL)
+		assert.Equal(t, gitwatch.ErrorClassNotFound, r.Class)
+		assert.Equal(t, retries, r.Retries)
+		assert.Equal(t, err.Error(), r.Message)
+
+		var e *gitwatch.Error
+		assert.T(t, errors.As(err, &e))
+		assert.Equal(t, "./test/local/missing", e.Repository)
+		assert.Equal(t, gitwatch.StageClone, e.Stage)
+	}
+}
+
+func TestOperationTimeout(t *testing.T) {
+	// a remote that accepts connections and never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer l.Close()
+	var conns []net.Conn
+	var mu sync.Mutex
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+		}
+	}()
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	err = os.RemoveAll("./test/timing-out")
+	assert.Equal(t, nil, err)
+	url := "http://" + l.Addr().String() + "/hung.git"
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: url, Timeout: 200 * time.Millisecond}}, 50*time.Millisecond, "./test/timing-out/", nil, false)
+	assert.Equal(t, nil, err)
+	session.OperationTimeout = time.Hour
+	session.ErrorPolicy = gitwatch.ErrorsResilient
+	session.ErrorRecords = make(chan gitwatch.ErrorRecord, 1)
+	go session.Run()
+	defer session.Close()
+
+	select {
+	case err := <-session.Errors:
+		var e *gitwatch.Error
+		assert.T(t, errors.As(err, &e))
+		assert.Equal(t, gitwatch.StageClone, e.Stage)
+		assert.T(t, strings.Contains(err.Error(), "timed out after 200ms"), err)
+		assert.Equal(t, gitwatch.ErrorClassNetwork, (<-session.ErrorRecords).Class)
+	case <-time.After(5 * time.Second):
+		t.Fatal("hung clone wasn't abandoned")
+	}
+
+	// the abandoned clone is still running, so the repository isn't checked
+	select {
+	case err := <-session.Errors:
+		t.Fatal("checked while the abandoned clone was running:", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// once the hung connections fail, checks start again
+	mu.Lock()
+	for _, c := range conns {
+		c.Close()
+	}
+	mu.Unlock()
+	select {
+	case <-session.Errors:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not checked after the abandoned clone returned")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	err := os.RemoveAll("./test/retrying")
+	assert.Equal(t, nil, err)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	url := "./test/local/missing-retry"
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: url}}, 20*time.Millisecond, "./test/retrying/", nil, false)
+	assert.Equal(t, nil, err)
+	session.ErrorPolicy = gitwatch.ErrorsResilient
+	session.Retry = gitwatch.RetryPolicy{MaxAttempts: 3, MinBackoff: 100 * time.Millisecond}
+	go session.Run()
+	defer session.Close()
+
+	// each retry waits twice as long as the last, until the attempts run out
+	var times []time.Time
+	for i := 0; i < 3; i++ {
+		err := <-session.Errors
+		times = append(times, time.Now())
+		assert.Equal(t, i == 2, strings.Contains(err.Error(), "gave up after 3 failed checks"), err)
+	}
+	assert.T(t, times[1].Sub(times[0]) >= 80*time.Millisecond)
+	assert.T(t, times[2].Sub(times[1]) >= 180*time.Millisecond)
+	select {
+	case err := <-session.Errors:
+		t.Fatal("checked after giving up:", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	path := filepath.Join("./test/retrying/", "missing-retry")
+	r := session.Status().Retrying[path]
+	assert.Equal(t, url, r.URL)
+	assert.Equal(t, 3, r.Attempts)
+	assert.T(t, r.NextRetry.IsZero())
+
+	assert.Equal(t, nil, session.Resume(url))
+	<-session.Errors
+	assert.Equal(t, 1, session.Status().Retrying[path].Attempts)
+
+	// an unreachable remote is retried rather than deleted and recloned
+	unreachable := gitwatchtest.NewServer()
+	remote := unreachable.Seed("retried.git", map[string]string{"README.md": "first"})
+	err = os.RemoveAll("./test/retrying-remote")
+	assert.Equal(t, nil, err)
+	session, err = gitwatch.New(ctx, []gitwatch.Repository{{URL: remote.URL()}}, 20*time.Millisecond, "./test/retrying-remote/", nil, false)
+	assert.Equal(t, nil, err)
+	session.ErrorPolicy = gitwatch.ErrorsResilient
+	session.AllowDeletion = true
+	go session.Run()
+	defer session.Close()
+	<-session.Started()
+	unreachable.Close()
+
+	<-session.Errors
+	<-session.Errors
+	_, err = os.Stat("./test/retrying-remote/retried.git/README.md")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, session.Status().Retrying[filepath.Join("./test/retrying-remote/", "retried.git")].Attempts)
+}
+
+func TestRecovery(t *testing.T) {
+	r := server.Seed("recovered.git", map[string]string{"README.md": "one"})
+	err := os.RemoveAll("./test/recovering")
+	assert.Equal(t, nil, err)
+	clone := "./test/recovering/recovered.git"
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	watch := func(recovery gitwatch.RecoveryStrategy, hook gitwatch.UpdateHook) *gitwatch.Session {
+		session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: r.URL()}}, 50*time.Millisecond, "./test/recovering/", nil, false)
+		assert.Equal(t, nil, err)
+		session.ErrorPolicy = gitwatch.ErrorsResilient
+		session.Recovery = recovery
+		session.BeforeUpdate = hook
+		go session.Run()
+		return session
+	}
+	session := watch(gitwatch.RecoverReport, nil)
+	<-session.InitialDone
+	assert.Equal(t, nil, session.Close())
+
+	// local changes stop the pull, a reset discards them
+	err = ioutil.WriteFile(clone+"/README.md", []byte("local"), 0644)
+	assert.Equal(t, nil, err)
+	two := r.Commit("two", map[string]string{"README.md": "two"})
+	session = watch(gitwatch.RecoverReset, nil)
+	e := <-session.Events
+	assert.Equal(t, two, e.Commit().Hash)
+	assert.Equal(t, nil, session.Close())
+	contents, err := ioutil.ReadFile(clone + "/README.md")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "two", string(contents))
+
+	// by default they're only reported
+	err = ioutil.WriteFile(clone+"/README.md", []byte("local"), 0644)
+	assert.Equal(t, nil, err)
+	r.Commit("three", map[string]string{"README.md": "three"})
+	session = watch(gitwatch.RecoverReport, nil)
+	err = <-session.Errors
+	assert.T(t, strings.Contains(err.Error(), "unstaged changes"), err)
+	assert.Equal(t, nil, session.Close())
+	contents, err = ioutil.ReadFile(clone + "/README.md")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "local", string(contents))
+
+	// fetching and resetting drops a local commit the remote doesn't have
+	repo, err := git.PlainOpen(clone)
+	assert.Equal(t, nil, err)
+	wt, err := repo.Worktree()
+	assert.Equal(t, nil, err)
+	err = ioutil.WriteFile(clone+"/local.txt", []byte("local"), 0644)
+	assert.Equal(t, nil, err)
+	_, err = wt.Add("local.txt")
+	assert.Equal(t, nil, err)
+	local, err := wt.Commit("local", &git.CommitOptions{Author: &object.Signature{Name: "test", Email: "test@test.com", When: time.Now()}})
+	assert.Equal(t, nil, err)
+	four := r.Commit("four", map[string]string{"README.md": "four"})
+
+	// neither strategy goes around a BeforeUpdate hook rejecting the update
+	reject := func(gitwatch.PendingUpdate) error { return errors.New("rejected") }
+	session = watch(gitwatch.RecoverFetchReset, reject)
+	err = <-session.Errors
+	assert.T(t, strings.Contains(err.Error(), "deferred"), err)
+	assert.Equal(t, nil, session.Close())
+	session = watch(gitwatch.RecoverReclone, reject)
+	err = <-session.Errors
+	assert.T(t, strings.Contains(err.Error(), "not re-cloned"), err)
+	assert.Equal(t, nil, session.Close())
+	_, err = os.Stat(clone + "/local.txt")
+	assert.Equal(t, nil, err)
+
+	session = watch(gitwatch.RecoverFetchReset, nil)
+	e = <-session.Events
+	assert.Equal(t, four, e.Commit().Hash)
+	assert.T(t, e.Forced)
+	assert.Equal(t, local.String(), e.From)
+	assert.Equal(t, nil, session.Close())
+	_, err = os.Stat(clone + "/local.txt")
+	assert.T(t, os.IsNotExist(err))
+}
+
+func TestExecSupersede(t *testing.T) {
+	mockRepo("superseded")
+	err := os.RemoveAll("./test/superseding")
+	assert.Equal(t, nil, err)
+	log := fullPath("./test/superseding.log")
+	os.Remove(log)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{{URL: "./test/local/superseded"}},
+		100*time.Millisecond,
+		"./test/superseding/",
+		nil,
+		true,
+	)
+	assert.Equal(t, nil, err)
+	session.Exec = &gitwatch.ExecHook{
+		Command:   []string{"sh", "-c", `trap 'echo stopped >> ` + log + `; exit 1' TERM; echo "$GITWATCH_COMMIT" >> ` + log + `; sleep 5 & wait`},
+		Supersede: gitwatch.SupersedeCancel,
+	}
+	go session.Run()
+	defer session.Close()
+	first := <-session.Events
+	<-session.InitialDone
+
+	mockRepoChange("superseded", "newer", false)
+	second := <-session.Events
+
+	want := first.Commit().Hash.String() + "\nstopped\n" + second.Commit().Hash.String() + "\n"
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if b, _ := ioutil.ReadFile(log); string(b) == want {
+			return
+		}
+	}
+	b, _ := ioutil.ReadFile(log)
+	t.Fatalf("hook output %q, want %q", b, want)
+}
+
+func TestExecQueue(t *testing.T) {
+	mockRepo("queued-a")
+	mockRepo("queued-b")
+	err := os.RemoveAll("./test/queueing")
+	assert.Equal(t, nil, err)
+	log, gate := fullPath("./test/queueing.log"), fullPath("./test/queueing.gate")
+	os.Remove(log)
+	os.Remove(gate)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(
+		ctx,
+		[]gitwatch.Repository{{URL: "./test/local/queued-a"}, {URL: "./test/local/queued-b"}},
+		50*time.Millisecond,
+		"./test/queueing/",
+		nil,
+		false,
+	)
+	assert.Equal(t, nil, err)
+	session.ExecLimit = 1
+	session.Exec = &gitwatch.ExecHook{
+		Command:  []string{"sh", "-c", `echo "$GITWATCH_COMMIT" >> ` + log + `; while [ ! -f ` + gate + ` ]; do sleep 0.05; done`},
+		Coalesce: true,
+	}
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	change := func(name, contents string) string {
+		mockRepoChange(name, contents, false)
+		e := <-session.Events
+		return e.Commit().Hash.String()
+	}
+	lines := func() []string {
+		b, _ := ioutil.ReadFile(log)
+		return strings.Fields(string(b))
+	}
+
+	a1 := change("queued-a", "a1")
+	b1 := change("queued-b", "b1")
+	change("queued-a", "a2")
+	a3 := change("queued-a", "a3")
+
+	// a1 holds the only slot, b1 waits for it and a2 was replaced by a3
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, []string{a1}, lines())
+
+	err = ioutil.WriteFile(gate, nil, 0644)
+	assert.Equal(t, nil, err)
+	for deadline := time.Now().Add(2 * time.Second); len(lines()) < 3 && time.Now().Before(deadline); {
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	got := lines()
+	assert.Equal(t, 3, len(got))
+	assert.Equal(t, a1, got[0])
+	if !(got[1] == b1 && got[2] == a3 || got[1] == a3 && got[2] == b1) {
+		t.Fatal("unexpected hook runs", got)
+	}
+}
+
+func TestArtifacts(t *testing.T) {
+	dir := "./test/artifacts"
+	err := os.RemoveAll(dir)
+	assert.Equal(t, nil, err)
+
+	e := gitwatch.Event{Type: gitwatch.EventCommit, URL: "./test/local/a", Path: "test/a", Branch: "it's"}
+	err = gitwatch.Artifacts{Dir: dir}.Send(ctx, e)
+	assert.Equal(t, nil, err)
+	err = gitwatch.Artifacts{Dir: dir, Env: true}.Send(ctx, e)
+	assert.Equal(t, nil, err)
+
+	files, err := ioutil.ReadDir(dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(files))
+	assert.T(t, strings.HasSuffix(files[0].Name(), "-a-commit.json"))
+	assert.T(t, strings.HasSuffix(files[1].Name(), "-a-commit.env"))
+
+	env, err := ioutil.ReadFile(filepath.Join(dir, files[1].Name()))
+	assert.Equal(t, nil, err)
+	assert.T(t, strings.Contains(string(env), `GITWATCH_BRANCH='it'\''s'`))
+}
+
+func TestChangelog(t *testing.T) {
+	dir := "./test/changelogs"
+	err := os.RemoveAll(dir)
+	assert.Equal(t, nil, err)
+
+	e := gitwatch.Event{Type: gitwatch.EventCommit, URL: "./test/local/a", Path: "test/a", CommitTypes: []gitwatch.CommitType{
+		{Hash: "3333333333", Description: "tidy up"},
+		{Hash: "2222222222", Type: "fix", Scope: "api", Description: "handle empty bodies"},
+		{Hash: "1111111111", Type: "feat", Breaking: true, Description: "drop v1"},
+	}}
+	err = gitwatch.Changelog{Dir: dir}.Enrich(&e)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `### Breaking Changes
+
+- drop v1 (1111111)
+
+### Bug Fixes
+
+- **api:** handle empty bodies (2222222)
+
+### Other Changes
+
+- tidy up (3333333)
+`, e.Changelog)
+
+	files, err := ioutil.ReadDir(dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(files))
+	assert.T(t, strings.HasSuffix(files[0].Name(), "-a-commit.md"))
+}
+
+func TestSinkOverflow(t *testing.T) {
+	var repos []gitwatch.Repository
+	for _, name := range []string{"overflow-a", "overflow-b", "overflow-c"} {
+		mockRepo(name)
+		repos = append(repos, gitwatch.Repository{URL: "./test/local/" + name})
+	}
+	err := os.RemoveAll("./test/overflowing")
+	assert.Equal(t, nil, err)
+	dead := gitwatch.DeadLetterDir("./test/overflowing/dead")
+
+	session, err := gitwatch.New(context.Background(), repos, time.Hour, "./test/overflowing/", nil, true)
+	assert.Equal(t, nil, err)
+	release := make(chan struct{})
+	session.Sinks = []gitwatch.Sink{gitwatch.SinkFunc(func(ctx context.Context, e gitwatch.Event) error {
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return nil
+	})}
+	session.SinkRetry.QueueSize = 1
+	session.DeadLetter = dead
+	go session.Run()
+	defer session.Close()
+	defer close(release)
+
+	// the stuck sink holds one event and its queue another, so the rest are
+	// dropped, reported and stored
+	events, errs := 0, 0
+	started := session.Started()
+	for events < 3 || started != nil {
+		select {
+		case <-session.Events:
+			events++
+		case err := <-session.Errors:
+			assert.T(t, strings.Contains(err.Error(), "queue is full"), err)
+			errs++
+		case <-started:
+			started = nil
+		}
+	}
+	dropped := int(session.SinkStats()[0].Dropped)
+	assert.T(t, dropped >= 1, dropped)
+	assert.Equal(t, dropped, errs)
+
+	var letters []gitwatch.Letter
+	err = dead.Replay(func(l gitwatch.Letter) error {
+		letters = append(letters, l)
+		return nil
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, dropped, len(letters))
+	assert.Equal(t, "sink delivery queue is full", letters[0].Error)
+	assert.T(t, strings.HasPrefix(letters[0].Event.URL, "./test/local/overflow-"), letters[0].Event.URL)
+}
+
+func TestDeadLetter(t *testing.T) {
+	mockRepo("dead-lettered")
+	err := os.RemoveAll("./test/dead-lettering")
+	assert.Equal(t, nil, err)
+	dead := gitwatch.DeadLetterDir("./test/dead-lettering/dead")
+
+	session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: "./test/local/dead-lettered"}}, time.Hour, "./test/dead-lettering/", nil, true)
+	assert.Equal(t, nil, err)
+	var broken int32 = 1
+	delivered := make(chan gitwatch.Event, 1)
+	sink := gitwatch.SinkFunc(func(ctx context.Context, e gitwatch.Event) error {
+		if atomic.LoadInt32(&broken) == 1 {
+			return errors.New("refused")
+		}
+		delivered <- e
+		return nil
+	})
+	session.Sinks = []gitwatch.Sink{sink}
+	session.SinkRetry = gitwatch.SinkRetry{MaxAttempts: 3, MinBackoff: time.Millisecond}
+	session.DeadLetter = dead
+	go session.Run()
+	defer session.Close()
+
+	e := <-session.Events
+	err = <-session.Errors
+	assert.T(t, strings.Contains(err.Error(), "failed to deliver event to sink: refused"), err)
+	stats := session.SinkStats()[0]
+	assert.Equal(t, uint64(2), stats.Retries)
+	assert.Equal(t, uint64(1), stats.Failed)
+
+	// replaying stops at the first failure and keeps the letter
+	replay := func(l gitwatch.Letter) error { return sink.Send(context.Background(), l.Event) }
+	err = dead.Replay(replay)
+	assert.Equal(t, "refused", err.Error())
+
+	atomic.StoreInt32(&broken, 0)
+	err = dead.Replay(replay)
+	assert.Equal(t, nil, err)
+	replayed := <-delivered
+	assert.Equal(t, e.URL, replayed.URL)
+	assert.Equal(t, e.Commit().Hash, replayed.Commit().Hash)
+
+	// and removes it once the sink has it
+	err = dead.Replay(func(l gitwatch.Letter) error {
+		t.Errorf("replayed twice: %v", l)
+		return nil
+	})
+	assert.Equal(t, nil, err)
+}
+
+func TestEnrichers(t *testing.T) {
+	mockRepo("enriched")
+	err := os.RemoveAll("./test/enriching")
+	assert.Equal(t, nil, err)
+
+	session, err := gitwatch.New(context.Background(), []gitwatch.Repository{{URL: "./test/local/enriched"}}, 50*time.Millisecond, "./test/enriching/", nil, true)
+	assert.Equal(t, nil, err)
+	session.Enrichers = []gitwatch.Enricher{
+		gitwatch.EnricherFunc(func(e *gitwatch.Event) error {
+			e.Annotate("order", "1")
+			return nil
+		}),
+		// each enricher sees the changes of the ones before it
+		gitwatch.EnricherFunc(func(e *gitwatch.Event) error {
+			e.Annotate("order", e.Annotations["order"]+"2")
+			return nil
+		}),
+		gitwatch.EnricherFunc(func(e *gitwatch.Event) error {
+			return errors.New("lookup failed")
+		}),
+		gitwatch.EnricherFunc(func(e *gitwatch.Event) error {
+			if e.Commit().Message == "add: skipped" {
+				return gitwatch.ErrSkipEvent
+			}
+			e.Annotate("order", e.Annotations["order"]+"4")
+			return nil
+		}),
+	}
+	go session.Run()
+	defer session.Close()
+
+	// a failing enricher is reported without holding the event back
+	err = <-session.Errors
+	assert.T(t, strings.Contains(err.Error(), "failed to enrich event: lookup failed"), err)
+	e := <-session.Events
+	assert.Equal(t, "124", e.Annotations["order"])
+	<-session.Started()
+
+	// and ErrSkipEvent drops the event before the enrichers after it
+	mockRepoChange("enriched", "skipped", false)
+	<-session.Errors
+	mockRepoChange("enriched", "kept", false)
+	<-session.Errors
+	e = <-session.Events
+	assert.Equal(t, "add: kept", e.Commit().Message)
+	assert.Equal(t, "124", e.Annotations["order"])
+}
+
+func TestPlugins(t *testing.T) {
+	dir := "./test/plugins"
+	err := os.RemoveAll(dir)
+	assert.Equal(t, nil, err)
+	err = os.MkdirAll(dir, 0755)
+	assert.Equal(t, nil, err)
+	record := fullPath("./test/plugins-record.json")
+	os.Remove(record)
+	count := fullPath("./test/plugins-count")
+	os.Remove(count)
+	for name, script := range map[string]string{
+		"10-fail":   "echo refused >&2; exit 3",
+		"20-record": "cat > " + record,
+		"25-count":  "echo run >> " + count,
+		"30-slow":   "sleep 5 & exec sleep 5",
+	} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0755)
+		assert.Equal(t, nil, err)
+	}
+	// files that can't be executed aren't plugins
+	err = ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a plugin"), 0644)
+	assert.Equal(t, nil, err)
+	runs := func() int {
+		b, err := ioutil.ReadFile(count)
+		assert.Equal(t, nil, err)
+		return strings.Count(string(b), "run")
+	}
+
+	plugins := &gitwatch.Plugins{Dir: dir, Timeout: 200 * time.Millisecond}
+	e := gitwatch.Event{Type: gitwatch.EventCommit, URL: "./test/local/plugged", Branch: "master"}
+	started := time.Now()
+	err = plugins.Send(context.Background(), e)
+	assert.NotEqual(t, nil, err)
+	assert.T(t, strings.Contains(err.Error(), "10-fail: refused"), err)
+	assert.T(t, strings.Contains(err.Error(), "30-slow"), err)
+	assert.T(t, !strings.Contains(err.Error(), "20-record"), err)
+	// a background process holding the killed plugin's output doesn't hold
+	// up the delivery
+	assert.T(t, time.Since(started) < 2*time.Second, time.Since(started))
+
+	// every plugin runs even after one fails, with the event on its input
+	b, err := ioutil.ReadFile(record)
+	assert.Equal(t, nil, err)
+	var received gitwatch.Event
+	err = json.Unmarshal(b, &received)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, e.URL, received.URL)
+	assert.Equal(t, "master", received.Branch)
+	assert.Equal(t, 1, runs())
+
+	// a retry only runs the plugins that failed
+	err = plugins.Send(context.Background(), e)
+	assert.T(t, strings.Contains(err.Error(), "10-fail: refused"), err)
+	assert.Equal(t, 1, runs())
+
+	// the directory is read again for each event
+	for _, name := range []string{"10-fail", "30-slow"} {
+		err = os.Remove(filepath.Join(dir, name))
+		assert.Equal(t, nil, err)
+	}
+	assert.Equal(t, nil, plugins.Send(context.Background(), e))
+	assert.Equal(t, 1, runs())
+
+	// once every plugin took it, the event is delivered afresh if sent again
+	assert.Equal(t, nil, plugins.Send(context.Background(), e))
+	assert.Equal(t, 2, runs())
+
+	err = (&gitwatch.Plugins{Dir: "./test/plugins-missing"}).Send(context.Background(), e)
+	assert.T(t, strings.Contains(err.Error(), "failed to read plugin directory"), err)
+}
+
+func TestWASMFilters(t *testing.T) {
+	dir := "./test/wasm"
+	err := os.RemoveAll(dir)
+	assert.Equal(t, nil, err)
+	err = os.MkdirAll(dir, 0755)
+	assert.Equal(t, nil, err)
+	for _, name := range []string{"20-drop.wasm", "10-annotate.wasm", "30-broken.wasm", "notes.txt"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		assert.Equal(t, nil, err)
+	}
 
-	tsb := mockRepoChange("b", "hello earth", false)
-	consumeAndAssert(t, gw.Events, gitwatch.Event{
-		URL:       "./test/local/b",
-		Path:      fullPath("./test/b"),
-		Timestamp: tsb.Truncate(time.Second),
+	// the modules are stood in for by Go functions, given the event as JSON
+	modules := map[string]wasmModule{
+		"10-annotate.wasm": func(event []byte) ([]byte, error) {
+			var e gitwatch.Event
+			if err := json.Unmarshal(event, &e); err != nil {
+				return nil, err
+			}
+			return []byte(`{"annotations": {"team": "` + e.Branch + `-team"}}`), nil
+		},
+		"20-drop.wasm": func(event []byte) ([]byte, error) {
+			if strings.Contains(string(event), "sandbox") {
+				return []byte(`{"drop": true}`), nil
+			}
+			return nil, nil
+		},
+		"30-broken.wasm": func(event []byte) ([]byte, error) {
+			return []byte("not json"), nil
+		},
+	}
+	var loaded []string
+	filters, err := gitwatch.LoadWASMFilters(dir, func(path string) (gitwatch.WASMModule, error) {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, string(b))
+		return modules[string(b)], nil
+	}, 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"10-annotate.wasm", "20-drop.wasm", "30-broken.wasm"}, loaded)
+
+	e := gitwatch.Event{Type: gitwatch.EventCommit, URL: "./test/local/filtered", Branch: "release"}
+	assert.Equal(t, nil, filters[0].Enrich(&e))
+	assert.Equal(t, "release-team", e.Annotations["team"])
+	assert.Equal(t, nil, filters[1].Enrich(&e))
+	err = filters[2].Enrich(&e)
+	assert.T(t, strings.Contains(err.Error(), "wasm filter 30-broken.wasm returned an invalid verdict"), err)
+
+	dropped := gitwatch.Event{Type: gitwatch.EventCommit, URL: "./test/local/sandbox"}
+	assert.Equal(t, gitwatch.ErrSkipEvent, filters[1].Enrich(&dropped))
+
+	_, err = gitwatch.LoadWASMFilters(dir, func(path string) (gitwatch.WASMModule, error) {
+		return nil, errors.New("unsupported module")
+	}, 0)
+	assert.T(t, strings.Contains(err.Error(), "failed to load wasm filter 10-annotate.wasm: unsupported module"), err)
+
+	// a module that never returns is abandoned after the timeout, or once the
+	// session is closed
+	stuck := make(chan struct{})
+	defer close(stuck)
+	hung := gitwatch.WASMFilter{Name: "hung.wasm", Timeout: 50 * time.Millisecond, Module: wasmModule(func([]byte) ([]byte, error) {
+		<-stuck
+		return nil, nil
+	})}
+	err = hung.Enrich(&e)
+	assert.Equal(t, "wasm filter hung.wasm timed out after 50ms", fmt.Sprint(err))
+	ctx, cf := context.WithCancel(context.Background())
+	cf()
+	hung.Timeout = time.Hour
+	err = hung.EnrichContext(ctx, &e)
+	assert.T(t, errors.Is(err, context.Canceled), err)
+}
+
+func TestWASMRuntime(t *testing.T) {
+	dir := "./test/wasm-runtime"
+	err := os.RemoveAll(dir)
+	assert.Equal(t, nil, err)
+	err = os.MkdirAll(dir, 0755)
+	assert.Equal(t, nil, err)
+	verdict := `{"annotations":{"checked":"wasm"}}`
+	for name, module := range map[string][]byte{
+		// returns the verdict stored in its memory
+		"10-annotate.wasm": wasmBinary(verdict, 0x42, 0x10, 0x42, 0x20, 0x86, 0x42, byte(len(verdict)), 0x84),
+		// returns the event it was given
+		"20-echo.wasm": wasmBinary("", 0x20, 0x00, 0xad, 0x42, 0x20, 0x86, 0x20, 0x01, 0xad, 0x84),
+		// loops forever
+		"30-loop.wasm": wasmBinary("", 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x00),
+	} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), module, 0644)
+		assert.Equal(t, nil, err)
+	}
+	filters, err := gitwatch.LoadWASMFilters(dir, gitwatch.LoadWASM, 200*time.Millisecond)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(filters))
+
+	e := gitwatch.Event{Type: gitwatch.EventCommit, URL: "./test/local/filtered", Branch: "release"}
+	assert.Equal(t, nil, filters[0].Enrich(&e))
+	assert.Equal(t, "wasm", e.Annotations["checked"])
+
+	// the event is written to the module's memory as JSON
+	payload, err := json.Marshal(e)
+	assert.Equal(t, nil, err)
+	out, err := filters[1].(gitwatch.WASMFilter).Module.Filter(context.Background(), payload)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, string(payload), string(out))
+
+	// a module that never returns is stopped after the timeout
+	started := time.Now()
+	err = filters[2].Enrich(&e)
+	assert.Equal(t, "wasm filter 30-loop.wasm timed out after 200ms", fmt.Sprint(err))
+	assert.T(t, time.Since(started) < 2*time.Second)
+
+	// a config file loads them too
+	c, err := gitwatch.LoadConfig(strings.NewReader("directory: ./test/wasm-config/\ninterval: 1s\nwasm_dir: " + dir + "\nwasm_timeout: 1s\nrepositories:\n  - url: ./test/local/filtered\n"))
+	assert.Equal(t, nil, err)
+	session, err := gitwatch.NewFromConfig(context.Background(), c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(session.Enrichers))
+	assert.Equal(t, time.Second, session.Enrichers[2].(gitwatch.WASMFilter).Timeout)
+	assert.Equal(t, nil, session.Close())
+
+	// modules must export the functions the verdict is called through
+	err = ioutil.WriteFile(filepath.Join(dir, "40-empty.wasm"), []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}, 0644)
+	assert.Equal(t, nil, err)
+	_, err = gitwatch.LoadWASMFilters(dir, gitwatch.LoadWASM, 0)
+	assert.T(t, strings.Contains(fmt.Sprint(err), "failed to load wasm filter 40-empty.wasm: module doesn't export memory"), err)
+}
+
+// wasmBinary assembles a filter module for LoadWASM whose alloc returns 1024
+// and whose filter runs body, with data stored in its memory at 16. Modules
+// are kept small enough for every size to fit in a byte.
+func wasmBinary(data string, body ...byte) []byte {
+	section := func(id byte, content ...byte) []byte {
+		return append([]byte{id, byte(len(content))}, content...)
+	}
+	name := func(s string) []byte {
+		return append([]byte{byte(len(s))}, s...)
+	}
+
+	b := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	// types: (i32) -> i32 and (i32, i32) -> i64
+	b = append(b, section(1, 0x02, 0x60, 0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e)...)
+	b = append(b, section(3, 0x02, 0x00, 0x01)...)
+	b = append(b, section(5, 0x01, 0x00, 0x01)...)
+
+	exports := []byte{0x03}
+	exports = append(append(exports, name("memory")...), 0x02, 0x00)
+	exports = append(append(exports, name("alloc")...), 0x00, 0x00)
+	exports = append(append(exports, name("filter")...), 0x00, 0x01)
+	b = append(b, section(7, exports...)...)
+
+	filter := append(append([]byte{0x00}, body...), 0x0b)
+	code := []byte{0x02, 0x05, 0x00, 0x41, 0x80, 0x08, 0x0b, byte(len(filter))}
+	b = append(b, section(10, append(code, filter...)...)...)
+	b = append(b, section(11, append([]byte{0x01, 0x00, 0x41, 0x10, 0x0b}, name(data)...)...)...)
+	return b
+}
+
+// wasmModule stands in for a WebAssembly module in tests
+type wasmModule func(event []byte) ([]byte, error)
+
+func (m wasmModule) Filter(ctx context.Context, event []byte) ([]byte, error) {
+	return m(event)
+}
+
+func TestCloudEvents(t *testing.T) {
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	e := gitwatch.Event{Type: gitwatch.EventCommit, URL: "https://example.com/a.git", Branch: "master", Timestamp: when}.
+		WithCommit(object.Commit{Hash: plumbing.NewHash("0123456789012345678901234567890123456789"), Message: "encoded"})
+
+	body, contentType, err := gitwatch.Encode(e, gitwatch.FormatCloudEvents)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "application/cloudevents+json", contentType)
+	var ce map[string]interface{}
+	err = json.Unmarshal(body, &ce)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "1.0", ce["specversion"])
+	assert.Equal(t, "https://example.com/a.git", ce["source"])
+	assert.Equal(t, "io.github.southclaws.gitwatch.commit", ce["type"])
+	assert.Equal(t, "master", ce["subject"])
+	assert.Equal(t, "2020-01-02T03:04:05Z", ce["time"])
+	assert.Equal(t, "application/json", ce["datacontenttype"])
+	assert.Equal(t, 32, len(ce["id"].(string)))
+
+	// the data is the plain JSON encoding
+	plain, contentType, err := gitwatch.Encode(e, gitwatch.FormatJSON)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "application/json", contentType)
+	data, err := json.Marshal(ce["data"])
+	assert.Equal(t, nil, err)
+	var want, got interface{}
+	assert.Equal(t, nil, json.Unmarshal(plain, &want))
+	assert.Equal(t, nil, json.Unmarshal(data, &got))
+	assert.Equal(t, want, got)
+
+	// the ID is the same for the same event, and differs for another
+	again, err := gitwatch.NewCloudEvent(e)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ce["id"], again.ID)
+	tag := gitwatch.Event{Type: gitwatch.EventTagDeleted, URL: "https://example.com/a.git", Tag: "v1", Timestamp: when}
+	other, err := gitwatch.NewCloudEvent(tag)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, again.ID, other.ID)
+	assert.Equal(t, "v1", other.Subject)
+	assert.Equal(t, "io.github.southclaws.gitwatch.tag-deleted", other.Type)
+
+	// without a ref, the subject is the commit, or left out
+	e.Branch = ""
+	ref, err := gitwatch.NewCloudEvent(e)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "0123456789012345678901234567890123456789", ref.Subject)
+	none, err := gitwatch.NewCloudEvent(gitwatch.Event{Type: gitwatch.EventConfigApplied})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", none.Subject)
+
+	_, _, err = gitwatch.Encode(e, gitwatch.Format(99))
+	assert.Equal(t, "unknown format 99", err.Error())
+}
+
+func TestSQLStore(t *testing.T) {
+	err := os.Remove("./test/events.db")
+	assert.T(t, err == nil || os.IsNotExist(err))
+	db, err := sql.Open("sqlite3", "./test/events.db")
+	assert.Equal(t, nil, err)
+	defer db.Close()
+	store, err := gitwatch.NewSQLStore(ctx, db)
+	assert.Equal(t, nil, err)
+
+	var commit gitwatch.Event
+	err = json.Unmarshal([]byte(`{
+		"type": "commit", "url": "./test/local/a", "path": "test/a", "timestamp": "2020-01-02T03:04:05Z", "branch": "master",
+		"commit": {"hash": "0123456789012345678901234567890123456789", "message": "add: stored", "author": {"name": "test"}}
+	}`), &commit)
+	assert.Equal(t, nil, err)
+	tag := gitwatch.Event{Type: gitwatch.EventTagDeleted, URL: "./test/local/a", Path: "test/a", Timestamp: commit.Timestamp.Add(time.Second), Tag: "v1"}
+	other := gitwatch.Event{Type: gitwatch.EventCommit, URL: "./test/local/b", Path: "test/b", Timestamp: commit.Timestamp}
+	for _, e := range []gitwatch.Event{commit, tag, other} {
+		err = store.Send(ctx, e)
+		assert.Equal(t, nil, err)
+	}
+
+	events, err := store.Events(ctx, gitwatch.EventFilter{URL: "./test/local/a"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, "add: stored", events[0].Commit().Message)
+	assert.Equal(t, "v1", events[1].Tag)
+	events, err = store.Events(ctx, gitwatch.EventFilter{Since: commit.Timestamp.Add(time.Millisecond)})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(events))
+	events, err = store.Events(ctx, gitwatch.EventFilter{Branch: "master", Until: tag.Timestamp})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(events))
+
+	// the tag event doesn't move the repository's head
+	var head string
+	var count int
+	err = db.QueryRow(`SELECT head, events FROM repositories WHERE path = 'test/a'`).Scan(&head, &count)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "0123456789012345678901234567890123456789", head)
+	assert.Equal(t, 2, count)
+
+	err = store.Store(gitwatch.Letter{Sink: 1, Error: "refused", FailedAt: time.Now(), Event: commit})
+	assert.Equal(t, nil, err)
+	var replayed []gitwatch.Letter
+	replay := func(l gitwatch.Letter) error {
+		replayed = append(replayed, l)
+		return nil
+	}
+	err = store.Replay(replay)
+	assert.Equal(t, nil, err)
+	err = store.Replay(replay)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(replayed))
+	assert.Equal(t, "refused", replayed[0].Error)
+	assert.Equal(t, "add: stored", replayed[0].Event.Commit().Message)
+}
+
+func TestReplay(t *testing.T) {
+	mockRepo("replayed")
+	err := os.Remove("./test/replay.db")
+	assert.T(t, err == nil || os.IsNotExist(err))
+	db, err := sql.Open("sqlite3", "./test/replay.db")
+	assert.Equal(t, nil, err)
+	defer db.Close()
+	store, err := gitwatch.NewSQLStore(ctx, db)
+	assert.Equal(t, nil, err)
+	for _, url := range []string{"./test/local/replayed", "./test/local/unwatched"} {
+		err = store.Send(ctx, gitwatch.Event{Type: gitwatch.EventCommit, URL: url, Timestamp: time.Now()})
+		assert.Equal(t, nil, err)
+	}
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: "./test/local/replayed"}}, time.Second, "./test/", nil, false)
+	assert.Equal(t, nil, err)
+	sunk := make(chan gitwatch.Event, 1)
+	session.Sinks = []gitwatch.Sink{store, gitwatch.SinkFunc(func(ctx context.Context, e gitwatch.Event) error {
+		sunk <- e
+		return nil
+	})}
+	session.History = store
+	go session.Run()
+	<-session.InitialDone
+
+	n, err := session.Replay(time.Now().Add(-time.Minute))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, n)
+	e := <-session.Events
+	assert.Equal(t, "./test/local/replayed", e.URL)
+	assert.T(t, e.Replayed)
+	e = <-sunk
+	assert.T(t, e.Replayed)
+
+	// the store isn't sent the events it replayed
+	time.Sleep(100 * time.Millisecond)
+	events, err := store.Events(ctx, gitwatch.EventFilter{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(events))
+}
+
+func TestAudit(t *testing.T) {
+	mockRepo("audited")
+	err := os.RemoveAll("./test/auditing")
+	assert.Equal(t, nil, err)
+	err = os.Remove("./test/audit.log")
+	assert.T(t, err == nil || os.IsNotExist(err))
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: "./test/local/audited"}}, 50*time.Millisecond, "./test/auditing/", nil, false)
+	assert.Equal(t, nil, err)
+	audit := &gitwatch.AuditFile{Path: "./test/audit.log"}
+	session.Audit = audit
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	mockRepoChange("audited", "audited change", false)
+	e := <-session.Events
+	entries, err := audit.Entries(ctx, gitwatch.EventFilter{URL: "./test/local/audited"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, gitwatch.AuditClone, entries[0].Op)
+	assert.Equal(t, gitwatch.AuditPull, entries[1].Op)
+	assert.Equal(t, e.Commit().Hash.String(), entries[1].To)
+	assert.Equal(t, "", entries[1].Error)
+
+	// the SQL store reads entries back the same way
+	err = os.Remove("./test/audit.db")
+	assert.T(t, err == nil || os.IsNotExist(err))
+	db, err := sql.Open("sqlite3", "./test/audit.db")
+	assert.Equal(t, nil, err)
+	defer db.Close()
+	store, err := gitwatch.NewSQLStore(ctx, db)
+	assert.Equal(t, nil, err)
+	err = store.Record(entries[1])
+	assert.Equal(t, nil, err)
+	stored, err := store.Entries(ctx, gitwatch.EventFilter{Since: entries[1].Time})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(stored))
+	assert.Equal(t, entries[1].To, stored[0].To)
+	assert.Equal(t, entries[1].Duration, stored[0].Duration)
+}
+
+func TestFileLocker(t *testing.T) {
+	mockRepo("locked")
+	for _, dir := range []string{"./test/locking-a", "./test/locking-b", "./test/locks"} {
+		err := os.RemoveAll(dir)
+		assert.Equal(t, nil, err)
+	}
+
+	start := func(dir string) (*gitwatch.Session, context.CancelFunc) {
+		ctx, cf := context.WithCancel(context.Background())
+		session, err := gitwatch.New(
+			ctx,
+			[]gitwatch.Repository{{URL: "./test/local/locked"}},
+			50*time.Millisecond,
+			dir,
+			nil,
+			false,
+		)
+		assert.Equal(t, nil, err)
+		session.Locker = gitwatch.FileLocker{Dir: "./test/locks"}
+		done := make(chan struct{})
+		go func() {
+			session.Run()
+			close(done)
+		}()
+		<-session.InitialDone
+		return session, func() {
+			cf()
+			<-done
+		}
+	}
+	a, stopA := start("./test/locking-a/")
+	b, stopB := start("./test/locking-b/")
+	defer stopB()
+
+	mockRepoChange("locked", "polled by a", false)
+	e := <-a.Events
+	assert.Equal(t, "add: polled by a", e.Commit().Message)
+	select {
+	case e := <-b.Events:
+		t.Fatal("standby instance emitted", e)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// b takes over once a lets go, cloning on its first check
+	stopA()
+	time.Sleep(300 * time.Millisecond)
+	mockRepoChange("locked", "polled by b", false)
+	e = <-b.Events
+	assert.Equal(t, "add: polled by b", e.Commit().Message)
+}
+
+func TestSharding(t *testing.T) {
+	var repos []gitwatch.Repository
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("sharded-%d", i)
+		mockRepo(name)
+		repos = append(repos, gitwatch.Repository{URL: "./test/local/" + name})
+	}
+	for _, dir := range []string{"./test/sharding-a", "./test/sharding-b", "./test/members"} {
+		err := os.RemoveAll(dir)
+		assert.Equal(t, nil, err)
+	}
+
+	start := func(name string) (*gitwatch.Session, context.CancelFunc) {
+		ctx, cf := context.WithCancel(context.Background())
+		session, err := gitwatch.New(ctx, repos, 50*time.Millisecond, "./test/sharding-"+name+"/", nil, false)
+		assert.Equal(t, nil, err)
+		session.Sharding = &gitwatch.Sharding{
+			Name:    name,
+			Members: gitwatch.FileMembers{Dir: "./test/members"},
+		}
+		done := make(chan struct{})
+		go func() {
+			session.Run()
+			close(done)
+		}()
+		<-session.InitialDone
+		return session, func() {
+			cf()
+			<-done
+		}
+	}
+	a, stopA := start("a")
+	defer stopA()
+	b, stopB := start("b")
+	time.Sleep(300 * time.Millisecond)
+
+	// every change is reported by exactly one of the instances
+	polledBy := map[string]string{}
+	for i := range repos {
+		mockRepoChange(fmt.Sprintf("sharded-%d", i), "split", false)
+	}
+	for len(polledBy) < len(repos) {
+		var e gitwatch.Event
+		var by string
+		select {
+		case e = <-a.Events:
+			by = "a"
+		case e = <-b.Events:
+			by = "b"
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out, changes seen:", polledBy)
+		}
+		if e.Commit().Message != "add: split" {
+			continue
+		}
+		if other, ok := polledBy[e.URL]; ok {
+			t.Fatal(e.URL, "polled by", other, "and", by)
+		}
+		polledBy[e.URL] = by
+	}
+	counts := map[string]int{}
+	for _, by := range polledBy {
+		counts[by]++
+	}
+	assert.Equal(t, 2, len(counts))
+
+	// a takes over b's repositories once b leaves
+	stopB()
+	time.Sleep(200 * time.Millisecond)
+	for i := range repos {
+		mockRepoChange(fmt.Sprintf("sharded-%d", i), "rebalanced", false)
+	}
+	seen := map[string]bool{}
+	for len(seen) < len(repos) {
+		select {
+		case e := <-a.Events:
+			if e.Commit().Message == "add: rebalanced" {
+				seen[e.URL] = true
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out, changes seen:", seen)
+		}
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	received := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- gitwatch.VerifySignature("secret", body, r.Header.Get(gitwatch.SignatureHeader))
+	}))
+	defer server.Close()
+
+	err := gitwatch.Webhook{URL: server.URL, Secret: "secret"}.Send(ctx, gitwatch.Event{URL: "./test/local/a"})
+	assert.Equal(t, nil, err)
+	assert.T(t, <-received)
+}
+
+func TestLoadConfig(t *testing.T) {
+	c, err := gitwatch.LoadConfig(strings.NewReader(`
+directory: ./test/
+interval: 30s
+operation_timeout: 2m
+error_policy: resilient
+recovery: fetch-reset
+retry:
+  max_attempts: 5
+  min_backoff: 10s
+  jitter: 0.2
+bump_rules:
+  feat: minor
+  docs: patch
+auths:
+  github:
+    type: token
+    token: abc
+groups:
+  services:
+    watch_tags: true
+repositories:
+  - url: https://github.com/Southclaws/gitwatch.git
+    auth: github
+    group: services
+    rate_limit: 5m
+    timeout: 10m
+    deploy:
+      dir: ./test/deploy
+      keep_for: 24h
+    exec:
+      command: [./deploy.sh, --prod]
+      env: [STAGE=prod]
+      timeout: 10m
+      supersede: cancel
+discover:
+  - github: acme
+    exclude: ["*-sandbox"]
+    group: services
+`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, gitwatch.Duration(30*time.Second), c.Interval)
+	assert.Equal(t, gitwatch.Duration(5*time.Minute), c.Repositories[0].RateLimit)
+	assert.Equal(t, gitwatch.Duration(2*time.Minute), c.OperationTimeout)
+	assert.Equal(t, gitwatch.RetryPolicy{MaxAttempts: 5, MinBackoff: 10 * time.Second, Jitter: 0.2}, c.Retry)
+	assert.Equal(t, gitwatch.Duration(10*time.Minute), c.Repositories[0].Timeout)
+	assert.Equal(t, 24*time.Hour, c.Repositories[0].Deploy.KeepFor)
+	assert.Equal(t, gitwatch.ErrorsResilient, c.ErrorPolicy)
+	assert.Equal(t, gitwatch.RecoverFetchReset, c.Recovery)
+	assert.Equal(t, map[string]gitwatch.Bump{"feat": gitwatch.BumpMinor, "docs": gitwatch.BumpPatch}, c.BumpRules)
+	assert.Equal(t, []string{"./deploy.sh", "--prod"}, c.Repositories[0].Exec.Command)
+	assert.Equal(t, 10*time.Minute, c.Repositories[0].Exec.Timeout)
+	assert.Equal(t, gitwatch.SupersedeCancel, c.Repositories[0].Exec.Supersede)
+	assert.T(t, c.Groups["services"].WatchTags)
+	assert.Equal(t, []string{"*-sandbox"}, c.Discover[0].Exclude)
+
+	_, err = gitwatch.LoadConfig(strings.NewReader(`{"directory": "./test/", "interval": "1s", "repositories": [{"url": "./test/local/a", "auth": "missing"}]}`))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	os.Setenv("GITWATCH_TEST_TOKEN", "s3cr$t")
+	c, err := gitwatch.LoadConfig(strings.NewReader(`
+directory: ./test/
+interval: 30s
+auths:
+  github: {type: token, token: "${GITWATCH_TEST_TOKEN}"}
+repositories:
+  - url: ./test/local/a
+`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "s3cr$t", c.Auths["github"].Token)
+
+	os.Setenv("GITWATCH_TEST_DIR", "gitwatch")
+	c, err = gitwatch.LoadConfig(strings.NewReader(`
+directory: ~/${GITWATCH_TEST_DIR}/clones
+interval: 30s
+state_file: ~/${GITWATCH_TEST_DIR}/state.json
+audit_log: ${GITWATCH_TEST_DIR}/audit.log
+repositories:
+  - url: ./test/local/a
+`))
+	assert.Equal(t, nil, err)
+	home, err := os.UserHomeDir()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, filepath.Join(home, "gitwatch/clones"), c.Directory)
+	assert.Equal(t, filepath.Join(home, "gitwatch/state.json"), c.StateFile)
+	assert.Equal(t, "gitwatch/audit.log", c.AuditLog)
+
+	_, err = gitwatch.LoadConfig(strings.NewReader(`{"directory": "${GITWATCH_TEST_UNSET}", "interval": "1s"}`))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestLoadTOMLConfig(t *testing.T) {
+	c, err := gitwatch.LoadTOMLConfig(strings.NewReader(`
+directory = "./test/"
+interval = "30s"
+
+[auths.github]
+type = "token"
+token = "abc"
+
+[[repositories]]
+url = "https://github.com/Southclaws/gitwatch.git"
+auth = "github"
+branch = "develop"
+depth = 1
+
+[repositories.exec]
+command = ["./deploy.sh", "--prod"]
+timeout = "10m"
+`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, gitwatch.Duration(30*time.Second), c.Interval)
+	assert.Equal(t, "develop", c.Repositories[0].Branch)
+	assert.Equal(t, 1, c.Repositories[0].Depth)
+	assert.Equal(t, []string{"./deploy.sh", "--prod"}, c.Repositories[0].Exec.Command)
+	assert.Equal(t, 10*time.Minute, c.Repositories[0].Exec.Timeout)
+
+	_, err = gitwatch.LoadTOMLConfig(strings.NewReader(`
+directory = "./test/"
+interval = "30s"
+unknown = true
+`))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestLoadConfigFileSOPS(t *testing.T) {
+	// a stand-in for sops that "decrypts" by dropping the metadata
+	bin, err := filepath.Abs("./test/bin")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, os.MkdirAll(bin, 0755))
+	err = ioutil.WriteFile(filepath.Join(bin, "sops"), []byte("#!/bin/sh\nsed '/^sops:/,$d' \"$2\"\n"), 0755)
+	assert.Equal(t, nil, err)
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	err = ioutil.WriteFile("./test/encrypted.yaml", []byte(`directory: ./test/
+interval: 30s
+repositories:
+  - url: ./test/local/a
+sops:
+  mac: ENC[AES256_GCM,data:abc]
+  version: 3.7.1
+`), 0600)
+	assert.Equal(t, nil, err)
+
+	c, err := gitwatch.LoadConfigFile(context.Background(), "./test/encrypted.yaml")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(c.Repositories))
+}
+
+func TestTokenAuth(t *testing.T) {
+	r, err := http.NewRequest("GET", "https://github.com/repo/a/info/refs", nil)
+	assert.Equal(t, nil, err)
+	gitwatch.TokenAuth("", "ghp_token").(interface{ SetAuth(*http.Request) }).SetAuth(r)
+	user, password, ok := r.BasicAuth()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "git", user)
+	assert.Equal(t, "ghp_token", password)
+}
+
+func TestCodeCommitAuth(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	os.Setenv("AWS_SESSION_TOKEN", "session")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	defer os.Unsetenv("AWS_SESSION_TOKEN")
+
+	auth, err := gitwatch.NewCodeCommitAuth("", "")
+	assert.Equal(t, nil, err)
+
+	r, err := http.NewRequest("GET", "https://git-codecommit.eu-west-1.amazonaws.com/v1/repos/repo/info/refs", nil)
+	assert.Equal(t, nil, err)
+	auth.SetAuth(r)
+
+	user, password, ok := r.BasicAuth()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "AKIDEXAMPLE%session", user)
+	// a timestamp such as 20060102T150405Z followed by a hex signature
+	assert.Equal(t, 16+64, len(password))
+	assert.Equal(t, "Z", password[15:16])
+
+	// the get-vanilla request of AWS's Signature Version 4 test suite
+	canonical := "GET\n/\n\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n" +
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	signature := gitwatch.SignV4("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20150830T123600Z", "us-east-1", "service", canonical)
+	assert.Equal(t, "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31", signature)
+
+	// and the same keys signing a CodeCommit repository at that time
+	creds := gitwatch.AWSCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", SessionToken: "session"}
+	user, password = gitwatch.CodeCommitPassword(creds, "us-east-1", "git-codecommit.us-east-1.amazonaws.com", "/v1/repos/repo", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	assert.Equal(t, "AKIDEXAMPLE%session", user)
+	assert.Equal(t, "20150830T123600Zeb6b24e416229acb127ec9c4531fb3802e8d74229944d896b532c7a944f9ddd1", password)
+}
+
+func TestGoogleAuth(t *testing.T) {
+	issued := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "refresh_token", r.FormValue("grant_type"))
+		assert.Equal(t, "refresh", r.FormValue("refresh_token"))
+		issued++
+		w.Write([]byte(`{"access_token": "token", "expires_in": 3600}`))
+	}))
+	defer server.Close()
+
+	err := ioutil.WriteFile("./test/adc.json", []byte(`{
+		"type": "authorized_user",
+		"client_id": "id",
+		"client_secret": "secret",
+		"refresh_token": "refresh",
+		"token_uri": "`+server.URL+`"
+	}`), 0600)
+	assert.Equal(t, nil, err)
+
+	auth, err := gitwatch.NewGoogleAuth("./test/adc.json")
+	assert.Equal(t, nil, err)
+
+	r, err := http.NewRequest("GET", "https://source.developers.google.com/p/project/r/repo/info/refs", nil)
+	assert.Equal(t, nil, err)
+	auth.SetAuth(r)
+	assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+	assert.Equal(t, 1, issued) // the token is reused until it expires
+}
+
+type countingTransport struct {
+	requests int
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.requests++
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestAzureDevOps(t *testing.T) {
+	remote := server.Seed("org/project/_git/repo", map[string]string{"README.md": "azure"})
+	err := os.RemoveAll("./test/azure")
+	assert.Equal(t, nil, err)
+
+	// stands in for dev.azure.com, which refuses fetches that don't ask for
+	// multi_ack and acknowledges each common commit before the last
+	target, err := url.Parse(server.URL)
+	assert.Equal(t, nil, err)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ModifyResponse = func(r *http.Response) error {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		if bytes.HasPrefix(body, []byte("0031ACK ")) {
+			body = append([]byte(fmt.Sprintf("003aACK %s continue\n", body[8:48])), body...)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Del("Content-Length")
+		return nil
+	}
+	var haves int32
+	azure := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			body, _ := ioutil.ReadAll(r.Body)
+			n, _ := strconv.ParseUint(string(body[:4]), 16, 16)
+			want := body[4:n]
+			if !bytes.Contains(want, []byte(" multi_ack")) {
+				http.Error(w, "multi_ack is required", http.StatusBadRequest)
+				return
+			}
+			if bytes.Contains(body, []byte("have ")) {
+				atomic.AddInt32(&haves, 1)
+			}
+			// the test server doesn't support multi_ack itself
+			want = bytes.Replace(want, []byte(" multi_ack"), nil, 1)
+			body = append([]byte(fmt.Sprintf("%04x%s", len(want)+4, want)), body[n:]...)
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer azure.Close()
+
+	gitwatch.UseHTTPClient(&http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == "dev.azure.com:80" {
+				addr = azure.Listener.Addr().String()
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}})
+	defer gitwatch.UseHTTPClient(http.DefaultClient)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: "http://org@dev.azure.com/org/project/_git/repo"}}, 50*time.Millisecond, "./test/azure/", nil, false)
+	assert.Equal(t, nil, err)
+	failed := make(chan error, 1)
+	go func() { failed <- session.Run() }()
+	defer session.Close()
+	select {
+	case <-session.InitialDone:
+	case err := <-failed:
+		t.Fatal(err)
+	}
+
+	// the change is fetched on top of the clone, rather than cloned again
+	hash := remote.Commit("change", map[string]string{"README.md": "changed"})
+	assert.Equal(t, hash, nextEvent(t, session).Commit().Hash)
+	assert.T(t, atomic.LoadInt32(&haves) > 0)
+}
+
+// sshServer serves a repository of a test server over SSH, counting the
+// connections made to it
+type sshServer struct {
+	URL      string // the repository's URL
+	listener net.Listener
+	repo     *gitwatchtest.Repo
+	conns    int32
+}
+
+func newSSHServer(t *testing.T, repo *gitwatchtest.Repo) *sshServer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Equal(t, nil, err)
+	signer, err := cryptossh.NewSignerFromKey(key)
+	assert.Equal(t, nil, err)
+	config := &cryptossh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	s := &sshServer{URL: "ssh://git@" + l.Addr().String() + "/repo.git", listener: l, repo: repo}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.conns, 1)
+			go s.serve(c, config)
+		}
+	}()
+	return s
+}
+
+func (s *sshServer) serve(c net.Conn, config *cryptossh.ServerConfig) {
+	_, chans, reqs, err := cryptossh.NewServerConn(c, config)
+	if err != nil {
+		return
+	}
+	go cryptossh.DiscardRequests(reqs)
+	for nc := range chans {
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for req := range reqs {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				status := struct{ Status uint32 }{}
+				if err := s.uploadPack(ch); err != nil {
+					status.Status = 1
+				}
+				ch.SendRequest("exit-status", false, cryptossh.Marshal(status))
+				return
+			}
+		}()
+	}
+}
+
+// uploadPack runs the git-upload-pack the client asked for, whatever the path.
+// Like the test server's requests, it holds the repository for the whole
+// conversation.
+func (s *sshServer) uploadPack(ch cryptossh.Channel) error {
+	return s.repo.Do(func(r *git.Repository) error {
+		srv := gitserver.NewServer(loaderFunc(func(*transport.Endpoint) (storer.Storer, error) {
+			return r.Storer, nil
+		}))
+		sess, err := srv.NewUploadPackSession(&transport.Endpoint{}, nil)
+		if err != nil {
+			return err
+		}
+		ar, err := sess.AdvertisedReferences()
+		if err != nil {
+			return err
+		}
+		if err = ar.Encode(ch); err != nil {
+			return err
+		}
+		req := packp.NewUploadPackRequest()
+		if err = req.Decode(ch); err != nil {
+			// a flush instead of wants only lists the refs
+			return nil
+		}
+		resp, err := sess.UploadPack(context.Background(), req)
+		if err != nil {
+			return err
+		}
+		return resp.Encode(ch)
 	})
 }
 
-func TestMakeChangeWithUntracked(t *testing.T) {
-	ts := mockRepoChange("a", "hello world!", true)
-	consumeAndAssert(t, gw.Events, gitwatch.Event{
-		URL:       "./test/local/a",
-		Path:      fullPath("./test/a"),
-		Timestamp: ts.Truncate(time.Second),
+func (s *sshServer) Close() {
+	s.listener.Close()
+}
+
+type loaderFunc func(*transport.Endpoint) (storer.Storer, error)
+
+func (f loaderFunc) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	return f(ep)
+}
+
+var installSSHAuth sync.Once
+
+// useTestSSHAuth replaces go-git's default SSH auth, which comes from the SSH
+// agent, with a new auth method for a test key each time it's built. It's only
+// installed once, as checks abandoned by closed sessions may still build one.
+func useTestSSHAuth(t *testing.T) {
+	installSSHAuth.Do(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.Equal(t, nil, err)
+		signer, err := cryptossh.NewSignerFromKey(key)
+		assert.Equal(t, nil, err)
+		gitssh.DefaultAuthBuilder = func(user string) (gitssh.AuthMethod, error) {
+			return &gitssh.PublicKeys{
+				User:                  user,
+				Signer:                signer,
+				HostKeyCallbackHelper: gitssh.HostKeyCallbackHelper{HostKeyCallback: cryptossh.InsecureIgnoreHostKey()},
+			}, nil
+		}
 	})
 }
 
+func TestReuseSSH(t *testing.T) {
+	remote := server.Seed("sshed.git", map[string]string{"README.md": "ssh"})
+	sshd := newSSHServer(t, remote)
+	defer sshd.Close()
+	err := os.RemoveAll("./test/sshing")
+	assert.Equal(t, nil, err)
+
+	// without an auth method, go-git builds the default for every connection
+	useTestSSHAuth(t)
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	session, err := gitwatch.New(ctx, []gitwatch.Repository{{URL: sshd.URL}}, 20*time.Millisecond, "./test/sshing/", nil, false)
+	assert.Equal(t, nil, err)
+	session.ReuseSSH = true
+	go session.Run()
+	defer session.Close()
+	<-session.InitialDone
+
+	// the clone's connection, then one shared by every check after it
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&sshd.conns))
+
+	// a change is then fetched, on a connection of its own
+	hash := remote.Commit("change", map[string]string{"README.md": "changed"})
+	assert.Equal(t, hash, nextEvent(t, session).Commit().Hash)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&sshd.conns))
+}
+
+func TestUseHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	counter := &countingTransport{}
+	gitwatch.UseHTTPClient(&http.Client{Transport: counter})
+	defer gitwatch.UseHTTPClient(http.DefaultClient)
+
+	err := gitwatch.Webhook{URL: server.URL}.Send(context.Background(), gitwatch.Event{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, counter.requests)
+}
+
+func TestSecrets(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/secret/data/git", r.URL.Path)
+		assert.Equal(t, "root", r.Header.Get("X-Vault-Token"))
+		w.Write([]byte(`{"data": {"data": {"token": "from-vault"}}}`))
+	}))
+	defer vault.Close()
+
+	os.Setenv("GITWATCH_TEST_SECRET", "from-env")
+	err := ioutil.WriteFile("./test/secret", []byte("from-file\n"), 0600)
+	assert.Equal(t, nil, err)
+
+	secrets := gitwatch.SecretSchemes{
+		"env":   gitwatch.DefaultSecrets["env"],
+		"file":  gitwatch.DefaultSecrets["file"],
+		"vault": gitwatch.VaultSecrets{Address: vault.URL, Token: "root"},
+	}
+	for ref, want := range map[string]string{
+		"plain":                       "plain",
+		"env:GITWATCH_TEST_SECRET":    "from-env",
+		"file:./test/secret":          "from-file",
+		"vault:secret/data/git#token": "from-vault",
+	} {
+		got, err := secrets.Resolve(context.Background(), ref)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, want, got)
+	}
+
+	_, err = secrets.Resolve(context.Background(), "vault:secret/data/git#missing")
+	assert.NotEqual(t, nil, err)
+}
+
 func mockRepo(name string) {
 	dirPath := filepath.Join("./test/local/", name)
 	err := os.RemoveAll(dirPath)
@@ -166,12 +4534,26 @@ func mockRepo(name string) {
 }
 
 func mockRepoChange(name, contents string, untracked bool) time.Time {
+	ts := mockRepoFile(name, "file", contents)
+	if untracked {
+		dirPath := filepath.Join("./test/", name)
+		log.Println("adding untracked file to", dirPath)
+		err := ioutil.WriteFile(filepath.Join(dirPath, "untracked"), []byte("i should not be here! :3"), 0666)
+		if err != nil {
+			panic(err)
+		}
+	}
+	log.Println("committed mock change", contents, "to", name)
+	return ts
+}
+
+func mockRepoFile(name, file, contents string) time.Time {
 	dirPath := filepath.Join("./test/local/", name)
 	repo, err := git.PlainOpen(dirPath)
 	if err != nil {
 		panic(err)
 	}
-	err = ioutil.WriteFile(filepath.Join(dirPath, "file"), []byte(contents), 0666)
+	err = ioutil.WriteFile(filepath.Join(dirPath, file), []byte(contents), 0666)
 	if err != nil {
 		panic(err)
 	}
@@ -179,7 +4561,7 @@ func mockRepoChange(name, contents string, untracked bool) time.Time {
 	if err != nil {
 		panic(err)
 	}
-	_, err = wt.Add("file")
+	_, err = wt.Add(file)
 	if err != nil {
 		panic(err)
 	}
@@ -194,18 +4576,36 @@ func mockRepoChange(name, contents string, untracked bool) time.Time {
 	if err != nil {
 		panic(err)
 	}
-	if untracked {
-		dirPath = filepath.Join("./test/", name)
-		log.Println("adding untracked file to", dirPath)
-		err = ioutil.WriteFile(filepath.Join(dirPath, "untracked"), []byte("i should not be here! :3"), 0666)
-		if err != nil {
-			panic(err)
-		}
-	}
-	log.Println("committed mock change", contents, "to", name)
 	return ts
 }
 
+func mockRepoTag(name, tag string) {
+	repo, err := git.PlainOpen(filepath.Join("./test/local/", name))
+	if err != nil {
+		panic(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		panic(err)
+	}
+	_, err = repo.CreateTag(tag, head.Hash(), nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func mockRepoDeleteTag(name, tag string) {
+	repo, err := git.PlainOpen(filepath.Join("./test/local/", name))
+	if err != nil {
+		panic(err)
+	}
+	err = repo.DeleteTag(tag)
+	if err != nil {
+		panic(err)
+	}
+	log.Println("deleted mock tag", tag, "from", name)
+}
+
 func fullPath(relative string) (result string) {
 	result, err := filepath.Abs(relative)
 	if err != nil {
@@ -229,6 +4629,9 @@ func TestGetRepoDirectory(t *testing.T) {
 		{"ssh", args{"git@a.com:user/repo"}, "repo", false},
 		{"ssh_short", args{"git@a.com:repo"}, "repo", false},
 		{"ssh_long", args{"git@a.com:user/s/u/b/d/i/r/repo"}, "repo", false},
+		{"azure_https", args{"https://org@dev.azure.com/org/project/_git/repo"}, "repo", false},
+		{"azure_ssh", args{"git@ssh.dev.azure.com:v3/org/project/repo"}, "repo", false},
+		{"azure_legacy", args{"https://org.visualstudio.com/DefaultCollection/project/_git/repo"}, "repo", false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,324 @@
+package gitwatchtest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/pktline"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// Author is the author and committer of the commits made by Repo's helpers
+var Author = object.Signature{Name: "gitwatchtest", Email: "gitwatchtest@example.com"}
+
+// Server is an in-process git server speaking the smart HTTP protocol, for
+// tests that watch repositories without depending on the filesystem layout or
+// on a remote host. Repositories are kept in memory, seeded with Seed and
+// changed with the helpers of Repo. Both cloning and pushing are supported.
+//
+// Like the helpers of this package's tests, the Server and Repo methods panic
+// if git fails, which only happens if they're misused.
+type Server struct {
+	URL string // the server's base URL, repositories are served at URL/name
+
+	http  *httptest.Server
+	git   transport.Transport
+	mu    sync.Mutex // guards the repositories, which the server reads while tests change them
+	repos map[string]*Repo
+}
+
+// NewServer starts a server with no repositories. Close it when done.
+func NewServer() *Server {
+	s := &Server{repos: make(map[string]*Repo)}
+	s.git = server.NewServer(loader{s})
+	s.http = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.http.URL
+	return s
+}
+
+// Close shuts the server down
+func (s *Server) Close() {
+	s.http.Close()
+}
+
+// loader finds a server's repositories by name, it's only used while the
+// server is locked
+type loader struct {
+	s *Server
+}
+
+// Load implements server.Loader
+func (l loader) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	r, ok := l.s.repos[strings.Trim(ep.Path, "/")]
+	if !ok {
+		return nil, transport.ErrRepositoryNotFound
+	}
+	return r.repo.Storer, nil
+}
+
+// Seed creates a repository on the server with a first commit of the given
+// files, keyed by their path, on `master`. With no files the repository is
+// left empty, to be pushed to. A name may contain slashes, such as
+// `org/repo.git`.
+func (s *Server) Seed(name string, files map[string]string) *Repo {
+	repo, err := git.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		panic(err)
+	}
+	r := &Repo{server: s, name: name, repo: repo}
+	s.mu.Lock()
+	s.repos[name] = r
+	s.mu.Unlock()
+	if len(files) > 0 {
+		r.Commit("initial commit", files)
+	}
+	return r
+}
+
+// Repo returns a repository created with Seed, or nil
+func (s *Server) Repo(name string) *Repo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.repos[name]
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var name, service string
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/info/refs"):
+		name = strings.TrimSuffix(r.URL.Path, "/info/refs")
+		service = r.URL.Query().Get("service")
+	case r.Method == http.MethodPost:
+		i := strings.LastIndex(r.URL.Path, "/")
+		name, service = r.URL.Path[:i], r.URL.Path[i+1:]
+	}
+	if service != transport.UploadPackServiceName && service != transport.ReceivePackServiceName {
+		http.Error(w, "only the smart HTTP protocol is supported", http.StatusForbidden)
+		return
+	}
+	ep := &transport.Endpoint{Protocol: "http", Path: strings.Trim(name, "/")}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if r.Method == http.MethodGet {
+		err = s.advertise(w, ep, service)
+	} else if service == transport.UploadPackServiceName {
+		err = s.uploadPack(w, r, ep)
+	} else {
+		err = s.receivePack(w, r, ep)
+	}
+	if errors.Cause(err) == transport.ErrRepositoryNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// advertisedRefs opens a session for a service and lists the references
+func (s *Server) advertisedRefs(ep *transport.Endpoint, service string) (sess transport.Session, ar *packp.AdvRefs, err error) {
+	if service == transport.UploadPackServiceName {
+		up, err := s.git.NewUploadPackSession(ep, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		ar, err = up.AdvertisedReferences()
+		return up, ar, err
+	}
+	rp, err := s.git.NewReceivePackSession(ep, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	ar, err = rp.AdvertisedReferences()
+	return rp, ar, err
+}
+
+func (s *Server) advertise(w http.ResponseWriter, ep *transport.Endpoint, service string) error {
+	_, ar, err := s.advertisedRefs(ep, service)
+	if err != nil {
+		return err
+	}
+	ar.Prefix = [][]byte{[]byte("# service=" + service), pktline.Flush}
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", service))
+	w.Header().Set("Cache-Control", "no-cache")
+	return ar.Encode(w)
+}
+
+func (s *Server) uploadPack(w http.ResponseWriter, r *http.Request, ep *transport.Endpoint) error {
+	// each request of the stateless protocol is a new session, which needs the
+	// references advertised again to know what it supports
+	sess, _, err := s.advertisedRefs(ep, transport.UploadPackServiceName)
+	if err != nil {
+		return err
+	}
+	req := packp.NewUploadPackRequest()
+	if err = req.Decode(r.Body); err != nil {
+		return errors.Wrap(err, "failed to decode upload-pack request")
+	}
+	resp, err := sess.(transport.UploadPackSession).UploadPack(context.Background(), req)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	return resp.Encode(w)
+}
+
+func (s *Server) receivePack(w http.ResponseWriter, r *http.Request, ep *transport.Endpoint) error {
+	sess, _, err := s.advertisedRefs(ep, transport.ReceivePackServiceName)
+	if err != nil {
+		return err
+	}
+	req := packp.NewReferenceUpdateRequest()
+	if err = req.Decode(r.Body); err != nil {
+		return errors.Wrap(err, "failed to decode receive-pack request")
+	}
+	status, err := sess.(transport.ReceivePackSession).ReceivePack(context.Background(), req)
+	if err == nil {
+		err = s.repos[ep.Path].checkout()
+	}
+	if status != nil {
+		w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
+		return status.Encode(w)
+	}
+	return err
+}
+
+// Repo is a repository served by a Server
+type Repo struct {
+	server *Server
+	name   string
+	repo   *git.Repository
+}
+
+// URL returns the URL to clone the repository from
+func (r *Repo) URL() string {
+	return r.server.URL + "/" + r.name
+}
+
+// Do runs fn with the repository while the server isn't serving it, for
+// changes the helpers don't cover.
+func (r *Repo) Do(fn func(repo *git.Repository) error) error {
+	r.server.mu.Lock()
+	defer r.server.mu.Unlock()
+	return fn(r.repo)
+}
+
+// checkout brings the worktree in line with a HEAD moved by a push, so later
+// commits build on what was pushed
+func (r *Repo) checkout() error {
+	head, err := r.repo.Head()
+	if err != nil {
+		return err
+	}
+	wt, err := r.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	return wt.Reset(&git.ResetOptions{Commit: head.Hash(), Mode: git.HardReset})
+}
+
+// Commit writes files, keyed by their path, to the checked out branch and
+// commits them. An empty content removes a file.
+func (r *Repo) Commit(message string, files map[string]string) plumbing.Hash {
+	var hash plumbing.Hash
+	err := r.Do(func(repo *git.Repository) error {
+		wt, err := repo.Worktree()
+		if err != nil {
+			return err
+		}
+		for path, contents := range files {
+			if contents == "" {
+				if _, err = wt.Remove(path); err != nil {
+					return err
+				}
+				continue
+			}
+			if err = util.WriteFile(wt.Filesystem, path, []byte(contents), 0644); err != nil {
+				return err
+			}
+			if _, err = wt.Add(path); err != nil {
+				return err
+			}
+		}
+		author := Author
+		author.When = time.Now()
+		hash, err = wt.Commit(message, &git.CommitOptions{Author: &author, Committer: &author})
+		return err
+	})
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}
+
+// Branch creates a branch at the checked out commit, if it doesn't exist, and
+// checks it out, so later commits land on it.
+func (r *Repo) Branch(name string) {
+	err := r.Do(func(repo *git.Repository) error {
+		wt, err := repo.Worktree()
+		if err != nil {
+			return err
+		}
+		ref := plumbing.NewBranchReferenceName(name)
+		_, err = repo.Reference(ref, false)
+		return wt.Checkout(&git.CheckoutOptions{Branch: ref, Create: err != nil})
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Reset moves the checked out branch back to an earlier commit, so later
+// commits rewrite its history as a force-push would.
+func (r *Repo) Reset(hash plumbing.Hash) {
+	err := r.Do(func(repo *git.Repository) error {
+		wt, err := repo.Worktree()
+		if err != nil {
+			return err
+		}
+		return wt.Reset(&git.ResetOptions{Commit: hash, Mode: git.HardReset})
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Tag creates a lightweight tag at the checked out commit
+func (r *Repo) Tag(name string) {
+	err := r.Do(func(repo *git.Repository) error {
+		head, err := repo.Head()
+		if err != nil {
+			return err
+		}
+		_, err = repo.CreateTag(name, head.Hash(), nil)
+		return err
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// DeleteTag removes a tag
+func (r *Repo) DeleteTag(name string) {
+	err := r.Do(func(repo *git.Repository) error {
+		return repo.DeleteTag(name)
+	})
+	if err != nil {
+		panic(err)
+	}
+}
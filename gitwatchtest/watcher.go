@@ -0,0 +1,262 @@
+// Package gitwatchtest provides a fake gitwatch.Watcher for testing code built
+// on gitwatch without real git repositories, and an in-process git server for
+// tests that do need them.
+package gitwatchtest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Southclaws/gitwatch"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// Watcher is a fake gitwatch.Watcher. It never touches git: the events and
+// errors it produces are the ones the test programs with Emit and Fail, and
+// the calls made to it are recorded for the test to inspect.
+//
+// The zero value isn't usable, create one with New.
+type Watcher struct {
+	// RunErr is returned by Run once the watcher is closed
+	RunErr error
+	// NotifyFunc, if set, is called by Notify, which otherwise reports every
+	// push as checking no repositories
+	NotifyFunc func(p gitwatch.Push) (int, error)
+	// ReplayFunc, if set, is called by Replay, which otherwise replays nothing
+	ReplayFunc func(since time.Time) (int, error)
+	// HealthyFunc, if set, is called by Healthy, which otherwise reports the
+	// watcher healthy while it runs
+	HealthyFunc func() error
+
+	mu           sync.Mutex
+	running      bool
+	repositories []gitwatch.Repository
+	pushes       []gitwatch.Push
+	rolledBack   map[string]plumbing.Hash
+
+	events      chan gitwatch.Event
+	errors      chan error
+	initialDone chan struct{}
+	started     chan struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+var _ gitwatch.Watcher = (*Watcher)(nil)
+
+// New creates a fake watcher of the given repositories. Events and errors are
+// buffered up to `buffer` each before Emit and Fail block.
+func New(buffer int, repos ...gitwatch.Repository) *Watcher {
+	return &Watcher{
+		repositories: repos,
+		rolledBack:   make(map[string]plumbing.Hash),
+		events:       make(chan gitwatch.Event, buffer),
+		errors:       make(chan error, buffer),
+		initialDone:  make(chan struct{}, 1),
+		started:      make(chan struct{}),
+		closed:       make(chan struct{}),
+	}
+}
+
+// Emit pushes an event to the watcher's event stream
+func (w *Watcher) Emit(e gitwatch.Event) {
+	w.events <- e
+}
+
+// Fail pushes an error to the watcher's error stream
+func (w *Watcher) Fail(err error) {
+	w.errors <- err
+}
+
+// Run implements gitwatch.Watcher. It signals that the initial checks are done
+// and that it has started straight away, and blocks until Close is called.
+func (w *Watcher) Run() error {
+	w.mu.Lock()
+	w.running = true
+	w.mu.Unlock()
+	w.initialDone <- struct{}{}
+	close(w.started)
+	<-w.closed
+	return w.RunErr
+}
+
+// Close implements gitwatch.Watcher, it always succeeds
+func (w *Watcher) Close() error {
+	w.closeOnce.Do(func() { close(w.closed) })
+	w.mu.Lock()
+	w.running = false
+	w.mu.Unlock()
+	return nil
+}
+
+// IsRunning implements gitwatch.Watcher
+func (w *Watcher) IsRunning() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.running
+}
+
+// Started implements gitwatch.Watcher
+func (w *Watcher) Started() <-chan struct{} {
+	return w.started
+}
+
+// Add implements gitwatch.Watcher, the repository is recorded
+func (w *Watcher) Add(r gitwatch.Repository) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.repositories = append(w.repositories, r)
+	return nil
+}
+
+// AddAll implements gitwatch.Watcher, the repositories are recorded
+func (w *Watcher) AddAll(repos []gitwatch.Repository) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.repositories = append(w.repositories, repos...)
+	return nil
+}
+
+// SetRepositories implements gitwatch.Watcher, the repositories replace those
+// recorded
+func (w *Watcher) SetRepositories(repos []gitwatch.Repository) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.repositories = append([]gitwatch.Repository(nil), repos...)
+	return nil
+}
+
+// Remove implements gitwatch.Watcher, the repository is no longer recorded
+func (w *Watcher) Remove(url string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.watches(url) {
+		return errors.Errorf("no repository with url %s", url)
+	}
+	kept := w.repositories[:0]
+	for _, r := range w.repositories {
+		if r.URL != url {
+			kept = append(kept, r)
+		}
+	}
+	w.repositories = kept
+	return nil
+}
+
+// RemoveAndClean implements gitwatch.Watcher, as Remove, there are no clones
+// to delete
+func (w *Watcher) RemoveAndClean(url string) error {
+	return w.Remove(url)
+}
+
+// Repositories returns the repositories the watcher was created with and those
+// added since
+func (w *Watcher) Repositories() []gitwatch.Repository {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]gitwatch.Repository(nil), w.repositories...)
+}
+
+// Notify implements gitwatch.Watcher, the push is recorded
+func (w *Watcher) Notify(p gitwatch.Push) (int, error) {
+	w.mu.Lock()
+	w.pushes = append(w.pushes, p)
+	w.mu.Unlock()
+	if w.NotifyFunc != nil {
+		return w.NotifyFunc(p)
+	}
+	return 0, nil
+}
+
+// Pushes returns the pushes the watcher was notified of, in order
+func (w *Watcher) Pushes() []gitwatch.Push {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]gitwatch.Push(nil), w.pushes...)
+}
+
+// Replay implements gitwatch.Watcher
+func (w *Watcher) Replay(since time.Time) (int, error) {
+	if w.ReplayFunc != nil {
+		return w.ReplayFunc(since)
+	}
+	return 0, nil
+}
+
+// Rollback implements gitwatch.Watcher, the commit is recorded
+func (w *Watcher) Rollback(url string, hash plumbing.Hash) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.watches(url) {
+		return errors.Errorf("no repository with url %s", url)
+	}
+	w.rolledBack[url] = hash
+	return nil
+}
+
+// Resume implements gitwatch.Watcher
+func (w *Watcher) Resume(url string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.watches(url) {
+		return errors.Errorf("no repository with url %s", url)
+	}
+	delete(w.rolledBack, url)
+	return nil
+}
+
+// RolledBack returns the commit a repository was rolled back to, if it hasn't
+// been resumed since
+func (w *Watcher) RolledBack(url string) (plumbing.Hash, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	hash, ok := w.rolledBack[url]
+	return hash, ok
+}
+
+func (w *Watcher) watches(url string) bool {
+	for _, r := range w.repositories {
+		if r.URL == url {
+			return true
+		}
+	}
+	return false
+}
+
+// Status implements gitwatch.Watcher
+func (w *Watcher) Status() gitwatch.Status {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return gitwatch.Status{
+		Running:      w.running,
+		Repositories: len(w.repositories),
+		EventBacklog: len(w.events),
+	}
+}
+
+// Healthy implements gitwatch.Watcher
+func (w *Watcher) Healthy() error {
+	if w.HealthyFunc != nil {
+		return w.HealthyFunc()
+	}
+	if !w.IsRunning() {
+		return errors.New("watcher is not running")
+	}
+	return nil
+}
+
+// EventStream implements gitwatch.Watcher
+func (w *Watcher) EventStream() <-chan gitwatch.Event {
+	return w.events
+}
+
+// ErrorStream implements gitwatch.Watcher
+func (w *Watcher) ErrorStream() <-chan error {
+	return w.errors
+}
+
+// Initialised implements gitwatch.Watcher
+func (w *Watcher) Initialised() <-chan struct{} {
+	return w.initialDone
+}
@@ -3,9 +3,15 @@ module github.com/Southclaws/gitwatch
 go 1.13
 
 require (
+	github.com/BurntSushi/toml v0.4.1
 	github.com/bmizerany/assert v0.0.0-20160611221934-b7ed37b82869
+	github.com/mattn/go-sqlite3 v1.14.5
 	github.com/pkg/errors v0.9.1
+	github.com/tetratelabs/wazero v1.0.0
 	github.com/urfave/cli v1.20.0
+	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4
 	golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543
+	gopkg.in/src-d/go-billy.v4 v4.3.2
 	gopkg.in/src-d/go-git.v4 v4.13.1
+	gopkg.in/yaml.v2 v2.4.0
 )
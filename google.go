@@ -0,0 +1,261 @@
+package gitwatch
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	googleTokenURL = "https://oauth2.googleapis.com/token"
+	googleScope    = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// GoogleAuth authenticates with Google Cloud Source Repositories
+// (source.developers.google.com) using OAuth access tokens from Application
+// Default Credentials. Tokens are refreshed shortly before they expire.
+//
+// Credentials are read from CredentialsFile, or if empty the file named by
+// GOOGLE_APPLICATION_CREDENTIALS, the gcloud application default credentials
+// or finally the metadata server when running on Google Cloud.
+type GoogleAuth struct {
+	CredentialsFile string       // a service account or authorized user JSON file
+	Client          *http.Client // the client used to fetch tokens, the shared client if nil
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// googleCredentials is the subset of a credentials file used to get tokens.
+type googleCredentials struct {
+	Type         string `json:"type"` // `service_account` or `authorized_user`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// googleToken is a token endpoint response
+type googleToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// NewGoogleAuth creates a GoogleAuth and fetches a first token to check the
+// credentials work.
+func NewGoogleAuth(credentialsFile string) (a *GoogleAuth, err error) {
+	a = &GoogleAuth{CredentialsFile: credentialsFile}
+	if _, err = a.Token(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Name is the name of the auth
+func (a *GoogleAuth) Name() string {
+	return "google-oauth"
+}
+
+func (a *GoogleAuth) String() string {
+	return a.Name()
+}
+
+// SetAuth adds an access token to a request. If no token can be fetched the
+// request is sent without one and the remote will reject it.
+func (a *GoogleAuth) SetAuth(r *http.Request) {
+	token, err := a.Token()
+	if err != nil {
+		return
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+}
+
+// Token returns a valid access token, fetching a new one if needed
+func (a *GoogleAuth) Token() (token string, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && time.Now().Add(time.Minute).Before(a.expiry) {
+		return a.token, nil
+	}
+
+	t, err := a.fetchToken()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get Google access token")
+	}
+	a.token = t.AccessToken
+	a.expiry = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+	return a.token, nil
+}
+
+func (a *GoogleAuth) fetchToken() (t googleToken, err error) {
+	path, err := a.credentialsPath()
+	if err != nil {
+		return
+	}
+	if path == "" {
+		return a.metadataToken()
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return t, errors.Wrap(err, "failed to read credentials")
+	}
+	var creds googleCredentials
+	if err = json.Unmarshal(b, &creds); err != nil {
+		return t, errors.Wrap(err, "failed to parse credentials")
+	}
+	if creds.TokenURI == "" {
+		creds.TokenURI = googleTokenURL
+	}
+
+	form := url.Values{}
+	switch creds.Type {
+	case "authorized_user":
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", creds.ClientID)
+		form.Set("client_secret", creds.ClientSecret)
+		form.Set("refresh_token", creds.RefreshToken)
+	case "service_account":
+		assertion, err := googleAssertion(creds, time.Now())
+		if err != nil {
+			return t, err
+		}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", assertion)
+	default:
+		return t, errors.Errorf("unsupported credentials type %q", creds.Type)
+	}
+
+	resp, err := a.client().PostForm(creds.TokenURI, form)
+	if err != nil {
+		return
+	}
+	return decodeGoogleToken(resp)
+}
+
+// credentialsPath finds the credentials file, an empty path means the
+// metadata server should be used.
+func (a *GoogleAuth) credentialsPath() (string, error) {
+	if a.CredentialsFile != "" {
+		return a.CredentialsFile, nil
+	}
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", nil
+	}
+	path := filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+	if _, err := os.Stat(path); err != nil {
+		return "", nil
+	}
+	return path, nil
+}
+
+// metadataToken gets a token for the instance's service account from the
+// Google Cloud metadata server.
+func (a *GoogleAuth) metadataToken() (t googleToken, err error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(
+		"http://%s/computeMetadata/v1/instance/service-accounts/default/token?scopes=%s",
+		host, url.QueryEscape(googleScope),
+	), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := a.client().Do(req)
+	if err != nil {
+		return t, errors.Wrap(err, "no credentials found and the metadata server is unavailable")
+	}
+	return decodeGoogleToken(resp)
+}
+
+func (a *GoogleAuth) client() *http.Client {
+	if a.Client != nil {
+		return a.Client
+	}
+	return httpClient()
+}
+
+func decodeGoogleToken(resp *http.Response) (t googleToken, err error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return t, errors.Errorf("token endpoint responded with %s", resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return t, errors.Wrap(err, "failed to decode token")
+	}
+	if t.AccessToken == "" {
+		return t, errors.New("token endpoint returned no access token")
+	}
+	return
+}
+
+// googleAssertion builds the signed JWT a service account exchanges for an
+// access token.
+func googleAssertion(creds googleCredentials, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return "", errors.New("service account private key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return "", errors.Wrap(err, "failed to parse service account private key")
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("service account private key is not an RSA key")
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   creds.ClientEmail,
+		"scope": googleScope,
+		"aud":   creds.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	unsigned := encode(header) + "." + encode(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", errors.Wrap(err, "failed to sign assertion")
+	}
+	return strings.Join([]string{unsigned, encode(signature)}, "."), nil
+}
@@ -0,0 +1,106 @@
+package gitwatch
+
+import (
+	"sort"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+// Group holds settings shared by every repository assigned to it. A repository
+// joins a group by naming it in its Group field. Settings a repository sets
+// itself take precedence over those of its group.
+type Group struct {
+	Branch     string               // the branch to watch
+	Branches   []string             // see Repository.Branches
+	Auth       transport.AuthMethod // authentication method for git operations
+	Webhook    bool                 // see Repository.Webhook
+	WatchTags  bool                 // see Repository.WatchTags
+	WatchNotes bool                 // see Repository.WatchNotes
+	WatchPulls bool                 // see Repository.WatchPulls
+	WatchFiles []string             // see Repository.WatchFiles
+	Ignore     []string             // see Repository.Ignore
+	Include    []string             // see Repository.Include
+	Components map[string]string    // see Repository.Components
+	MinCommits int                  // see Repository.MinCommits
+	AllCommits bool                 // see Repository.AllCommits
+	RateLimit  time.Duration        // see Repository.RateLimit
+	Interval   time.Duration        // see Repository.Interval
+	Depth      int                  // see Repository.Depth
+	Digest     time.Duration        // see Repository.Digest
+	Timeout    time.Duration        // see Repository.Timeout
+	Retry      *RetryPolicy         // see Repository.Retry
+	Enrichers  []Enricher           // run on the group's events after the session's enrichers
+	Sinks      []Sink               // the group's events are also delivered to each of these
+	Exec       *ExecHook            // see Repository.Exec
+}
+
+// withGroup fills in any settings a repository leaves unset from its group.
+func (s *Session) withGroup(r Repository) Repository {
+	g, ok := s.Groups[r.Group]
+	if r.Group == "" || !ok {
+		return r
+	}
+
+	if r.Branch == "" {
+		r.Branch = g.Branch
+	}
+	if r.Branches == nil {
+		r.Branches = g.Branches
+	}
+	if r.Auth == nil {
+		r.Auth = g.Auth
+	}
+	r.Webhook = r.Webhook || g.Webhook
+	r.WatchTags = r.WatchTags || g.WatchTags
+	r.WatchNotes = r.WatchNotes || g.WatchNotes
+	r.WatchPulls = r.WatchPulls || g.WatchPulls
+	if r.WatchFiles == nil {
+		r.WatchFiles = g.WatchFiles
+	}
+	if r.Ignore == nil {
+		r.Ignore = g.Ignore
+	}
+	if r.Include == nil {
+		r.Include = g.Include
+	}
+	if r.Components == nil {
+		r.Components = g.Components
+	}
+	if r.MinCommits == 0 {
+		r.MinCommits = g.MinCommits
+	}
+	r.AllCommits = r.AllCommits || g.AllCommits
+	if r.RateLimit == 0 {
+		r.RateLimit = g.RateLimit
+	}
+	if r.Interval == 0 {
+		r.Interval = g.Interval
+	}
+	if r.Depth == 0 {
+		r.Depth = g.Depth
+	}
+	if r.Digest == 0 {
+		r.Digest = g.Digest
+	}
+	if r.Timeout == 0 {
+		r.Timeout = g.Timeout
+	}
+	if r.Retry == nil {
+		r.Retry = g.Retry
+	}
+	if r.Exec == nil {
+		r.Exec = g.Exec
+	}
+	return r
+}
+
+// groupNames returns the names of the session's groups in a stable order.
+func (s *Session) groupNames() []string {
+	names := make([]string, 0, len(s.Groups))
+	for name := range s.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
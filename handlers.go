@@ -0,0 +1,102 @@
+package gitwatch
+
+import (
+	"sync/atomic"
+)
+
+// OnEvent registers a function to call with every event, as an alternative to
+// reading Events. Once a handler is registered, events are no longer sent to
+// Events. Handlers are called by the daemon, which waits for them to return,
+// unless AsyncHandlers is set.
+func (s *Session) OnEvent(h func(Event)) {
+	s.handlerMu.Lock()
+	defer s.handlerMu.Unlock()
+	s.eventHandlers = append(s.eventHandlers, h)
+}
+
+// OnError registers a function to call with every error, as an alternative to
+// reading Errors. Once a handler is registered, errors are no longer sent to
+// Errors, though ErrorRecords still receives their records.
+func (s *Session) OnError(h func(error)) {
+	s.handlerMu.Lock()
+	defer s.handlerMu.Unlock()
+	s.errorHandlers = append(s.errorHandlers, h)
+}
+
+// handleEvent passes an event to the OnEvent handlers and reports whether
+// there were any. The event counts towards the backlog until they return.
+func (s *Session) handleEvent(event Event) bool {
+	s.handlerMu.Lock()
+	handlers := s.eventHandlers
+	s.handlerMu.Unlock()
+	if len(handlers) == 0 {
+		return false
+	}
+
+	atomic.AddInt32(&s.pendingEvents, 1)
+	s.checkBacklog()
+	s.dispatch(func() {
+		for _, h := range handlers {
+			h(event)
+		}
+		atomic.AddInt32(&s.pendingEvents, -1)
+		s.checkBacklog()
+	})
+	return true
+}
+
+// handleError passes an error to the OnError handlers and reports whether
+// there were any.
+func (s *Session) handleError(err error) bool {
+	s.handlerMu.Lock()
+	handlers := s.errorHandlers
+	s.handlerMu.Unlock()
+	if len(handlers) == 0 {
+		return false
+	}
+
+	s.dispatch(func() {
+		for _, h := range handlers {
+			h(err)
+		}
+	})
+	return true
+}
+
+const (
+	asyncHandlerWorkers = 8  // the goroutines calling handlers if AsyncHandlers is set
+	asyncHandlerQueue   = 64 // the handler calls waiting for them before dispatch waits too
+)
+
+// dispatch calls handlers on the caller's goroutine or, if AsyncHandlers is
+// set, queues them for the handler workers, waiting for room if the queue is
+// full. Calls still queued when the session is closed are dropped, and the
+// events among them are counted by Close as never read.
+func (s *Session) dispatch(f func()) {
+	if !s.AsyncHandlers {
+		f()
+		return
+	}
+	s.handlerOnce.Do(func() {
+		s.handlerCalls = make(chan func(), asyncHandlerQueue)
+		for i := 0; i < asyncHandlerWorkers; i++ {
+			go s.runHandlers()
+		}
+	})
+	select {
+	case s.handlerCalls <- f:
+	case <-s.ctx.Done():
+	}
+}
+
+// runHandlers makes the queued handler calls until the session is closed
+func (s *Session) runHandlers() {
+	for {
+		select {
+		case f := <-s.handlerCalls:
+			f()
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
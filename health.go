@@ -0,0 +1,41 @@
+package gitwatch
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Healthy returns nil if the session is running and has finished a round of
+// checks recently: within three intervals, plus a minute for slow remotes.
+// Otherwise the error says what's wrong. A round finishes even if some
+// repositories fail, see Status().Retrying for those.
+func (s *Session) Healthy() error {
+	status := s.Status()
+	switch {
+	case !status.Running:
+		return errors.New("session is not running")
+	case status.LastCheck.IsZero():
+		return errors.New("initial checks have not finished")
+	}
+	if since := time.Since(status.LastCheck); since > 3*s.Interval+time.Minute {
+		return errors.Errorf("no checks have finished for %s", since.Round(time.Second))
+	}
+	return nil
+}
+
+// HealthHandler serves a session's Status as JSON, for health checks and
+// probes. The response is 200 OK if the session is Healthy and 503 Service
+// Unavailable with the reason in an `X-Gitwatch-Unhealthy` header otherwise.
+func HealthHandler(s *Session) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := s.Healthy(); err != nil {
+			w.Header().Set("X-Gitwatch-Unhealthy", err.Error())
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(s.Status())
+	})
+}
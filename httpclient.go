@@ -0,0 +1,118 @@
+package gitwatch
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+// HTTPOptions tunes the client built by NewHTTPClient
+type HTTPOptions struct {
+	Timeout             time.Duration                         // the limit for a whole request, including reading a clone's body, none if zero
+	DialTimeout         time.Duration                         // the limit for opening a connection, 30 seconds if zero
+	MaxIdleConnsPerHost int                                   // idle connections kept open per host, 16 if zero
+	IdleConnTimeout     time.Duration                         // how long idle connections are kept open, 90 seconds if zero
+	DisableHTTP2        bool                                  // if true, only HTTP/1.1 is used
+	Proxy               func(*http.Request) (*url.URL, error) // the proxy to use, taken from the environment if nil
+}
+
+var (
+	sharedHTTPMu sync.RWMutex
+	sharedHTTP   *http.Client
+)
+
+// NewHTTPClient builds an http.Client with connection pooling suited to polling
+// many repositories on the same few hosts: more idle connections are kept per
+// host than the standard library's default of two, and HTTP/2 is used where
+// the server supports it.
+func NewHTTPClient(o HTTPOptions) *http.Client {
+	if o.DialTimeout == 0 {
+		o.DialTimeout = 30 * time.Second
+	}
+	if o.MaxIdleConnsPerHost == 0 {
+		o.MaxIdleConnsPerHost = 16
+	}
+	if o.IdleConnTimeout == 0 {
+		o.IdleConnTimeout = 90 * time.Second
+	}
+	if o.Proxy == nil {
+		o.Proxy = http.ProxyFromEnvironment
+	}
+
+	transport := &http.Transport{
+		Proxy: o.Proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   o.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     !o.DisableHTTP2,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   o.MaxIdleConnsPerHost,
+		IdleConnTimeout:       o.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if o.DisableHTTP2 {
+		// a non-nil, empty map stops the transport from upgrading to HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &http.Client{Transport: transport, Timeout: o.Timeout}
+}
+
+// UseHTTPClient makes c the client for every HTTP and HTTPS git operation in
+// the process, as well as for webhooks, Vault and token requests that don't
+// set their own. go-git keeps one transport per protocol for the whole
+// process, so this applies to every session, not just one.
+func UseHTTPClient(c *http.Client) {
+	sharedHTTPMu.Lock()
+	defer sharedHTTPMu.Unlock()
+
+	sharedHTTP = c
+}
+
+// httpTransport is go-git's transport for HTTP and HTTPS. Each session is
+// opened with the client from httpClient, so UseHTTPClient doesn't need to
+// change go-git's protocols, which aren't safe to change while in use.
+type httpTransport struct{}
+
+func init() {
+	client.InstallProtocol("http", httpTransport{})
+	client.InstallProtocol("https", httpTransport{})
+}
+
+// NewUploadPackSession implements transport.Transport
+func (httpTransport) NewUploadPackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	return gitHTTP().NewUploadPackSession(ep, auth)
+}
+
+// NewReceivePackSession implements transport.Transport
+func (httpTransport) NewReceivePackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.ReceivePackSession, error) {
+	return gitHTTP().NewReceivePackSession(ep, auth)
+}
+
+// gitHTTP returns a go-git transport using the client from httpClient, with
+// the upload-pack requests to Azure DevOps changed as it needs.
+func gitHTTP() transport.Transport {
+	c := *httpClient()
+	c.Transport = azureTransport{next: c.Transport}
+	return githttp.NewClient(&c)
+}
+
+// httpClient returns the client installed with UseHTTPClient, or
+// http.DefaultClient if there isn't one.
+func httpClient() *http.Client {
+	sharedHTTPMu.RLock()
+	defer sharedHTTPMu.RUnlock()
+
+	if sharedHTTP != nil {
+		return sharedHTTP
+	}
+	return http.DefaultClient
+}
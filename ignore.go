@@ -0,0 +1,97 @@
+package gitwatch
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// ignoreFile is the file in a watched repository listing changes that don't
+// trigger events
+const ignoreFile = ".gitwatchignore"
+
+// ignorePattern is a line of an ignore list, `!` negates it
+type ignorePattern struct {
+	pattern pathPattern
+	negate  bool
+}
+
+// ignoredChange reports whether every file changed between `from` and `to`
+// is ignored by the repository's Ignore patterns followed by those of its
+// .gitwatchignore file as of `to`, or, if the repository has Include patterns,
+// matches none of them.
+func ignoredChange(repo *git.Repository, repository Repository, from plumbing.Hash, to *object.Commit) (bool, error) {
+	if from.IsZero() || from == to.Hash {
+		return false, nil
+	}
+
+	lines := repository.Ignore
+	if f, err := to.File(ignoreFile); err == nil {
+		contents, err := f.Contents()
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to read %s", ignoreFile)
+		}
+		lines = append(lines[:len(lines):len(lines)], strings.Split(contents, "\n")...)
+	} else if err != object.ErrFileNotFound {
+		return false, errors.Wrapf(err, "failed to get %s", ignoreFile)
+	}
+	patterns, err := parseIgnore(lines)
+	if err != nil {
+		return false, err
+	}
+	include := make([]pathPattern, len(repository.Include))
+	for i, pattern := range repository.Include {
+		if include[i], err = compilePattern(pattern); err != nil {
+			return false, errors.Wrapf(err, "invalid include pattern %s", pattern)
+		}
+	}
+	if len(patterns) == 0 && len(include) == 0 {
+		return false, nil
+	}
+
+	c, err := repo.CommitObject(from)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get commit to compare against")
+	}
+	files, err := changedFiles(c, to)
+	if err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		if (len(include) == 0 || matchAny(include, file)) && !ignored(patterns, file) {
+			return false, nil
+		}
+	}
+	return len(files) > 0, nil
+}
+
+// parseIgnore compiles ignore patterns in the gitignore syntax, skipping blank
+// lines and `#` comments.
+func parseIgnore(lines []string) (patterns []ignorePattern, err error) {
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		negate := strings.HasPrefix(line, "!")
+		p, err := compilePattern(strings.TrimPrefix(line, "!"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid ignore pattern %s", line)
+		}
+		patterns = append(patterns, ignorePattern{p, negate})
+	}
+	return
+}
+
+// ignored reports whether the last pattern matching a file ignores it
+func ignored(patterns []ignorePattern, file string) (ignore bool) {
+	for _, p := range patterns {
+		if p.pattern.Match(file) {
+			ignore = !p.negate
+		}
+	}
+	return
+}
@@ -0,0 +1,54 @@
+package gitwatch
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WebhookListener runs an HTTP server that feeds a session from webhook
+// deliveries, parsed and verified by its Receiver, as an alternative to
+// polling. Repositories that set Webhook are only checked when a delivery
+// announces a change to them, the others are still polled.
+type WebhookListener struct {
+	Receiver
+	Addr string // the address to listen on, such as `:8080`
+	Path string // the path deliveries are posted to, `/` if empty
+}
+
+// ListenAndServe listens on the listener's Addr and serves deliveries until
+// the context is cancelled.
+func (l WebhookListener) ListenAndServe(ctx context.Context) error {
+	ln, err := net.Listen("tcp", l.Addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen for webhooks")
+	}
+	return l.Serve(ctx, ln)
+}
+
+// Serve serves deliveries on ln until the context is cancelled, then shuts the
+// server down, letting requests in progress finish for up to five seconds.
+func (l WebhookListener) Serve(ctx context.Context, ln net.Listener) error {
+	path := l.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, l.Receiver)
+	server := &http.Server{Handler: mux}
+
+	errs := make(chan error, 1)
+	go func() { errs <- server.Serve(ln) }()
+	select {
+	case err := <-errs:
+		return errors.Wrap(err, "failed to serve webhooks")
+	case <-ctx.Done():
+	}
+
+	shutdown, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	return server.Shutdown(shutdown)
+}
@@ -0,0 +1,107 @@
+package gitwatch
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Locker hands out locks on repositories, so when several gitwatch instances
+// watch the same repositories for high availability, only one of them polls
+// each repository at a time. Locks can live on shared storage, see FileLocker,
+// or in a service such as Redis or etcd.
+type Locker interface {
+	// TryLock takes the lock with the given key without waiting for it, and
+	// returns ok false if another instance holds it. A lock is held until it's
+	// released, so lockers built on expiring leases must keep them alive.
+	TryLock(ctx context.Context, key string) (lock Lock, ok bool, err error)
+}
+
+// Lock is a lock held on a repository
+type Lock interface {
+	Unlock() error
+}
+
+// FileLocker is a Locker that takes advisory locks (flock) on files in a
+// directory, which can be on storage shared by every instance, such as NFS.
+// The operating system releases the locks of an instance that dies.
+type FileLocker struct {
+	Dir string
+}
+
+// TryLock implements Locker
+func (l FileLocker) TryLock(ctx context.Context, key string) (lock Lock, ok bool, err error) {
+	if err = os.MkdirAll(l.Dir, 0755); err != nil {
+		return nil, false, errors.Wrap(err, "failed to create lock directory")
+	}
+	sum := sha1.Sum([]byte(key))
+	f, err := os.OpenFile(filepath.Join(l.Dir, hex.EncodeToString(sum[:])+".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to open lock file")
+	}
+	ok, err = tryFlock(f)
+	if err != nil || !ok {
+		f.Close()
+		return nil, false, err
+	}
+	// the key is only for people looking at the directory
+	f.Truncate(0)
+	f.WriteString(key + "\n")
+	return fileLock{f}, true, nil
+}
+
+type fileLock struct {
+	f *os.File
+}
+
+func (l fileLock) Unlock() error {
+	defer l.f.Close()
+	return unflock(l.f)
+}
+
+// lockKey identifies a repository the same way on every instance
+func lockKey(r Repository) string {
+	return r.URL + "#" + r.Branch
+}
+
+// holdsLock reports whether this session may poll a repository, taking its
+// lock if it doesn't hold it yet.
+func (s *Session) holdsLock(repository Repository) (bool, error) {
+	if s.Locker == nil {
+		return true, nil
+	}
+	state := s.stateOf(repository)
+	if state.lock != nil {
+		return true, nil
+	}
+	lock, ok, err := s.Locker.TryLock(s.ctx, lockKey(repository))
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to lock %s", repository.URL)
+	}
+	if ok {
+		state.lock = lock
+	}
+	return ok, nil
+}
+
+// releaseLock gives up a repository's lock, if it's held
+func (s *Session) releaseLock(st *repoState) {
+	if st.lock == nil {
+		return
+	}
+	if err := st.lock.Unlock(); err != nil {
+		s.reportError(ErrorRecord{Op: "lock"}, errors.Wrap(err, "failed to release repository lock"))
+	}
+	st.lock = nil
+}
+
+// releaseLocks gives up every lock the session holds
+func (s *Session) releaseLocks() {
+	for _, st := range s.state {
+		s.releaseLock(st)
+	}
+}
@@ -0,0 +1,162 @@
+package gitwatch
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Manager owns several sessions, for example one per environment or tenant,
+// starting and stopping them together and merging their event and error
+// streams.
+type Manager struct {
+	Events chan ManagedEvent // events from every session, tagged with the session's name
+	Errors chan ManagedError // errors from every session, tagged with the session's name
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+	running  bool
+	ctx      context.Context
+	cf       context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// ManagedEvent is an event from one of a manager's sessions
+type ManagedEvent struct {
+	Session string
+	Event
+}
+
+// ManagedError is an error from one of a manager's sessions
+type ManagedError struct {
+	Session string
+	Err     error
+}
+
+func (e ManagedError) Error() string {
+	return e.Session + ": " + e.Err.Error()
+}
+
+// Unwrap returns the session's error
+func (e ManagedError) Unwrap() error {
+	return e.Err
+}
+
+// NewManager creates an empty manager
+func NewManager() *Manager {
+	return &Manager{
+		Events:   make(chan ManagedEvent, 16),
+		Errors:   make(chan ManagedError, 16),
+		sessions: make(map[string]*Session),
+	}
+}
+
+// Add registers a session under a name. If the manager has already been
+// started, the session is started immediately.
+func (m *Manager) Add(name string, s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.sessions[name]; exists {
+		return errors.Errorf("session %s already exists", name)
+	}
+	m.sessions[name] = s
+	if m.running {
+		m.start(name, s)
+	}
+	return nil
+}
+
+// Session returns the session registered under a name, or nil
+func (m *Manager) Session(name string) *Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sessions[name]
+}
+
+// Start runs every session. It returns immediately, failures of individual
+// sessions are reported on Errors.
+func (m *Manager) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.running {
+		return
+	}
+	m.running = true
+	m.ctx, m.cf = context.WithCancel(context.Background())
+	for name, s := range m.sessions {
+		m.start(name, s)
+	}
+}
+
+// Stop closes every session and waits for them to finish. Closed sessions
+// can't be run again, so neither can a stopped manager.
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	if !m.running {
+		m.mu.Unlock()
+		return
+	}
+	m.running = false
+	for _, s := range m.sessions {
+		s.Close()
+	}
+	m.cf()
+	m.mu.Unlock()
+
+	m.wg.Wait()
+}
+
+// Status returns the status of each session by name
+func (m *Manager) Status() map[string]Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := make(map[string]Status, len(m.sessions))
+	for name, s := range m.sessions {
+		status[name] = s.Status()
+	}
+	return status
+}
+
+// start runs a session and forwards its events and errors, the lock must be
+// held.
+func (m *Manager) start(name string, s *Session) {
+	ctx := m.ctx
+	m.wg.Add(2)
+
+	go func() {
+		defer m.wg.Done()
+		err := s.Run()
+		if err != nil && err != context.Canceled {
+			select {
+			case m.Errors <- ManagedError{name, err}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	go func() {
+		defer m.wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-s.Events:
+				select {
+				case m.Events <- ManagedEvent{name, e}:
+				case <-ctx.Done():
+					return
+				}
+			case err := <-s.Errors:
+				select {
+				case m.Errors <- ManagedError{name, err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,91 @@
+package gitwatch
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// mirrorRemote is the name of the remote the i-th mirror of a repository is
+// fetched from.
+func mirrorRemote(i int) string {
+	return fmt.Sprintf("mirror-%d", i+1)
+}
+
+// failsOver reports whether an error from the primary URL should send the
+// check to a repository's mirrors. Errors about the state of the branch rather
+// than the reachability of the remote would be the same on a mirror.
+func failsOver(err error) bool {
+	switch errors.Cause(err) {
+	case plumbing.ErrReferenceNotFound, git.ErrNonFastForwardUpdate, git.ErrUnstagedChanges, context.Canceled:
+		return false
+	}
+	return true
+}
+
+// pullWithMirrors pulls from the repository's primary URL and, if that can't
+// be reached, from each of its mirrors in order. The primary is always tried
+// first, so checks fail back to it as soon as it's reachable again. Events
+// served by a mirror name it in Mirror.
+func (s *Session) pullWithMirrors(repo *git.Repository, repository Repository) (event *Event, err error) {
+	event, err = s.pullChanges(repo, "origin", repository)
+	if err == nil || len(repository.Mirrors) == 0 || !failsOver(err) || s.busy(repository) {
+		return
+	}
+	primaryErr := err
+
+	if err = syncMirrorRemotes(repo, repository.Mirrors); err != nil {
+		return nil, err
+	}
+	for i, url := range repository.Mirrors {
+		event, err = s.pullChanges(repo, mirrorRemote(i), repository)
+		if err == nil {
+			if event != nil {
+				event.Mirror = url
+			}
+			return event, nil
+		}
+		if !failsOver(err) || s.busy(repository) {
+			return nil, err
+		}
+	}
+	return nil, errors.Wrap(primaryErr, "primary and every mirror are unreachable")
+}
+
+// syncMirrorRemotes makes sure the local repository has a remote for each
+// mirror, pointing at the configured URL.
+func syncMirrorRemotes(repo *git.Repository, mirrors []string) (err error) {
+	for i, url := range mirrors {
+		if err = syncRemote(repo, mirrorRemote(i), url); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// cloneFromMirror clones a repository from the first reachable mirror and then
+// points origin back at the primary URL, so later checks try it first.
+func (s *Session) cloneFromMirror(repository Repository, primaryErr error) (repo *git.Repository, err error) {
+	for _, url := range repository.Mirrors {
+		mirrored := repository
+		mirrored.URL = url
+		repo, err = s.cloneRepoFrom(mirrored)
+		if err != nil {
+			continue
+		}
+
+		if err = repo.DeleteRemote("origin"); err != nil {
+			return nil, errors.Wrap(err, "failed to reset origin after cloning from mirror")
+		}
+		_, err = repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{repository.URL}})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to reset origin after cloning from mirror")
+		}
+		return repo, syncMirrorRemotes(repo, repository.Mirrors)
+	}
+	return nil, errors.Wrap(primaryErr, "primary and every mirror are unreachable")
+}
@@ -0,0 +1,137 @@
+package gitwatch
+
+import (
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// notesRefSpec mirrors every notes reference from the remote.
+const notesRefSpec = config.RefSpec("+refs/notes/*:refs/notes/*")
+
+// checkNotes fetches the remote's notes references and returns an event for
+// each one that moved since the previous check, listing the notes that were
+// added or changed. The first check of a repository only records the refs.
+func (s *Session) checkNotes(repo *git.Repository, repository Repository) (events []Event, err error) {
+	refs, err := s.remoteRefs(repo, repository)
+	if err != nil {
+		return
+	}
+
+	current := make(map[plumbing.ReferenceName]plumbing.Hash)
+	for _, ref := range refs {
+		if ref.Name().IsNote() {
+			current[ref.Name()] = ref.Hash()
+		}
+	}
+
+	state := s.stateOf(repository)
+	previous := state.notes
+
+	var changed []plumbing.ReferenceName
+	for name, hash := range current {
+		if previous == nil || previous[name] != hash {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) > 0 {
+		err = s.fetchRefs(repo, repository, notesRefSpec)
+		if err != nil {
+			return
+		}
+	}
+	state.notes = current
+	if previous == nil {
+		return
+	}
+
+	sort.Slice(changed, func(i, j int) bool { return changed[i] < changed[j] })
+	for _, name := range changed {
+		var notes []Note
+		notes, err = diffNotes(repo, name, previous[name], current[name])
+		if err != nil {
+			return nil, err
+		}
+		if len(notes) == 0 {
+			continue
+		}
+
+		var event Event
+		event, err = newEvent(repo, EventNotes)
+		if err != nil {
+			return nil, err
+		}
+		event.Timestamp = time.Now()
+		event.Notes = notes
+		events = append(events, event)
+	}
+	return
+}
+
+// diffNotes lists the notes added or modified between two commits of a notes
+// reference. A zero `from` hash means the reference is new.
+func diffNotes(repo *git.Repository, ref plumbing.ReferenceName, from, to plumbing.Hash) (notes []Note, err error) {
+	toTree, err := notesTree(repo, to)
+	if err != nil {
+		return
+	}
+	fromTree := &object.Tree{}
+	if !from.IsZero() {
+		fromTree, err = notesTree(repo, from)
+		if err != nil {
+			return
+		}
+	}
+
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to diff notes")
+	}
+	for _, change := range changes {
+		if change.To.Name == "" {
+			continue // removed note
+		}
+		_, file, err := change.Files()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read note")
+		}
+		message, err := readFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read note")
+		}
+
+		// large notes trees fan out into directories, the path with the
+		// separators removed is the hash of the annotated commit.
+		notes = append(notes, Note{
+			Ref:     ref.String(),
+			Commit:  plumbing.NewHash(strings.Replace(change.To.Name, "/", "", -1)),
+			Message: message,
+		})
+	}
+	return
+}
+
+func notesTree(repo *git.Repository, hash plumbing.Hash) (*object.Tree, error) {
+	c, err := repo.CommitObject(hash)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get notes commit")
+	}
+	return c.Tree()
+}
+
+func readFile(f *object.File) (string, error) {
+	r, err := f.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	return string(b), err
+}
@@ -0,0 +1,97 @@
+package gitwatch
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// observed reports whether a repository's clone is left untouched, with
+// updates only fetched into its remote-tracking references.
+func (r Repository) observed() bool {
+	return r.Observe || r.Bare
+}
+
+// observedRef is the remote-tracking reference an observed repository's branch
+// is fetched into. Without a Branch, the branch checked out in the clone is
+// used.
+func observedRef(repo *git.Repository, repository Repository) (name plumbing.ReferenceName, err error) {
+	branch := repository.Branch
+	if branch == "" {
+		head, err := repo.Head()
+		if err != nil {
+			return "", errors.Wrap(err, "failed to get head")
+		}
+		branch = head.Name().Short()
+	}
+	return plumbing.NewRemoteReferenceName("origin", branch), nil
+}
+
+// watchedHead returns the commit the watched branch is at locally: HEAD, or
+// the remote-tracking reference for observed repositories, whose HEAD is left
+// wherever its owner put it.
+func (s *Session) watchedHead(repo *git.Repository, repository Repository) (hash plumbing.Hash, err error) {
+	if !repository.observed() {
+		head, err := repo.Head()
+		if err != nil {
+			return hash, errors.Wrap(err, "failed to get head")
+		}
+		return head.Hash(), nil
+	}
+
+	name, err := observedRef(repo, repository)
+	if err != nil {
+		return
+	}
+	ref, err := repo.Reference(name, true)
+	if err != nil {
+		return hash, errors.Wrapf(err, "failed to find %s", name)
+	}
+	return ref.Hash(), nil
+}
+
+// observeChanges fetches an observed repository into its remote-tracking
+// references, without touching its branches, index or worktree, and returns an
+// event if the watched branch has moved since the last check.
+func (s *Session) observeChanges(repo *git.Repository, repository Repository) (event *Event, err error) {
+	ctx, cancel := s.opContext(repository)
+	defer cancel()
+	started := time.Now()
+	err = s.within(ctx, repository, func() error {
+		return repo.FetchContext(ctx, &git.FetchOptions{
+			RemoteName: "origin",
+			Auth:       s.chooseAuth(repository.Auth),
+			Depth:      s.depth(repository),
+		})
+	})
+	err = s.timedOut(ctx, repository, err)
+	s.audit(repository, AuditEntry{Op: AuditFetch}, started, err)
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, withStage(StageFetch, errors.Wrap(err, "failed to fetch observed repo"))
+	}
+
+	hash, err := s.watchedHead(repo, repository)
+	if err != nil {
+		return
+	}
+	state := s.stateOf(repository)
+	if hash == state.observed {
+		return nil, nil
+	}
+	old := state.observed
+	state.observed = hash
+
+	c, err := repo.CommitObject(hash)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get fetched commit")
+	}
+	e, err := newEvent(repo, EventCommit)
+	if err != nil {
+		return
+	}
+	e.Timestamp = c.Author.When
+	e.commit = *c
+	return &e, markForced(repo, &e, old)
+}
@@ -0,0 +1,94 @@
+package gitwatch
+
+import (
+	"bufio"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// codeOwnersPaths are the locations a CODEOWNERS file is looked for, in the
+// order GitHub uses them.
+var codeOwnersPaths = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS"}
+
+// codeOwnersRule is a single line of a CODEOWNERS file.
+type codeOwnersRule struct {
+	pattern pathPattern
+	owners  []string
+}
+
+// codeOwners resolves the owners of a set of changed files using the
+// CODEOWNERS file in the given commit, if there is one. For each file the last
+// matching rule wins, as it does on GitHub and GitLab.
+func codeOwners(c *object.Commit, files []string) (owners []string, err error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	var f *object.File
+	for _, path := range codeOwnersPaths {
+		f, err = c.File(path)
+		if err == nil {
+			break
+		}
+		if err != object.ErrFileNotFound {
+			return nil, errors.Wrap(err, "failed to read CODEOWNERS")
+		}
+	}
+	if f == nil {
+		return nil, nil
+	}
+
+	contents, err := readFile(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read CODEOWNERS")
+	}
+	rules, err := parseCodeOwners(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, file := range files {
+		var matched []string
+		for _, rule := range rules {
+			if rule.pattern.Match(file) {
+				matched = rule.owners
+			}
+		}
+		for _, owner := range matched {
+			if !seen[owner] {
+				seen[owner] = true
+				owners = append(owners, owner)
+			}
+		}
+	}
+	return
+}
+
+func parseCodeOwners(contents string) (rules []codeOwnersRule, err error) {
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.Index(line, " #"); i != -1 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		// GitLab section headers such as `[Docs]` aren't rules
+		if strings.HasPrefix(fields[0], "[") || strings.HasPrefix(fields[0], "^[") {
+			continue
+		}
+
+		pattern, err := compilePattern(fields[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid CODEOWNERS pattern %s", fields[0])
+		}
+		rules = append(rules, codeOwnersRule{pattern, fields[1:]})
+	}
+	return rules, scanner.Err()
+}
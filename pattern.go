@@ -0,0 +1,63 @@
+package gitwatch
+
+import (
+	"regexp"
+	"strings"
+)
+
+// pathPattern is a path pattern using the gitignore syntax, as used by
+// CODEOWNERS and similar files: a leading `/` or a `/` in the middle anchors
+// the pattern to the repository root, a trailing `/` only matches directories,
+// `*` and `?` match within a path segment and `**` matches across segments.
+// A pattern that matches a directory also matches everything inside it.
+type pathPattern struct {
+	re *regexp.Regexp
+}
+
+func compilePattern(pattern string) (pathPattern, error) {
+	p := strings.TrimSpace(pattern)
+
+	dirOnly := strings.HasSuffix(p, "/")
+	p = strings.TrimSuffix(p, "/")
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(p); i++ {
+		switch {
+		case strings.HasPrefix(p[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case p[i] == '*':
+			b.WriteString("[^/]*")
+		case p[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(p[i])))
+		}
+	}
+	if dirOnly {
+		b.WriteString("/.*$")
+	} else {
+		b.WriteString("(/.*)?$")
+	}
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return pathPattern{}, err
+	}
+	return pathPattern{re}, nil
+}
+
+// Match reports whether a slash-separated path relative to the repository root
+// matches the pattern.
+func (p pathPattern) Match(path string) bool {
+	return p.re.MatchString(path)
+}
@@ -0,0 +1,106 @@
+package gitwatch
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Plugins is a Sink that hands every event to each executable found in a
+// directory. The event is written to the plugin's standard input in the chosen
+// Format and a plugin signals failure with a non-zero exit status. The
+// directory is read for each event so plugins can be added or removed while
+// running.
+type Plugins struct {
+	Dir     string        // the directory to discover plugin executables in
+	Timeout time.Duration // if set, plugins running for longer than this are killed
+	Format  Format        // the encoding of the event passed to plugins
+
+	mu       sync.Mutex
+	pending  []byte          // the event some plugins failed to take, as encoded for them
+	accepted map[string]bool // the plugins that took the pending event
+}
+
+// Send runs every plugin in the directory with the event on its standard input.
+// All plugins are run even if some fail. When the same event is sent again,
+// as a retry, only the plugins that failed it are run.
+func (p *Plugins) Send(ctx context.Context, e Event) error {
+	plugins, err := p.discover()
+	if err != nil {
+		return err
+	}
+
+	payload, _, err := Encode(e, p.Format)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode event")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !bytes.Equal(payload, p.pending) {
+		p.pending, p.accepted = payload, make(map[string]bool)
+	}
+
+	var failed []string
+	for _, plugin := range plugins {
+		if p.accepted[plugin] {
+			continue
+		}
+		if err := p.run(ctx, plugin, payload); err != nil {
+			failed = append(failed, err.Error())
+		} else {
+			p.accepted[plugin] = true
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("plugins failed: %s", strings.Join(failed, "; "))
+	}
+	p.pending, p.accepted = nil, nil
+	return nil
+}
+
+// discover lists the executable files in the plugin directory, sorted by name.
+func (p *Plugins) discover() (plugins []string, err error) {
+	files, err := ioutil.ReadDir(p.Dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read plugin directory")
+	}
+	for _, f := range files {
+		if f.Mode().IsRegular() && f.Mode().Perm()&0111 != 0 {
+			plugins = append(plugins, filepath.Join(p.Dir, f.Name()))
+		}
+	}
+	sort.Strings(plugins)
+	return
+}
+
+// run runs a plugin with the event on its standard input, killing it if ctx
+// is done first or its Timeout passes.
+func (p *Plugins) run(ctx context.Context, plugin string, payload []byte) (err error) {
+	if p.Timeout > 0 {
+		var cf context.CancelFunc
+		ctx, cf = context.WithTimeout(ctx, p.Timeout)
+		defer cf()
+	}
+
+	cmd := exec.CommandContext(ctx, plugin)
+	cmd.Stdin = bytes.NewReader(payload)
+	var out bytes.Buffer
+	copied, err := startWithOutput(cmd, &out)
+	if err == nil {
+		err = cmd.Wait()
+		copied()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "%s: %s", filepath.Base(plugin), strings.TrimSpace(out.String()))
+	}
+	return nil
+}
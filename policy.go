@@ -0,0 +1,178 @@
+package gitwatch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// Policy is a set of rules every update must pass before the worktree is
+// updated or an event is emitted for it. An update that breaks a rule is
+// fetched but not checked out, and a policy violation event lists what it
+// broke. Like a rejection by BeforeUpdate, the update is checked again on
+// later checks, so it goes through once the rules pass, for example once a
+// pending status succeeds.
+type Policy struct {
+	Keyring          string        // if set, an armored PGP key ring every new commit must be signed by a key of
+	AllowedAuthors   []string      // if set, every new commit's author email must match one of these, such as `*@example.com`
+	ProtectedPaths   []string      // path patterns of files only ProtectedAuthors may change
+	ProtectedAuthors []string      // author email patterns allowed to change ProtectedPaths
+	Status           StatusChecker // if set, the new head commit's status must be `success`
+}
+
+// StatusChecker looks up the combined status of a commit from the provider
+// hosting a repository, such as the result of its CI.
+type StatusChecker interface {
+	// Status returns the commit's state: `success`, `pending` or `failure`.
+	Status(ctx context.Context, url string, commit plumbing.Hash) (string, error)
+}
+
+// check returns the rules the commits of an update break, if any.
+func (p *Policy) check(ctx context.Context, repo *git.Repository, update PendingUpdate) (violations []string, err error) {
+	commits, err := commitRange(repo, update.Old, update.New)
+	if err != nil {
+		return nil, err
+	}
+	var protected []pathPattern
+	for _, pattern := range p.ProtectedPaths {
+		compiled, err := compilePattern(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid protected path %s", pattern)
+		}
+		protected = append(protected, compiled)
+	}
+
+	for i := range commits {
+		c := &commits[i]
+		hash := c.Hash.String()[:7]
+		email := strings.ToLower(c.Author.Email)
+
+		if p.Keyring != "" {
+			if c.PGPSignature == "" {
+				violations = append(violations, fmt.Sprintf("commit %s is not signed", hash))
+			} else if _, err := c.Verify(p.Keyring); err != nil {
+				violations = append(violations, fmt.Sprintf("commit %s has an untrusted signature", hash))
+			}
+		}
+		if len(p.AllowedAuthors) > 0 && !matchName(p.AllowedAuthors, email) {
+			violations = append(violations, fmt.Sprintf("commit %s is by %s, who is not an allowed author", hash, c.Author.Email))
+		}
+		if len(protected) > 0 && !matchName(p.ProtectedAuthors, email) {
+			files, err := commitFiles(c)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range files {
+				if matchAny(protected, f) {
+					violations = append(violations, fmt.Sprintf("commit %s by %s changes protected path %s", hash, c.Author.Email, f))
+				}
+			}
+		}
+	}
+
+	if p.Status != nil {
+		state, err := p.Status.Status(ctx, update.URL, update.New)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get status of %s", update.New)
+		}
+		if state != "success" {
+			violations = append(violations, fmt.Sprintf("commit %s has status %s", update.New.String()[:7], state))
+		}
+	}
+	return
+}
+
+// commitFiles lists the files a commit changes from its first parent, or every
+// file of a root commit.
+func commitFiles(c *object.Commit) (files []string, err error) {
+	if c.NumParents() == 0 {
+		iter, err := c.Files()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list files")
+		}
+		err = iter.ForEach(func(f *object.File) error {
+			files = append(files, f.Name)
+			return nil
+		})
+		return files, errors.Wrap(err, "failed to list files")
+	}
+	parent, err := c.Parent(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get parent commit")
+	}
+	return changedFiles(parent, c)
+}
+
+// violationEvent describes an update the session's Policy rejected
+func violationEvent(repo *git.Repository, update PendingUpdate, violations []string) (event *Event, err error) {
+	e, err := newEvent(repo, EventPolicyViolation)
+	if err != nil {
+		return nil, err
+	}
+	c, err := repo.CommitObject(update.New)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get fetched commit")
+	}
+	e.Branch = update.Branch
+	e.Timestamp = time.Now()
+	e.Violations = violations
+	e.commit = *c
+	return &e, nil
+}
+
+// GitHubStatus is a StatusChecker using the combined status of commits on
+// GitHub, which is `pending` until every status reported has succeeded.
+type GitHubStatus struct {
+	Token  string       // if set, used to read the status of private repositories
+	API    string       // the API's base URL, https://api.github.com if empty, set it for GitHub Enterprise
+	Client *http.Client // the client to call the API with, the one set with UseHTTPClient if nil
+}
+
+// Status implements StatusChecker
+func (g GitHubStatus) Status(ctx context.Context, url string, commit plumbing.Hash) (string, error) {
+	api := strings.TrimSuffix(g.API, "/")
+	if api == "" {
+		api = "https://api.github.com"
+	}
+	client := g.Client
+	if client == nil {
+		client = httpClient()
+	}
+	// the key is `host/owner/repo`
+	key := repositoryKey(url)
+	if i := strings.Index(key, "/"); i != -1 {
+		key = key[i+1:]
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/repos/%s/commits/%s/status", api, key, commit), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if g.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.Token)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get commit status")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("failed to get commit status: %s", resp.Status)
+	}
+	var status struct {
+		State string `json:"state"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return "", errors.Wrap(err, "failed to decode commit status")
+	}
+	return status.State, nil
+}
@@ -0,0 +1,140 @@
+package gitwatch
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// pullRefPrefixes are the namespaces hosting providers publish pull request
+// heads under: GitHub and Gitea use `refs/pull/<n>/head` while GitLab uses
+// `refs/merge-requests/<n>/head`.
+var pullRefPrefixes = []string{"refs/pull/", "refs/merge-requests/"}
+
+// pullNumber returns the pull request number for a pull request head
+// reference, or false if the reference isn't one.
+func pullNumber(name plumbing.ReferenceName) (int, bool) {
+	for _, prefix := range pullRefPrefixes {
+		s := name.String()
+		if !strings.HasPrefix(s, prefix) || !strings.HasSuffix(s, "/head") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(s, prefix), "/head"))
+		if err != nil {
+			return 0, false
+		}
+		return n, true
+	}
+	return 0, false
+}
+
+// pullTrackingRef is the local reference a pull request head is fetched into.
+func pullTrackingRef(name plumbing.ReferenceName) plumbing.ReferenceName {
+	return plumbing.ReferenceName("refs/remotes/origin/" + strings.TrimPrefix(name.String(), "refs/"))
+}
+
+// checkPulls compares the pull request heads advertised by the remote with
+// those seen on the previous check, fetches any that are new or have moved and
+// returns an event for each. The first check of a repository only records
+// them.
+func (s *Session) checkPulls(repo *git.Repository, repository Repository) (events []Event, err error) {
+	refs, err := s.remoteRefs(repo, repository)
+	if err != nil {
+		return
+	}
+
+	current := make(map[plumbing.ReferenceName]plumbing.Hash)
+	for _, ref := range refs {
+		if _, ok := pullNumber(ref.Name()); ok {
+			current[ref.Name()] = ref.Hash()
+		}
+	}
+
+	state := s.stateOf(repository)
+	previous := state.pulls
+	state.pulls = current
+	if previous == nil {
+		return
+	}
+
+	var changed []plumbing.ReferenceName
+	var specs []config.RefSpec
+	for name, hash := range current {
+		if previous[name] != hash {
+			changed = append(changed, name)
+			specs = append(specs, config.RefSpec(fmt.Sprintf("+%s:%s", name, pullTrackingRef(name))))
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	err = s.fetchRefs(repo, repository, specs...)
+	if err != nil {
+		state.pulls = previous
+		return
+	}
+
+	sort.Slice(changed, func(i, j int) bool { return changed[i] < changed[j] })
+	for _, name := range changed {
+		var event Event
+		event, err = newEvent(repo, EventPullRequest)
+		if err != nil {
+			return nil, err
+		}
+		c, err := repo.CommitObject(current[name])
+		if err != nil {
+			return nil, err
+		}
+		event.PullRequest, _ = pullNumber(name)
+		event.Timestamp = c.Author.When
+		event.commit = *c
+		events = append(events, event)
+	}
+	return
+}
+
+var (
+	// GitHub: "Merge pull request #123 from user/branch"
+	githubMergeMessage = regexp.MustCompile(`^Merge pull request #(\d+) `)
+	// GitLab: "See merge request group/project!123"
+	gitlabMergeMessage = regexp.MustCompile(`(?m)^See merge request \S*!(\d+)\s*$`)
+	// squash merges on GitHub and Gitea: "Subject line (#123)"
+	squashMergeMessage = regexp.MustCompile(`\(#(\d+)\)$`)
+)
+
+// mergedPullRequest returns the number of the pull request that a commit
+// merged, or zero if it doesn't look like a pull request merge. Pull request
+// heads that were seen on the remote are matched against the commit's parents
+// first and the commit message is used as a fallback.
+func mergedPullRequest(c *object.Commit, pulls map[plumbing.ReferenceName]plumbing.Hash) int {
+	if len(c.ParentHashes) > 1 {
+		for name, hash := range pulls {
+			for _, parent := range c.ParentHashes[1:] {
+				if parent == hash {
+					n, _ := pullNumber(name)
+					return n
+				}
+			}
+		}
+	}
+
+	subject := strings.SplitN(c.Message, "\n", 2)[0]
+	for _, re := range []*regexp.Regexp{githubMergeMessage, squashMergeMessage} {
+		if m := re.FindStringSubmatch(strings.TrimSpace(subject)); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			return n
+		}
+	}
+	if m := gitlabMergeMessage.FindStringSubmatch(c.Message); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,97 @@
+package gitwatch
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// pushMirrorRemote is the name of the remote a repository's PushMirror is
+// pushed to.
+const pushMirrorRemote = "push-mirror"
+
+// pushMirror pushes the watched branch, and the tags if they are watched, to
+// the repository's PushMirror whenever the branch has moved since the last
+// push or the check produced events. A failed push is retried on the next
+// check.
+func (s *Session) pushMirror(repo *git.Repository, repository Repository, changed bool) (err error) {
+	head, err := repo.Head()
+	if err != nil {
+		return errors.Wrap(err, "failed to get head for push mirror")
+	}
+	watched, err := s.watchedHead(repo, repository)
+	if err != nil {
+		return err
+	}
+	state := s.stateOf(repository)
+	if watched == state.lastPushed && !changed {
+		return nil
+	}
+
+	if err = syncRemote(repo, pushMirrorRemote, repository.PushMirror); err != nil {
+		return err
+	}
+
+	// the push always mirrors the branch that is checked out, which is the
+	// watched branch or the remote's default branch if none was given, or its
+	// remote-tracking ref for observed repositories.
+	branch := head.Name()
+	if !branch.IsBranch() {
+		return errors.Errorf("cannot push mirror from detached head %s", head.Hash())
+	}
+	source := branch
+	if repository.observed() {
+		if source, err = observedRef(repo, repository); err != nil {
+			return err
+		}
+		branch = plumbing.NewBranchReferenceName(source.Short()[len("origin/"):])
+	}
+	specs := []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", source, branch))}
+	if repository.WatchTags {
+		specs = append(specs, config.RefSpec("+refs/tags/*:refs/tags/*"))
+	}
+
+	ctx, cancel := s.opContext(repository)
+	defer cancel()
+	started := time.Now()
+	err = s.within(ctx, repository, func() error {
+		return repo.PushContext(ctx, &git.PushOptions{
+			RemoteName: pushMirrorRemote,
+			RefSpecs:   specs,
+			Auth:       s.chooseAuth(repository.PushAuth),
+			Prune:      repository.WatchTags,
+		})
+	})
+	err = s.timedOut(ctx, repository, err)
+	s.audit(repository, AuditEntry{Op: AuditPush, To: watched.String()}, started, err)
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return errors.Wrapf(err, "failed to push to mirror %s", repository.PushMirror)
+	}
+	state.lastPushed = watched
+	return nil
+}
+
+// syncRemote makes sure the local repository has the named remote, pointing at
+// the given URL.
+func syncRemote(repo *git.Repository, name, url string) error {
+	remote, err := repo.Remote(name)
+	if err == nil && remote.Config().URLs[0] == url {
+		return nil
+	}
+	if err == nil {
+		if err = repo.DeleteRemote(name); err != nil {
+			return errors.Wrapf(err, "failed to replace remote %s", name)
+		}
+	} else if err != git.ErrRemoteNotFound {
+		return errors.Wrapf(err, "failed to get remote %s", name)
+	}
+	_, err = repo.CreateRemote(&config.RemoteConfig{Name: name, URLs: []string{url}})
+	if err != nil {
+		return errors.Wrapf(err, "failed to create remote %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package gitwatch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// maxPayloadSize caps the size of webhook payloads read by a Receiver, GitHub
+// never sends more than this
+const maxPayloadSize = 25 << 20
+
+// ErrBadSignature is returned by webhook adapters when a delivery's signature
+// or token doesn't match the receiver's secret
+var ErrBadSignature = errors.New("webhook signature doesn't match")
+
+// Push describes a ref update announced by a webhook
+type Push struct {
+	URLs    []string `json:"urls"`               // the URLs the repository can be cloned from
+	TraceID string   `json:"trace_id,omitempty"` // the trace the checks of the push continue, a new one if empty
+	Ref     string   `json:"ref"`                // the full name of the updated ref, such as `refs/heads/master`
+	Before  string   `json:"before,omitempty"`   // the hash the ref pointed at before the update
+	After   string   `json:"after,omitempty"`    // the hash the ref points at now
+	Deleted bool     `json:"deleted,omitempty"`  // true if the ref was deleted
+}
+
+// WebhookAdapter translates a provider's webhook deliveries into pushes.
+type WebhookAdapter interface {
+	// Parse returns ok false if the request didn't come from the adapter's
+	// provider. Deliveries from the provider that aren't ref updates, such as
+	// pings, return no pushes. A delivery that doesn't carry the right
+	// signature for a non-empty secret returns ErrBadSignature.
+	Parse(r *http.Request, body []byte, secret string) (pushes []Push, ok bool, err error)
+}
+
+// DefaultAdapters are the webhook adapters a Receiver uses if none are set
+var DefaultAdapters = []WebhookAdapter{
+	GiteaAdapter{}, // before GitHub, Gitea also sends GitHub's headers
+	GitHubAdapter{},
+	GitLabAdapter{},
+	BitbucketAdapter{},
+}
+
+// Receiver is an http.Handler that checks a session's repositories as soon as
+// a webhook announces a change to them, rather than waiting for the next poll.
+//
+// Deliveries are parsed by the first adapter that recognises them. Anything
+// else is read in the generic format: a JSON encoded Push, signed like the
+// Webhook sink signs its deliveries.
+type Receiver struct {
+	Session  *Session
+	Secret   string           // if set, deliveries must be signed with this secret
+	Adapters []WebhookAdapter // DefaultAdapters if nil
+}
+
+// ServeHTTP accepts a webhook delivery and checks the repositories it applies
+// to in the background
+func (h Receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPayloadSize))
+	if err != nil {
+		http.Error(w, "failed to read payload", http.StatusBadRequest)
+		return
+	}
+
+	pushes, err := h.parse(r, body)
+	if err == ErrBadSignature {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	trace := requestTrace(r)
+	for i := range pushes {
+		if pushes[i].TraceID == "" {
+			pushes[i].TraceID = trace
+		}
+	}
+
+	// checks can take longer than providers wait for a response
+	go func() {
+		for _, p := range pushes {
+			if _, err := h.Session.Notify(p); err != nil {
+				r := ErrorRecord{Op: "webhook"}
+				if len(p.URLs) > 0 {
+					r.URL = p.URLs[0]
+				}
+				h.Session.reportError(r, errors.Wrap(err, "failed to check repository for webhook"))
+			}
+		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h Receiver) parse(r *http.Request, body []byte) (pushes []Push, err error) {
+	adapters := h.Adapters
+	if adapters == nil {
+		adapters = DefaultAdapters
+	}
+	for _, a := range adapters {
+		pushes, ok, err := a.Parse(r, body, h.Secret)
+		if ok || err != nil {
+			return pushes, err
+		}
+	}
+
+	if h.Secret != "" && !VerifySignature(h.Secret, body, r.Header.Get(SignatureHeader)) {
+		return nil, ErrBadSignature
+	}
+	var p Push
+	if err = json.Unmarshal(body, &p); err != nil {
+		return nil, errors.Wrap(err, "failed to decode push")
+	}
+	return []Push{p}, nil
+}
+
+// Notify checks every repository a push applies to straight away and returns
+// how many were checked. A push applies to a repository cloned from one of its
+// URLs if it updates the watched branch, any branch if none is set, or a tag
+// if tags are watched. Clone-less repositories take every push.
+func (s *Session) Notify(p Push) (checked int, err error) {
+	err = s.onDaemon(func() error {
+		s.beginTrace(p.TraceID)
+		for _, repository := range s.Repositories {
+			if !p.appliesTo(s.withGroup(repository)) {
+				continue
+			}
+			checked++
+			if err := s.checkOne(repository, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (p Push) appliesTo(r Repository) bool {
+	urls := append([]string{r.URL}, r.Mirrors...)
+	if !sameRepository(urls, p.URLs) {
+		return false
+	}
+	if r.RefsOnly {
+		return true
+	}
+	name := plumbing.ReferenceName(p.Ref)
+	switch {
+	case name.IsBranch():
+		return r.Branch == "" || name.Short() == r.Branch || matchBranch(r.Branches, name.Short())
+	case name.IsTag():
+		return r.WatchTags
+	}
+	return false
+}
+
+// sameRepository reports whether any URL in one list refers to the same
+// repository as a URL in the other.
+func sameRepository(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if y != "" && repositoryKey(x) == repositoryKey(y) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// repositoryKey reduces a repository URL to its host and path, so HTTPS, SSH
+// and web URLs of the same repository compare equal.
+func repositoryKey(url string) string {
+	u := strings.ToLower(strings.TrimSpace(url))
+	if i := strings.Index(u, "://"); i != -1 {
+		u = u[i+3:]
+	} else if c, sl := strings.Index(u, ":"), strings.Index(u+"/", "/"); c != -1 && c < sl {
+		// scp-like `user@host:path`
+		u = u[:c] + "/" + u[c+1:]
+	}
+	host := strings.Index(u+"/", "/")
+	if at := strings.LastIndex(u[:host], "@"); at != -1 {
+		u, host = u[at+1:], host-at-1
+	}
+	if c := strings.Index(u[:host], ":"); c != -1 {
+		u = u[:c] + u[host:]
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(u, "/"), ".git")
+}
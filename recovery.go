@@ -0,0 +1,219 @@
+package gitwatch
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// RecoveryStrategy decides what a session does with a clone whose update
+// failed, such as because of local changes to the worktree or a history that
+// diverged from the remote's. Failures to reach the remote are only reported,
+// whatever the strategy, as recovering wouldn't help.
+type RecoveryStrategy int
+
+const (
+	// RecoverReport leaves the clone as it is and only reports the error. It's
+	// the default, unless AllowDeletion is set.
+	RecoverReport RecoveryStrategy = iota
+	// RecoverReset discards changes to the worktree's tracked files and pulls
+	// again.
+	RecoverReset
+	// RecoverFetchReset fetches the branch and hard resets the clone to it,
+	// discarding local changes and commits, and following a rewritten history.
+	RecoverFetchReset
+	// RecoverReclone deletes the clone and clones the repository afresh, which
+	// is what AllowDeletion does.
+	RecoverReclone
+)
+
+var recoveryNames = []string{
+	RecoverReport:     "report",
+	RecoverReset:      "reset",
+	RecoverFetchReset: "fetch-reset",
+	RecoverReclone:    "reclone",
+}
+
+func (r RecoveryStrategy) String() string {
+	if r >= 0 && int(r) < len(recoveryNames) {
+		return recoveryNames[r]
+	}
+	return "unknown"
+}
+
+// UnmarshalText parses `report`, `reset`, `fetch-reset` or `reclone`, as used
+// in configuration files and flags
+func (r *RecoveryStrategy) UnmarshalText(b []byte) error {
+	for i, name := range recoveryNames {
+		if string(b) == name {
+			*r = RecoveryStrategy(i)
+			return nil
+		}
+	}
+	return errors.Errorf("unknown recovery strategy %q", b)
+}
+
+// recovery returns the session's Recovery, or RecoverReclone if it's unset and
+// AllowDeletion is.
+func (s *Session) recovery() RecoveryStrategy {
+	if s.Recovery == RecoverReport && s.AllowDeletion {
+		return RecoverReclone
+	}
+	return s.Recovery
+}
+
+// recoverRepo applies the session's RecoveryStrategy to a repository whose
+// update failed with `cause`, and returns the clone and any event once it has
+// been brought up to date. Events compare the branch with where it was at the
+// last event, as a failed pull may already have moved it.
+func (s *Session) recoverRepo(repo *git.Repository, repository Repository, cause error) (*git.Repository, *Event, error) {
+	var (
+		event *Event
+		err   error
+		from  = s.stateOf(repository).lastEvent
+	)
+	switch s.recovery() {
+	case RecoverReset:
+		event, err = s.resetAndPull(repo, repository, from)
+	case RecoverFetchReset:
+		event, err = s.fetchAndReset(repo, repository, from)
+	case RecoverReclone:
+		if s.gated() {
+			// a new clone would check out the remote's branch unchecked
+			return repo, nil, errors.Wrap(cause, "not re-cloned, as updates must be accepted first")
+		}
+		return s.recloneRepo(repository)
+	default:
+		return repo, nil, cause
+	}
+	if err != nil {
+		return repo, nil, errors.Wrapf(err, "%v, and failed to recover with %s", cause, s.recovery())
+	}
+	return repo, event, nil
+}
+
+// resetAndPull hard resets the worktree to the checked out commit and pulls.
+func (s *Session) resetAndPull(repo *git.Repository, repository Repository, from plumbing.Hash) (event *Event, err error) {
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get worktree")
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get head")
+	}
+
+	started := time.Now()
+	err = wt.Reset(&git.ResetOptions{Commit: head.Hash(), Mode: git.HardReset})
+	s.audit(repository, AuditEntry{Op: AuditReset, From: head.Hash().String(), To: head.Hash().String()}, started, err)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to reset worktree")
+	}
+	event, err = s.pullWithMirrors(repo, repository)
+	if event != nil || err != nil {
+		return
+	}
+	if head, err = repo.Head(); err != nil {
+		return nil, errors.Wrap(err, "failed to get head")
+	}
+	if head.Hash() == from {
+		return nil, nil
+	}
+	return changedEvent(repo, from.String(), head.Hash().String())
+}
+
+// fetchAndReset fetches the repository's origin and hard resets the checked
+// out branch to what was fetched for it.
+func (s *Session) fetchAndReset(repo *git.Repository, repository Repository, from plumbing.Hash) (event *Event, err error) {
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get worktree")
+	}
+	var before string
+	if head, err := repo.Head(); err == nil {
+		before = head.Hash().String()
+	}
+
+	ctx, cancel := s.opContext(repository)
+	defer cancel()
+	started := time.Now()
+	err = s.within(ctx, repository, func() error {
+		return repo.FetchContext(ctx, &git.FetchOptions{
+			RemoteName: "origin",
+			Auth:       s.chooseAuth(repository.Auth),
+			Depth:      s.depth(repository),
+			Force:      true,
+		})
+	})
+	err = s.timedOut(ctx, repository, err)
+	s.audit(repository, AuditEntry{Op: AuditFetch}, started, err)
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, withStage(StageFetch, errors.Wrap(err, "failed to fetch local repo"))
+	}
+	if s.gated() {
+		if accepted, event, err := s.acceptsFetched(repo, repository); !accepted {
+			return event, err
+		}
+	}
+
+	started = time.Now()
+	err = resetToFetched(repo, wt, "origin", repository.Branch, true)
+	var to string
+	if head, err := repo.Head(); err == nil && head.Hash().String() != before {
+		to = head.Hash().String()
+	}
+	s.audit(repository, AuditEntry{Op: AuditReset, From: before, To: to}, started, err)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to reset to fetched branch")
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get head")
+	}
+	if head.Hash() == from {
+		return nil, nil
+	}
+	return changedEvent(repo, from.String(), head.Hash().String())
+}
+
+// acceptsFetched checks the reset of a repository to what was fetched from its
+// origin against the session's Policy and BeforeUpdate hook, as a pull would.
+func (s *Session) acceptsFetched(repo *git.Repository, repository Repository) (accepted bool, event *Event, err error) {
+	head, err := repo.Head()
+	if err != nil {
+		return false, nil, errors.Wrap(err, "failed to get head")
+	}
+	branch := repository.Branch
+	if branch == "" {
+		branch = head.Name().Short()
+	}
+	fetched, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", branch), true)
+	if err != nil {
+		return false, nil, errors.Wrap(err, "failed to find fetched branch")
+	}
+	if fetched.Hash() == head.Hash() {
+		return true, nil, nil
+	}
+	update, err := pendingUpdate(repo, "origin", branch, head.Hash(), fetched.Hash())
+	if err != nil {
+		return false, nil, err
+	}
+	return s.accepts(repo, repository, update)
+}
+
+// changedEvent returns an event for the checked out commit if an update moved
+// the branch from `from` to `to`, flagged as forced if it doesn't descend from
+// `from`.
+func changedEvent(repo *git.Repository, from, to string) (event *Event, err error) {
+	if to == "" {
+		return nil, nil
+	}
+	event, err = GetEventFromRepo(repo)
+	if err != nil {
+		return
+	}
+	return event, markForced(repo, event, plumbing.NewHash(from))
+}
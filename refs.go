@@ -0,0 +1,356 @@
+package gitwatch
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// repoState holds what the watcher has learned about a repository between
+// checks.
+type repoState struct {
+	tags          map[string]plumbing.Hash                 // tags advertised by the remote on the last check
+	notes         map[plumbing.ReferenceName]plumbing.Hash // notes refs advertised by the remote on the last check
+	pulls         map[plumbing.ReferenceName]plumbing.Hash // pull request heads advertised by the remote on the last check
+	branches      map[string]plumbing.Hash                 // heads of the branches matching Branches on the last check
+	lastEvent     plumbing.Hash                            // the head commit of the last commit event emitted
+	lastEmitted   time.Time                                // when the last commit event was emitted
+	pending       *Event                                   // a commit event held back by the rate limit
+	lastDigest    plumbing.Hash                            // the head commit when the last digest was emitted
+	lastDigestAt  time.Time                                // when the last digest was emitted
+	lastPushed    plumbing.Hash                            // the head commit last pushed to the push mirror
+	vetoed        plumbing.Hash                            // the last update rejected by the session's BeforeUpdate hook
+	violated      plumbing.Hash                            // the last update rejected by the session's Policy
+	observed      plumbing.Hash                            // the commit an observed repository's branch was at on the last check
+	attempts      int                                      // the number of checks in a row that have failed, reset by a successful check or Resume
+	retryAt       time.Time                                // when a failing repository is due to be retried
+	exhausted     bool                                     // the repository ran out of retries and isn't checked until resumed
+	checked       bool                                     // the repository has been checked successfully at least once
+	polledAt      time.Time                                // when the repository was last polled by a round of checks
+	lock          Lock                                     // the repository's lock, if the session's Locker gave it to this instance
+	branchDeleted bool                                     // the watched branch was missing from the remote on the last check
+	parked        bool                                     // the repository is no longer checked
+	rolledBack    bool                                     // the repository was rolled back and isn't checked until resumed
+	removed       bool                                     // the repository is to be dropped from the session
+	abandoned     []chan struct{}                          // closed as each operation abandoned by within returns
+}
+
+// BranchDeletionPolicy decides what happens to a repository entry once the
+// branch it watches has been deleted on the remote.
+type BranchDeletionPolicy int
+
+const (
+	// BranchDeletionKeep keeps checking the repository, so watching resumes if
+	// the branch is pushed again.
+	BranchDeletionKeep BranchDeletionPolicy = iota
+	// BranchDeletionPark keeps the repository in the session but stops
+	// checking it.
+	BranchDeletionPark
+	// BranchDeletionRemove removes the repository from the session.
+	BranchDeletionRemove
+)
+
+func (s *Session) stateOf(r Repository) *repoState {
+	if s.state == nil {
+		s.state = make(map[string]*repoState)
+	}
+	st, ok := s.state[r.fullPath]
+	if !ok {
+		st = &repoState{}
+		s.state[r.fullPath] = st
+	}
+	return st
+}
+
+// pruneRepos drops any repositories that have been marked for removal.
+func (s *Session) pruneRepos() {
+	kept := s.Repositories[:0]
+	for _, r := range s.Repositories {
+		if st, ok := s.state[r.fullPath]; ok && st.removed {
+			s.forget(r)
+			continue
+		}
+		kept = append(kept, r)
+	}
+	s.setRepos(kept)
+}
+
+// forget drops the state kept for a repository that's no longer watched
+func (s *Session) forget(r Repository) {
+	if st, ok := s.state[r.fullPath]; ok {
+		s.releaseLock(st)
+		delete(s.state, r.fullPath)
+	}
+	s.retryMu.Lock()
+	delete(s.retrying, r.URL)
+	s.retryMu.Unlock()
+}
+
+// remoteRefs lists the references currently advertised by a repository's
+// origin remote.
+func (s *Session) remoteRefs(repo *git.Repository, repository Repository) (refs []*plumbing.Reference, err error) {
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get origin remote")
+	}
+	ctx, cancel := s.opContext(repository)
+	defer cancel()
+	auth := s.chooseAuth(repository.Auth)
+	var listed []*plumbing.Reference
+	err = s.within(ctx, repository, func() (err error) {
+		if url := remote.Config().URLs[0]; s.ReuseSSH && isSSHURL(url) {
+			listed, err = s.sshPool.listRefs(url, auth)
+		} else {
+			listed, err = remote.List(&git.ListOptions{Auth: auth})
+		}
+		return
+	})
+	if err = s.timedOut(ctx, repository, err); err != nil {
+		return nil, withStage(StageFetch, errors.Wrap(err, "failed to list remote references"))
+	}
+	return listed, nil
+}
+
+// branchMoved compares the watched branch on the remote with the local copy
+// without fetching anything. As with a pull, a branch missing from the remote
+// is reported as plumbing.ErrReferenceNotFound.
+func (s *Session) branchMoved(repo *git.Repository, repository Repository) (moved bool, err error) {
+	refs, err := s.remoteRefs(repo, repository)
+	if err != nil {
+		return
+	}
+
+	name := plumbing.HEAD
+	if repository.Branch != "" {
+		name = plumbing.NewBranchReferenceName(repository.Branch)
+	}
+	remote, ok := findRef(refs, name)
+	if !ok {
+		return false, errors.Wrap(plumbing.ErrReferenceNotFound, "failed to find remote branch")
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get local head")
+	}
+	return head.Hash() != remote, nil
+}
+
+// findRef looks up the hash of a reference in a remote's advertised refs,
+// following symbolic references such as HEAD.
+func findRef(refs []*plumbing.Reference, name plumbing.ReferenceName) (hash plumbing.Hash, ok bool) {
+	for i := 0; i < 2; i++ {
+		for _, ref := range refs {
+			if ref.Name() != name {
+				continue
+			}
+			if ref.Type() == plumbing.HashReference {
+				return ref.Hash(), true
+			}
+			name = ref.Target()
+			break
+		}
+	}
+	return
+}
+
+// fetchRefs fetches the given refspecs from a repository's origin remote.
+func (s *Session) fetchRefs(repo *git.Repository, repository Repository, specs ...config.RefSpec) (err error) {
+	ctx, cancel := s.opContext(repository)
+	defer cancel()
+	started := time.Now()
+	err = s.within(ctx, repository, func() error {
+		return repo.FetchContext(ctx, &git.FetchOptions{
+			RemoteName: "origin",
+			RefSpecs:   specs,
+			Auth:       s.chooseAuth(repository.Auth),
+			Depth:      s.depth(repository),
+			Force:      true,
+		})
+	})
+	err = s.timedOut(ctx, repository, err)
+	s.audit(repository, AuditEntry{Op: AuditFetch}, started, err)
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return withStage(StageFetch, errors.Wrap(err, "failed to fetch references"))
+	}
+	return nil
+}
+
+// checkTags compares the tags advertised by the remote against the set seen on
+// the previous check, fetches any that are new or have moved and returns an
+// event for each of them and for each tag that has disappeared. The first
+// check of a repository only records the tag set.
+func (s *Session) checkTags(repo *git.Repository, repository Repository) (events []Event, err error) {
+	refs, err := s.remoteRefs(repo, repository)
+	if err != nil {
+		return
+	}
+
+	tags := make(map[string]plumbing.Hash)
+	for _, ref := range refs {
+		if ref.Name().IsTag() {
+			tags[ref.Name().Short()] = ref.Hash()
+		}
+	}
+
+	state := s.stateOf(repository)
+	if state.tags != nil {
+		var deleted []string
+		for name := range state.tags {
+			if _, ok := tags[name]; !ok {
+				deleted = append(deleted, name)
+			}
+		}
+		sort.Strings(deleted)
+
+		for _, name := range deleted {
+			var event Event
+			event, err = tagDeletedEvent(repo, name, state.tags[name], !repository.observed())
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, event)
+		}
+
+		var created []string
+		var specs []config.RefSpec
+		for name, hash := range tags {
+			if state.tags[name] != hash {
+				created = append(created, name)
+				ref := plumbing.NewTagReferenceName(name)
+				specs = append(specs, config.RefSpec(fmt.Sprintf("+%s:%s", ref, ref)))
+			}
+		}
+		if len(created) > 0 {
+			if err = s.fetchRefs(repo, repository, specs...); err != nil {
+				return nil, err
+			}
+		}
+		sort.Strings(created)
+
+		for _, name := range created {
+			var event Event
+			event, err = tagCreatedEvent(repo, name, tags[name])
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, event)
+		}
+	}
+	state.tags = tags
+
+	return
+}
+
+// tagCreatedEvent builds the event for a tag that was pushed or moved, carrying
+// the commit it points at and, for an annotated tag, its message.
+func tagCreatedEvent(repo *git.Repository, name string, hash plumbing.Hash) (event Event, err error) {
+	event, err = newEvent(repo, EventTagCreated)
+	if err != nil {
+		return
+	}
+	event.Tag = name
+
+	var c *object.Commit
+	if tag, err := repo.TagObject(hash); err == nil {
+		event.TagMessage = tag.Message
+		event.Timestamp = tag.Tagger.When
+		c, err = tag.Commit()
+		if err != nil {
+			return event, errors.Wrapf(err, "failed to get commit of tag %s", name)
+		}
+	} else {
+		c, err = repo.CommitObject(hash)
+		if err != nil {
+			return event, errors.Wrapf(err, "failed to get commit of tag %s", name)
+		}
+		event.Timestamp = c.Author.When
+	}
+	event.commit = *c
+	return
+}
+
+// tagDeletedEvent builds the event for a tag that no longer exists upstream and,
+// if `prune` is set, removes the local copy of the tag so the clone mirrors the
+// remote.
+func tagDeletedEvent(repo *git.Repository, name string, hash plumbing.Hash, prune bool) (event Event, err error) {
+	event, err = newEvent(repo, EventTagDeleted)
+	if err != nil {
+		return
+	}
+	event.Tag = name
+	event.Timestamp = time.Now()
+
+	// the tag may point at an annotated tag object or directly at a commit,
+	// if neither is available locally the event simply carries no commit.
+	if tag, err := repo.TagObject(hash); err == nil {
+		if c, err := tag.Commit(); err == nil {
+			event.commit = *c
+		}
+	} else if c, err := repo.CommitObject(hash); err == nil {
+		event.commit = *c
+	}
+
+	if !prune {
+		return
+	}
+	err = repo.Storer.RemoveReference(plumbing.NewTagReferenceName(name))
+	if err != nil {
+		return event, errors.Wrapf(err, "failed to remove local tag %s", name)
+	}
+	return
+}
+
+// isBranchDeleted reports whether a failed pull was caused by the watched
+// branch no longer existing on the remote.
+func (s *Session) isBranchDeleted(repo *git.Repository, repository Repository, err error) bool {
+	if repository.Branch == "" || errors.Cause(err) != plumbing.ErrReferenceNotFound {
+		return false
+	}
+
+	refs, err := s.remoteRefs(repo, repository)
+	if err != nil {
+		return false
+	}
+	name := plumbing.NewBranchReferenceName(repository.Branch)
+	for _, ref := range refs {
+		if ref.Name() == name {
+			return false
+		}
+	}
+	return true
+}
+
+// branchDeleted applies the session's BranchDeletionPolicy to a repository
+// whose branch has disappeared and returns an event the first time the
+// deletion is seen.
+func (s *Session) branchDeleted(repo *git.Repository, repository Repository) (event *Event, err error) {
+	state := s.stateOf(repository)
+	switch s.BranchDeleted {
+	case BranchDeletionPark:
+		state.parked = true
+	case BranchDeletionRemove:
+		state.removed = true
+	}
+
+	if state.branchDeleted {
+		return nil, nil
+	}
+	state.branchDeleted = true
+
+	// the event carries the last commit seen on the branch before it went.
+	event, err = GetEventFromRepo(repo)
+	if err != nil {
+		return
+	}
+	event.Type = EventBranchDeleted
+	event.Branch = repository.Branch
+	event.Timestamp = time.Now()
+	return
+}
@@ -0,0 +1,196 @@
+package gitwatch
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// refTableFile is the name of the file a clone-less repository's last snapshot
+// of remote refs is kept in, inside the repository's directory.
+const refTableFile = "refs"
+
+// refTable maps ref names to the hashes they point at
+type refTable map[plumbing.ReferenceName]plumbing.Hash
+
+// checkRefTable lists the refs of a clone-less repository and returns an event
+// for every ref created, moved or deleted since the last snapshot. The snapshot
+// is kept on disk, so changes made while the watcher wasn't running are
+// reported on the first check. A repository seen for the first time only
+// records its snapshot.
+func (s *Session) checkRefTable(repository Repository) (events []Event, err error) {
+	refs, err := s.listRefs(repository)
+	if err != nil {
+		return
+	}
+	current := make(refTable)
+	for _, ref := range refs {
+		if ref.Type() == plumbing.HashReference {
+			current[ref.Name()] = ref.Hash()
+		}
+	}
+
+	previous, err := readRefTable(repository.fullPath)
+	if err != nil {
+		return
+	}
+	if previous != nil {
+		events = diffRefTables(repository, previous, current)
+	}
+	if previous == nil || len(events) > 0 {
+		if err = writeRefTable(repository.fullPath, current); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// listRefs lists the refs a repository's remote advertises without a local
+// clone.
+func (s *Session) listRefs(repository Repository) (refs []*plumbing.Reference, err error) {
+	ctx, cancel := s.opContext(repository)
+	defer cancel()
+	auth := s.chooseAuth(repository.Auth)
+	var listed []*plumbing.Reference
+	err = s.within(ctx, repository, func() (err error) {
+		if s.ReuseSSH && isSSHURL(repository.URL) {
+			listed, err = s.sshPool.listRefs(repository.URL, auth)
+			return
+		}
+		remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+			Name: "origin",
+			URLs: []string{repository.URL},
+		})
+		listed, err = remote.List(&git.ListOptions{Auth: auth})
+		return
+	})
+	if err = s.timedOut(ctx, repository, err); err != nil {
+		return nil, withStage(StageFetch, errors.Wrap(err, "failed to list remote references"))
+	}
+	return listed, nil
+}
+
+// diffRefTables returns an event for each difference between two snapshots,
+// ordered by ref name.
+func diffRefTables(repository Repository, previous, current refTable) (events []Event) {
+	names := make([]string, 0, len(previous)+len(current))
+	for name := range previous {
+		names = append(names, string(name))
+	}
+	for name := range current {
+		if _, ok := previous[name]; !ok {
+			names = append(names, string(name))
+		}
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	for _, n := range names {
+		name := plumbing.ReferenceName(n)
+		from, existed := previous[name]
+		to, exists := current[name]
+
+		event := Event{
+			URL:       repository.URL,
+			Path:      repository.fullPath,
+			Timestamp: now,
+			Ref:       n,
+		}
+		switch {
+		case !existed:
+			event.Type = EventRefCreated
+			event.To = to.String()
+		case !exists:
+			event.Type = EventRefDeleted
+			event.From = from.String()
+		case from != to:
+			event.Type = EventRefMoved
+			event.From = from.String()
+			event.To = to.String()
+		default:
+			continue
+		}
+		if name.IsBranch() {
+			event.Branch = name.Short()
+		} else if name.IsTag() {
+			event.Tag = name.Short()
+		}
+		events = append(events, event)
+	}
+	return
+}
+
+// readRefTable reads a repository's snapshot, which is nil if none was saved.
+// The file has one `<hash> <ref>` line per ref, as in git's packed-refs.
+func readRefTable(dir string) (table refTable, err error) {
+	f, err := os.Open(filepath.Join(dir, refTableFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to open ref snapshot")
+	}
+	defer f.Close()
+
+	table = make(refTable)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return nil, errors.Errorf("malformed ref snapshot line %q", scanner.Text())
+		}
+		table[plumbing.ReferenceName(fields[1])] = plumbing.NewHash(fields[0])
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read ref snapshot")
+	}
+	return
+}
+
+// writeRefTable replaces a repository's snapshot. The new snapshot is renamed
+// into place so a crash never leaves a partial one behind.
+func writeRefTable(dir string, table refTable) (err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "failed to create repository directory")
+	}
+
+	names := make([]string, 0, len(table))
+	for name := range table {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s %s\n", table[plumbing.ReferenceName(name)], name)
+	}
+
+	f, err := ioutil.TempFile(dir, "."+refTableFile+"-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create ref snapshot")
+	}
+	if _, err = f.WriteString(b.String()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.Wrap(err, "failed to write ref snapshot")
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "failed to write ref snapshot")
+	}
+	if err = os.Rename(f.Name(), filepath.Join(dir, refTableFile)); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "failed to save ref snapshot")
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package gitwatch
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// History is a record of past events a session can replay, such as a SQLStore
+type History interface {
+	Events(ctx context.Context, f EventFilter) ([]Event, error)
+}
+
+// Replay delivers the events recorded in the session's History from since
+// onwards again, oldest first, so a consumer that attached late can catch up.
+// Events of repositories the session watches go to Events and to their sinks,
+// except the History itself, marked as Replayed. Enrichers and exec hooks
+// don't run again.
+func (s *Session) Replay(since time.Time) (replayed int, err error) {
+	if s.History == nil {
+		return 0, errors.New("session has no history to replay")
+	}
+	if !s.IsRunning() {
+		return 0, errors.New("session is not running")
+	}
+
+	groups := make(map[string]string)
+	if err = s.onDaemon(func() error {
+		for _, r := range s.Repositories {
+			groups[r.URL] = r.Group
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+	events, err := s.History.Events(s.ctx, EventFilter{Since: since})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read history")
+	}
+
+	for _, event := range events {
+		group, ok := groups[event.URL]
+		if !ok {
+			continue
+		}
+		event.Replayed = true
+		s.sendEvent(event)
+		for _, q := range s.queues() {
+			if s.isHistory(q.sink) || (q.group != "" && q.group != group) {
+				continue
+			}
+			// unlike new events, replayed ones wait for room in the queue
+			// rather than being dropped
+			select {
+			case q.queue <- event:
+			case <-s.ctx.Done():
+				return replayed, s.ctx.Err()
+			}
+		}
+		replayed++
+	}
+	return
+}
+
+// isHistory reports whether a sink is the session's History, which already
+// has every event it would replay.
+func (s *Session) isHistory(sink Sink) bool {
+	t := reflect.TypeOf(sink)
+	return t == reflect.TypeOf(s.History) && t.Comparable() && interface{}(sink) == interface{}(s.History)
+}
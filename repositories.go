@@ -0,0 +1,159 @@
+package gitwatch
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AddAll adds several repositories in one go, as Add does. If any of them is
+// invalid, none are added.
+func (s *Session) AddAll(repos []Repository) error {
+	hydrated, err := hydrateRepos(s.Directory, repos)
+	if err != nil {
+		return err
+	}
+	s.addMu.Lock()
+	s.added = append(s.added, hydrated...)
+	s.addMu.Unlock()
+	select {
+	case s.newRepos <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetRepositories replaces the session's repositories with repos in a single
+// step between checks, for config reloads and discovery sources that know the
+// whole set they want watched. Repositories are matched to the current ones by
+// directory. Those already watched from the same URL keep their state and take
+// the new settings, new ones are checked straight away as with Add, and those
+// no longer listed stop being watched, leaving their clones on disk. A
+// directory that was watched from another URL has its old clone removed so
+// it's cloned afresh.
+//
+// Repositories given to Add but not picked up yet are dropped. If any of the
+// repositories is invalid, or two share a directory, nothing changes.
+func (s *Session) SetRepositories(repos []Repository) error {
+	hydrated, err := hydrateRepos(s.Directory, repos)
+	if err != nil {
+		return err
+	}
+	return s.onDaemon(func() error {
+		s.beginTrace("")
+		return s.setRepositories(hydrated, s.IsRunning())
+	})
+}
+
+// setRepositories replaces the session's repositories with hydrated ones, on
+// the daemon's goroutine. New repositories are checked if `check` is set.
+func (s *Session) setRepositories(hydrated []Repository, check bool) error {
+	if err := sharedDirectories(hydrated); err != nil {
+		return err
+	}
+
+	s.addMu.Lock()
+	s.added = nil
+	s.addMu.Unlock()
+
+	current := make(map[string]Repository, len(s.Repositories))
+	for _, r := range s.Repositories {
+		current[r.fullPath] = r
+	}
+	var added []Repository
+	for _, r := range hydrated {
+		old, ok := current[r.fullPath]
+		delete(current, r.fullPath)
+		if ok && old.URL == r.URL {
+			continue
+		}
+		if ok {
+			s.forget(old)
+			started := time.Now()
+			s.audit(old, AuditEntry{Op: AuditDelete}, started, s.removeRepo(old))
+		}
+		added = append(added, r)
+	}
+	for _, old := range current {
+		s.forget(old)
+	}
+	s.setRepos(hydrated)
+
+	if check {
+		s.checkNew(added)
+	}
+	return nil
+}
+
+// Remove stops watching the repository with the given URL, whether or not the
+// session is running, leaving its clone on disk. A repository given to Add but
+// not picked up yet is dropped too.
+func (s *Session) Remove(url string) error {
+	return s.onDaemon(func() error {
+		return s.remove(url, false)
+	})
+}
+
+// RemoveAndClean stops watching the repository with the given URL, as Remove
+// does, and deletes its clone.
+func (s *Session) RemoveAndClean(url string) error {
+	return s.onDaemon(func() error {
+		s.beginTrace("")
+		return s.remove(url, true)
+	})
+}
+
+func (s *Session) remove(url string, clean bool) error {
+	var removed []Repository
+	s.addMu.Lock()
+	added := s.added[:0]
+	for _, r := range s.added {
+		if r.URL == url {
+			removed = append(removed, r)
+			continue
+		}
+		added = append(added, r)
+	}
+	s.added = added
+	s.addMu.Unlock()
+
+	kept := s.Repositories[:0]
+	for _, r := range s.Repositories {
+		if r.URL == url {
+			s.forget(r)
+			removed = append(removed, r)
+			continue
+		}
+		kept = append(kept, r)
+	}
+	s.setRepos(kept)
+
+	if len(removed) == 0 {
+		return errors.Errorf("no repository with url %s", url)
+	}
+	if !clean {
+		return nil
+	}
+	for _, r := range removed {
+		started := time.Now()
+		err := s.removeRepo(r)
+		s.audit(r, AuditEntry{Op: AuditDelete}, started, err)
+		if err != nil {
+			return errors.Wrapf(err, "failed to remove clone of %s", url)
+		}
+	}
+	return nil
+}
+
+// sharedDirectories returns an error if two repositories would be cloned into
+// the same directory
+func sharedDirectories(hydrated []Repository) error {
+	seen := make(map[string]string, len(hydrated))
+	for _, r := range hydrated {
+		if other, ok := seen[r.fullPath]; ok {
+			return errors.Errorf("%s and %s would share the directory %s", other, r.URL, r.fullPath)
+		}
+		seen[r.fullPath] = r.URL
+	}
+	return nil
+}
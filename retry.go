@@ -0,0 +1,129 @@
+package gitwatch
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy decides how a repository whose checks fail is retried. Without
+// one, a failing repository is checked again on every tick.
+type RetryPolicy struct {
+	MaxAttempts int           `yaml:"max_attempts"` // if above 0, the checks in a row that may fail before the repository is no longer checked, until Resume is called
+	MinBackoff  time.Duration `yaml:"min_backoff"`  // if set, the delay before the first retry, doubled for each one after
+	MaxBackoff  time.Duration `yaml:"max_backoff"`  // the longest delay between retries, 1h if zero
+	Jitter      float64       `yaml:"jitter"`       // the fraction, up to 1, of each delay taken off at random so repositories failing together don't retry in step
+}
+
+// RetryState describes a repository whose last check failed
+type RetryState struct {
+	URL       string    // the repository's URL
+	Attempts  int       // the checks in a row that have failed
+	NextRetry time.Time // when the repository is checked again, zero once it has run out of attempts
+	LastError string    // the error of the last check
+}
+
+// retryPolicy returns the policy a repository is retried under, its own or the
+// session's.
+func (s *Session) retryPolicy(repository Repository) RetryPolicy {
+	if repository.Retry != nil {
+		return *repository.Retry
+	}
+	return s.Retry
+}
+
+// transient reports whether an error comes from a remote that couldn't be
+// reached, rather than from the clone, so another attempt may succeed without
+// starting afresh.
+func transient(err error) bool {
+	class := classifyError(err)
+	return class == ErrorClassNetwork || class == ErrorClassRateLimited
+}
+
+// retryLater records a failed check of a repository and schedules the next
+// one as its RetryPolicy says. Once it has run out of attempts, the repository
+// isn't checked again until resumed and the error says so.
+func (s *Session) retryLater(repository Repository, err error) error {
+	policy := s.retryPolicy(repository)
+	state := s.stateOf(repository)
+	state.attempts++
+
+	state.retryAt = time.Time{}
+	if policy.MaxAttempts > 0 && state.attempts >= policy.MaxAttempts {
+		state.exhausted = true
+		err = errors.Wrapf(err, "gave up after %d failed checks", state.attempts)
+	} else if delay := policy.backoff(state.attempts); delay > 0 {
+		state.retryAt = time.Now().Add(delay)
+	}
+
+	s.retryMu.Lock()
+	defer s.retryMu.Unlock()
+	if s.retrying == nil {
+		s.retrying = make(map[string]RetryState)
+	}
+	s.retrying[repository.fullPath] = RetryState{
+		URL:       repository.URL,
+		Attempts:  state.attempts,
+		NextRetry: state.retryAt,
+		LastError: err.Error(),
+	}
+	return err
+}
+
+// retried forgets the failures of a repository, once it has been checked
+// successfully or resumed.
+func (s *Session) retried(repository Repository) {
+	if state, ok := s.state[repository.fullPath]; ok {
+		state.attempts = 0
+		state.retryAt = time.Time{}
+		state.exhausted = false
+	}
+	s.retryMu.Lock()
+	defer s.retryMu.Unlock()
+	delete(s.retrying, repository.fullPath)
+}
+
+// backingOff reports whether a failing repository is still waiting for its
+// next retry, allowing for the daemon's ticks arriving a little early.
+func (s *Session) backingOff(state *repoState) bool {
+	return state.exhausted || time.Until(state.retryAt) > s.tick()/2
+}
+
+// backoff returns the delay before the retry following a number of failed
+// checks in a row.
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	if p.MinBackoff <= 0 {
+		return 0
+	}
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = maxThrottle
+	}
+	delay := p.MinBackoff
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if jitter := p.Jitter; jitter > 0 {
+		if jitter > 1 {
+			jitter = 1
+		}
+		delay -= time.Duration(rand.Float64() * jitter * float64(delay))
+	}
+	return delay
+}
+
+// retryingRepos returns the repositories whose last check failed, by the
+// path of their clone.
+func (s *Session) retryingRepos() map[string]RetryState {
+	s.retryMu.Lock()
+	defer s.retryMu.Unlock()
+	repos := make(map[string]RetryState, len(s.retrying))
+	for path, r := range s.retrying {
+		repos[path] = r
+	}
+	return repos
+}
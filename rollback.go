@@ -0,0 +1,124 @@
+package gitwatch
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// Rollback checks a repository back out at an earlier commit, usually that of
+// a previous event, and pauses forward updates to it until Resume is called.
+//
+// If the repository has a Deploy layout, `current` is switched to a release of
+// the commit, made afresh if it has been pruned, and the clone is left alone.
+// Otherwise the clone's worktree is hard reset to the commit.
+func (s *Session) Rollback(url string, hash plumbing.Hash) error {
+	return s.onDaemon(func() error {
+		s.beginTrace("")
+		return s.rollback(url, hash)
+	})
+}
+
+// Resume restarts forward updates to a repository paused by Rollback, and
+// checks of one that ran out of retries. The next check brings it back up to
+// date with the remote.
+func (s *Session) Resume(url string) error {
+	return s.onDaemon(func() error {
+		repository, ok := s.findRepo(url)
+		if !ok {
+			return errors.Errorf("no repository with url %s", url)
+		}
+		s.stateOf(repository).rolledBack = false
+		s.retried(repository)
+		return nil
+	})
+}
+
+func (s *Session) rollback(url string, hash plumbing.Hash) (err error) {
+	repository, ok := s.findRepo(url)
+	if !ok {
+		return errors.Errorf("no repository with url %s", url)
+	}
+	repository = s.withGroup(repository)
+
+	repo, err := s.openRepo(repository)
+	if err != nil {
+		return errors.Wrap(err, "failed to open local repo")
+	}
+	repo = openShallow(repo)
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return errors.Wrapf(err, "failed to find commit %s", hash)
+	}
+
+	started := time.Now()
+	if layout := repository.Deploy; layout.Dir != "" {
+		name, ok := findRelease(layout, hash)
+		if !ok {
+			name, err = makeRelease(commit, layout)
+		}
+		if err == nil {
+			err = switchCurrent(layout, name)
+		}
+		s.audit(repository, AuditEntry{Op: AuditDeploy, Path: filepath.Join(layout.Dir, "releases", name), To: hash.String()}, started, err)
+		if err != nil {
+			return err
+		}
+	} else if repository.observed() {
+		return errors.Errorf("repository %s is observed and can't be reset", url)
+	} else {
+		wt, err := repo.Worktree()
+		if err != nil {
+			return errors.Wrap(err, "failed to get worktree")
+		}
+		var from string
+		if head, err := repo.Head(); err == nil {
+			from = head.Hash().String()
+		}
+		err = wt.Reset(&git.ResetOptions{Commit: hash, Mode: git.HardReset})
+		s.audit(repository, AuditEntry{Op: AuditReset, From: from, To: hash.String()}, started, err)
+		if err != nil {
+			return errors.Wrapf(err, "failed to reset worktree to %s", hash)
+		}
+	}
+
+	s.stateOf(repository).rolledBack = true
+	return nil
+}
+
+// findRepo looks a repository up by its URL.
+func (s *Session) findRepo(url string) (Repository, bool) {
+	for _, r := range s.Repositories {
+		if r.URL == url {
+			return r, true
+		}
+	}
+	return Repository{}, false
+}
+
+// onDaemon runs f on the daemon's goroutine, so it can change repository state
+// between checks, or directly if the daemon isn't running, in which case the
+// daemon doesn't start until f returns. Either way, calls don't overlap.
+func (s *Session) onDaemon(f func() error) error {
+	for {
+		s.lifeMu.Lock()
+		if !s.IsRunning() {
+			defer s.lifeMu.Unlock()
+			return f()
+		}
+		s.lifeMu.Unlock()
+
+		done := make(chan error, 1)
+		select {
+		case s.control <- func() { done <- f() }:
+			return <-done
+		case <-s.stopped:
+			// stopped by Shutdown, with the context still live
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package gitwatch
+
+import (
+	"time"
+)
+
+// tick returns how often the daemon wakes up to check repositories: the
+// session's Interval, or the shortest Interval of its repositories if that's
+// shorter.
+func (s *Session) tick() time.Duration {
+	tick := s.Interval
+	for _, r := range s.Repositories {
+		if every := s.withGroup(r).Interval; every > 0 && every < tick {
+			tick = every
+		}
+	}
+	return tick
+}
+
+// elapsed reports whether a period has passed since `last`, allowing for the
+// daemon's ticks arriving a little early or late.
+func (s *Session) elapsed(last time.Time, period time.Duration) bool {
+	return last.IsZero() || time.Since(last) >= period-s.tick()/2
+}
+
+// due reports whether a repository is due a poll under its own Interval, or
+// the session's, and if so records that it's being polled now.
+func (s *Session) due(repository Repository) bool {
+	every := s.withGroup(repository).Interval
+	if every <= 0 {
+		every = s.Interval
+	}
+	state := s.stateOf(repository)
+	if !s.elapsed(state.polledAt, every) {
+		return false
+	}
+	state.polledAt = time.Now()
+	return true
+}
+
+// fullRound reports whether the session's Interval has passed since the last
+// round that also reconciled the configuration and refreshed shard members,
+// which happen at most once per Interval however often repositories are
+// polled, and if so records that one is starting.
+func (s *Session) fullRound() bool {
+	if !s.elapsed(s.roundAt, s.Interval) {
+		return false
+	}
+	s.roundAt = time.Now()
+	return true
+}
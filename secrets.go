@@ -0,0 +1,160 @@
+package gitwatch
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SecretResolver turns a reference to a secret into the secret itself, so
+// credentials never have to be written into configuration files.
+type SecretResolver interface {
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// SecretResolverFunc adapts an ordinary function to the SecretResolver
+// interface
+type SecretResolverFunc func(ctx context.Context, ref string) (string, error)
+
+// Resolve calls f(ctx, ref)
+func (f SecretResolverFunc) Resolve(ctx context.Context, ref string) (string, error) {
+	return f(ctx, ref)
+}
+
+// SecretSchemes is a SecretResolver that dispatches on the scheme prefixing a
+// value, such as `env:` in `env:GITHUB_TOKEN`. Values without a known scheme
+// are returned as they are, so plain credentials keep working.
+type SecretSchemes map[string]SecretResolver
+
+// DefaultSecrets resolves the following references:
+//
+//	env:NAME                   the environment variable NAME
+//	file:/path/to/file         the contents of a file, without trailing newlines
+//	exec:command arg...        the output of a command, without trailing newlines
+//	vault:secret/data/git#key  the field `key` of a HashiCorp Vault secret, using
+//	                           VAULT_ADDR and VAULT_TOKEN from the environment
+var DefaultSecrets = SecretSchemes{
+	"env":   SecretResolverFunc(resolveEnv),
+	"file":  SecretResolverFunc(resolveFile),
+	"exec":  SecretResolverFunc(resolveExec),
+	"vault": VaultSecrets{},
+}
+
+// Resolve resolves the reference with the resolver for its scheme
+func (s SecretSchemes) Resolve(ctx context.Context, ref string) (string, error) {
+	i := strings.Index(ref, ":")
+	if i == -1 {
+		return ref, nil
+	}
+	resolver, ok := s[ref[:i]]
+	if !ok {
+		return ref, nil
+	}
+	v, err := resolver.Resolve(ctx, ref[i+1:])
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to resolve %s secret", ref[:i])
+	}
+	return v, nil
+}
+
+func resolveEnv(ctx context.Context, name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", errors.Errorf("environment variable %s is not set", name)
+	}
+	return v, nil
+}
+
+func resolveFile(ctx context.Context, path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+func resolveExec(ctx context.Context, command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", errors.New("empty command")
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// VaultSecrets resolves `path#field` references against the HashiCorp Vault
+// HTTP API, supporting both version 1 and 2 of the key/value secrets engine.
+type VaultSecrets struct {
+	Address string       // the Vault server, VAULT_ADDR if empty
+	Token   string       // the Vault token, VAULT_TOKEN if empty
+	Client  *http.Client // the client to use, the shared client if nil
+}
+
+// Resolve reads the field of the secret at the path
+func (v VaultSecrets) Resolve(ctx context.Context, ref string) (string, error) {
+	i := strings.LastIndex(ref, "#")
+	if i == -1 {
+		return "", errors.New("vault reference must be of the form path#field")
+	}
+	path, field := strings.Trim(ref[:i], "/"), ref[i+1:]
+
+	addr, token := v.Address, v.Token
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if addr == "" {
+		return "", errors.New("no vault address, set VAULT_ADDR")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Vault-Token", token)
+
+	client := v.Client
+	if client == nil {
+		client = httpClient()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("vault responded with %s", resp.Status)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", errors.Wrap(err, "failed to decode vault response")
+	}
+
+	// version 2 of the key/value engine nests the secret inside `data.data`
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", errors.Errorf("vault secret %s has no field %s", path, field)
+	}
+	return value, nil
+}
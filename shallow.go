@@ -0,0 +1,70 @@
+package gitwatch
+
+import (
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+)
+
+// shallowStorage reads the objects of a shallow clone, presenting the commits
+// at its boundary without the parents that were never fetched, as git itself
+// does. go-git otherwise fails walking the history of a shallow clone, which
+// it does before every fetch and pull.
+type shallowStorage struct {
+	*filesystem.Storage
+}
+
+// graftedCommit is a commit re-encoded without its missing parents, which
+// keeps the hash it's stored under.
+type graftedCommit struct {
+	*plumbing.MemoryObject
+	hash plumbing.Hash
+}
+
+func (c graftedCommit) Hash() plumbing.Hash {
+	return c.hash
+}
+
+// EncodedObject reads an object, dropping the parents of a commit that aren't
+// stored.
+func (s shallowStorage) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	obj, err := s.Storage.EncodedObject(t, h)
+	if err != nil || obj.Type() != plumbing.CommitObject {
+		return obj, err
+	}
+
+	var c object.Commit
+	if err = c.Decode(obj); err != nil {
+		return nil, err
+	}
+	var parents []plumbing.Hash
+	for _, p := range c.ParentHashes {
+		if s.Storage.HasEncodedObject(p) == nil {
+			parents = append(parents, p)
+		}
+	}
+	if len(parents) == len(c.ParentHashes) {
+		return obj, nil
+	}
+
+	c.ParentHashes = parents
+	grafted := &plumbing.MemoryObject{}
+	if err = c.Encode(grafted); err != nil {
+		return nil, err
+	}
+	return graftedCommit{grafted, h}, nil
+}
+
+// openShallow has a repository read its objects through shallowStorage if it's
+// a shallow clone.
+func openShallow(repo *git.Repository) *git.Repository {
+	st, ok := repo.Storer.(*filesystem.Storage)
+	if !ok {
+		return repo
+	}
+	if shallows, err := st.Shallow(); err == nil && len(shallows) > 0 {
+		repo.Storer = shallowStorage{st}
+	}
+	return repo
+}
@@ -0,0 +1,158 @@
+package gitwatch
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Sharding splits a session's repositories between instances that are all
+// given the same configuration. Each repository is polled by one live member,
+// picked by rendezvous hashing, a form of consistent hashing: when a member
+// joins or leaves, only the repositories it gains or loses change hands.
+type Sharding struct {
+	Name    string     // this instance's name, unique among the members, the host name if empty
+	Members Membership // finds the live members, once per round of checks
+}
+
+// Membership tracks the instances sharing a session's repositories.
+type Membership interface {
+	// Members announces the named instance as live and returns the names of
+	// every live instance, including it.
+	Members(ctx context.Context, self string) ([]string, error)
+}
+
+// StaticMembers is a Membership with a fixed list of instances. An instance
+// not on the list polls nothing.
+type StaticMembers []string
+
+// Members implements Membership
+func (m StaticMembers) Members(ctx context.Context, self string) ([]string, error) {
+	return m, nil
+}
+
+const defaultMemberTTL = time.Minute
+
+// FileMembers is a Membership kept in a directory on storage shared by every
+// instance. Each instance touches a file named after itself on every round of
+// checks, and instances whose file hasn't been touched within the TTL are
+// considered gone. The TTL must be longer than the session's Interval.
+type FileMembers struct {
+	Dir string
+	TTL time.Duration // 1 minute if zero
+}
+
+// Members implements Membership
+func (m FileMembers) Members(ctx context.Context, self string) (members []string, err error) {
+	if err = os.MkdirAll(m.Dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "failed to create membership directory")
+	}
+	if err = ioutil.WriteFile(m.path(self), nil, 0644); err != nil {
+		return nil, errors.Wrap(err, "failed to announce membership")
+	}
+
+	ttl := m.TTL
+	if ttl <= 0 {
+		ttl = defaultMemberTTL
+	}
+	files, err := ioutil.ReadDir(m.Dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list members")
+	}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, ".member") || time.Since(f.ModTime()) > ttl {
+			continue
+		}
+		members = append(members, strings.TrimSuffix(name, ".member"))
+	}
+	return
+}
+
+// Leave removes an instance from the directory, so the others take over its
+// repositories without waiting for the TTL.
+func (m FileMembers) Leave(ctx context.Context, self string) error {
+	if err := os.Remove(m.path(self)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to leave membership")
+	}
+	return nil
+}
+
+func (m FileMembers) path(self string) string {
+	return filepath.Join(m.Dir, filepath.Base(self)+".member")
+}
+
+// shardName is this instance's name among the members
+func (s *Session) shardName() (string, error) {
+	if s.Sharding.Name != "" {
+		return s.Sharding.Name, nil
+	}
+	name, err := os.Hostname()
+	return name, errors.Wrap(err, "failed to name shard member")
+}
+
+// refreshMembers looks up the live members at the start of a round of checks.
+// If that fails after the first round, the previous members are kept.
+func (s *Session) refreshMembers() error {
+	if s.Sharding == nil {
+		return nil
+	}
+	name, err := s.shardName()
+	if err == nil {
+		var members []string
+		members, err = s.Sharding.Members.Members(s.ctx, name)
+		if err == nil {
+			sort.Strings(members)
+			s.members = members
+			s.memberName = name
+			return nil
+		}
+	}
+	if s.members == nil {
+		return err
+	}
+	s.reportError(ErrorRecord{Op: "shard"}, errors.Wrap(err, "failed to refresh shard members, using the previous members"))
+	return nil
+}
+
+// leaveMembers announces that this instance is going away, if the Membership
+// supports it.
+func (s *Session) leaveMembers() {
+	if s.Sharding == nil || s.memberName == "" {
+		return
+	}
+	if l, ok := s.Sharding.Members.(interface {
+		Leave(ctx context.Context, self string) error
+	}); ok {
+		// the session's context is usually done by now
+		if err := l.Leave(context.Background(), s.memberName); err != nil {
+			s.reportError(ErrorRecord{Op: "shard"}, err)
+		}
+	}
+}
+
+// owns reports whether this instance polls a repository: the member with the
+// highest hash of its name and the repository wins.
+func (s *Session) owns(repository Repository) bool {
+	if s.Sharding == nil {
+		return true
+	}
+	key := lockKey(repository)
+	var owner string
+	var best uint64
+	for _, member := range s.members {
+		sum := sha1.Sum([]byte(member + "\x00" + key))
+		if weight := binary.BigEndian.Uint64(sum[:8]); owner == "" || weight > best {
+			owner, best = member, weight
+		}
+	}
+	return owner != "" && owner == s.memberName
+}
@@ -0,0 +1,102 @@
+package gitwatch
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Shutdown stops the git watcher without interrupting it: no more checks are
+// started, and the one in progress, event deliveries and exec hooks are
+// waited for until ctx is done, before the session is closed as by Close.
+// Events and Errors are then closed, so loops ranging over them end. Like
+// Close, it's safe to call more than once, and every call to either returns
+// the same error.
+func (s *Session) Shutdown(ctx context.Context) error {
+	s.closeOnce.Do(func() { s.closeErr = s.shutdown(ctx) })
+	return s.closeErr
+}
+
+func (s *Session) shutdown(ctx context.Context) error {
+	close(s.stopping)
+
+	var problems []string
+	if s.IsRunning() {
+		select {
+		case <-s.stopped:
+		case <-ctx.Done():
+			problems = append(problems, fmt.Sprintf("checks interrupted: %v", ctx.Err()))
+		}
+	}
+	if len(problems) == 0 {
+		if err := s.awaitDeliveries(ctx); err != nil {
+			problems = append(problems, fmt.Sprintf("deliveries interrupted: %v", err))
+		}
+	}
+
+	err := s.finish(problems)
+	s.closeChannels()
+	return err
+}
+
+// shuttingDown reports whether Shutdown asked the daemon to stop
+func (s *Session) shuttingDown() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// awaitDeliveries waits until the events emitted have been read and delivered
+// to sinks and the exec hooks have finished, or ctx is done.
+func (s *Session) awaitDeliveries(ctx context.Context) error {
+	hooks := make(chan struct{})
+	go func() {
+		s.hooks.Wait()
+		close(hooks)
+	}()
+
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for s.eventBacklog() > 0 || s.Status().PendingDeliveries > 0 {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	select {
+	case <-hooks:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// send runs f, a send on Events, Errors or ErrorRecords, unless Shutdown has
+// closed them. f must give up once the session's context is done.
+func (s *Session) send(f func()) {
+	s.sendMu.RLock()
+	defer s.sendMu.RUnlock()
+	if !s.chansClosed {
+		f()
+	}
+}
+
+// closeChannels closes Events and Errors, and ErrorRecords if it's set, once
+// the sends in progress have given up.
+func (s *Session) closeChannels() {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.chansClosed {
+		return
+	}
+	s.chansClosed = true
+	close(s.Events)
+	close(s.Errors)
+	if s.ErrorRecords != nil {
+		close(s.ErrorRecords)
+	}
+}
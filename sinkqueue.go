@@ -0,0 +1,175 @@
+package gitwatch
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SinkRetry configures the delivery queue each sink is given. Deliveries to a
+// sink happen one at a time in the background so a slow or failing sink never
+// holds up polling, failed deliveries are retried with exponential backoff.
+type SinkRetry struct {
+	QueueSize   int           // deliveries waiting per sink before new ones are dropped, and stored in DeadLetter, 64 if zero
+	MaxAttempts int           // attempts made per delivery, 1 (no retries) if zero
+	MinBackoff  time.Duration // the delay before the first retry, doubled for each one after, 1s if zero
+	MaxBackoff  time.Duration // the longest delay between retries, 1m if zero
+}
+
+// DeliveryStats describes the deliveries made to a sink
+type DeliveryStats struct {
+	Group     string // the group the sink belongs to, empty for the session's own sinks
+	Sink      int    // the index of the sink in Sinks of the session or group
+	Queued    int    // deliveries waiting to be attempted
+	Delivered uint64 // deliveries that succeeded
+	Retries   uint64 // attempts that failed and were retried
+	Failed    uint64 // deliveries that failed on every attempt
+	Dropped   uint64 // deliveries dropped because the queue was full
+}
+
+type sinkQueue struct {
+	group string
+	index int
+	sink  Sink
+	queue chan Event
+
+	delivered uint64
+	retries   uint64
+	failed    uint64
+	dropped   uint64
+}
+
+// startSinks creates a delivery queue and worker for each of the session's
+// sinks and those of its groups.
+func (s *Session) startSinks() {
+	size := s.SinkRetry.QueueSize
+	if size <= 0 {
+		size = 64
+	}
+
+	var queues []*sinkQueue
+	start := func(group string, sinks []Sink) {
+		for i, sink := range sinks {
+			q := &sinkQueue{group: group, index: i, sink: sink, queue: make(chan Event, size)}
+			queues = append(queues, q)
+			go s.deliverQueue(q)
+		}
+	}
+
+	start("", s.Sinks)
+	for _, name := range s.groupNames() {
+		start(name, s.Groups[name].Sinks)
+	}
+	s.sinkMu.Lock()
+	s.sinkQueues = queues
+	s.sinkMu.Unlock()
+}
+
+// enqueue adds an event to a sink's delivery queue without blocking. If the
+// queue is full, the event is dropped and handed to the DeadLetter instead.
+func (s *Session) enqueue(q *sinkQueue, e Event) {
+	select {
+	case q.queue <- e:
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+		err := errors.New("sink delivery queue is full")
+		s.reportError(ErrorRecord{Op: "deliver", URL: e.URL}, errors.Wrap(err, "event dropped"))
+		s.storeDeadLetter(q, e, err)
+	}
+}
+
+func (s *Session) deliverQueue(q *sinkQueue) {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case e := <-q.queue:
+			if retries, err := s.deliver(q, e); err != nil {
+				atomic.AddUint64(&q.failed, 1)
+				s.reportError(ErrorRecord{Op: "deliver", URL: e.URL, Retries: retries}, errors.Wrap(err, "failed to deliver event to sink"))
+				s.storeDeadLetter(q, e, err)
+			} else {
+				atomic.AddUint64(&q.delivered, 1)
+			}
+		}
+	}
+}
+
+// deliver sends an event to a sink, retrying as configured by SinkRetry.
+func (s *Session) deliver(q *sinkQueue, e Event) (retries int, err error) {
+	attempts := s.SinkRetry.MaxAttempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+	backoff := s.SinkRetry.MinBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxBackoff := s.SinkRetry.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = time.Minute
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = q.sink.Send(ContextWithTrace(s.ctx, e.TraceID), e)
+		if err == nil || attempt >= attempts {
+			return attempt - 1, err
+		}
+		atomic.AddUint64(&q.retries, 1)
+
+		select {
+		case <-s.ctx.Done():
+			return attempt - 1, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// storeDeadLetter hands an undeliverable event to the session's DeadLetter, if
+// there is one.
+func (s *Session) storeDeadLetter(q *sinkQueue, e Event, cause error) {
+	if s.DeadLetter == nil {
+		return
+	}
+	l := Letter{
+		Group:    q.group,
+		Sink:     q.index,
+		Error:    cause.Error(),
+		FailedAt: time.Now(),
+		Event:    e,
+	}
+	if err := s.DeadLetter.Store(l); err != nil {
+		s.reportError(ErrorRecord{Op: "dead-letter", URL: e.URL}, errors.Wrap(err, "failed to store dead letter, event lost"))
+	}
+}
+
+// SinkStats returns delivery statistics for each of the session's sinks, in
+// the same order as Sinks, followed by those of its groups ordered by name.
+func (s *Session) SinkStats() []DeliveryStats {
+	queues := s.queues()
+	stats := make([]DeliveryStats, len(queues))
+	for i, q := range queues {
+		stats[i] = DeliveryStats{
+			Group:     q.group,
+			Sink:      q.index,
+			Queued:    len(q.queue),
+			Delivered: atomic.LoadUint64(&q.delivered),
+			Retries:   atomic.LoadUint64(&q.retries),
+			Failed:    atomic.LoadUint64(&q.failed),
+			Dropped:   atomic.LoadUint64(&q.dropped),
+		}
+	}
+	return stats
+}
+
+// queues returns the sinks' delivery queues, from any goroutine
+func (s *Session) queues() []*sinkQueue {
+	s.sinkMu.RLock()
+	defer s.sinkMu.RUnlock()
+	return s.sinkQueues
+}
@@ -0,0 +1,288 @@
+package gitwatch
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SQLStore keeps events, dead letters and the latest state of each repository
+// in a SQLite database, so history can be queried with SQL and read by other
+// tools. It's a Sink, recording every event delivered to it, a DeadLetter and
+// an AuditLog.
+//
+// The store works through database/sql, so the program chooses the driver,
+// such as github.com/mattn/go-sqlite3 or modernc.org/sqlite.
+type SQLStore struct {
+	db *sql.DB
+	mu sync.Mutex // SQLite allows one writer at a time
+}
+
+// sqlTimeFormat is a fixed width RFC 3339 format, so timestamps stored as text
+// sort in time order and can be used with SQLite's date and time functions.
+const sqlTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS events (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		type        TEXT NOT NULL,
+		url         TEXT NOT NULL,
+		path        TEXT NOT NULL,
+		branch      TEXT NOT NULL,
+		tag         TEXT NOT NULL,
+		ref         TEXT NOT NULL,
+		commit_hash TEXT NOT NULL,
+		author      TEXT NOT NULL,
+		message     TEXT NOT NULL,
+		timestamp   TEXT NOT NULL,
+		payload     TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS events_url_timestamp ON events (url, timestamp)`,
+	`CREATE TABLE IF NOT EXISTS repositories (
+		path        TEXT PRIMARY KEY,
+		url         TEXT NOT NULL,
+		branch      TEXT NOT NULL,
+		head        TEXT NOT NULL,
+		last_event  TEXT NOT NULL,
+		events      INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS dead_letters (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		sink_group  TEXT NOT NULL,
+		sink        INTEGER NOT NULL,
+		error       TEXT NOT NULL,
+		failed_at   TEXT NOT NULL,
+		payload     TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS audit (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		time        TEXT NOT NULL,
+		duration    INTEGER NOT NULL,
+		op          TEXT NOT NULL,
+		url         TEXT NOT NULL,
+		path        TEXT NOT NULL,
+		branch      TEXT NOT NULL,
+		from_hash   TEXT NOT NULL,
+		to_hash     TEXT NOT NULL,
+		error       TEXT NOT NULL
+	)`,
+}
+
+// sqlMigrations add the columns tables created by earlier versions lack. They
+// fail with a duplicate column error once applied, which is ignored.
+var sqlMigrations = []string{
+	`ALTER TABLE audit ADD COLUMN trace_id TEXT NOT NULL DEFAULT ''`,
+}
+
+// NewSQLStore creates the store's tables in db, if they don't exist yet.
+func NewSQLStore(ctx context.Context, db *sql.DB) (s *SQLStore, err error) {
+	for _, stmt := range sqlSchema {
+		if _, err = db.ExecContext(ctx, stmt); err != nil {
+			return nil, errors.Wrap(err, "failed to create tables")
+		}
+	}
+	for _, stmt := range sqlMigrations {
+		if _, err = db.ExecContext(ctx, stmt); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return nil, errors.Wrap(err, "failed to update tables")
+		}
+	}
+	return &SQLStore{db: db}, nil
+}
+
+// Send records an event and updates its repository's row.
+func (s *SQLStore) Send(ctx context.Context, e Event) (err error) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode event")
+	}
+	c := e.Commit()
+	var hash string
+	if !c.Hash.IsZero() {
+		hash = c.Hash.String()
+	}
+	ts := e.Timestamp.UTC().Format(sqlTimeFormat)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO events
+		(type, url, path, branch, tag, ref, commit_hash, author, message, timestamp, payload)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Type.String(), e.URL, e.Path, e.Branch, e.Tag, e.Ref, hash, c.Author.Name, c.Message, ts, string(payload))
+	if err != nil {
+		return errors.Wrap(err, "failed to insert event")
+	}
+	// the head only moves with events that carry a commit
+	_, err = tx.ExecContext(ctx, `INSERT INTO repositories (path, url, branch, head, last_event, events)
+		VALUES (?, ?, ?, ?, ?, 1)
+		ON CONFLICT (path) DO UPDATE SET
+			url = excluded.url,
+			branch = CASE WHEN excluded.branch = '' THEN branch ELSE excluded.branch END,
+			head = CASE WHEN excluded.head = '' THEN head ELSE excluded.head END,
+			last_event = excluded.last_event,
+			events = events + 1`,
+		e.Path, e.URL, e.Branch, hash, ts)
+	if err != nil {
+		return errors.Wrap(err, "failed to update repository")
+	}
+	return errors.Wrap(tx.Commit(), "failed to commit event")
+}
+
+// EventFilter selects recorded events or audit entries. Empty fields match
+// every one.
+type EventFilter struct {
+	URL    string    // the repository's URL
+	Branch string    // the branch of the event
+	Since  time.Time // the earliest event time, inclusive
+	Until  time.Time // the latest event time, exclusive
+}
+
+// Events returns the recorded events that match the filter, oldest first.
+func (s *SQLStore) Events(ctx context.Context, f EventFilter) (events []Event, err error) {
+	until := "9999"
+	if !f.Until.IsZero() {
+		until = f.Until.UTC().Format(sqlTimeFormat)
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT payload FROM events
+		WHERE (? = '' OR url = ?) AND (? = '' OR branch = ?) AND timestamp >= ? AND timestamp < ?
+		ORDER BY timestamp, id`,
+		f.URL, f.URL, f.Branch, f.Branch, f.Since.UTC().Format(sqlTimeFormat), until)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query events")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var payload string
+		if err = rows.Scan(&payload); err != nil {
+			return nil, errors.Wrap(err, "failed to read event")
+		}
+		var e Event
+		if err = json.Unmarshal([]byte(payload), &e); err != nil {
+			return nil, errors.Wrap(err, "failed to decode event")
+		}
+		events = append(events, e)
+	}
+	return events, errors.Wrap(rows.Err(), "failed to read events")
+}
+
+// Store implements DeadLetter
+func (s *SQLStore) Store(l Letter) error {
+	payload, err := json.Marshal(l.Event)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode dead letter")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.db.Exec(`INSERT INTO dead_letters (sink_group, sink, error, failed_at, payload)
+		VALUES (?, ?, ?, ?, ?)`,
+		l.Group, l.Sink, l.Error, l.FailedAt.UTC().Format(sqlTimeFormat), string(payload))
+	return errors.Wrap(err, "failed to store dead letter")
+}
+
+// Replay calls fn for each stored letter, oldest first, removing the ones it
+// succeeds for. Replaying stops at the first error.
+func (s *SQLStore) Replay(fn func(Letter) error) error {
+	rows, err := s.db.Query(`SELECT id, sink_group, sink, error, failed_at, payload
+		FROM dead_letters ORDER BY failed_at, id`)
+	if err != nil {
+		return errors.Wrap(err, "failed to query dead letters")
+	}
+	type stored struct {
+		id     int64
+		letter Letter
+	}
+	var letters []stored
+	for rows.Next() {
+		var st stored
+		var failedAt, payload string
+		if err = rows.Scan(&st.id, &st.letter.Group, &st.letter.Sink, &st.letter.Error, &failedAt, &payload); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "failed to read dead letter")
+		}
+		if st.letter.FailedAt, err = time.Parse(sqlTimeFormat, failedAt); err != nil {
+			rows.Close()
+			return errors.Wrapf(err, "failed to decode dead letter %d", st.id)
+		}
+		if err = json.Unmarshal([]byte(payload), &st.letter.Event); err != nil {
+			rows.Close()
+			return errors.Wrapf(err, "failed to decode dead letter %d", st.id)
+		}
+		letters = append(letters, st)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "failed to read dead letters")
+	}
+
+	// rows are read up front, SQLite can't delete while a query is open on
+	// the same connection
+	for _, st := range letters {
+		if err := fn(st.letter); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		_, err := s.db.Exec(`DELETE FROM dead_letters WHERE id = ?`, st.id)
+		s.mu.Unlock()
+		if err != nil {
+			return errors.Wrap(err, "failed to remove replayed dead letter")
+		}
+	}
+	return nil
+}
+
+// Record implements AuditLog
+func (s *SQLStore) Record(e AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.db.Exec(`INSERT INTO audit (time, duration, op, url, path, branch, from_hash, to_hash, error, trace_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Time.UTC().Format(sqlTimeFormat), int64(e.Duration), string(e.Op), e.URL, e.Path, e.Branch, e.From, e.To, e.Error, e.TraceID)
+	return errors.Wrap(err, "failed to record audit entry")
+}
+
+// Entries implements AuditLog
+func (s *SQLStore) Entries(ctx context.Context, f EventFilter) (entries []AuditEntry, err error) {
+	until := "9999"
+	if !f.Until.IsZero() {
+		until = f.Until.UTC().Format(sqlTimeFormat)
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT time, duration, op, url, path, branch, from_hash, to_hash, error, trace_id FROM audit
+		WHERE (? = '' OR url = ?) AND (? = '' OR branch = ?) AND time >= ? AND time < ?
+		ORDER BY time, id`,
+		f.URL, f.URL, f.Branch, f.Branch, f.Since.UTC().Format(sqlTimeFormat), until)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query audit log")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e AuditEntry
+		var t string
+		var d int64
+		if err = rows.Scan(&t, &d, &e.Op, &e.URL, &e.Path, &e.Branch, &e.From, &e.To, &e.Error, &e.TraceID); err != nil {
+			return nil, errors.Wrap(err, "failed to read audit entry")
+		}
+		if e.Time, err = time.Parse(sqlTimeFormat, t); err != nil {
+			return nil, errors.Wrap(err, "failed to decode audit entry")
+		}
+		e.Duration = time.Duration(d)
+		entries = append(entries, e)
+	}
+	return entries, errors.Wrap(rows.Err(), "failed to read audit log")
+}
@@ -0,0 +1,185 @@
+package gitwatch
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/pktline"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+// sshPool keeps one SSH connection open per server and auth method, so that
+// listing the refs of many repositories on the same server each check doesn't
+// need a full handshake for every repository. The git protocol conversation
+// for each listing runs in its own channel multiplexed over the connection.
+type sshPool struct {
+	mu       sync.Mutex
+	clients  map[string]*ssh.Client
+	defaults map[string]transport.AuthMethod // the default auth built for each user, so each builds one connection and one agent client
+}
+
+// isSSHURL reports whether a repository URL is reached over SSH, including
+// scp-style addresses such as `git@host:user/repo`.
+func isSSHURL(url string) bool {
+	ep, err := transport.NewEndpoint(url)
+	return err == nil && ep.Protocol == "ssh"
+}
+
+// listRefs lists the refs advertised by a repository over a pooled connection,
+// reconnecting once if the pooled connection has gone stale.
+func (p *sshPool) listRefs(url string, auth transport.AuthMethod) (refs []*plumbing.Reference, err error) {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse repository url")
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		var (
+			client *ssh.Client
+			key    string
+		)
+		client, key, err = p.client(ep, auth)
+		if err != nil {
+			return nil, err
+		}
+		refs, err = advertisedRefs(client, ep)
+		if err == nil {
+			return refs, nil
+		}
+		p.drop(key)
+	}
+	return nil, errors.Wrap(err, "failed to list remote references over ssh")
+}
+
+// client returns the pooled connection for an endpoint, dialling it if there
+// isn't one yet.
+func (p *sshPool) client(ep *transport.Endpoint, auth transport.AuthMethod) (client *ssh.Client, key string, err error) {
+	if auth == nil {
+		if auth, err = p.defaultAuth(ep.User); err != nil {
+			return nil, "", err
+		}
+	}
+	method, ok := auth.(gitssh.AuthMethod)
+	if !ok {
+		return nil, "", transport.ErrInvalidAuthMethod
+	}
+
+	port := ep.Port
+	if port == 0 {
+		port = 22
+	}
+	addr := net.JoinHostPort(ep.Host, strconv.Itoa(port))
+	key = fmt.Sprintf("%s@%s#%p", ep.User, addr, auth)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if client, ok = p.clients[key]; ok {
+		return
+	}
+
+	config, err := method.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	client, err = ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to connect to %s", addr)
+	}
+	if p.clients == nil {
+		p.clients = make(map[string]*ssh.Client)
+	}
+	p.clients[key] = client
+	return
+}
+
+// defaultAuth returns the auth go-git would use for a user when none is set,
+// building it the first time. Building it connects to the SSH agent, and a new
+// one for each check would also key a new pooled connection.
+func (p *sshPool) defaultAuth(user string) (auth transport.AuthMethod, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if auth, ok := p.defaults[user]; ok {
+		return auth, nil
+	}
+	if auth, err = gitssh.DefaultAuthBuilder(user); err != nil {
+		return nil, err
+	}
+	if p.defaults == nil {
+		p.defaults = make(map[string]transport.AuthMethod)
+	}
+	p.defaults[user] = auth
+	return auth, nil
+}
+
+// drop closes and forgets a pooled connection.
+func (p *sshPool) drop(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if client, ok := p.clients[key]; ok {
+		client.Close()
+		delete(p.clients, key)
+	}
+}
+
+// close closes every pooled connection.
+func (p *sshPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, client := range p.clients {
+		client.Close()
+		delete(p.clients, key)
+	}
+	p.defaults = nil
+}
+
+// advertisedRefs starts git-upload-pack for a repository, reads the refs it
+// advertises and then ends the conversation without fetching anything.
+func advertisedRefs(client *ssh.Client, ep *transport.Endpoint) (refs []*plumbing.Reference, err error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return
+	}
+	if err = session.Start(fmt.Sprintf("git-upload-pack '%s'", ep.Path)); err != nil {
+		return
+	}
+
+	ar := packp.NewAdvRefs()
+	if err = ar.Decode(stdout); err != nil {
+		return
+	}
+	// a flush instead of a list of wants tells the server we're done
+	if err = pktline.NewEncoder(stdin).Flush(); err != nil {
+		return
+	}
+	stdin.Close()
+
+	all, err := ar.AllReferences()
+	if err != nil {
+		return
+	}
+	for _, ref := range all {
+		refs = append(refs, ref)
+	}
+	return
+}
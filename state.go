@@ -0,0 +1,118 @@
+package gitwatch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// StateStore remembers the head commit of each repository's last commit event,
+// so a restarted session carries on from there instead of emitting initial
+// events again or missing what the clone was updated to before the event for
+// it was sent.
+type StateStore interface {
+	// LastEvent returns the commit recorded for a repository, by URL, or the
+	// zero hash if there is none
+	LastEvent(url string) (plumbing.Hash, error)
+	// SetLastEvent records the commit of a repository's latest commit event
+	SetLastEvent(url string, hash plumbing.Hash) error
+}
+
+// StateFile is a StateStore kept in a JSON file mapping repository URLs to
+// commit hashes. The file is replaced whole on every change, so it's never
+// left half written.
+type StateFile struct {
+	Path  string
+	mu    sync.Mutex
+	heads map[string]string
+}
+
+// LastEvent implements StateStore
+func (f *StateFile) LastEvent(url string) (plumbing.Hash, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.load(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return plumbing.NewHash(f.heads[url]), nil
+}
+
+// SetLastEvent implements StateStore
+func (f *StateFile) SetLastEvent(url string, hash plumbing.Hash) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.load(); err != nil {
+		return err
+	}
+	if f.heads[url] == hash.String() {
+		return nil
+	}
+	f.heads[url] = hash.String()
+
+	b, err := json.MarshalIndent(f.heads, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode state")
+	}
+	tmp := f.Path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrap(err, "failed to write state file")
+	}
+	return errors.Wrap(os.Rename(tmp, f.Path), "failed to replace state file")
+}
+
+// load reads the file the first time it's needed
+func (f *StateFile) load() error {
+	if f.heads != nil {
+		return nil
+	}
+	b, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		f.heads = make(map[string]string)
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to read state file")
+	}
+	heads := make(map[string]string)
+	if err = json.Unmarshal(b, &heads); err != nil {
+		return errors.Wrap(err, "failed to decode state file")
+	}
+	f.heads = heads
+	return nil
+}
+
+// recordedEvent returns the commit the session's State recorded for a
+// repository's last commit event, if it's one its clone has.
+func (s *Session) recordedEvent(repo *git.Repository, repository Repository) plumbing.Hash {
+	if s.State == nil {
+		return plumbing.ZeroHash
+	}
+	hash, err := s.State.LastEvent(repository.URL)
+	if err != nil {
+		s.reportError(ErrorRecord{Op: "state", URL: repository.URL}, errors.Wrap(err, "failed to read state"))
+		return plumbing.ZeroHash
+	}
+	if hash.IsZero() {
+		return hash
+	}
+	if _, err = repo.CommitObject(hash); err != nil {
+		return plumbing.ZeroHash
+	}
+	return hash
+}
+
+// setLastEvent moves a repository on to a commit event's commit, recording it
+// in the session's State.
+func (s *Session) setLastEvent(repository Repository, hash plumbing.Hash) {
+	s.stateOf(repository).lastEvent = hash
+	if s.State == nil {
+		return
+	}
+	if err := s.State.SetLastEvent(repository.URL, hash); err != nil {
+		s.reportError(ErrorRecord{Op: "state", URL: repository.URL}, errors.Wrap(err, "failed to record state"))
+	}
+}
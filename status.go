@@ -0,0 +1,112 @@
+package gitwatch
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Status is a snapshot of a session's activity
+type Status struct {
+	Running           bool                  // whether the daemon is running
+	Repositories      int                   // the number of repositories being watched
+	EventBacklog      int                   // events emitted but not yet read from the Events channel
+	PendingDeliveries int                   // events queued for delivery to sinks
+	DroppedEvents     uint64                // events that were dropped rather than delivered
+	Sinks             []DeliveryStats       // delivery statistics for each sink
+	Throttled         map[string]time.Time  // hosts that rate limited the watcher, with when checks against them resume
+	Retrying          map[string]RetryState // repositories whose last check failed, by the path of their clone
+	LastCheck         time.Time             // when the last round of checks finished, zero until the initial checks are done
+}
+
+// Status returns a snapshot of the session's activity
+func (s *Session) Status() Status {
+	status := Status{
+		Running:       s.IsRunning(),
+		Repositories:  s.repoCount() + s.pendingAdds(),
+		EventBacklog:  s.eventBacklog(),
+		Sinks:         s.SinkStats(),
+		Throttled:     s.throttledHosts(),
+		Retrying:      s.retryingRepos(),
+		DroppedEvents: atomic.LoadUint64(&s.droppedEvents),
+	}
+	if t := atomic.LoadInt64(&s.lastCheck); t != 0 {
+		status.LastCheck = time.Unix(0, t)
+	}
+	for _, stats := range status.Sinks {
+		status.PendingDeliveries += stats.Queued
+		status.DroppedEvents += stats.Dropped
+	}
+	return status
+}
+
+// eventBacklog counts the events waiting to be read from the Events channel,
+// both buffered and waiting in the session's queue.
+func (s *Session) eventBacklog() int {
+	return int(atomic.LoadInt32(&s.pendingEvents)) + len(s.Events)
+}
+
+// backlogged reports whether the event backlog is above the BacklogLimit.
+func (s *Session) backlogged() bool {
+	return s.BacklogLimit > 0 && s.eventBacklog() > s.BacklogLimit
+}
+
+// sendEvent delivers an event to the OnEvent handlers, if there are any, or
+// the Events channel, keeping track of the backlog while it waits to be read.
+// With OrderedEvents or DeliverBlock, it blocks until the event is read,
+// otherwise the event is queued as the session's EventDelivery says.
+func (s *Session) sendEvent(event Event) {
+	if s.handleEvent(event) {
+		return
+	}
+	atomic.AddInt32(&s.pendingEvents, 1)
+	s.checkBacklog()
+	if s.OrderedEvents || s.EventDelivery == DeliverBlock {
+		sent := false
+		s.send(func() {
+			select {
+			case s.Events <- event:
+				sent = true
+			case <-s.ctx.Done():
+			}
+		})
+		if !sent {
+			return
+		}
+		atomic.AddInt32(&s.pendingEvents, -1)
+		s.checkBacklog()
+		return
+	}
+	s.queueEvent(event)
+}
+
+// checkBacklog calls OnBacklog when the event backlog crosses the
+// session's BacklogLimit in either direction.
+func (s *Session) checkBacklog() {
+	if s.OnBacklog == nil {
+		return
+	}
+
+	over := s.backlogged()
+	var flag int32
+	if over {
+		flag = 1
+	}
+	if atomic.SwapInt32(&s.backpressured, flag) != flag {
+		s.OnBacklog(s.Status(), over)
+	}
+}
+
+// repoCount counts the repositories being watched, from any goroutine
+func (s *Session) repoCount() int {
+	s.repoMu.RLock()
+	defer s.repoMu.RUnlock()
+	return len(s.Repositories)
+}
+
+// pendingAdds counts the repositories given to Add that the daemon hasn't
+// picked up yet.
+func (s *Session) pendingAdds() int {
+	s.addMu.Lock()
+	defer s.addMu.Unlock()
+	return len(s.added)
+}
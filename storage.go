@@ -0,0 +1,152 @@
+package gitwatch
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// Storage keeps the clones of a session's repositories somewhere other than
+// the local filesystem. Clones are identified by the directory they would have
+// been cloned to under the session's Directory.
+type Storage interface {
+	// Open returns the storer of a clone's objects and references and the
+	// filesystem of its worktree, nil for a bare clone. A clone that doesn't
+	// exist yet is returned empty, ready to be cloned into.
+	Open(path string, bare bool) (storage.Storer, billy.Filesystem, error)
+	// Remove deletes a clone
+	Remove(path string) error
+}
+
+// MemoryStorage is a Storage that keeps clones in memory, for ephemeral
+// watchers that shouldn't touch the disk. Clones are lost when the process
+// exits.
+type MemoryStorage struct {
+	mu     sync.Mutex
+	clones map[string]memoryClone
+}
+
+type memoryClone struct {
+	storer   *memory.Storage
+	worktree billy.Filesystem
+}
+
+// Open implements Storage
+func (m *MemoryStorage) Open(path string, bare bool) (storage.Storer, billy.Filesystem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.clones == nil {
+		m.clones = make(map[string]memoryClone)
+	}
+	c, ok := m.clones[path]
+	if !ok {
+		c = memoryClone{storer: memory.NewStorage()}
+		if !bare {
+			c.worktree = memfs.New()
+		}
+		m.clones[path] = c
+	}
+	return c.storer, c.worktree, nil
+}
+
+// Remove implements Storage
+func (m *MemoryStorage) Remove(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.clones, path)
+	return nil
+}
+
+// FilesystemStorage is a Storage that keeps clones on a billy filesystem, such
+// as a mounted volume abstraction, at their paths within it.
+type FilesystemStorage struct {
+	FS billy.Filesystem
+}
+
+// Open implements Storage
+func (f FilesystemStorage) Open(path string, bare bool) (storage.Storer, billy.Filesystem, error) {
+	wt, err := f.FS.Chroot(path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to open clone directory")
+	}
+	dot := wt
+	if !bare {
+		if dot, err = wt.Chroot(git.GitDirName); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to open clone directory")
+		}
+	} else {
+		wt = nil
+	}
+	return filesystem.NewStorage(dot, cache.NewObjectLRUDefault()), wt, nil
+}
+
+// Remove implements Storage
+func (f FilesystemStorage) Remove(path string) error {
+	return util.RemoveAll(f.FS, filepath.ToSlash(path))
+}
+
+// openRepo opens a repository's clone from the session's Storage, or its
+// directory if there is none.
+func (s *Session) openRepo(repository Repository) (*git.Repository, error) {
+	if s.Storage == nil {
+		return git.PlainOpen(repository.fullPath)
+	}
+	st, wt, err := s.Storage.Open(repository.fullPath, repository.Bare)
+	if err != nil {
+		return nil, err
+	}
+	return git.Open(st, wt)
+}
+
+// cloneInto clones a repository into the session's Storage, or its directory
+// if there is none. A failed clone is removed.
+func (s *Session) cloneInto(repository Repository, o *git.CloneOptions) (*git.Repository, error) {
+	ctx, cancel := s.opContext(repository)
+	defer cancel()
+	var repo *git.Repository
+	if s.Storage == nil {
+		err := s.within(ctx, repository, func() (err error) {
+			repo, err = git.PlainCloneContext(ctx, repository.fullPath, repository.Bare, o)
+			return
+		})
+		if err != nil {
+			return nil, s.timedOut(ctx, repository, err)
+		}
+		return repo, nil
+	}
+	st, wt, err := s.Storage.Open(repository.fullPath, repository.Bare)
+	if err != nil {
+		return nil, err
+	}
+	err = s.within(ctx, repository, func() (err error) {
+		// removed here rather than by the caller, so an abandoned clone is
+		// only removed once it has stopped writing to it
+		if repo, err = git.CloneContext(ctx, st, wt, o); err != nil {
+			s.Storage.Remove(repository.fullPath)
+		}
+		return
+	})
+	if err != nil {
+		return nil, s.timedOut(ctx, repository, err)
+	}
+	return repo, nil
+}
+
+// removeRepo deletes a repository's clone from the session's Storage, or its
+// directory if there is none.
+func (s *Session) removeRepo(repository Repository) error {
+	if s.Storage == nil {
+		return os.RemoveAll(repository.fullPath)
+	}
+	return s.Storage.Remove(repository.fullPath)
+}
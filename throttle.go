@@ -0,0 +1,138 @@
+package gitwatch
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+// maxThrottle caps how far polling of a rate limited host is pushed back when
+// the host doesn't say how long to wait.
+const maxThrottle = time.Hour
+
+// hostThrottle records that a host has rate limited the watcher.
+type hostThrottle struct {
+	until   time.Time     // no repositories on the host are checked before this
+	backoff time.Duration // the last delay used when the host gave no hint
+}
+
+// repoHost returns the host part of a repository URL, including scp-style SSH
+// addresses such as `git@host:user/repo`.
+func repoHost(repo string) string {
+	if u, err := url.Parse(repo); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	if i := strings.Index(repo, ":"); i != -1 {
+		host := repo[:i]
+		if j := strings.LastIndex(host, "@"); j != -1 {
+			host = host[j+1:]
+		}
+		return host
+	}
+	return ""
+}
+
+// rateLimitDelay inspects an error for an HTTP response telling the watcher to
+// slow down. If it was rate limited, the delay the remote asked for is
+// returned, or zero if it didn't say.
+func rateLimitDelay(err error) (delay time.Duration, limited bool) {
+	unexpected, ok := errors.Cause(err).(*plumbing.UnexpectedError)
+	if !ok {
+		return 0, false
+	}
+	herr, ok := unexpected.Err.(*githttp.Err)
+	if !ok || herr.Response == nil {
+		return 0, false
+	}
+
+	h := herr.Response.Header
+	switch {
+	case herr.StatusCode() == http.StatusTooManyRequests,
+		herr.StatusCode() == http.StatusServiceUnavailable && h.Get("Retry-After") != "",
+		h.Get("X-RateLimit-Remaining") == "0":
+	default:
+		return 0, false
+	}
+
+	if after := h.Get("Retry-After"); after != "" {
+		if seconds, err := strconv.Atoi(after); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if t, err := http.ParseTime(after); err == nil {
+			return time.Until(t), true
+		}
+	}
+	if reset := h.Get("X-RateLimit-Reset"); reset != "" {
+		if epoch, err := strconv.ParseInt(reset, 10, 64); err == nil {
+			return time.Until(time.Unix(epoch, 0)), true
+		}
+	}
+	return 0, true
+}
+
+// throttle pushes back checks of every repository on a host. Without a delay
+// from the host, the delay starts at the session's interval and doubles each
+// time the host rate limits again.
+func (s *Session) throttle(host string, delay time.Duration) time.Time {
+	s.throttleMu.Lock()
+	defer s.throttleMu.Unlock()
+	if s.throttles == nil {
+		s.throttles = make(map[string]*hostThrottle)
+	}
+	t, ok := s.throttles[host]
+	if !ok {
+		t = &hostThrottle{}
+		s.throttles[host] = t
+	}
+
+	if delay <= 0 {
+		t.backoff *= 2
+		if t.backoff < s.Interval {
+			t.backoff = s.Interval
+		}
+		if t.backoff > maxThrottle {
+			t.backoff = maxThrottle
+		}
+		delay = t.backoff
+	}
+	t.until = time.Now().Add(delay)
+	return t.until
+}
+
+// throttled reports whether a host is currently being backed off from.
+func (s *Session) throttled(host string) bool {
+	s.throttleMu.Lock()
+	defer s.throttleMu.Unlock()
+	t, ok := s.throttles[host]
+	if !ok {
+		return false
+	}
+	return time.Now().Before(t.until)
+}
+
+// unthrottle forgets a host's back off once a check against it succeeds.
+func (s *Session) unthrottle(host string) {
+	s.throttleMu.Lock()
+	defer s.throttleMu.Unlock()
+	delete(s.throttles, host)
+}
+
+// throttledHosts returns the hosts currently being backed off from, with the
+// time checks against them resume.
+func (s *Session) throttledHosts() map[string]time.Time {
+	s.throttleMu.Lock()
+	defer s.throttleMu.Unlock()
+	hosts := make(map[string]time.Time)
+	for host, t := range s.throttles {
+		if time.Now().Before(t.until) {
+			hosts[host] = t.until
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,75 @@
+package gitwatch
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+)
+
+// timeout returns how long each clone, fetch, pull or push of a repository may
+// take, zero if there's no limit.
+func (s *Session) timeout(repository Repository) time.Duration {
+	if repository.Timeout > 0 {
+		return repository.Timeout
+	}
+	return s.OperationTimeout
+}
+
+// opContext returns the context for a network operation on a repository,
+// which is done once the repository's timeout has passed.
+func (s *Session) opContext(repository Repository) (context.Context, context.CancelFunc) {
+	if t := s.timeout(repository); t > 0 {
+		return context.WithTimeout(s.ctx, t)
+	}
+	return context.WithCancel(s.ctx)
+}
+
+// timedOut replaces the error of an operation that failed because its context
+// from opContext passed its deadline with one saying so. The cause is still
+// context.DeadlineExceeded, so it's classified as a network error.
+func (s *Session) timedOut(ctx context.Context, repository Repository, err error) error {
+	if err == nil || err == git.NoErrAlreadyUpToDate || ctx.Err() != context.DeadlineExceeded || s.ctx.Err() != nil {
+		return err
+	}
+	return errors.Wrapf(context.DeadlineExceeded, "timed out after %s", s.timeout(repository))
+}
+
+// within runs op, an operation on a repository, and gives up waiting for it
+// once ctx is done. go-git only heeds the context after the remote has
+// advertised its references, so an operation on a remote that hangs before
+// then is abandoned, and carries on in the background until its connection
+// fails. Until it returns, the repository is busy.
+func (s *Session) within(ctx context.Context, repository Repository, op func() error) error {
+	done := make(chan error, 1)
+	returned := make(chan struct{})
+	go func() {
+		done <- op()
+		close(returned)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		state := s.stateOf(repository)
+		state.abandoned = append(state.abandoned, returned)
+		return ctx.Err()
+	}
+}
+
+// busy reports whether an operation on a repository abandoned by within is
+// still running, in which case the clone mustn't be touched until it returns.
+func (s *Session) busy(repository Repository) bool {
+	state := s.stateOf(repository)
+	running := state.abandoned[:0]
+	for _, returned := range state.abandoned {
+		select {
+		case <-returned:
+		default:
+			running = append(running, returned)
+		}
+	}
+	state.abandoned = running
+	return len(running) > 0
+}
@@ -0,0 +1,62 @@
+package gitwatch
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// TraceHeader carries an event's trace ID in webhook deliveries, and is read
+// from deliveries to a Receiver so the checks they cause continue the trace
+const TraceHeader = "X-Gitwatch-Trace"
+
+// deliveryHeaders identify a webhook delivery for each provider, they're used
+// as the trace ID of the checks it causes if TraceHeader isn't set
+var deliveryHeaders = []string{
+	TraceHeader,
+	"X-GitHub-Delivery",
+	"X-Gitea-Delivery",
+	"X-Gitlab-Event-UUID",
+	"X-Request-UUID", // Bitbucket
+}
+
+type traceKey struct{}
+
+// ContextWithTrace returns a context carrying a trace ID
+func ContextWithTrace(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, traceKey{}, id)
+}
+
+// TraceFromContext returns the trace ID carried by a context, if any. Sinks
+// are sent events with the event's trace ID in their context.
+func TraceFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(traceKey{}).(string)
+	return id
+}
+
+// newTraceID generates a random ID in the form of a W3C trace ID
+func newTraceID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// beginTrace sets the trace ID of the work the daemon does next: the events it
+// emits and the changes it audits. An empty ID starts a new trace.
+func (s *Session) beginTrace(id string) {
+	if id == "" {
+		id = newTraceID()
+	}
+	s.trace = id
+}
+
+// requestTrace finds the trace ID of a webhook delivery
+func requestTrace(r *http.Request) string {
+	for _, h := range deliveryHeaders {
+		if id := r.Header.Get(h); id != "" {
+			return id
+		}
+	}
+	return ""
+}
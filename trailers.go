@@ -0,0 +1,42 @@
+package gitwatch
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Trailers are the `Key: value` lines at the end of a commit message, the
+// values listed in order under the key as written.
+type Trailers map[string][]string
+
+// trailerLine matches a `Key: value` trailer, such as `Signed-off-by: A <a@b>`
+var trailerLine = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9-]*):\s*(.*)$`)
+
+// parseTrailers returns the trailers of a commit message: the `Key: value`
+// lines of its last paragraph, if every line of it is one. Lines starting with
+// whitespace continue the previous value, as in `git interpret-trailers`.
+func parseTrailers(message string) Trailers {
+	paragraphs := strings.Split(strings.TrimSpace(message), "\n\n")
+	// the subject alone is never a trailer block
+	if len(paragraphs) < 2 {
+		return nil
+	}
+
+	trailers := make(Trailers)
+	var key string
+	for _, line := range strings.Split(paragraphs[len(paragraphs)-1], "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if key != "" && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			values := trailers[key]
+			values[len(values)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		m := trailerLine.FindStringSubmatch(line)
+		if m == nil {
+			return nil
+		}
+		key = m[1]
+		trailers[key] = append(trailers[key], m[2])
+	}
+	return trailers
+}
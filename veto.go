@@ -0,0 +1,199 @@
+package gitwatch
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// PendingUpdate describes a change to a repository's branch that has been
+// fetched but not yet checked out.
+type PendingUpdate struct {
+	URL    string        // the repository's URL
+	Branch string        // the branch being updated
+	Old    plumbing.Hash // the commit currently checked out
+	New    plumbing.Hash // the commit the worktree would be updated to
+	Files  []string      // the files changed between Old and New
+}
+
+// UpdateHook is called with a pending update before the worktree is changed.
+// Returning an error rejects the update: what was fetched is kept, but the
+// checkout is deferred and the update is offered again on later checks until
+// the hook accepts it. This lets consumers gate updates on checks such as
+// signature or policy validation.
+type UpdateHook func(PendingUpdate) error
+
+// vetoablePull splits a pull in two, fetching first and only updating the
+// worktree once the session's Policy and BeforeUpdate hook accept the change. A
+// policy violation emits an event, and a rejection by the hook is reported on
+// Errors, once for each commit rejected.
+func (s *Session) vetoablePull(repo *git.Repository, remote string, repository Repository) (event *Event, err error) {
+	ctx, cancel := s.opContext(repository)
+	defer cancel()
+	started := time.Now()
+	err = s.within(ctx, repository, func() error {
+		return repo.FetchContext(ctx, &git.FetchOptions{
+			RemoteName: remote,
+			Auth:       s.chooseAuth(repository.Auth),
+			Depth:      s.depth(repository),
+			Force:      s.UseForce,
+		})
+	})
+	err = s.timedOut(ctx, repository, err)
+	s.audit(repository, AuditEntry{Op: AuditFetch}, started, err)
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, withStage(StageFetch, errors.Wrap(err, "failed to fetch local repo"))
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get head")
+	}
+	branch := repository.Branch
+	if branch == "" {
+		branch = head.Name().Short()
+	}
+	fetched, err := repo.Reference(plumbing.NewRemoteReferenceName(remote, branch), true)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find fetched branch")
+	}
+	if fetched.Hash() == head.Hash() {
+		return nil, nil
+	}
+
+	ff, err := isAncestor(repo, head.Hash(), fetched.Hash())
+	if err != nil {
+		return nil, err
+	}
+	if !ff && !s.UseForce && s.depth(repository) == 0 {
+		return nil, withStage(StagePull, errors.Wrap(git.ErrNonFastForwardUpdate, "failed to pull local repo"))
+	}
+
+	update, err := pendingUpdate(repo, remote, branch, head.Hash(), fetched.Hash())
+	if err != nil {
+		return nil, err
+	}
+	if accepted, event, err := s.accepts(repo, repository, update); !accepted {
+		return event, err
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get worktree")
+	}
+	mode := git.MergeReset
+	if s.UseForce {
+		mode = git.HardReset
+	}
+	started = time.Now()
+	err = wt.Reset(&git.ResetOptions{Commit: update.New, Mode: mode})
+	s.audit(repository, AuditEntry{Op: AuditReset, From: update.Old.String(), To: update.New.String()}, started, err)
+	if err != nil {
+		return nil, withStage(StagePull, errors.Wrap(err, "failed to update worktree"))
+	}
+	subs, err := wt.Submodules()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get submodules")
+	}
+	err = subs.Update(&git.SubmoduleUpdateOptions{Init: true, RecurseSubmodules: git.DefaultSubmoduleRecursionDepth})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to update submodules")
+	}
+
+	event, err = GetEventFromRepo(repo)
+	if err != nil {
+		return
+	}
+	return event, markForced(repo, event, update.Old)
+}
+
+// gated reports whether updates wait for the session's Policy or BeforeUpdate
+// hook to accept them.
+func (s *Session) gated() bool {
+	return s.Policy != nil || s.BeforeUpdate != nil
+}
+
+// accepts checks an update against the session's Policy and BeforeUpdate hook.
+// A rejected update returns false, with the event to emit for a policy
+// violation the first time it's rejected.
+func (s *Session) accepts(repo *git.Repository, repository Repository, update PendingUpdate) (accepted bool, event *Event, err error) {
+	state := s.stateOf(repository)
+	if s.Policy != nil {
+		violations, err := s.Policy.check(s.ctx, repo, update)
+		if err != nil {
+			return false, nil, err
+		}
+		if len(violations) > 0 {
+			if state.violated == update.New {
+				return false, nil, nil
+			}
+			state.violated = update.New
+			event, err = violationEvent(repo, update, violations)
+			return false, event, err
+		}
+		state.violated = plumbing.ZeroHash
+	}
+	if s.BeforeUpdate != nil {
+		if err = s.BeforeUpdate(update); err != nil {
+			if state.vetoed != update.New {
+				state.vetoed = update.New
+				s.reportError(ErrorRecord{Op: "update", URL: repository.URL}, errors.Wrapf(err, "update of %s to %s deferred", update.URL, update.New))
+			}
+			return false, nil, nil
+		}
+		state.vetoed = plumbing.ZeroHash
+	}
+	return true, nil, nil
+}
+
+func pendingUpdate(repo *git.Repository, remote, branch string, old, new plumbing.Hash) (update PendingUpdate, err error) {
+	r, err := repo.Remote(remote)
+	if err != nil {
+		return update, errors.Wrapf(err, "failed to get remote %s", remote)
+	}
+	from, err := repo.CommitObject(old)
+	if err != nil {
+		return update, errors.Wrap(err, "failed to get current commit")
+	}
+	to, err := repo.CommitObject(new)
+	if err != nil {
+		return update, errors.Wrap(err, "failed to get fetched commit")
+	}
+	files, err := changedFiles(from, to)
+	if err != nil {
+		return update, err
+	}
+	return PendingUpdate{
+		URL:    r.Config().URLs[0],
+		Branch: branch,
+		Old:    old,
+		New:    new,
+		Files:  files,
+	}, nil
+}
+
+// isAncestor reports whether `ancestor` is reachable from `of`, within the
+// history a shallow clone has.
+func isAncestor(repo *git.Repository, ancestor, of plumbing.Hash) (found bool, err error) {
+	iter, err := repo.Log(&git.LogOptions{From: of})
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read commit log")
+	}
+	defer iter.Close()
+
+	err = iter.ForEach(func(c *object.Commit) error {
+		if c.Hash == ancestor {
+			found = true
+			return storer.ErrStop
+		}
+		return nil
+	})
+	if err != nil && err != plumbing.ErrObjectNotFound {
+		return false, errors.Wrap(err, "failed to walk commits")
+	}
+	return
+}
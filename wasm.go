@@ -0,0 +1,224 @@
+package gitwatch
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// WASMModule is a loaded WebAssembly filter module. LoadWASM runs modules with
+// wazero, which gitwatch bundles, and embedders can wrap another runtime in
+// this interface instead.
+//
+// A filter module is handed the JSON encoded event and returns a JSON encoded
+// verdict of the form:
+//
+//	{"drop": false, "annotations": {"key": "value"}}
+//
+// where `drop` discards the event and `annotations` are merged into the
+// event's annotations. An empty result leaves the event untouched. Filters
+// can't change the event's other fields: the URL, path and commits are what
+// exec hooks and sinks act on, so a module rewriting them could point them at
+// another repository and escape its sandbox.
+type WASMModule interface {
+	Filter(ctx context.Context, event []byte) ([]byte, error)
+}
+
+// WASMLoader instantiates the WebAssembly module in the given file
+type WASMLoader func(path string) (WASMModule, error)
+
+// WASMFilter is an Enricher that runs events through a WebAssembly module
+type WASMFilter struct {
+	Name    string
+	Module  WASMModule
+	Timeout time.Duration // how long the module may take over an event, 5s if zero
+}
+
+const defaultWASMTimeout = 5 * time.Second
+
+type wasmVerdict struct {
+	Drop        bool              `json:"drop"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// Enrich passes the event to the module and applies its verdict
+func (f WASMFilter) Enrich(e *Event) error {
+	return f.EnrichContext(context.Background(), e)
+}
+
+// EnrichContext passes the event to the module and applies its verdict,
+// giving up on the module once ctx is done or the filter's Timeout passes.
+func (f WASMFilter) EnrichContext(ctx context.Context, e *Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode event")
+	}
+
+	timeout := f.Timeout
+	if timeout <= 0 {
+		timeout = defaultWASMTimeout
+	}
+	ctx, cf := context.WithTimeout(ctx, timeout)
+	defer cf()
+
+	// the module runs on its own goroutine so one that ignores ctx can be
+	// abandoned rather than hold up the session
+	type result struct {
+		out []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		out, err := f.Module.Filter(ctx, payload)
+		done <- result{out, err}
+	}()
+	var out []byte
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return errors.Wrapf(r.err, "wasm filter %s failed", f.Name)
+		}
+		out = r.out
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return errors.Errorf("wasm filter %s timed out after %s", f.Name, timeout)
+		}
+		return errors.Wrapf(ctx.Err(), "wasm filter %s abandoned", f.Name)
+	}
+	if len(strings.TrimSpace(string(out))) == 0 {
+		return nil
+	}
+
+	var verdict wasmVerdict
+	if err := json.Unmarshal(out, &verdict); err != nil {
+		return errors.Wrapf(err, "wasm filter %s returned an invalid verdict", f.Name)
+	}
+	if verdict.Drop {
+		return ErrSkipEvent
+	}
+	for k, v := range verdict.Annotations {
+		e.Annotate(k, v)
+	}
+	return nil
+}
+
+// wasmMemoryPages limits the memory of modules run by LoadWASM to 16MiB
+const wasmMemoryPages = 256
+
+// wazeroModule is a filter module compiled by wazero
+type wazeroModule struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+}
+
+// LoadWASM is a WASMLoader that compiles a filter module with wazero. The
+// module exports its `memory`, `alloc(size i32) i32`, which returns where the
+// event of that size is to be written, and `filter(ptr i32, len i32) i64`,
+// which returns where the verdict is as the pointer in the high 32 bits and
+// the length in the low ones, zero for no verdict.
+//
+// Each event is filtered by a fresh instance of the module, so no state is
+// kept between events. Modules get up to 16MiB of memory and WASI without any
+// files, environment variables or arguments, and nothing else, and are stopped
+// once the context of the call is done.
+func LoadWASM(path string) (WASMModule, error) {
+	binary, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read module")
+	}
+
+	ctx := context.Background()
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(wasmMemoryPages))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		r.Close(ctx)
+		return nil, errors.Wrap(err, "failed to instantiate WASI")
+	}
+	compiled, err := r.CompileModule(ctx, binary)
+	if err != nil {
+		r.Close(ctx)
+		return nil, errors.Wrap(err, "failed to compile module")
+	}
+	if _, ok := compiled.ExportedMemories()["memory"]; !ok {
+		r.Close(ctx)
+		return nil, errors.New("module doesn't export memory")
+	}
+	for _, name := range []string{"alloc", "filter"} {
+		if _, ok := compiled.ExportedFunctions()[name]; !ok {
+			r.Close(ctx)
+			return nil, errors.Errorf("module doesn't export %s", name)
+		}
+	}
+	return &wazeroModule{runtime: r, compiled: compiled}, nil
+}
+
+// Filter runs the event through a new instance of the module
+func (m *wazeroModule) Filter(ctx context.Context, event []byte) (verdict []byte, err error) {
+	mod, err := m.runtime.InstantiateModule(ctx, m.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to instantiate module")
+	}
+	// ctx may be done by now, which mustn't stop the instance being closed
+	defer mod.Close(context.Background())
+
+	res, err := mod.ExportedFunction("alloc").Call(ctx, uint64(len(event)))
+	if err != nil {
+		return nil, errors.Wrap(err, "alloc failed")
+	}
+	ptr := uint32(res[0])
+	if !mod.Memory().Write(ptr, event) {
+		return nil, errors.Errorf("alloc returned %d, outside the module's memory", ptr)
+	}
+
+	res, err = mod.ExportedFunction("filter").Call(ctx, uint64(ptr), uint64(len(event)))
+	if err != nil {
+		return nil, errors.Wrap(err, "filter failed")
+	}
+	ptr, size := uint32(res[0]>>32), uint32(res[0])
+	if size == 0 {
+		return nil, nil
+	}
+	out, ok := mod.Memory().Read(ptr, size)
+	if !ok {
+		return nil, errors.Errorf("filter returned a verdict outside the module's memory")
+	}
+	return append([]byte(nil), out...), nil
+}
+
+// LoadWASMFilters loads every `.wasm` file in a directory, in name order, as
+// an enricher using the given loader, such as LoadWASM. Each filter may take
+// up to timeout over an event, 5s if zero.
+func LoadWASMFilters(dir string, load WASMLoader, timeout time.Duration) (filters []Enricher, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read wasm filter directory")
+	}
+
+	var names []string
+	for _, f := range files {
+		if f.Mode().IsRegular() && filepath.Ext(f.Name()) == ".wasm" {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		module, err := load(filepath.Join(dir, name))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load wasm filter %s", name)
+		}
+		filters = append(filters, WASMFilter{Name: name, Module: module, Timeout: timeout})
+	}
+	return
+}
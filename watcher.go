@@ -0,0 +1,68 @@
+package gitwatch
+
+import (
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// Watcher is the behaviour of a Session that programs built on it use. Code
+// that takes a Watcher rather than a *Session can be tested against the fake
+// in the gitwatchtest package, without real git repositories.
+type Watcher interface {
+	// Run starts watching and blocks until the watcher stops
+	Run() error
+	// Close stops the watcher, it can be called more than once
+	Close() error
+	// IsRunning returns true while Run is running
+	IsRunning() bool
+	// Started returns a channel closed once Run has begun serving calls
+	Started() <-chan struct{}
+	// Add starts watching another repository
+	Add(r Repository) error
+	// AddAll starts watching several more repositories
+	AddAll(repos []Repository) error
+	// SetRepositories replaces the watched repositories
+	SetRepositories(repos []Repository) error
+	// Remove stops watching a repository
+	Remove(url string) error
+	// RemoveAndClean stops watching a repository and deletes its clone
+	RemoveAndClean(url string) error
+	// Notify checks the repositories a push applies to right away
+	Notify(p Push) (checked int, err error)
+	// Replay delivers the events recorded since a time again
+	Replay(since time.Time) (replayed int, err error)
+	// Rollback checks a repository out at an earlier commit
+	Rollback(url string, hash plumbing.Hash) error
+	// Resume restarts updates to a repository paused by Rollback
+	Resume(url string) error
+	// Status returns a snapshot of the watcher's activity
+	Status() Status
+	// Healthy reports whether the watcher is checking its repositories
+	Healthy() error
+
+	// EventStream returns the channel events are pushed to
+	EventStream() <-chan Event
+	// ErrorStream returns the channel errors are pushed to
+	ErrorStream() <-chan error
+	// Initialised returns the channel pushed to once the initial checks are
+	// done
+	Initialised() <-chan struct{}
+}
+
+var _ Watcher = (*Session)(nil)
+
+// EventStream implements Watcher, it returns the session's Events channel
+func (s *Session) EventStream() <-chan Event {
+	return s.Events
+}
+
+// ErrorStream implements Watcher, it returns the session's Errors channel
+func (s *Session) ErrorStream() <-chan error {
+	return s.Errors
+}
+
+// Initialised implements Watcher, it returns the session's InitialDone channel
+func (s *Session) Initialised() <-chan struct{} {
+	return s.InitialDone
+}
@@ -0,0 +1,68 @@
+package gitwatch
+
+import (
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// FileChange is the old and new contents of a watched file that a change
+// touched, see Repository.WatchFiles.
+type FileChange struct {
+	Path    string `json:"path"`
+	Old     string `json:"old,omitempty"`     // the contents before the change
+	New     string `json:"new,omitempty"`     // the contents after the change
+	Created bool   `json:"created,omitempty"` // true if the file didn't exist before
+	Deleted bool   `json:"deleted,omitempty"` // true if the change removed the file
+}
+
+// watchedFiles returns the contents of the changed files that match one of
+// the patterns, before and after the change.
+func watchedFiles(from, to *object.Commit, changed, patterns []string) (files []FileChange, err error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	compiled := make([]pathPattern, len(patterns))
+	for i, pattern := range patterns {
+		if compiled[i], err = compilePattern(pattern); err != nil {
+			return nil, errors.Wrapf(err, "invalid watched file pattern %s", pattern)
+		}
+	}
+
+	for _, name := range changed {
+		if !matchAny(compiled, name) {
+			continue
+		}
+		f := FileChange{Path: name}
+		if f.Old, f.Created, err = fileContents(from, name); err != nil {
+			return nil, err
+		}
+		if f.New, f.Deleted, err = fileContents(to, name); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return
+}
+
+// matchAny reports whether a path matches any of the patterns
+func matchAny(patterns []pathPattern, name string) bool {
+	for _, pattern := range patterns {
+		if pattern.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileContents reads a file at a commit, or reports it missing
+func fileContents(c *object.Commit, name string) (contents string, missing bool, err error) {
+	f, err := c.File(name)
+	if err == object.ErrFileNotFound {
+		return "", true, nil
+	}
+	if err != nil {
+		return "", false, errors.Wrapf(err, "failed to get %s", name)
+	}
+	contents, err = f.Contents()
+	return contents, false, errors.Wrapf(err, "failed to read %s", name)
+}
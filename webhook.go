@@ -0,0 +1,80 @@
+package gitwatch
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// SignatureHeader carries the HMAC-SHA256 signature of a webhook delivery, in
+// the same `sha256=<hex>` form GitHub uses for its webhooks
+const SignatureHeader = "X-Gitwatch-Signature"
+
+// EventHeader carries the type of the event in a webhook delivery
+const EventHeader = "X-Gitwatch-Event"
+
+// Webhook is a Sink that POSTs each event to a URL
+type Webhook struct {
+	URL    string       // the endpoint to deliver events to
+	Secret string       // if set, deliveries are signed with this secret
+	Format Format       // the encoding of the request body
+	Client *http.Client // the client to deliver with, the shared client if nil
+}
+
+// Send POSTs the event, treating any non-2xx response as a failure
+func (w Webhook) Send(ctx context.Context, e Event) error {
+	body, contentType, err := Encode(e, w.Format)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode event")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create webhook request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(EventHeader, e.Type.String())
+	if e.TraceID != "" {
+		req.Header.Set(TraceHeader, e.TraceID)
+	}
+	if w.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(w.Secret, body))
+	}
+
+	client := w.Client
+	if client == nil {
+		client = httpClient()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to deliver webhook")
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("webhook %s responded with %s", w.URL, resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the signature of a payload in the form used by SignatureHeader
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks a SignatureHeader value against a payload, for
+// receivers of webhook deliveries.
+func VerifySignature(secret string, payload []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, payload)), []byte(signature))
+}